@@ -0,0 +1,109 @@
+package vchtml
+
+import (
+	"fmt"
+	"slices"
+
+	"golang.org/x/net/html"
+)
+
+// anchorOps rewrites the paths of ops, in place, relative to the nearest
+// ancestor (or, where the op allows it, the target itself) that has an id
+// unique in the document. root is the old tree; it is patched along the way
+// so each op is anchored in the state it applies to.
+func anchorOps(root *html.Node, ops []Operation) error {
+	cur := NewCursor(root)
+	for i, op := range ops {
+		// Ops that need the target's parent must keep at least one step.
+		usable := len(op.Path)
+		switch op.Type {
+		case OpDeleteNode, OpWrapNode, OpSplitText, OpMoveNode:
+			usable--
+		}
+		if op.MovedFrom != nil {
+			// The anchor must hold the source element too, and not be it.
+			usable = min(usable, commonPathLen(op.Path, op.MovedFrom), len(op.MovedFrom)-1)
+		}
+
+		best, bestID := 0, ""
+		node := root
+		for depth := 0; depth < usable; depth++ {
+			node = getChildAtIndex(node, op.Path[depth])
+			if node == nil {
+				break
+			}
+			if id := getAttr(node, "id"); node.Type == html.ElementNode && id != "" && countID(root, id) == 1 {
+				best, bestID = depth+1, id
+			}
+		}
+
+		if err := applyOp(cur, op, PatchOptions{}); err != nil {
+			return fmt.Errorf("failed to anchor op %d (%s): %w", i, op.Type, err)
+		}
+		if best > 0 {
+			ops[i].Anchor = bestID
+			ops[i].Path = append(NodePath{}, op.Path[best:]...)
+			if op.MovedFrom != nil {
+				ops[i].MovedFrom = append(NodePath{}, op.MovedFrom[best:]...)
+			}
+		}
+	}
+	return nil
+}
+
+// commonPathLen returns the length of the common prefix of a and b.
+func commonPathLen(a, b NodePath) int {
+	n := 0
+	for n < len(a) && n < len(b) && a[n] == b[n] {
+		n++
+	}
+	return n
+}
+
+// resolveAnchor returns op with its paths made absolute from root when it is
+// relative to an anchor element.
+func resolveAnchor(root *html.Node, op Operation) (Operation, error) {
+	if op.Anchor == "" {
+		return op, nil
+	}
+	anchor := findByID(root, op.Anchor)
+	if anchor == nil {
+		return op, fmt.Errorf("anchor element #%s not found", op.Anchor)
+	}
+	path, err := GetPath(root, anchor)
+	if err != nil {
+		return op, err
+	}
+	if op.MovedFrom != nil {
+		op.MovedFrom = append(slices.Clone(path), op.MovedFrom...)
+	}
+	op.Path = append(path, op.Path...)
+	op.Anchor = ""
+	return op, nil
+}
+
+// findByID returns the first element under root (in document order) whose id
+// is id, like getElementById.
+func findByID(root *html.Node, id string) *html.Node {
+	for c := root.FirstChild; c != nil; c = c.NextSibling {
+		if c.Type == html.ElementNode && getAttr(c, "id") == id {
+			return c
+		}
+		if found := findByID(c, id); found != nil {
+			return found
+		}
+	}
+	return nil
+}
+
+// countID counts the elements under root whose id is id.
+func countID(root *html.Node, id string) int {
+	count := 0
+	for c := root.FirstChild; c != nil; c = c.NextSibling {
+		if c.Type == html.ElementNode && getAttr(c, "id") == id {
+			count++
+		}
+		count += countID(c, id)
+	}
+	return count
+}
@@ -0,0 +1,144 @@
+package vchtml
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+
+	"golang.org/x/net/html"
+)
+
+// DeltaApplier applies a sequence of deltas to a document, keeping the parsed
+// tree between deltas instead of re-parsing the HTML for every one.
+// Each delta must be based on the document produced by the previous one.
+//
+// Apply is atomic: a delta that fails leaves the document as it was before
+// it. Checkpoint and Rollback extend this to a group of deltas.
+type DeltaApplier struct {
+	doc        *html.Node
+	current    string // Rendered document after the last applied delta
+	checkpoint string // Document saved by Checkpoint
+	opts       PatchOptions
+}
+
+// NewDeltaApplier parses baseHTML and returns an applier positioned at it.
+func NewDeltaApplier(baseHTML string, opts PatchOptions) (*DeltaApplier, error) {
+	doc, err := ParseHTML(baseHTML)
+	if err != nil {
+		return nil, err
+	}
+	return &DeltaApplier{doc: doc, current: baseHTML, checkpoint: baseHTML, opts: opts}, nil
+}
+
+// Apply verifies delta against the current document and applies it.
+// If an operation fails, the document is restored to its state before delta.
+func (a *DeltaApplier) Apply(delta *Delta) error {
+	if currentHash := hashFunc(a.current); currentHash != delta.BaseHash {
+		return fmt.Errorf("base hash mismatch: expected %s, got %s", delta.BaseHash, currentHash)
+	}
+
+	if err := applyDelta(a.doc, delta, a.opts); err != nil {
+		// The tree may be partially modified; rebuild it from the last
+		// rendered state, which the next delta is based on anyway.
+		if restoreErr := a.restore(a.current); restoreErr != nil {
+			return fmt.Errorf("%w (restore failed: %v)", err, restoreErr)
+		}
+		return err
+	}
+
+	// The next delta is based on the rendered form of this result.
+	rendered, err := RenderNode(a.doc)
+	if err != nil {
+		return err
+	}
+	a.current = rendered
+	return nil
+}
+
+// Checkpoint saves the current document for a later Rollback.
+func (a *DeltaApplier) Checkpoint() {
+	a.checkpoint = a.current
+}
+
+// Rollback discards the deltas applied since the last Checkpoint (or since
+// the applier was created, if there was none).
+func (a *DeltaApplier) Rollback() error {
+	return a.restore(a.checkpoint)
+}
+
+// restore replaces the tree with a parse of content.
+func (a *DeltaApplier) restore(content string) error {
+	doc, err := ParseHTML(content)
+	if err != nil {
+		return err
+	}
+	a.doc, a.current = doc, content
+	return nil
+}
+
+// Result returns the current document as HTML.
+func (a *DeltaApplier) Result() (string, error) {
+	return a.current, nil
+}
+
+// ApplyStream reads newline-delimited JSON deltas from r and applies them in
+// order to baseHTML. Blank lines are ignored. It returns the final document,
+// or the first error annotated with its line number.
+func ApplyStream(baseHTML string, r io.Reader) (string, error) {
+	applier, err := NewDeltaApplier(baseHTML, PatchOptions{})
+	if err != nil {
+		return "", err
+	}
+
+	scanner := bufio.NewScanner(r)
+	// Deltas carrying inserted subtrees can exceed the default token size.
+	scanner.Buffer(make([]byte, 0, 64*1024), 16*1024*1024)
+
+	line := 0
+	for scanner.Scan() {
+		line++
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" {
+			continue
+		}
+
+		var delta Delta
+		if err := json.Unmarshal([]byte(text), &delta); err != nil {
+			return "", fmt.Errorf("line %d: failed to decode delta: %w", line, err)
+		}
+		if err := applier.Apply(&delta); err != nil {
+			return "", fmt.Errorf("line %d: %w", line, err)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return "", fmt.Errorf("line %d: %w", line+1, err)
+	}
+
+	return applier.Result()
+}
+
+// ReplayHistory applies deltas in order to baseHTML and returns the document
+// after each one, for timeline and scrubbing views: states[i] is the result
+// of deltas[:i+1]. Each delta's BaseHash must match the state before it. On
+// failure it returns the states reached so far and the error, annotated with
+// the delta's index.
+func ReplayHistory(baseHTML string, deltas []*Delta) ([]string, error) {
+	applier, err := NewDeltaApplier(baseHTML, PatchOptions{})
+	if err != nil {
+		return nil, err
+	}
+	states := make([]string, 0, len(deltas))
+	for i, delta := range deltas {
+		if err := applier.Apply(delta); err != nil {
+			return states, fmt.Errorf("delta %d: %w", i, err)
+		}
+		state, err := applier.Result()
+		if err != nil {
+			return states, err
+		}
+		states = append(states, state)
+	}
+	return states, nil
+}
@@ -0,0 +1,153 @@
+package vchtml
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestApplyStream(t *testing.T) {
+	states := []string{
+		`<p>Hello</p>`,
+		`<p>Hello World</p>`,
+		`<p class="greeting">Hello World</p>`,
+		`<p class="greeting">Hello World!</p>`,
+	}
+
+	// Each delta is computed against the rendered result of the previous one,
+	// exactly as a client round-tripping through Patch would.
+	var buf bytes.Buffer
+	current := states[0]
+	for _, next := range states[1:] {
+		delta, err := Diff(current, next, "tester")
+		if err != nil {
+			t.Fatal(err)
+		}
+		line, err := json.Marshal(delta)
+		if err != nil {
+			t.Fatal(err)
+		}
+		buf.Write(line)
+		buf.WriteByte('\n')
+
+		current, err = Patch(current, delta)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	result, err := ApplyStream(states[0], &buf)
+	if err != nil {
+		t.Fatalf("ApplyStream failed: %v", err)
+	}
+	if !compareHTML(t, result, states[len(states)-1]) {
+		t.Errorf("Cumulative result incorrect")
+	}
+}
+
+func TestApplyStreamReportsLine(t *testing.T) {
+	base := `<p>Hello</p>`
+	delta, _ := Diff(base, `<p>Hello World</p>`, "tester")
+	line, _ := json.Marshal(delta)
+
+	// The same delta twice: the second no longer matches the base hash.
+	input := string(line) + "\n\n" + string(line) + "\n"
+	_, err := ApplyStream(base, strings.NewReader(input))
+	if err == nil {
+		t.Fatalf("Expected an error")
+	}
+	if !strings.HasPrefix(err.Error(), "line 3:") {
+		t.Errorf("Expected error on line 3, got: %v", err)
+	}
+}
+
+func TestDeltaApplierRollback(t *testing.T) {
+	base := `<p>one</p>`
+	first, _ := Diff(base, `<p>one two</p>`, "tester")
+	afterFirst, _ := Patch(base, first)
+
+	// The second delta changes the text, then fails on a stale attribute.
+	second := &Delta{BaseHash: hashString(afterFirst), Operations: []Operation{
+		{Type: OpUpdateText, Path: NodePath{0, 1, 0, 0}, OldValue: "one two", NewValue: "changed"},
+		{Type: OpDeleteAttr, Path: NodePath{0, 1, 9}, Key: "class"},
+	}}
+	third, _ := Diff(afterFirst, `<p>one two three</p>`, "tester")
+
+	applier, err := NewDeltaApplier(base, PatchOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := applier.Apply(first); err != nil {
+		t.Fatalf("First delta failed: %v", err)
+	}
+	if err := applier.Apply(second); err == nil {
+		t.Fatal("Expected the second delta to fail")
+	}
+	if result, _ := applier.Result(); result != afterFirst {
+		t.Errorf("Result after failed delta = %s, want %s", result, afterFirst)
+	}
+	if text, _ := GetNode(applier.doc, NodePath{0, 1, 0, 0}); text.Data != "one two" {
+		t.Errorf("Tree not rolled back: text is %q", text.Data)
+	}
+
+	// The document is still at the first delta's result, so the third applies.
+	applier.Checkpoint()
+	if err := applier.Apply(third); err != nil {
+		t.Fatalf("Third delta failed: %v", err)
+	}
+	if result, _ := applier.Result(); !compareHTML(t, result, `<p>one two three</p>`) {
+		t.Error("Result after third delta incorrect")
+	}
+
+	// Rollback returns to the checkpoint.
+	if err := applier.Rollback(); err != nil {
+		t.Fatal(err)
+	}
+	if result, _ := applier.Result(); result != afterFirst {
+		t.Errorf("Result after Rollback = %s, want %s", result, afterFirst)
+	}
+}
+
+func TestReplayHistory(t *testing.T) {
+	states := []string{
+		`<p>Draft</p>`,
+		`<p>Draft one</p>`,
+		`<h1>Title</h1><p>Draft one</p>`,
+		`<h1>Title</h1><p class="final">Draft one</p>`,
+	}
+	var deltas []*Delta
+	current := states[0]
+	for _, next := range states[1:] {
+		delta, err := Diff(current, next, "tester")
+		if err != nil {
+			t.Fatal(err)
+		}
+		deltas = append(deltas, delta)
+		if current, err = Patch(current, delta); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	replayed, err := ReplayHistory(states[0], deltas)
+	if err != nil {
+		t.Fatalf("ReplayHistory failed: %v", err)
+	}
+	if len(replayed) != len(deltas) {
+		t.Fatalf("Expected %d states, got %d", len(deltas), len(replayed))
+	}
+	for i, state := range replayed {
+		if !compareHTML(t, state, states[i+1]) {
+			t.Errorf("State %d incorrect", i)
+		}
+	}
+
+	// Skipping a delta breaks the hash chain at the next one.
+	replayed, err = ReplayHistory(states[0], []*Delta{deltas[0], deltas[2]})
+	if err == nil || !strings.HasPrefix(err.Error(), "delta 1:") {
+		t.Errorf("Expected a base hash error on delta 1, got %v", err)
+	}
+	if len(replayed) != 1 {
+		t.Errorf("Expected the state before the failure, got %d states", len(replayed))
+	}
+}
@@ -0,0 +1,204 @@
+package vchtml
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// benchFixtures are representative documents: a short note, a wiki-page-sized
+// article, and a large multi-section document.
+var benchFixtures = []string{"small", "medium", "large"}
+
+func loadFixture(tb testing.TB, name string) string {
+	tb.Helper()
+	data, err := os.ReadFile("testdata/" + name + ".html")
+	if err != nil {
+		tb.Fatalf("failed to read fixture: %v", err)
+	}
+	return string(data)
+}
+
+// editA changes the text of the last paragraph and adds an attribute to the
+// page heading.
+func editA(src string) string {
+	i := strings.LastIndex(src, "</p>")
+	src = src[:i] + " Edited by A." + src[i:]
+	return strings.Replace(src, "<h1>", `<h1 data-rev="2">`, 1)
+}
+
+// editB prefixes the first list item and appends a paragraph to the content.
+func editB(src string) string {
+	src = strings.Replace(src, "<li>", "<li>Reviewed: ", 1)
+	return strings.Replace(src, "</div>\n</body>", "<p>Appended by B.</p>\n</div>\n</body>", 1)
+}
+
+func BenchmarkDiff(b *testing.B) {
+	for _, name := range benchFixtures {
+		base := loadFixture(b, name)
+		edited := editA(base)
+		b.Run(name, func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				if _, err := Diff(base, edited, "bench"); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+// BenchmarkDiffNodes measures diffing alone, on trees parsed up front.
+func BenchmarkDiffNodes(b *testing.B) {
+	for _, name := range benchFixtures {
+		base := loadFixture(b, name)
+		oldDoc, _ := ParseHTML(base)
+		newDoc, _ := ParseHTML(editA(base))
+		b.Run(name, func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				if _, err := DiffNodes(oldDoc, newDoc, DiffOptions{}); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkPatch(b *testing.B) {
+	for _, name := range benchFixtures {
+		base := loadFixture(b, name)
+		delta, err := Diff(base, editA(base), "bench")
+		if err != nil {
+			b.Fatal(err)
+		}
+		b.Run(name, func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				if _, err := Patch(base, delta); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkMerge(b *testing.B) {
+	for _, name := range benchFixtures {
+		base := loadFixture(b, name)
+		deltaA, err := Diff(base, editA(base), "A")
+		if err != nil {
+			b.Fatal(err)
+		}
+		deltaB, err := Diff(base, editB(base), "B")
+		if err != nil {
+			b.Fatal(err)
+		}
+		b.Run(name, func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				_, _, conflicts, err := Merge(base, deltaA, deltaB)
+				if err != nil {
+					b.Fatal(err)
+				}
+				if len(conflicts) > 0 {
+					b.Fatalf("unexpected conflicts: %v", conflicts)
+				}
+			}
+		})
+	}
+}
+
+// TestBenchFixtures keeps the benchmark inputs honest: the edits must merge
+// cleanly and reproduce both changes.
+func TestBenchFixtures(t *testing.T) {
+	for _, name := range benchFixtures {
+		base := loadFixture(t, name)
+		deltaA, _ := Diff(base, editA(base), "A")
+		deltaB, _ := Diff(base, editB(base), "B")
+		merged, _, conflicts, err := Merge(base, deltaA, deltaB)
+		if err != nil || len(conflicts) > 0 {
+			t.Fatalf("%s: merge failed: %v %v", name, err, conflicts)
+		}
+		if !compareHTML(t, merged, editB(editA(base))) {
+			t.Errorf("%s: merged document incorrect", name)
+		}
+	}
+}
+
+// BenchmarkDiffAppendOnly compares the memory of the tree diff with the
+// token scan of DiffOptions.Streaming on sections appended to the large
+// fixture.
+func BenchmarkDiffAppendOnly(b *testing.B) {
+	base := loadFixture(b, "large")
+	var sections strings.Builder
+	for i := 0; i < 20; i++ {
+		fmt.Fprintf(&sections, "<section id=\"log%d\">\n<h2>Entry %d</h2>\n<p>Appended entry %d.</p>\n</section>\n", i, i, i)
+	}
+	edited := strings.Replace(base, "</div>\n</body>", sections.String()+"</div>\n</body>", 1)
+	for _, tc := range []struct {
+		name string
+		opts DiffOptions
+	}{
+		{"tree", DiffOptions{}},
+		{"streaming", DiffOptions{Streaming: true}},
+	} {
+		b.Run(tc.name, func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				delta, err := DiffWithOptions(base, edited, "bench", tc.opts)
+				if err != nil {
+					b.Fatal(err)
+				}
+				if len(delta.Operations) != 40 { // Each section and the newline after it
+					b.Fatalf("got %d ops", len(delta.Operations))
+				}
+			}
+		})
+	}
+}
+
+// BenchmarkMergeAll merges 50 concurrent deltas, each appending its own
+// paragraph, and reports how many documents were hashed per merge. Merging
+// pairwise with Merge hashes (and patches) the base at every step; MergeAll
+// hashes it once.
+func BenchmarkMergeAll(b *testing.B) {
+	base := loadFixture(b, "medium")
+	deltas := make([]*Delta, 50)
+	for i := range deltas {
+		edited := strings.Replace(base, "</div>\n</body>", fmt.Sprintf("<p>Appended by %d.</p>\n</div>\n</body>", i), 1)
+		d, err := Diff(base, edited, strconv.Itoa(i))
+		if err != nil {
+			b.Fatal(err)
+		}
+		deltas[i] = d
+	}
+
+	b.Run("MergeAll", func(b *testing.B) {
+		b.ReportAllocs()
+		hashed := countHashes(b)
+		for i := 0; i < b.N; i++ {
+			if _, _, conflicts, err := MergeAll(base, deltas); err != nil || len(conflicts) > 0 {
+				b.Fatal(err, conflicts)
+			}
+		}
+		b.ReportMetric(float64(*hashed)/float64(b.N), "hashes/op")
+	})
+	b.Run("pairwise", func(b *testing.B) {
+		b.ReportAllocs()
+		hashed := countHashes(b)
+		for i := 0; i < b.N; i++ {
+			merged := deltas[0]
+			for _, d := range deltas[1:] {
+				_, next, conflicts, err := Merge(base, merged, d)
+				if err != nil || len(conflicts) > 0 {
+					b.Fatal(err, conflicts)
+				}
+				merged = next
+			}
+		}
+		b.ReportMetric(float64(*hashed)/float64(b.N), "hashes/op")
+	})
+}
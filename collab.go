@@ -0,0 +1,91 @@
+package vchtml
+
+import (
+	"fmt"
+	"sync"
+)
+
+// CollaborativeDoc is a server-side editing session. It holds the current
+// document and the history of applied deltas, and rebases client deltas made
+// against older revisions onto the latest one (operational transformation).
+// It is safe for concurrent use.
+type CollaborativeDoc struct {
+	mu       sync.Mutex
+	html     string
+	hashes   []string // hashes[r] is the hash of the document at revision r
+	history  []*Delta // history[r] transforms revision r into revision r+1
+	revision int
+}
+
+// NewCollaborativeDoc starts a session at revision 0 with initialHTML.
+func NewCollaborativeDoc(initialHTML string) *CollaborativeDoc {
+	return &CollaborativeDoc{
+		html:   initialHTML,
+		hashes: []string{hashFunc(initialHTML)},
+	}
+}
+
+// HTML returns the current document.
+func (d *CollaborativeDoc) HTML() string {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.html
+}
+
+// Revision returns the number of deltas applied so far.
+func (d *CollaborativeDoc) Revision() int {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.revision
+}
+
+// Submit accepts a delta computed by a client against any earlier revision of
+// the document (identified by its BaseHash). The delta is transformed against
+// every delta applied since that revision and then applied. It returns the
+// transformed delta, based on the previous head, for broadcasting to other
+// clients. If the client delta conflicts with a concurrent change, nothing is
+// applied and the conflicts are returned.
+func (d *CollaborativeDoc) Submit(clientDelta *Delta) (*Delta, []Conflict, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	base := d.findRevision(clientDelta.BaseHash)
+	if base < 0 {
+		return nil, nil, fmt.Errorf("unknown base revision for hash %s", clientDelta.BaseHash)
+	}
+
+	ops, conflicts, err := rebaseOps(clientDelta, d.history[base:])
+	if err != nil || len(conflicts) > 0 {
+		return nil, conflicts, err
+	}
+
+	broadcast := &Delta{
+		BaseHash:     d.hashes[d.revision],
+		Operations:   ops,
+		Timestamp:    clientDelta.Timestamp,
+		Author:       clientDelta.Author,
+		Root:         clientDelta.Root,
+		ElementIndex: clientDelta.ElementIndex,
+	}
+	patched, err := Patch(d.html, broadcast)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	d.html = patched
+	d.history = append(d.history, broadcast)
+	d.hashes = append(d.hashes, hashFunc(patched))
+	d.revision++
+	return broadcast, nil, nil
+}
+
+// findRevision returns the latest revision whose document hashes to hash,
+// or -1 if there is none.
+func (d *CollaborativeDoc) findRevision(hash string) int {
+	for r := d.revision; r >= 0; r-- {
+		if d.hashes[r] == hash {
+			return r
+		}
+	}
+	return -1
+}
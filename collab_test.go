@@ -0,0 +1,80 @@
+package vchtml
+
+import (
+	"testing"
+)
+
+func TestCollaborativeDocConcurrentEdits(t *testing.T) {
+	doc := NewCollaborativeDoc(`<p>Hello World</p>`)
+
+	// Both clients start from revision 0.
+	base := doc.HTML()
+	alice, err := Diff(base, `<p>Hello Go World</p>`, "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	bob, err := Diff(base, `<p>Hello World!</p>`, "bob")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Alice's delta is based on the head and applies unchanged.
+	toBob, conflicts, err := doc.Submit(alice)
+	if err != nil || len(conflicts) > 0 {
+		t.Fatalf("Submit(alice) failed: %v %v", err, conflicts)
+	}
+
+	// Bob's delta is one revision behind and must be shifted past Alice's insert.
+	toAlice, conflicts, err := doc.Submit(bob)
+	if err != nil || len(conflicts) > 0 {
+		t.Fatalf("Submit(bob) failed: %v %v", err, conflicts)
+	}
+	if doc.Revision() != 2 {
+		t.Errorf("Want revision 2, got %d", doc.Revision())
+	}
+
+	want := `<p>Hello Go World!</p>`
+	if !compareHTML(t, doc.HTML(), want) {
+		t.Fatalf("Server document incorrect")
+	}
+
+	// Alice, having applied her own edit, receives Bob's transformed delta.
+	aliceState, err := Patch(base, alice)
+	if err != nil {
+		t.Fatal(err)
+	}
+	aliceState, err = Patch(aliceState, toAlice)
+	if err != nil {
+		t.Fatalf("Alice could not apply broadcast: %v", err)
+	}
+	if !compareHTML(t, aliceState, want) {
+		t.Errorf("Alice did not converge")
+	}
+
+	// The first broadcast is simply Alice's delta.
+	if len(toBob.Operations) != len(alice.Operations) {
+		t.Errorf("Broadcast to Bob should carry Alice's ops unchanged")
+	}
+}
+
+func TestCollaborativeDocConflict(t *testing.T) {
+	doc := NewCollaborativeDoc(`<div class="a"></div>`)
+	base := doc.HTML()
+
+	first, _ := Diff(base, `<div class="b"></div>`, "alice")
+	second, _ := Diff(base, `<div class="c"></div>`, "bob")
+
+	if _, _, err := doc.Submit(first); err != nil {
+		t.Fatal(err)
+	}
+	_, conflicts, err := doc.Submit(second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(conflicts) == 0 {
+		t.Errorf("Expected a conflict")
+	}
+	if doc.Revision() != 1 {
+		t.Errorf("Conflicting delta must not be applied, revision=%d", doc.Revision())
+	}
+}
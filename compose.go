@@ -0,0 +1,144 @@
+package vchtml
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// Compose combines two sequential deltas into a single delta equivalent to
+// applying d1 to 'baseHTML' followed by d2. d2 must have been computed against
+// the result of applying d1.
+func Compose(baseHTML string, d1, d2 *Delta) (*Delta, error) {
+	if d1.Root != d2.Root {
+		return nil, fmt.Errorf("path root mismatch: %q vs %q", d1.Root, d2.Root)
+	}
+	if d1.ElementIndex != d2.ElementIndex {
+		return nil, errors.New("path indexing mismatch: only one delta uses element indices")
+	}
+
+	intermediate, err := Patch(baseHTML, d1)
+	if err != nil {
+		return nil, fmt.Errorf("failed to apply first delta: %w", err)
+	}
+	if hash := hashFunc(intermediate); hash != d2.BaseHash {
+		return nil, fmt.Errorf("second delta base hash mismatch: expected %s, got %s", d2.BaseHash, hash)
+	}
+
+	// d2's paths are relative to the document produced by d1, so a plain
+	// concatenation is already a valid op sequence. Folding then removes
+	// intermediate churn between adjacent ops on the same node.
+	ops := make([]Operation, 0, len(d1.Operations)+len(d2.Operations))
+	ops = append(ops, d1.Operations...)
+	ops = append(ops, d2.Operations...)
+
+	return &Delta{
+		BaseHash:     d1.BaseHash,
+		Operations:   foldOperations(ops),
+		Timestamp:    d2.Timestamp,
+		Author:       d2.Author,
+		Root:         d1.Root,
+		ElementIndex: d1.ElementIndex,
+	}, nil
+}
+
+// foldOperations merges adjacent operations on the same node where the pair
+// can be expressed as a single operation (or cancels out entirely).
+func foldOperations(ops []Operation) []Operation {
+	var out []Operation
+	for _, op := range ops {
+		if len(out) == 0 {
+			out = append(out, op)
+			continue
+		}
+		prev := out[len(out)-1]
+		folded, ok := foldPair(prev, op)
+		if !ok {
+			out = append(out, op)
+			continue
+		}
+		out = out[:len(out)-1]
+		out = append(out, folded...)
+	}
+	return out
+}
+
+// foldPair attempts to combine a followed by b. It returns the replacement ops
+// (possibly none) and whether folding was possible.
+func foldPair(a, b Operation) ([]Operation, bool) {
+	if !pathEqual(a.Path, b.Path) {
+		return nil, false
+	}
+
+	switch {
+	case a.Type == OpInsertText && b.Type == OpInsertText:
+		// b inserts inside (or at either edge of) the text a inserted.
+		offset := b.Position - a.Position
+		if offset < 0 || offset > len(a.NewValue) {
+			return nil, false
+		}
+		a.NewValue = a.NewValue[:offset] + b.NewValue + a.NewValue[offset:]
+		return []Operation{a}, true
+
+	case a.Type == OpInsertText && b.Type == OpDeleteText:
+		// b deletes text that lies entirely within a's insertion.
+		offset := b.Position - a.Position
+		if offset < 0 || offset+len(b.OldValue) > len(a.NewValue) {
+			return nil, false
+		}
+		if a.NewValue[offset:offset+len(b.OldValue)] != b.OldValue {
+			return nil, false
+		}
+		a.NewValue = a.NewValue[:offset] + a.NewValue[offset+len(b.OldValue):]
+		if a.NewValue == "" {
+			return nil, true
+		}
+		return []Operation{a}, true
+
+	case a.Type == OpDeleteText && b.Type == OpDeleteText:
+		if b.Position == a.Position {
+			// b continues deleting forward from where a stopped.
+			a.OldValue += b.OldValue
+			return []Operation{a}, true
+		}
+		if b.Position+len(b.OldValue) == a.Position {
+			// b deletes the text immediately before a's deletion.
+			a.Position = b.Position
+			a.OldValue = b.OldValue + a.OldValue
+			return []Operation{a}, true
+		}
+		return nil, false
+
+	case a.Type == OpDeleteText && b.Type == OpInsertText:
+		// Re-inserting exactly what was deleted is a no-op.
+		if a.Position == b.Position && a.OldValue == b.NewValue {
+			return nil, true
+		}
+		return nil, false
+
+	case a.Type == OpUpdateText && b.Type == OpUpdateText:
+		a.NewValue = b.NewValue
+		if a.OldValue == a.NewValue {
+			return nil, true
+		}
+		return []Operation{a}, true
+
+	case a.Type == OpChangeTag && b.Type == OpChangeTag:
+		a.NewValue = b.NewValue
+		if strings.EqualFold(a.OldValue, a.NewValue) {
+			return nil, true
+		}
+		return []Operation{a}, true
+
+	case a.Type == OpUpdateAttr && b.Type == OpUpdateAttr && strings.EqualFold(a.Key, b.Key) && strings.EqualFold(a.SubKey, b.SubKey):
+		if a.Added && b.Removed {
+			return nil, true // Added and removed again: no change.
+		}
+		a.NewValue = b.NewValue
+		a.Removed = b.Removed
+		a.MovedFrom = b.MovedFrom // The value now comes from b
+		return []Operation{a}, true
+	}
+
+	return nil, false
+}
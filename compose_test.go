@@ -0,0 +1,61 @@
+package vchtml
+
+import (
+	"testing"
+)
+
+func TestComposeTextEdits(t *testing.T) {
+	baseHTML := `<p>Hello</p>`
+
+	// d1: Hello -> Hello World
+	d1, err := Diff(baseHTML, `<p>Hello World</p>`, "A")
+	if err != nil {
+		t.Fatal(err)
+	}
+	intermediate, err := Patch(baseHTML, d1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// d2: Hello World -> Hello World!
+	d2, err := Diff(intermediate, `<p>Hello World!</p>`, "A")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	composed, err := Compose(baseHTML, d1, d2)
+	if err != nil {
+		t.Fatalf("Compose failed: %v", err)
+	}
+
+	// Both inserts are on the same text node and adjacent, so they fold.
+	if len(composed.Operations) != 1 {
+		for i, op := range composed.Operations {
+			t.Logf("Op[%d]: %v", i, op)
+		}
+		t.Fatalf("Want 1 op, got %d", len(composed.Operations))
+	}
+	op := composed.Operations[0]
+	if op.Type != OpInsertText || op.Position != 5 || op.NewValue != " World!" {
+		t.Errorf("Unexpected composed op: %+v", op)
+	}
+
+	patched, err := Patch(baseHTML, composed)
+	if err != nil {
+		t.Fatalf("Patch failed: %v", err)
+	}
+	if !compareHTML(t, patched, `<p>Hello World!</p>`) {
+		t.Errorf("Composed delta produced wrong result")
+	}
+}
+
+func TestComposeBaseMismatch(t *testing.T) {
+	baseHTML := `<p>Hello</p>`
+	d1, _ := Diff(baseHTML, `<p>Hello World</p>`, "A")
+	// d2 computed against the original base instead of d1's result.
+	d2, _ := Diff(baseHTML, `<p>Hi</p>`, "A")
+
+	if _, err := Compose(baseHTML, d1, d2); err == nil {
+		t.Errorf("Expected base hash mismatch error")
+	}
+}
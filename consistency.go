@@ -0,0 +1,246 @@
+package vchtml
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
+)
+
+// CheckPathConsistency replays d's ops on a model of the document built only
+// from what the ops themselves reveal, shifting indices as inserts, deletes,
+// splits, wraps and moves would, and reports the first op whose path cannot
+// be valid whatever the base document is: an index past the known children
+// of a node the delta inserted, a path through a text node, a text op on an
+// element (or the reverse), or a negative index. It catches bugs in delta
+// generators without needing the base. Anchored ops are not checked, and a
+// keyed insert is assumed to land at its Position.
+func CheckPathConsistency(d *Delta) error {
+	root := &shapeNode{}
+	for i, op := range d.Operations {
+		if op.Anchor != "" {
+			continue
+		}
+		if err := root.apply(op); err != nil {
+			return fmt.Errorf("op %d (%s) at %v: %w", i, op.Type, op.Path, err)
+		}
+	}
+	return nil
+}
+
+// shapeNode is what is known of one node while checking paths. A zero kind
+// means the node came from the base document and its type is unknown; its
+// children are then only the ones paths have reached so far, padded with
+// unknown nodes. Nodes parsed from an op's NodeData are known completely.
+type shapeNode struct {
+	kind     html.NodeType
+	complete bool // children holds every child
+	children []*shapeNode
+}
+
+// shapeOf models the parsed node n and its subtree completely.
+func shapeOf(n *html.Node) *shapeNode {
+	s := &shapeNode{kind: n.Type, complete: true}
+	for c := n.FirstChild; c != nil; c = c.NextSibling {
+		s.children = append(s.children, shapeOf(c))
+	}
+	return s
+}
+
+// child returns child i of s, growing an incomplete child list to reach it.
+func (s *shapeNode) child(i int) (*shapeNode, error) {
+	if i < 0 {
+		return nil, fmt.Errorf("negative index %d", i)
+	}
+	if err := s.reach(i + 1); err != nil {
+		return nil, err
+	}
+	return s.children[i], nil
+}
+
+// reach makes sure s has at least n children.
+func (s *shapeNode) reach(n int) error {
+	if s.kind != 0 && s.kind != html.ElementNode && s.kind != html.DocumentNode {
+		return errors.New("path descends into a node that has no children")
+	}
+	if len(s.children) >= n {
+		return nil
+	}
+	if s.complete {
+		return fmt.Errorf("index %d out of range, the node has %d children", n-1, len(s.children))
+	}
+	for len(s.children) < n {
+		s.children = append(s.children, &shapeNode{})
+	}
+	return nil
+}
+
+// resolve returns the node at path below s.
+func (s *shapeNode) resolve(path NodePath) (*shapeNode, error) {
+	n := s
+	for _, i := range path {
+		c, err := n.child(i)
+		if err != nil {
+			return nil, err
+		}
+		n = c
+	}
+	return n, nil
+}
+
+// expect records that s is of kind, failing if it is known to be another.
+func (s *shapeNode) expect(kind html.NodeType) error {
+	switch {
+	case s.kind == kind:
+		return nil
+	case s.kind != 0:
+		return fmt.Errorf("target is %s, not %s", nodeKindName(s.kind), nodeKindName(kind))
+	case kind == html.TextNode && len(s.children) > 0:
+		return errors.New("target has children, so it is not a text node")
+	}
+	s.kind = kind
+	if kind == html.TextNode {
+		s.complete = true
+	}
+	return nil
+}
+
+// remove detaches and returns the node at path.
+func (s *shapeNode) remove(path NodePath) (*shapeNode, error) {
+	if len(path) == 0 {
+		return nil, errors.New("cannot remove the root node")
+	}
+	parent, err := s.resolve(path[:len(path)-1])
+	if err != nil {
+		return nil, err
+	}
+	i := path[len(path)-1]
+	n, err := parent.child(i)
+	if err != nil {
+		return nil, err
+	}
+	parent.children = append(parent.children[:i], parent.children[i+1:]...)
+	return n, nil
+}
+
+// insert adds n as child position of the node at path.
+func (s *shapeNode) insert(path NodePath, position int, n *shapeNode) error {
+	parent, err := s.resolve(path)
+	if err != nil {
+		return err
+	}
+	if position < 0 {
+		return fmt.Errorf("negative insert position %d", position)
+	}
+	if err := parent.reach(position); err != nil {
+		return fmt.Errorf("insert position: %w", err)
+	}
+	parent.children = append(parent.children[:position], append([]*shapeNode{n}, parent.children[position:]...)...)
+	return nil
+}
+
+// apply replays op on the model rooted at s.
+func (s *shapeNode) apply(op Operation) error {
+	switch op.Type {
+	case OpUpdateText, OpInsertText, OpDeleteText, OpReplaceText, OpSplitText:
+		n, err := s.resolve(op.Path)
+		if err != nil {
+			return err
+		}
+		if err := n.expect(html.TextNode); err != nil {
+			return err
+		}
+		if op.Type == OpSplitText {
+			if len(op.Path) == 0 {
+				return errors.New("cannot split the root node")
+			}
+			tail := &shapeNode{kind: html.TextNode, complete: true}
+			return s.insert(op.Path[:len(op.Path)-1], op.Path[len(op.Path)-1]+1, tail)
+		}
+
+	case OpUpdateAttr, OpDeleteAttr, OpInsertAttrText, OpDeleteAttrText, OpAddClass, OpRemoveClass, OpChangeTag:
+		n, err := s.resolve(op.Path)
+		if err != nil {
+			return err
+		}
+		if err := n.expect(html.ElementNode); err != nil {
+			return err
+		}
+		if op.MovedFrom != nil {
+			from, err := s.resolve(op.MovedFrom)
+			if err != nil {
+				return fmt.Errorf("moved_from: %w", err)
+			}
+			if err := from.expect(html.ElementNode); err != nil {
+				return fmt.Errorf("moved_from: %w", err)
+			}
+		}
+		return nil
+
+	case OpInsertNode:
+		if op.Placement != PlaceAtIndex {
+			if _, err := s.resolve(op.Path); err != nil {
+				return err
+			}
+			var err error
+			if op, err = atIndex(op); err != nil {
+				return err
+			}
+		}
+		context := op.ParentTag
+		if context == "" {
+			context = "body"
+		}
+		nodes, err := html.ParseFragment(strings.NewReader(op.NodeData), &html.Node{Type: html.ElementNode, Data: context, DataAtom: atom.Lookup([]byte(context))})
+		if err != nil {
+			return fmt.Errorf("failed to parse node data: %w", err)
+		}
+		if len(nodes) == 0 {
+			_, err := s.resolve(op.Path)
+			return err
+		}
+		return s.insert(op.Path, op.Position, shapeOf(nodes[0]))
+
+	case OpDeleteNode:
+		_, err := s.remove(op.Path)
+		return err
+
+	case OpMoveNode:
+		n, err := s.remove(op.Path)
+		if err != nil {
+			return err
+		}
+		return s.insert(op.To, op.Position, n)
+
+	case OpWrapNode:
+		n, err := s.remove(op.Path)
+		if err != nil {
+			return err
+		}
+		wrapper := &shapeNode{kind: html.ElementNode, complete: true, children: []*shapeNode{n}}
+		return s.insert(op.Path[:len(op.Path)-1], op.Path[len(op.Path)-1], wrapper)
+
+	default:
+		return fmt.Errorf("unknown operation type %q", op.Type)
+	}
+	return nil
+}
+
+// nodeKindName names a node type, with an article, in error messages.
+func nodeKindName(t html.NodeType) string {
+	switch t {
+	case html.TextNode:
+		return "a text node"
+	case html.ElementNode:
+		return "an element"
+	case html.DocumentNode:
+		return "the document"
+	case html.CommentNode:
+		return "a comment"
+	case html.DoctypeNode:
+		return "a doctype"
+	}
+	return fmt.Sprintf("node of type %d", t)
+}
@@ -0,0 +1,88 @@
+package vchtml
+
+import "unicode/utf8"
+
+// isContextOp reports whether op is a text op that can carry context.
+func isContextOp(op Operation) bool {
+	return op.Type == OpInsertText || op.Type == OpDeleteText || op.Type == OpReplaceText
+}
+
+// addTextContext sets the context of the text ops in ops, consecutive edits
+// of a node whose text was oldText, to up to n bytes on each side of the
+// edited range, cut at rune boundaries.
+func addTextContext(oldText string, ops []Operation, n int) {
+	text := oldText
+	for i := range ops {
+		op := &ops[i]
+		if !isContextOp(*op) {
+			continue
+		}
+		start, end := op.Position, op.Position+len(op.OldValue)
+		if start < 0 || end > len(text) {
+			return
+		}
+		from := max(0, start-n)
+		for from < start && !utf8.RuneStart(text[from]) {
+			from++
+		}
+		to := min(len(text), end+n)
+		for to > end && to < len(text) && !utf8.RuneStart(text[to]) {
+			to--
+		}
+		op.ContextBefore, op.ContextAfter = text[from:start], text[end:to]
+		text = text[:start] + op.NewValue + text[end:]
+	}
+}
+
+// relocateText returns where the text op op applies in text. Without context
+// that is op.Position. Otherwise it is the offset where the op's OldValue
+// is found with the most of its context around it, preferring op.Position
+// and then the nearest offset. If no offset matches any context, the
+// position is left for the op's own checks to reject.
+func relocateText(text string, op Operation) int {
+	if op.ContextBefore == "" && op.ContextAfter == "" {
+		return op.Position
+	}
+	score := func(p int) int {
+		end := p + len(op.OldValue)
+		if p < 0 || end > len(text) || text[p:end] != op.OldValue {
+			return -1
+		}
+		if p < len(text) && !utf8.RuneStart(text[p]) {
+			return -1
+		}
+		return commonSuffixLen(text[:p], op.ContextBefore) + commonPrefixLen(text[end:], op.ContextAfter)
+	}
+	best, bestScore := op.Position, score(op.Position)
+	if bestScore == len(op.ContextBefore)+len(op.ContextAfter) {
+		return best
+	}
+	distance := func(p int) int { return max(p-op.Position, op.Position-p) }
+	for p := 0; p+len(op.OldValue) <= len(text); p++ {
+		if s := score(p); s > bestScore || s == bestScore && distance(p) < distance(best) {
+			best, bestScore = p, s
+		}
+	}
+	if bestScore <= 0 {
+		return op.Position
+	}
+	return best
+}
+
+// commonPrefixLen returns the length of the common prefix of a and b.
+func commonPrefixLen(a, b string) int {
+	n := 0
+	for n < len(a) && n < len(b) && a[n] == b[n] {
+		n++
+	}
+	return n
+}
+
+// commonSuffixLen returns the length of the common suffix of a and b.
+func commonSuffixLen(a, b string) int {
+	n := 0
+	for n < len(a) && n < len(b) && a[len(a)-1-n] == b[len(b)-1-n] {
+		n++
+	}
+	return n
+}
@@ -0,0 +1,95 @@
+package vchtml
+
+import (
+	"fmt"
+
+	"golang.org/x/net/html"
+)
+
+// Cursor resolves paths like GetNode, but remembers the nodes along the last
+// resolved path. A following path that shares a prefix with it only walks the
+// divergent suffix, and a step to a later sibling continues from the cached
+// sibling instead of the parent's first child.
+//
+// A Cursor does not observe the tree: after changing the children of a node,
+// call Invalidate with that node's path (or Reset).
+type Cursor struct {
+	root   *html.Node
+	path   NodePath
+	nodes  []*html.Node // nodes[i] is the node at path[:i+1]
+	visits int          // Child links followed, for measuring the cache
+}
+
+// NewCursor returns a Cursor resolving paths from root.
+func NewCursor(root *html.Node) *Cursor {
+	return &Cursor{root: root}
+}
+
+// Resolve returns the node at path, like GetNode(root, path).
+func (c *Cursor) Resolve(path NodePath) (*html.Node, error) {
+	common := 0
+	for common < len(c.path) && common < len(path) && c.path[common] == path[common] {
+		common++
+	}
+
+	// Resume at the cached sibling when the first divergent step moves right.
+	var sibling *html.Node
+	skip := 0
+	if common < len(c.path) && common < len(path) && path[common] > c.path[common] {
+		sibling = c.nodes[common]
+		skip = path[common] - c.path[common]
+	}
+
+	c.path = c.path[:common]
+	c.nodes = c.nodes[:common]
+
+	current := c.root
+	if common > 0 {
+		current = c.nodes[common-1]
+	}
+	for i := common; i < len(path); i++ {
+		var child *html.Node
+		if i == common && sibling != nil {
+			child = sibling
+			for n := 0; n < skip && child != nil; n++ {
+				child = child.NextSibling
+				c.visits++
+			}
+		} else {
+			child = current.FirstChild
+			c.visits++
+			for n := 0; n < path[i] && child != nil; n++ {
+				child = child.NextSibling
+				c.visits++
+			}
+		}
+		if child == nil || path[i] < 0 {
+			return nil, fmt.Errorf("node not found at path %v (failed at index %d, step %d)", path, path[i], i)
+		}
+		c.path = append(c.path, path[i])
+		c.nodes = append(c.nodes, child)
+		current = child
+	}
+	return current, nil
+}
+
+// Invalidate drops cached nodes that may have moved because the children of
+// the node at parent changed. Nodes outside that subtree stay cached.
+func (c *Cursor) Invalidate(parent NodePath) {
+	if len(parent) > len(c.path) {
+		return
+	}
+	for i, index := range parent {
+		if c.path[i] != index {
+			return
+		}
+	}
+	c.path = c.path[:len(parent)]
+	c.nodes = c.nodes[:len(parent)]
+}
+
+// Reset drops every cached node.
+func (c *Cursor) Reset() {
+	c.path = c.path[:0]
+	c.nodes = c.nodes[:0]
+}
@@ -0,0 +1,152 @@
+package vchtml
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+// deepListHTML nests depth divs, each preceded by `padding` siblings, around a
+// list of n paragraphs. It returns the document and the path of the list.
+func deepListHTML(depth, padding, n int) (string, NodePath) {
+	var b strings.Builder
+	path := NodePath{0, 1} // <html>, <body>
+	for i := 0; i < depth; i++ {
+		b.WriteString(strings.Repeat("<span></span>", padding))
+		b.WriteString("<div>")
+		path = append(path, padding)
+	}
+	for i := 0; i < n; i++ {
+		fmt.Fprintf(&b, "<p>Item %d</p>", i)
+	}
+	b.WriteString(strings.Repeat("</div>", depth))
+	return "<html><head></head><body>" + b.String() + "</body></html>", path
+}
+
+// naiveVisits counts the child links GetNode follows to resolve path.
+func naiveVisits(path NodePath) int {
+	visits := 0
+	for _, index := range path {
+		visits += index + 1
+	}
+	return visits
+}
+
+func TestCursorMatchesGetNode(t *testing.T) {
+	doc, err := ParseHTML(`<div><p>a<b>b</b></p><p>c</p></div><ul><li>1</li><li>2</li><li>3</li></ul>`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cur := NewCursor(doc)
+	paths := []NodePath{
+		{0, 1, 0, 0, 1, 0},
+		{0, 1, 0, 1},
+		{0, 1, 1, 2, 0},
+		{0, 1, 1, 0},
+		{},
+		{0, 1, 1, 2},
+		{0, 1, 0, 0, 0},
+	}
+	for _, path := range paths {
+		want, _ := GetNode(doc, path)
+		got, err := cur.Resolve(path)
+		if err != nil {
+			t.Fatalf("Resolve(%v): %v", path, err)
+		}
+		if got != want {
+			t.Errorf("Resolve(%v) returned a different node than GetNode", path)
+		}
+	}
+
+	if _, err := cur.Resolve(NodePath{0, 1, 1, 5}); err == nil {
+		t.Error("Expected an error for a missing child")
+	}
+
+	// Removing a child must not leave a stale sibling cached.
+	ul, _ := cur.Resolve(NodePath{0, 1, 1})
+	if _, err := cur.Resolve(NodePath{0, 1, 1, 1}); err != nil {
+		t.Fatal(err)
+	}
+	ul.RemoveChild(ul.FirstChild)
+	cur.Invalidate(NodePath{0, 1, 1})
+	got, err := cur.Resolve(NodePath{0, 1, 1, 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.FirstChild.Data != "3" {
+		t.Errorf("Expected the third item after invalidation, got %q", got.FirstChild.Data)
+	}
+}
+
+func TestCursorFewerVisits(t *testing.T) {
+	const n = 500
+	htmlStr, listPath := deepListHTML(30, 5, n)
+	doc, err := ParseHTML(htmlStr)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cur := NewCursor(doc)
+	naive := 0
+	for i := 0; i < n; i++ {
+		path := append(append(NodePath{}, listPath...), i, 0)
+		naive += naiveVisits(path)
+		node, err := cur.Resolve(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := fmt.Sprintf("Item %d", i); node.Data != want {
+			t.Fatalf("Resolve(%v) = %q, want %q", path, node.Data, want)
+		}
+	}
+	if cur.visits*10 > naive {
+		t.Errorf("Expected the cursor to visit far fewer nodes: cursor=%d naive=%d", cur.visits, naive)
+	}
+
+	// Patch resolves through a cursor; the result must match the edits.
+	ops := make([]Operation, 0, n)
+	for i := 0; i < n; i++ {
+		path := append(append(NodePath{}, listPath...), i)
+		ops = append(ops, Operation{Type: OpUpdateAttr, Path: path, Key: "data-i", NewValue: fmt.Sprint(i)})
+	}
+	patched, err := Patch(htmlStr, &Delta{BaseHash: hashString(htmlStr), Operations: ops})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(patched, `<p data-i="0">Item 0</p>`) || !strings.Contains(patched, `<p data-i="499">Item 499</p>`) {
+		t.Errorf("Patch did not apply every op")
+	}
+}
+
+func BenchmarkResolvePaths(b *testing.B) {
+	const n = 500
+	htmlStr, listPath := deepListHTML(30, 5, n)
+	doc, err := ParseHTML(htmlStr)
+	if err != nil {
+		b.Fatal(err)
+	}
+	paths := make([]NodePath, n)
+	for i := range paths {
+		paths[i] = append(append(NodePath{}, listPath...), i, 0)
+	}
+
+	b.Run("GetNode", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			for _, path := range paths {
+				if _, err := GetNode(doc, path); err != nil {
+					b.Fatal(err)
+				}
+			}
+		}
+	})
+	b.Run("Cursor", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			cur := NewCursor(doc)
+			for _, path := range paths {
+				if _, err := cur.Resolve(path); err != nil {
+					b.Fatal(err)
+				}
+			}
+		}
+	})
+}
@@ -3,69 +3,520 @@ package vchtml
 import (
 	"crypto/sha256"
 	"encoding/hex"
+	"errors"
 	"fmt"
+	"slices"
+	"sort"
+	"strings"
 	"time"
 
 	"golang.org/x/net/html"
 )
 
+// DiffOptions controls optional behavior of DiffWithOptions.
+type DiffOptions struct {
+	// NodeEqual decides whether an old and a new child are the "same" node
+	// when aligning children. Matched nodes are diffed in place; unmatched
+	// ones are deleted or inserted. Defaults to DefaultNodeEqual.
+	NodeEqual func(a, b *html.Node) bool
+	// Root selects the node operation paths are relative to. PathRootBody
+	// makes deltas independent of the html/head/body wrapper the parser adds.
+	Root PathRoot
+	// StructuredAttrs lists attributes ("style", "srcset") whose values are
+	// diffed component by component: a changed style property becomes an
+	// UPDATE_ATTR with SubKey set to the property, so concurrent edits to
+	// different properties merge cleanly. Other names are ignored.
+	StructuredAttrs []string
+	// AnchorPaths makes each op's path relative to the nearest enclosing
+	// element with a unique id (recorded in Operation.Anchor), so the delta
+	// still finds its targets when the structure outside the anchor changes.
+	// Merge, Compose and Rebase compare paths literally and expect deltas
+	// without anchors.
+	AnchorPaths bool
+	// MaxTextDiffLen bounds granular text diffing: when either side of a
+	// changed text node is longer than this many bytes, the change is
+	// emitted as a single UPDATE_TEXT instead of INSERT_TEXT/DELETE_TEXT
+	// ops, capping the work spent on very large nodes such as <pre> blocks.
+	// Zero means no limit.
+	MaxTextDiffLen int
+	// IgnoreAttrs lists attributes whose changes are left out of the delta,
+	// such as framework bookkeeping ("data-reactid"). A trailing "*" matches
+	// by prefix ("data-v-*"). Names are case-insensitive. Inserted nodes are
+	// still copied with all their attributes.
+	IgnoreAttrs []string
+	// DetectMoves turns an element deleted under one parent and inserted
+	// unchanged under another into a single MOVE_NODE, so the node keeps its
+	// identity instead of being copied. Merge and Rebase carry concurrent
+	// edits inside a moved node to its new place.
+	DetectMoves bool
+	// NormalizeUnicode compares text in Unicode normalization form C, so
+	// composed and decomposed spellings of the same characters ("é" as one
+	// code point or as "e" plus a combining accent) are not a change. Ops
+	// still address the original bytes; text that did change is copied from
+	// the new document as written.
+	NormalizeUnicode bool
+	// GranularAttrs emits a changed attribute value as INSERT_ATTR_TEXT and
+	// DELETE_ATTR_TEXT ops for the part that changed instead of an
+	// UPDATE_ATTR carrying the whole new value, which keeps deltas small for
+	// long values such as an SVG path's d. Added and removed attributes and
+	// StructuredAttrs are unaffected.
+	GranularAttrs bool
+	// TagHandlers customizes the diff of elements by tag name (lowercase),
+	// such as treating <canvas> as opaque. The handler of the old element
+	// applies; the root passed to DiffNodes is always diffed normally.
+	TagHandlers map[string]TagHandler
+	// NormalizeFunc, when set, is applied to both parsed documents before
+	// they are compared, so differences the caller does not care about (such
+	// as class order or attributes a sanitizer adds) produce no ops. Paths in
+	// the delta address the normalized old tree; a normalizer that adds or
+	// removes nodes makes the delta apply only to the normalized base.
+	// DiffNodes ignores it: it would have to edit or copy the caller's
+	// trees, and node-keyed callbacks such as IdentityFunc would no longer
+	// see the caller's nodes. Normalize the trees before calling DiffNodes.
+	NormalizeFunc func(*html.Node)
+	// Tokenizer sets the units granular text ops are cut on: the unchanged
+	// start and end of a changed text node are matched token by token, so
+	// no INSERT_TEXT or DELETE_TEXT begins or ends inside a token. Tokens
+	// must concatenate back to the text. Positions remain byte offsets. Use
+	// one of TokenizeRunes, TokenizeGraphemes, TokenizeWords or
+	// TokenizeSentences, or a custom splitter. By default text is compared
+	// byte by byte. NormalizeUnicode takes precedence.
+	Tokenizer func(string) []string
+	// ScopeSelector, when set, restricts the diff to the elements matching
+	// this selector (see QuerySelector), such as "[contenteditable]" for a
+	// CMS that tracks only editable regions. Everything outside them is left
+	// out of the delta, even where it changed. Matches nested in another
+	// match are part of it. The i-th match in the old tree is diffed against
+	// the i-th in the new one, so both must have the same number. Paths stay
+	// relative to the document root.
+	ScopeSelector string
+	// ReplaceText emits a changed stretch of a text node, where text is both
+	// removed and added, as one REPLACE_TEXT instead of a DELETE_TEXT and an
+	// INSERT_TEXT, so a concurrent edit cannot land between the two halves.
+	// Pure insertions and deletions are unaffected.
+	ReplaceText bool
+	// WrapText emits text wrapped in a new element ("Hello world" to
+	// "Hello <b>world</b>") as a WRAP_NODE that moves the existing text node
+	// into the element, so a concurrent edit of that text follows it. By
+	// default the text is split off and replaced by an INSERT_NODE of the
+	// element holding it, and a concurrent edit of that text conflicts with
+	// the delete.
+	WrapText bool
+	// IdentityFunc, when set, returns a caller-maintained identity for a
+	// node, such as a UUID kept in an external map, or "" for none. When
+	// either of an old and a new child has an identity, they are the same
+	// node exactly when both identities are equal (and they are the same kind
+	// of node), whatever NodeEqual says; other pairs fall back to NodeEqual.
+	// This lets reordered elements without id attributes keep their match.
+	IdentityFunc func(*html.Node) string
+	// TextContext records up to this many bytes of the surrounding text on
+	// each INSERT_TEXT, DELETE_TEXT and REPLACE_TEXT (Operation.ContextBefore
+	// and ContextAfter). When the op is applied to text that has shifted, for
+	// example by a concurrent edit applied first, Patch moves it to where
+	// the context matches best instead of failing or editing the wrong spot.
+	TextContext int
+	// ElementIndexOnly numbers children in paths and positions skipping
+	// whitespace-only text nodes (except inside <pre>, <textarea> and raw
+	// text elements), so in pretty-printed markup the third <li> of a list
+	// is index 2 rather than 5. The delta records the mode
+	// (Delta.ElementIndex) and Patch resolves its paths the same way. The
+	// skipped whitespace is ignored by the diff: changes to it produce no
+	// ops, and inserted markup carries none. Cannot be combined with
+	// AnchorPaths.
+	ElementIndexOnly bool
+	// OnWarning, if set, is called for each change the delta represents
+	// imperfectly: a node whose type changed but was matched anyway (it is
+	// not diffed), a change to an IgnoreAttrs attribute (left out), and the
+	// removal of a non-boolean attribute, which is sent as an UPDATE_ATTR
+	// with Removed set that clients ignoring Removed apply as an empty value.
+	OnWarning func(path NodePath, message string)
+	// DetectAttrMoves notes an attribute that moves between elements, such
+	// as an id given to another element: when exactly one element loses a
+	// value and exactly one other gains it for the same attribute, the op
+	// setting it records where it came from (Operation.MovedFrom). The two
+	// ops still apply separately. Merge reports two deltas moving the same
+	// value onto different elements as a conflict, since together they would
+	// leave both claiming it. Moves are found among the attribute ops of
+	// the elements NodeEqual pairs: DefaultNodeEqual pairs by id, so an id
+	// handed to another element is only seen as a move with a NodeEqual that
+	// ignores it.
+	DetectAttrMoves bool
+	// Streaming first compares the documents token by token, without parsing
+	// them into trees. When the new document only adds whole nodes at one
+	// place in the old one, as when a log-style page gains an entry, the
+	// delta is their INSERT_NODEs, found in memory bounded by the nesting
+	// depth. Other changes, and markup whose parse a token scan can't follow
+	// (implied end tags, tables without <tbody>, SVG, ...), fall back to the
+	// tree diff. It has no effect with AnchorPaths, ElementIndexOnly,
+	// ScopeSelector, NormalizeFunc or TagHandlers, which the scan doesn't
+	// apply.
+	Streaming bool
+}
+
+// TagHandler overrides how DiffWithOptions diffs one kind of element.
+type TagHandler struct {
+	// Opaque diffs the element as a unit: any change to it or its content
+	// deletes it and inserts the new element in its place, so nothing inside
+	// is ever addressed by a path.
+	Opaque bool
+	// Attributes, when set, replaces the attribute diff of the element. It
+	// returns ops for path, the element's path in the old tree.
+	Attributes func(oldNode, newNode *html.Node, path NodePath) []Operation
+	// Children, when set, replaces the diff of the element's children. Ops
+	// must use paths valid in the old tree as the previous ops leave it,
+	// like those of DiffNodes prefixed with path.
+	Children func(oldNode, newNode *html.Node, path NodePath) ([]Operation, error)
+}
+
 // Diff calculates the operations needed to transform 'oldHTML' into 'newHTML'.
 func Diff(oldHTML, newHTML, author string) (*Delta, error) {
-	oldDoc, err := ParseHTML(oldHTML)
+	return DiffWithOptions(oldHTML, newHTML, author, DiffOptions{})
+}
+
+// DiffWithOptions calculates the operations needed to transform 'oldHTML' into
+// 'newHTML' using opts.
+func DiffWithOptions(oldHTML, newHTML, author string, opts DiffOptions) (*Delta, error) {
+	if err := checkDiffOptions(opts); err != nil {
+		return nil, err
+	}
+	delta := &Delta{
+		BaseHash:     hashFunc(oldHTML),
+		Timestamp:    time.Now().Unix(),
+		Author:       author,
+		Root:         opts.Root,
+		ElementIndex: opts.ElementIndexOnly,
+	}
+	// Identical documents are not parsed: the delta is empty (see IsEmpty).
+	if oldHTML == newHTML {
+		switch opts.Root {
+		case PathRootDocument, PathRootBody, PathRootFragment:
+			return delta, nil
+		}
+	}
+
+	if opts.Streaming && !opts.AnchorPaths && !opts.ElementIndexOnly && opts.ScopeSelector == "" && opts.NormalizeFunc == nil && len(opts.TagHandlers) == 0 {
+		if ops, ok := streamInserts(oldHTML, newHTML, opts.Root); ok {
+			delta.Operations = ops
+			return delta, nil
+		}
+	}
+
+	oldDoc, err := parseForRoot(oldHTML, opts.Root)
 	if err != nil {
 		return nil, fmt.Errorf("failed to parse old HTML: %w", err)
 	}
-	newDoc, err := ParseHTML(newHTML)
+	newDoc, err := parseForRoot(newHTML, opts.Root)
 	if err != nil {
 		return nil, fmt.Errorf("failed to parse new HTML: %w", err)
 	}
+	return diffDocs(delta, oldDoc, newDoc, opts)
+}
 
-	delta := &Delta{
-		BaseHash:  hashString(oldHTML),
-		Timestamp: time.Now().Unix(),
-		Author:    author,
+// checkDiffOptions rejects option combinations and selectors that can't be
+// used, before any parsing, so identical documents get the same errors as
+// different ones.
+func checkDiffOptions(opts DiffOptions) error {
+	if opts.ElementIndexOnly && opts.AnchorPaths {
+		return errors.New("ElementIndexOnly cannot be combined with AnchorPaths")
+	}
+	if opts.ScopeSelector != "" {
+		if _, err := parseSelector(opts.ScopeSelector); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// diffDocs fills in delta's ops to take oldDoc to newDoc, parsed for
+// opts.Root and checked with checkDiffOptions. It is the part of
+// DiffWithOptions after parsing.
+func diffDocs(delta *Delta, oldDoc, newDoc *html.Node, opts DiffOptions) (*Delta, error) {
+	if opts.NormalizeFunc != nil {
+		opts.NormalizeFunc(oldDoc)
+		opts.NormalizeFunc(newDoc)
+	}
+	if opts.ElementIndexOnly {
+		stripWhitespace(oldDoc)
+		stripWhitespace(newDoc)
+	}
+
+	oldRoot, err := resolvePathRoot(oldDoc, opts.Root)
+	if err != nil {
+		return nil, fmt.Errorf("old HTML: %w", err)
+	}
+	newRoot, err := resolvePathRoot(newDoc, opts.Root)
+	if err != nil {
+		return nil, fmt.Errorf("new HTML: %w", err)
 	}
 
-	ops, err := diffNodes(oldDoc, newDoc, NodePath{})
+	ops, err := DiffNodes(oldRoot, newRoot, opts)
 	if err != nil {
 		return nil, err
 	}
+	if opts.AnchorPaths {
+		// The old tree is no longer needed, so it is patched in place.
+		if err := anchorOps(oldRoot, ops); err != nil {
+			return nil, err
+		}
+	}
 	delta.Operations = ops
 
 	return delta, nil
 }
 
+// DiffFragment diffs two HTML fragments. Their top-level nodes are children of
+// a virtual root, so a delta's paths carry no html/body prefix; Patch parses
+// and renders the base as a fragment too.
+func DiffFragment(oldHTML, newHTML, author string) (*Delta, error) {
+	return DiffWithOptions(oldHTML, newHTML, author, DiffOptions{Root: PathRootFragment})
+}
+
+// DiffBestBase diffs newHTML against each of candidates, such as the
+// revisions a stale client may have started from, and returns the smallest
+// delta with the index of the candidate it is based on. Deltas are compared
+// by op count, then by the bytes of content they carry; ties go to the
+// earlier candidate.
+func DiffBestBase(candidates []string, newHTML, author string) (*Delta, int, error) {
+	if len(candidates) == 0 {
+		return nil, -1, fmt.Errorf("no candidate bases")
+	}
+	var best *Delta
+	bestIndex, bestSize := -1, 0
+	for i, base := range candidates {
+		delta, err := Diff(base, newHTML, author)
+		if err != nil {
+			return nil, -1, fmt.Errorf("candidate %d: %w", i, err)
+		}
+		size := 0
+		for _, op := range delta.Operations {
+			size += len(op.OldValue) + len(op.NewValue) + len(op.NodeData)
+		}
+		if best == nil || len(delta.Operations) < len(best.Operations) ||
+			len(delta.Operations) == len(best.Operations) && size < bestSize {
+			best, bestIndex, bestSize = delta, i, size
+		}
+	}
+	return best, bestIndex, nil
+}
+
+// DiffNodes calculates the operations needed to transform the tree at oldRoot
+// into the tree at newRoot, with paths relative to the roots. It is the core of
+// Diff for callers that already hold parsed trees. opts.NormalizeFunc is not
+// applied.
+func DiffNodes(oldRoot, newRoot *html.Node, opts DiffOptions) ([]Operation, error) {
+	d := newDiffer(oldRoot, newRoot, opts)
+	var ops []Operation
+	var err error
+	if opts.ScopeSelector != "" {
+		ops, err = d.diffScopes(oldRoot, newRoot, opts.ScopeSelector)
+	} else {
+		ops, err = d.diffNodes(oldRoot, newRoot, NodePath{})
+	}
+	if err != nil {
+		return nil, err
+	}
+	canonicalOrder(ops)
+	if opts.DetectMoves {
+		ops = detectMoves(oldRoot, ops)
+	}
+	if opts.DetectAttrMoves {
+		detectAttrMoves(oldRoot, ops)
+	}
+	return ops, nil
+}
+
+// diffScopes diffs the outermost elements matching selector in the old tree
+// against those in the new tree, pairing them in document order. Ops carry
+// paths from oldRoot; scopes don't nest, so the ops of one never move the
+// nodes of another.
+func (d *differ) diffScopes(oldRoot, newRoot *html.Node, selector string) ([]Operation, error) {
+	steps, err := parseSelector(selector)
+	if err != nil {
+		return nil, err
+	}
+	oldScopes := scopeElements(oldRoot, steps)
+	newScopes := scopeElements(newRoot, steps)
+	if len(oldScopes) != len(newScopes) {
+		return nil, fmt.Errorf("scope selector %q matches %d elements in old HTML and %d in new HTML", selector, len(oldScopes), len(newScopes))
+	}
+	var ops []Operation
+	for i, scope := range oldScopes {
+		path, err := GetPath(oldRoot, scope)
+		if err != nil {
+			return nil, err
+		}
+		scopeOps, err := d.diffNodes(scope, newScopes[i], path)
+		if err != nil {
+			return nil, err
+		}
+		ops = append(ops, scopeOps...)
+	}
+	return ops, nil
+}
+
+// scopeElements returns the elements under root that steps match, in
+// document order, without descending into a match.
+func scopeElements(root *html.Node, steps []selectorStep) []*html.Node {
+	var scopes []*html.Node
+	var walk func(n *html.Node)
+	walk = func(n *html.Node) {
+		for c := n.FirstChild; c != nil; c = c.NextSibling {
+			if matchSelector(root, c, steps, len(steps)-1) {
+				scopes = append(scopes, c)
+				continue
+			}
+			walk(c)
+		}
+	}
+	walk(root)
+	return scopes
+}
+
+// canonicalOrder sorts ops into a deterministic order so that diffing the same
+// inputs always yields byte-identical deltas (attribute ops come out of map
+// iteration in random order).
+//
+// Only runs of adjacent attribute ops on the same node are reordered: they
+// touch distinct keys and commute. A global sort by path is not possible
+// because child ops use pre-change indices and must precede the sibling
+// deletes/inserts that follow them; the traversal order is already canonical.
+// Within a run, DELETE_ATTR sorts before UPDATE_ATTR, then by key.
+func canonicalOrder(ops []Operation) {
+	for start := 0; start < len(ops); {
+		end := start + 1
+		if isAttrOp(ops[start]) {
+			for end < len(ops) && isAttrOp(ops[end]) && pathEqual(ops[end].Path, ops[start].Path) {
+				end++
+			}
+			// Stable, so the text ops of one attribute keep their order.
+			run := ops[start:end]
+			sort.SliceStable(run, func(i, j int) bool {
+				if (run[i].Type == OpDeleteAttr) != (run[j].Type == OpDeleteAttr) {
+					return run[i].Type == OpDeleteAttr
+				}
+				if run[i].Key != run[j].Key {
+					return run[i].Key < run[j].Key
+				}
+				return run[i].SubKey < run[j].SubKey
+			})
+		}
+		start = end
+	}
+}
+
+// hashFunc computes the base hashes of documents. Tests replace it to count
+// how often documents are hashed.
+var hashFunc = hashString
+
 func hashString(s string) string {
 	h := sha256.New()
 	h.Write([]byte(s))
 	return hex.EncodeToString(h.Sum(nil))
 }
 
+// differ holds the state shared across one Diff traversal.
+type differ struct {
+	nodeEqual      func(a, b *html.Node) bool
+	structured     map[string]attrFormat
+	maxTextDiffLen int
+	ignoreAttrs    []string
+	normalizeText  bool
+	granularAttrs  bool
+	tagHandlers    map[string]TagHandler
+	tokenizer      func(string) []string
+	replaceText    bool
+	wrapText       bool
+	identity       func(*html.Node) string
+	textContext    int
+	onWarning      func(NodePath, string)
+
+	// Structural hashes of every node in the old and new trees, used to skip
+	// unchanged subtrees without descending into them.
+	oldHashes map[*html.Node]string
+	newHashes map[*html.Node]string
+	// visits counts the node pairs compared, for benchmarking.
+	visits int
+}
+
+func newDiffer(oldRoot, newRoot *html.Node, opts DiffOptions) *differ {
+	d := &differ{
+		nodeEqual:      opts.NodeEqual,
+		maxTextDiffLen: opts.MaxTextDiffLen,
+		normalizeText:  opts.NormalizeUnicode,
+		granularAttrs:  opts.GranularAttrs,
+		tagHandlers:    opts.TagHandlers,
+		tokenizer:      opts.Tokenizer,
+		replaceText:    opts.ReplaceText,
+		wrapText:       opts.WrapText,
+		identity:       opts.IdentityFunc,
+		textContext:    opts.TextContext,
+		onWarning:      opts.OnWarning,
+		oldHashes:      make(map[*html.Node]string),
+		newHashes:      make(map[*html.Node]string),
+	}
+	if d.nodeEqual == nil {
+		d.nodeEqual = DefaultNodeEqual
+	}
+	if opts.IdentityFunc != nil {
+		d.nodeEqual = identityEqual(opts.IdentityFunc, d.nodeEqual)
+	}
+	for _, name := range opts.IgnoreAttrs {
+		d.ignoreAttrs = append(d.ignoreAttrs, strings.ToLower(name))
+	}
+	for _, name := range opts.StructuredAttrs {
+		if f, ok := structuredFormats[strings.ToLower(name)]; ok {
+			if d.structured == nil {
+				d.structured = make(map[string]attrFormat)
+			}
+			d.structured[strings.ToLower(name)] = f
+		}
+	}
+	hashSubtree(oldRoot, d.oldHashes)
+	hashSubtree(newRoot, d.newHashes)
+	return d
+}
+
 // diffNodes compares two nodes and returns a list of operations.
 // It assumes oldNode and newNode represent the "same" node in position.
-func diffNodes(oldNode, newNode *html.Node, path NodePath) ([]Operation, error) {
+func (d *differ) diffNodes(oldNode, newNode *html.Node, path NodePath) ([]Operation, error) {
+	d.visits++
+
+	// Identical subtrees need no further comparison.
+	if d.oldHashes[oldNode] == d.newHashes[newNode] {
+		return nil, nil
+	}
+
 	var ops []Operation
 
 	// 1. Check if nodes are inherently different (e.g. different tag).
-	if oldNode.Type != newNode.Type || oldNode.DataAtom != newNode.DataAtom || (oldNode.Type == html.ElementNode && oldNode.Data != newNode.Data) {
+	if oldNode.Type != newNode.Type {
 		// Structural replacement not implemented fully in this snippet, assumes structure matches.
+		d.warn(path, "node type changed from %d to %d; the node is not diffed", oldNode.Type, newNode.Type)
+	} else if oldNode.Type == html.ElementNode && oldNode.Data != newNode.Data {
+		// Renamed element: the rest of the node is diffed in place.
+		ops = append(ops, Operation{Type: OpChangeTag, Path: path, OldValue: oldNode.Data, NewValue: newNode.Data})
 	}
 
+	handler := d.handler(oldNode)
+
 	// 2. Compare Attributes (if Element)
-	if oldNode.Type == html.ElementNode {
-		attrOps := diffAttributes(oldNode, newNode, path)
+	if handler.Attributes != nil {
+		ops = append(ops, handler.Attributes(oldNode, newNode, path)...)
+	} else if oldNode.Type == html.ElementNode {
+		attrOps := d.diffAttributes(oldNode, newNode, path)
 		ops = append(ops, attrOps...)
 	}
 
 	// 3. Compare Text (if TextNode)
-	if oldNode.Type == html.TextNode {
-		if oldNode.Data != newNode.Data {
-			textOps := diffText(oldNode.Data, newNode.Data, path)
-			ops = append(ops, textOps...)
-		}
+	if oldNode.Type == html.TextNode && oldNode.Data != newNode.Data {
+		ops = append(ops, d.diffTextData(oldNode.Data, newNode.Data, path)...)
 	}
 
 	// 4. Compare Children
+	diffChildren := d.diffChildren
+	if handler.Children != nil {
+		diffChildren = handler.Children
+	}
 	childOps, err := diffChildren(oldNode, newNode, path)
 	if err != nil {
 		return nil, err
@@ -75,23 +526,85 @@ func diffNodes(oldNode, newNode *html.Node, path NodePath) ([]Operation, error)
 	return ops, nil
 }
 
-func diffAttributes(oldNode, newNode *html.Node, path NodePath) []Operation {
+// diffTextData returns the ops that turn the text node at path from oldText
+// into newText, cut as the options ask.
+func (d *differ) diffTextData(oldText, newText string, path NodePath) []Operation {
 	var ops []Operation
-	oldAttrs := make(map[string]string)
+	if d.maxTextDiffLen > 0 && max(len(oldText), len(newText)) > d.maxTextDiffLen {
+		ops = []Operation{{Type: OpUpdateText, Path: path, OldValue: oldText, NewValue: newText}}
+	} else if d.normalizeText {
+		ops = diffTextNFC(oldText, newText, path)
+	} else if d.tokenizer != nil {
+		ops = diffTokens(oldText, newText, path, d.tokenizer)
+	} else {
+		ops = diffText(oldText, newText, path)
+	}
+	if d.replaceText {
+		ops = joinReplacements(ops)
+	}
+	if d.textContext > 0 {
+		addTextContext(oldText, ops, d.textContext)
+	}
+	return ops
+}
+
+func (d *differ) diffAttributes(oldNode, newNode *html.Node, path NodePath) []Operation {
+	var ops []Operation
+	// Maps are keyed by lowercased qualified name (attribute names are
+	// case-insensitive, and "xlink:href" is not "href") and hold the
+	// attribute so ops can carry its original spelling.
+	oldAttrs := make(map[string]html.Attribute)
 	for _, a := range oldNode.Attr {
-		oldAttrs[a.Key] = a.Val
+		if name := strings.ToLower(attrName(a)); !d.ignored(name) {
+			oldAttrs[name] = a
+		}
 	}
 
-	newAttrs := make(map[string]string)
+	newAttrs := make(map[string]html.Attribute)
 	for _, a := range newNode.Attr {
-		newAttrs[a.Key] = a.Val
+		if name := strings.ToLower(attrName(a)); !d.ignored(name) {
+			newAttrs[name] = a
+		}
+	}
+
+	if d.onWarning != nil && len(d.ignoreAttrs) > 0 {
+		d.warnIgnoredAttrs(oldNode, newNode, path)
 	}
 
 	// Check for updates or deletions
-	for k, vOld := range oldAttrs {
-		vNew, exists := newAttrs[k]
+	for name, aOld := range oldAttrs {
+		k, vOld := attrName(aOld), aOld.Val
+		aNew, exists := newAttrs[name]
+		vNew := aNew.Val
 		if !exists {
-			// Attribute deleted (or set to empty if we handle it that way, but explicit delete is better)
+			// Boolean attributes are pure presence toggles, so their removal is always explicit.
+			// Other removals are flagged on UPDATE_ATTR: clients that predate DELETE_ATTR
+			// still understand the op and degrade to an empty value.
+			if isBooleanAttr(k) {
+				ops = append(ops, Operation{
+					Type:     OpDeleteAttr,
+					Path:     path,
+					Key:      k,
+					OldValue: vOld,
+				})
+			} else {
+				ops = append(ops, Operation{
+					Type:     OpUpdateAttr,
+					Path:     path,
+					Key:      k,
+					OldValue: vOld,
+					Removed:  true,
+				})
+				d.warn(path, "attribute %q removal is sent as UPDATE_ATTR with removed set; clients that ignore it set the value to \"\"", k)
+			}
+		} else if f, ok := d.structured[name]; ok && vOld != vNew {
+			ops = append(ops, diffComponents(f, path, k, vOld, vNew)...)
+		} else if d.granularAttrs && vOld != vNew {
+			for _, op := range diffText(vOld, vNew, path) {
+				op.Key = k
+				op.Type = attrTextTypes[op.Type]
+				ops = append(ops, op)
+			}
 		} else if vOld != vNew {
 			ops = append(ops, Operation{
 				Type:     OpUpdateAttr,
@@ -104,13 +617,14 @@ func diffAttributes(oldNode, newNode *html.Node, path NodePath) []Operation {
 	}
 
 	// Check for additions
-	for k, vNew := range newAttrs {
-		if _, exists := oldAttrs[k]; !exists {
+	for name, aNew := range newAttrs {
+		if _, exists := oldAttrs[name]; !exists {
 			ops = append(ops, Operation{
 				Type:     OpUpdateAttr,
 				Path:     path,
-				Key:      k,
-				NewValue: vNew,
+				Key:      attrName(aNew),
+				NewValue: aNew.Val,
+				Added:    true,
 			})
 		}
 	}
@@ -118,57 +632,628 @@ func diffAttributes(oldNode, newNode *html.Node, path NodePath) []Operation {
 	return ops
 }
 
+// warnIgnoredAttrs reports each IgnoreAttrs attribute that differs between
+// oldNode and newNode.
+func (d *differ) warnIgnoredAttrs(oldNode, newNode *html.Node, path NodePath) {
+	seen := make(map[string]bool)
+	for _, attrs := range [][]html.Attribute{oldNode.Attr, newNode.Attr} {
+		for _, a := range attrs {
+			name := attrName(a)
+			key := strings.ToLower(name)
+			if seen[key] || !d.ignored(key) {
+				continue
+			}
+			seen[key] = true
+			if hasAttr(oldNode, name) != hasAttr(newNode, name) || getAttr(oldNode, name) != getAttr(newNode, name) {
+				d.warn(path, "change to ignored attribute %q is left out", name)
+			}
+		}
+	}
+}
+
+// warn reports a lossy decision to DiffOptions.OnWarning.
+func (d *differ) warn(path NodePath, format string, args ...any) {
+	if d.onWarning != nil {
+		d.onWarning(slices.Clone(path), fmt.Sprintf(format, args...))
+	}
+}
+
+// booleanAttributes lists HTML attributes whose presence, not value, carries
+// meaning. x/net/html parses `<input disabled>` with an empty value, so an
+// empty value cannot be used to tell "absent" from "present".
+var booleanAttributes = map[string]bool{
+	"allowfullscreen": true,
+	"async":           true,
+	"autofocus":       true,
+	"autoplay":        true,
+	"checked":         true,
+	"controls":        true,
+	"default":         true,
+	"defer":           true,
+	"disabled":        true,
+	"formnovalidate":  true,
+	"hidden":          true,
+	"inert":           true,
+	"ismap":           true,
+	"itemscope":       true,
+	"loop":            true,
+	"multiple":        true,
+	"muted":           true,
+	"nomodule":        true,
+	"novalidate":      true,
+	"open":            true,
+	"playsinline":     true,
+	"readonly":        true,
+	"required":        true,
+	"reversed":        true,
+	"selected":        true,
+}
+
+// ignored reports whether the lowercased attribute name matches
+// DiffOptions.IgnoreAttrs.
+func (d *differ) ignored(name string) bool {
+	for _, pattern := range d.ignoreAttrs {
+		if prefix, ok := strings.CutSuffix(pattern, "*"); ok {
+			if strings.HasPrefix(name, prefix) {
+				return true
+			}
+		} else if name == pattern {
+			return true
+		}
+	}
+	return false
+}
+
+// handler returns the TagHandler registered for n's tag, or the zero handler.
+func (d *differ) handler(n *html.Node) TagHandler {
+	if n.Type != html.ElementNode {
+		return TagHandler{}
+	}
+	return d.tagHandlers[n.Data]
+}
+
+func isBooleanAttr(key string) bool {
+	return booleanAttributes[strings.ToLower(key)]
+}
+
 // diffChildren compares lists of children.
-func diffChildren(oldNode, newNode *html.Node, parentPath NodePath) ([]Operation, error) {
+// Children are aligned with a longest-common-subsequence match using the
+// configured NodeEqual predicate. Matched pairs are diffed recursively, then
+// unmatched old children are deleted and unmatched new children inserted.
+func (d *differ) diffChildren(oldNode, newNode *html.Node, parentPath NodePath) ([]Operation, error) {
 	var ops []Operation
 
 	oldChildren := getChildrenList(oldNode)
 	newChildren := getChildrenList(newNode)
 
-	// Simple loop over matching indices
-	commonLen := len(oldChildren)
-	if len(newChildren) < commonLen {
-		commonLen = len(newChildren)
+	var matches []childMatch
+	if oldNode.Type == html.ElementNode && oldNode.Data == "head" {
+		matches = alignHeadChildren(oldChildren, newChildren, d.nodeEqual)
+	} else {
+		matches = alignChildren(oldChildren, newChildren, d.nodeEqual)
+	}
+	oldMatched := make([]bool, len(oldChildren))
+	newMatched := make([]bool, len(newChildren))
+	for _, m := range matches {
+		oldMatched[m.old] = true
+		newMatched[m.new] = true
+	}
+
+	// Text that was wrapped in a new element is split and wrapped in place
+	// rather than deleted and re-inserted. The wrap's new nodes are treated as
+	// matched so they aren't inserted, and the old text node isn't text-diffed.
+	wraps := detectWraps(oldChildren, newChildren, matches, newMatched)
+	wrapped := make(map[int]bool)
+	for _, w := range wraps {
+		wrapped[w.oldIndex] = true
+		for _, j := range w.consumed {
+			newMatched[j] = true
+		}
 	}
 
-	for i := 0; i < commonLen; i++ {
+	// Unmatched elements that only differ by tag are renamed in place.
+	if oldNode.Type != html.ElementNode || oldNode.Data != "head" {
+		for _, m := range d.detectRenames(oldChildren, newChildren, matches, oldMatched, newMatched) {
+			matches = append(matches, m)
+			oldMatched[m.old] = true
+			newMatched[m.new] = true
+		}
+		// Later steps walk matches in old order, as alignChildren returns them.
+		sort.Slice(matches, func(i, j int) bool { return matches[i].old < matches[j].old })
+	}
+
+	// Text that new nodes were inserted into is split where they go, so the
+	// tail is not deleted and re-inserted. The text node on the far side of
+	// the inserted nodes counts as matched; both halves are edited once split.
+	splits := detectSplits(oldChildren, newChildren, matches, newMatched, wrapped)
+	for _, s := range splits {
+		wrapped[s.oldIndex] = true
+		newMatched[s.head] = true
+		newMatched[s.tail] = true
+	}
+
+	// Recurse into matched pairs first. No structural change has happened at
+	// this level yet, so old indices address the children correctly.
+	for _, m := range matches {
+		if wrapped[m.old] {
+			continue
+		}
+		if d.handler(oldChildren[m.old]).Opaque && d.oldHashes[oldChildren[m.old]] != d.newHashes[newChildren[m.new]] {
+			// Changed opaque elements are replaced below.
+			oldMatched[m.old] = false
+			newMatched[m.new] = false
+			continue
+		}
+		if oldChildren[m.old].Type == html.CommentNode && oldChildren[m.old].Data != newChildren[m.new].Data {
+			// Text ops don't apply to comments, so a changed one, such as a
+			// conditional comment holding markup, is replaced as a unit.
+			oldMatched[m.old] = false
+			newMatched[m.new] = false
+			continue
+		}
+
 		// New Path for this child
 		childPath := append(NodePath(nil), parentPath...)
-		childPath = append(childPath, i)
+		childPath = append(childPath, m.old)
 
 		// Recursively diff
-		childOps, err := diffNodes(oldChildren[i], newChildren[i], childPath)
+		childOps, err := d.diffNodes(oldChildren[m.old], newChildren[m.new], childPath)
 		if err != nil {
 			return nil, err
 		}
 		ops = append(ops, childOps...)
 	}
 
-	// Handle Deletions (Old has more)
-	for i := len(oldChildren) - 1; i >= commonLen; i-- {
+	// Handle Deletions, from the end so earlier indices stay valid
+	for i := len(oldChildren) - 1; i >= 0; i-- {
+		if oldMatched[i] {
+			continue
+		}
 		ops = append(ops, Operation{
 			Type: OpDeleteNode,
 			Path: append(append(NodePath(nil), parentPath...), i),
 		})
 	}
 
-	// Handle Insertions (New has more)
-	for i := commonLen; i < len(newChildren); i++ {
+	// Handle Insertions in ascending order: every earlier sibling of the new
+	// child is already in place when it is inserted at its final index.
+	for i := 0; i < len(newChildren); i++ {
+		if s, ok := splits[i]; ok {
+			ops = append(ops, d.splitOps(s, oldChildren, newChildren, parentPath)...)
+		}
+		if w, ok := wraps[i]; ok {
+			wrapOps, err := w.ops(parentPath, d.wrapText)
+			if err != nil {
+				return nil, err
+			}
+			if newNode.Type == html.ElementNode {
+				for k := range wrapOps {
+					if wrapOps[k].Type == OpInsertNode {
+						wrapOps[k].ParentTag = newNode.Data
+					}
+				}
+			}
+			ops = append(ops, wrapOps...)
+			continue
+		}
+		if newMatched[i] {
+			continue
+		}
 		nodeHTML, err := RenderNode(newChildren[i])
 		if err != nil {
 			return nil, err
 		}
-		ops = append(ops, Operation{
+		op := Operation{
 			Type:     OpInsertNode,
 			Path:     parentPath,
 			Position: i,
 			NodeData: nodeHTML,
-		})
+		}
+		if newNode.Type == html.ElementNode {
+			op.ParentTag = newNode.Data
+		}
+		ops = append(ops, op)
 	}
 
 	return ops, nil
 }
 
+// detectRenames pairs the unmatched children between two consecutive matches
+// when the gap holds as many old as new children and each old element differs
+// from its new counterpart only by tag: same namespace and aligned children.
+func (d *differ) detectRenames(oldChildren, newChildren []*html.Node, matches []childMatch, oldMatched, newMatched []bool) []childMatch {
+	var renames []childMatch
+	prevOld, prevNew := -1, -1
+	gaps := append(append([]childMatch(nil), matches...), childMatch{len(oldChildren), len(newChildren)})
+	for _, m := range gaps {
+		var olds, news []int
+		for i := prevOld + 1; i < m.old; i++ {
+			if !oldMatched[i] {
+				olds = append(olds, i)
+			}
+		}
+		for j := prevNew + 1; j < m.new; j++ {
+			if !newMatched[j] {
+				news = append(news, j)
+			}
+		}
+		prevOld, prevNew = m.old, m.new
+		if len(olds) != len(news) {
+			continue
+		}
+		for k := range olds {
+			o, n := oldChildren[olds[k]], newChildren[news[k]]
+			if o.Type != html.ElementNode || n.Type != html.ElementNode || o.Data == n.Data || o.Namespace != n.Namespace {
+				continue
+			}
+			if d.identity != nil && (d.identity(o) != "" || d.identity(n) != "") {
+				continue // Identified nodes that didn't match are different nodes.
+			}
+			oc, nc := getChildrenList(o), getChildrenList(n)
+			if len(oc) == len(nc) && len(alignChildren(oc, nc, d.nodeEqual)) == len(oc) {
+				renames = append(renames, childMatch{olds[k], news[k]})
+			}
+		}
+	}
+	return renames
+}
+
+// textWrap describes an old text node whose middle (or edge) part was wrapped
+// in a new element: "pre" + wrapped + "post" became pre, <elem>wrapped</elem>, post.
+type textWrap struct {
+	oldIndex int        // Old text node
+	elem     int        // New index of the wrapping element
+	elemNode *html.Node // The wrapping element in the new tree
+	pre      string     // Text kept before the element (may be empty)
+	wrapped  string     // Text moved into the element
+	post     string     // Text kept after the element (may be empty)
+	consumed []int      // New indices produced by the wrap that need no insert
+}
+
+// detectWraps finds matched text nodes that were split around a newly
+// inserted element holding exactly the missing text. The result is keyed by
+// the new index of the wrapping element.
+func detectWraps(oldChildren, newChildren []*html.Node, matches []childMatch, newMatched []bool) map[int]*textWrap {
+	wraps := make(map[int]*textWrap)
+	unmatchedText := func(j int) bool {
+		return j >= 0 && j < len(newChildren) && !newMatched[j] && newChildren[j].Type == html.TextNode
+	}
+
+	for _, m := range matches {
+		o, n := oldChildren[m.old], newChildren[m.new]
+		if o.Type != html.TextNode || n.Type != html.TextNode || o.Data == n.Data {
+			continue
+		}
+
+		// The matched text is the part before the wrap: pre, <elem>, [post].
+		if e := m.new + 1; e < len(newChildren) && !newMatched[e] {
+			if inner, ok := wrappedText(newChildren[e]); ok && n.Data != "" {
+				w := &textWrap{oldIndex: m.old, elem: e, elemNode: newChildren[e], pre: n.Data, wrapped: inner, consumed: []int{e}}
+				if unmatchedText(e + 1) {
+					w.post = newChildren[e+1].Data
+					w.consumed = append(w.consumed, e+1)
+				}
+				if o.Data == w.pre+w.wrapped+w.post {
+					wraps[e] = w
+					continue
+				}
+			}
+		}
+
+		// The matched text is the part after the wrap: <elem>, post.
+		if e := m.new - 1; e >= 0 && !newMatched[e] && !unmatchedText(e-1) {
+			if inner, ok := wrappedText(newChildren[e]); ok && o.Data == inner+n.Data {
+				wraps[e] = &textWrap{oldIndex: m.old, elem: e, elemNode: newChildren[e], wrapped: inner, post: n.Data, consumed: []int{e}}
+			}
+		}
+	}
+	return wraps
+}
+
+// textSplit describes an old text node that new nodes were inserted into:
+// its text before offset at became the new text node head, the rest the new
+// text node tail, with only unmatched non-text nodes between them.
+type textSplit struct {
+	oldIndex   int
+	head, tail int // New indices of the two halves
+	at         int // Byte offset in the old text
+}
+
+// detectSplits finds matched, changed text nodes whose new counterpart is
+// one end of a run of inserted non-text nodes with unmatched text at the
+// other end, and whose old text is the two texts joined with at most one of
+// them edited. Old nodes in skip are left alone. The result is keyed by the
+// new index of the first inserted node.
+func detectSplits(oldChildren, newChildren []*html.Node, matches []childMatch, newMatched []bool, skip map[int]bool) map[int]*textSplit {
+	splits := make(map[int]*textSplit)
+	inserted := func(j int) bool {
+		return j >= 0 && j < len(newChildren) && !newMatched[j] && newChildren[j].Type != html.TextNode
+	}
+	unmatchedText := func(j int) bool {
+		return j >= 0 && j < len(newChildren) && !newMatched[j] && newChildren[j].Type == html.TextNode
+	}
+
+	for _, m := range matches {
+		o, n := oldChildren[m.old], newChildren[m.new]
+		if skip[m.old] || o.Type != html.TextNode || n.Type != html.TextNode || o.Data == n.Data {
+			continue
+		}
+
+		// The matched text is the head or the tail of the split.
+		head, tail := m.new, m.new+1
+		for inserted(tail) {
+			tail++
+		}
+		if tail == m.new+1 || !unmatchedText(tail) {
+			head, tail = m.new-1, m.new
+			for inserted(head) {
+				head--
+			}
+			if head == m.new-1 || !unmatchedText(head) {
+				continue
+			}
+		}
+		if _, taken := splits[head+1]; taken {
+			continue
+		}
+
+		pre, post := newChildren[head].Data, newChildren[tail].Data
+		at := -1
+		switch {
+		case strings.HasSuffix(o.Data, post):
+			at = len(o.Data) - len(post)
+		case strings.HasPrefix(o.Data, pre):
+			at = len(pre)
+		}
+		if at > 0 && at < len(o.Data) {
+			splits[head+1] = &textSplit{oldIndex: m.old, head: head, tail: tail, at: at}
+		}
+	}
+	return splits
+}
+
+// splitOps emits the split of s and the edits of its halves. It runs in the
+// insertion phase when the first inserted node's turn comes: every earlier
+// new sibling is in place, so the old text node sits at s.head and its tail
+// lands right after it, where the inserts that follow push it on.
+func (d *differ) splitOps(s *textSplit, oldChildren, newChildren []*html.Node, parentPath NodePath) []Operation {
+	childPath := func(i int) NodePath {
+		return append(append(NodePath(nil), parentPath...), i)
+	}
+	text := oldChildren[s.oldIndex].Data
+	pre, post := newChildren[s.head].Data, newChildren[s.tail].Data
+
+	ops := []Operation{{Type: OpSplitText, Path: childPath(s.head), Position: s.at}}
+	if text[:s.at] != pre {
+		ops = append(ops, d.diffTextData(text[:s.at], pre, childPath(s.head))...)
+	}
+	if text[s.at:] != post {
+		ops = append(ops, d.diffTextData(text[s.at:], post, childPath(s.head+1))...)
+	}
+	return ops
+}
+
+// wrappedText returns the text of an element whose only child is a
+// non-empty text node.
+func wrappedText(n *html.Node) (string, bool) {
+	if n.Type != html.ElementNode || n.FirstChild == nil || n.FirstChild != n.LastChild {
+		return "", false
+	}
+	if c := n.FirstChild; c.Type == html.TextNode && c.Data != "" {
+		return c.Data, true
+	}
+	return "", false
+}
+
+// ops emits the split/wrap sequence: the wrapped text is split off, then
+// wrapped in place with wrap, or deleted and inserted inside the new element
+// otherwise. It runs in the insertion phase when the wrapping element's turn
+// comes: every earlier new sibling is in place, so the old text node sits at
+// w.elem (or one before it when there is pre text).
+func (w *textWrap) ops(parentPath NodePath, wrap bool) ([]Operation, error) {
+	childPath := func(i int) NodePath {
+		return append(append(NodePath(nil), parentPath...), i)
+	}
+
+	var ops []Operation
+	target := w.elem
+	if w.pre != "" {
+		target = w.elem - 1
+		ops = append(ops, Operation{Type: OpSplitText, Path: childPath(target), Position: len(w.pre)})
+		target++
+	}
+	if w.post != "" {
+		ops = append(ops, Operation{Type: OpSplitText, Path: childPath(target), Position: len(w.wrapped)})
+	}
+	if !wrap {
+		elemHTML, err := RenderNode(w.elemNode)
+		if err != nil {
+			return nil, err
+		}
+		return append(ops,
+			Operation{Type: OpDeleteNode, Path: childPath(target)},
+			Operation{Type: OpInsertNode, Path: parentPath, Position: target, NodeData: elemHTML},
+		), nil
+	}
+
+	// Render the wrapper without its children; the existing text moves into it.
+	shell := &html.Node{Type: html.ElementNode, Data: w.elemNode.Data, DataAtom: w.elemNode.DataAtom, Namespace: w.elemNode.Namespace, Attr: w.elemNode.Attr}
+	wrapperHTML, err := RenderNode(shell)
+	if err != nil {
+		return nil, err
+	}
+	ops = append(ops, Operation{Type: OpWrapNode, Path: childPath(target), NodeData: wrapperHTML})
+	return ops, nil
+}
+
+// childMatch pairs an old child index with the new child index it aligns to.
+type childMatch struct {
+	old, new int
+}
+
+// alignChildren returns the longest order-preserving sequence of matches
+// between oldChildren and newChildren according to eq. Common prefixes and
+// suffixes are matched directly so the quadratic step only covers the middle.
+func alignChildren(oldChildren, newChildren []*html.Node, eq func(a, b *html.Node) bool) []childMatch {
+	var matches []childMatch
+
+	start := 0
+	for start < len(oldChildren) && start < len(newChildren) && eq(oldChildren[start], newChildren[start]) {
+		matches = append(matches, childMatch{start, start})
+		start++
+	}
+
+	oldEnd, newEnd := len(oldChildren), len(newChildren)
+	var suffix []childMatch
+	for oldEnd > start && newEnd > start && eq(oldChildren[oldEnd-1], newChildren[newEnd-1]) {
+		oldEnd--
+		newEnd--
+		suffix = append(suffix, childMatch{oldEnd, newEnd})
+	}
+
+	// LCS table over the middle section: lcs[i][j] is the match length of
+	// oldChildren[start+i:oldEnd] and newChildren[start+j:newEnd].
+	n, m := oldEnd-start, newEnd-start
+	if n > 0 && m > 0 {
+		lcs := make([][]int, n+1)
+		for i := range lcs {
+			lcs[i] = make([]int, m+1)
+		}
+		for i := n - 1; i >= 0; i-- {
+			for j := m - 1; j >= 0; j-- {
+				if eq(oldChildren[start+i], newChildren[start+j]) {
+					lcs[i][j] = lcs[i+1][j+1] + 1
+				} else if lcs[i+1][j] >= lcs[i][j+1] {
+					lcs[i][j] = lcs[i+1][j]
+				} else {
+					lcs[i][j] = lcs[i][j+1]
+				}
+			}
+		}
+		for i, j := 0, 0; i < n && j < m; {
+			if eq(oldChildren[start+i], newChildren[start+j]) {
+				matches = append(matches, childMatch{start + i, start + j})
+				i++
+				j++
+			} else if lcs[i+1][j] >= lcs[i][j+1] {
+				i++
+			} else {
+				j++
+			}
+		}
+	}
+
+	for i := len(suffix) - 1; i >= 0; i-- {
+		matches = append(matches, suffix[i])
+	}
+	return matches
+}
+
+// alignHeadChildren aligns the children of <head>. The order of metadata
+// elements carries no meaning, so keyed elements (see headKey) are matched by
+// key wherever they appear; the remaining children are aligned in order.
+// Matches may therefore cross, which means reordering head metadata produces
+// no operations (the old order is kept).
+func alignHeadChildren(oldChildren, newChildren []*html.Node, eq func(a, b *html.Node) bool) []childMatch {
+	var matches []childMatch
+
+	oldByKey := make(map[string][]int)
+	for i, c := range oldChildren {
+		if key := headKey(c); key != "" {
+			oldByKey[key] = append(oldByKey[key], i)
+		}
+	}
+
+	oldUsed := make([]bool, len(oldChildren))
+	newUsed := make([]bool, len(newChildren))
+	for j, c := range newChildren {
+		key := headKey(c)
+		if candidates := oldByKey[key]; key != "" && len(candidates) > 0 {
+			matches = append(matches, childMatch{candidates[0], j})
+			oldByKey[key] = candidates[1:]
+			oldUsed[candidates[0]] = true
+			newUsed[j] = true
+		}
+	}
+
+	// Align whatever is left (whitespace, scripts, styles...) positionally.
+	var oldRest, newRest []*html.Node
+	var oldIdx, newIdx []int
+	for i, c := range oldChildren {
+		if !oldUsed[i] {
+			oldRest = append(oldRest, c)
+			oldIdx = append(oldIdx, i)
+		}
+	}
+	for j, c := range newChildren {
+		if !newUsed[j] {
+			newRest = append(newRest, c)
+			newIdx = append(newIdx, j)
+		}
+	}
+	for _, m := range alignChildren(oldRest, newRest, eq) {
+		matches = append(matches, childMatch{oldIdx[m.old], newIdx[m.new]})
+	}
+	return matches
+}
+
+// headKey identifies a metadata element in <head> independently of its
+// position: <meta> by name/property/http-equiv/charset, <link> by rel and href,
+// and the singleton <title> and <base>. Other nodes have no key.
+func headKey(n *html.Node) string {
+	if n.Type != html.ElementNode {
+		return ""
+	}
+	switch n.Data {
+	case "meta":
+		for _, attr := range []string{"name", "property", "http-equiv"} {
+			if v := getAttr(n, attr); v != "" {
+				return "meta " + attr + "=" + v
+			}
+		}
+		if hasAttr(n, "charset") {
+			return "meta charset"
+		}
+	case "link":
+		return "link " + getAttr(n, "rel") + " " + getAttr(n, "href")
+	case "title", "base":
+		return n.Data
+	}
+	return ""
+}
+
+// DefaultNodeEqual reports whether two nodes should be treated as the same
+// node when aligning children: same node type and, for elements, the same tag
+// and id attribute. Text and comment nodes always match each other so their
+// content is diffed rather than replaced.
+func DefaultNodeEqual(a, b *html.Node) bool {
+	if a.Type != b.Type {
+		return false
+	}
+	switch a.Type {
+	case html.ElementNode:
+		return strings.EqualFold(a.Data, b.Data) && a.Namespace == b.Namespace && getAttr(a, "id") == getAttr(b, "id")
+	case html.DoctypeNode:
+		return a.Data == b.Data
+	}
+	return true
+}
+
+// identityEqual wraps eq so that nodes carrying an identity match only a
+// node of the same type and namespace with the same identity.
+func identityEqual(identity func(*html.Node) string, eq func(a, b *html.Node) bool) func(a, b *html.Node) bool {
+	return func(a, b *html.Node) bool {
+		ia, ib := identity(a), identity(b)
+		if ia == "" && ib == "" {
+			return eq(a, b)
+		}
+		return ia == ib && a.Type == b.Type && a.Namespace == b.Namespace
+	}
+}
+
+// getChildrenList returns the children of n. x/net/html keeps the contents of
+// a <template> as its ordinary children (there is no separate content
+// fragment), so template contents are diffed like any other subtree.
 func getChildrenList(n *html.Node) []*html.Node {
 	var children []*html.Node
 	for c := n.FirstChild; c != nil; c = c.NextSibling {
@@ -178,27 +1263,46 @@ func getChildrenList(n *html.Node) []*html.Node {
 }
 
 func diffText(oldText, newText string, path NodePath) []Operation {
-	// Find common prefix length
-	prefixLen := 0
-	minLen := len(oldText)
-	if len(newText) < minLen {
-		minLen = len(newText)
+	prefixLen, suffixLen := commonAffixes(oldText, newText)
+	return replaceMiddle(oldText, newText, prefixLen, suffixLen, path)
+}
+
+// joinReplacements merges each DELETE_TEXT directly followed by an
+// INSERT_TEXT at the same offset of the same node into one REPLACE_TEXT.
+func joinReplacements(ops []Operation) []Operation {
+	var out []Operation
+	for i := 0; i < len(ops); i++ {
+		op := ops[i]
+		if i+1 < len(ops) && op.Type == OpDeleteText {
+			next := ops[i+1]
+			if next.Type == OpInsertText && next.Position == op.Position && pathEqual(next.Path, op.Path) {
+				op.Type = OpReplaceText
+				op.NewValue = next.NewValue
+				i++
+			}
+		}
+		out = append(out, op)
 	}
-	for prefixLen < minLen && oldText[prefixLen] == newText[prefixLen] {
+	return out
+}
+
+// commonAffixes returns the lengths of the common prefix and suffix of a and
+// b. The suffix never overlaps the prefix.
+func commonAffixes(a, b string) (prefixLen, suffixLen int) {
+	minLen := min(len(a), len(b))
+	for prefixLen < minLen && a[prefixLen] == b[prefixLen] {
 		prefixLen++
 	}
-
-	// Find common suffix length, constrained by prefixLen
-	suffixLen := 0
-	maxSuffix := minLen - prefixLen
-	for suffixLen < maxSuffix {
-		if oldText[len(oldText)-1-suffixLen] == newText[len(newText)-1-suffixLen] {
-			suffixLen++
-		} else {
-			break
-		}
+	for suffixLen < minLen-prefixLen && a[len(a)-1-suffixLen] == b[len(b)-1-suffixLen] {
+		suffixLen++
 	}
+	return prefixLen, suffixLen
+}
 
+// replaceMiddle returns the DELETE_TEXT and INSERT_TEXT ops that replace
+// everything but the first prefixLen and last suffixLen bytes of oldText with
+// the same middle of newText.
+func replaceMiddle(oldText, newText string, prefixLen, suffixLen int, path NodePath) []Operation {
 	var ops []Operation
 
 	// Middle part of oldText is deleted
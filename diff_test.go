@@ -1,7 +1,17 @@
 package vchtml
 
 import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
 	"testing"
+	"time"
+
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
 )
 
 func TestDiffTextGranularity(t *testing.T) {
@@ -112,3 +122,1567 @@ func TestDiffSimple(t *testing.T) {
 		})
 	}
 }
+
+func TestDiffBooleanAttributes(t *testing.T) {
+	off := `<button>Go</button>`
+	on := `<button disabled>Go</button>`
+
+	// Toggle on: the attribute is added with an empty value.
+	delta, err := Diff(off, on, "tester")
+	if err != nil {
+		t.Fatalf("Diff error: %v", err)
+	}
+	if len(delta.Operations) != 1 || delta.Operations[0].Type != OpUpdateAttr || delta.Operations[0].Key != "disabled" {
+		t.Fatalf("Expected a single UPDATE_ATTR for disabled, got %v", delta.Operations)
+	}
+	patched, err := Patch(off, delta)
+	if err != nil {
+		t.Fatalf("Patch error: %v", err)
+	}
+	if !compareHTML(t, patched, on) {
+		t.Errorf("Toggle on produced wrong result")
+	}
+
+	// Toggle off: the removal is explicit.
+	delta, err = Diff(on, off, "tester")
+	if err != nil {
+		t.Fatalf("Diff error: %v", err)
+	}
+	if len(delta.Operations) != 1 || delta.Operations[0].Type != OpDeleteAttr || delta.Operations[0].Key != "disabled" {
+		t.Fatalf("Expected a single DELETE_ATTR for disabled, got %v", delta.Operations)
+	}
+	patched, err = Patch(on, delta)
+	if err != nil {
+		t.Fatalf("Patch error: %v", err)
+	}
+	if !compareHTML(t, patched, off) {
+		t.Errorf("Toggle off produced wrong result")
+	}
+}
+
+// largeListHTML builds a list of n items, each contributing three nodes
+// (<li>, <span>, text). The item at index changed gets different text.
+func largeListHTML(n, changed int) string {
+	var sb strings.Builder
+	sb.WriteString("<ul>")
+	for i := 0; i < n; i++ {
+		text := fmt.Sprintf("item %d", i)
+		if i == changed {
+			text += " edited"
+		}
+		sb.WriteString("<li><span>" + text + "</span></li>")
+	}
+	sb.WriteString("</ul>")
+	return sb.String()
+}
+
+func countNodes(n *html.Node) int {
+	count := 1
+	for c := n.FirstChild; c != nil; c = c.NextSibling {
+		count += countNodes(c)
+	}
+	return count
+}
+
+func BenchmarkDiffLocalizedChange(b *testing.B) {
+	oldDoc, _ := ParseHTML(largeListHTML(667, -1))
+	newDoc, _ := ParseHTML(largeListHTML(667, 333))
+
+	var visits int
+	for i := 0; i < b.N; i++ {
+		d := newDiffer(oldDoc, newDoc, DiffOptions{})
+		if _, err := d.diffNodes(oldDoc, newDoc, NodePath{}); err != nil {
+			b.Fatal(err)
+		}
+		visits = d.visits
+	}
+	b.ReportMetric(float64(countNodes(oldDoc)), "nodes")
+	b.ReportMetric(float64(visits), "visits/op")
+}
+
+func TestDiffSkipsUnchangedSubtrees(t *testing.T) {
+	oldDoc, _ := ParseHTML(largeListHTML(667, -1))
+	newDoc, _ := ParseHTML(largeListHTML(667, 333))
+
+	d := newDiffer(oldDoc, newDoc, DiffOptions{})
+	ops, err := d.diffNodes(oldDoc, newDoc, NodePath{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ops) != 1 {
+		t.Errorf("Want 1 op, got %d", len(ops))
+	}
+	// Only the spine down to the changed leaf and the direct children of <ul>
+	// are compared; every other subtree is skipped by hash.
+	if nodes := countNodes(oldDoc); d.visits >= nodes/2 {
+		t.Errorf("Expected far fewer visits than %d nodes, got %d", nodes, d.visits)
+	}
+}
+
+func TestDiffInterleavedTextNodes(t *testing.T) {
+	oldHTML := `<p>a<b>x</b>c</p>`
+	newHTML := `<p>a<b>x</b>cd</p>`
+
+	delta, err := Diff(oldHTML, newHTML, "tester")
+	if err != nil {
+		t.Fatalf("Diff error: %v", err)
+	}
+	if len(delta.Operations) != 1 {
+		t.Fatalf("Want 1 op, got %v", delta.Operations)
+	}
+
+	// p has three children: "a", <b>, "c". Only the last text node changes.
+	op := delta.Operations[0]
+	if op.Type != OpInsertText || op.NewValue != "d" || op.Position != 1 {
+		t.Errorf("Unexpected op: %+v", op)
+	}
+	if len(op.Path) == 0 || op.Path[len(op.Path)-1] != 2 {
+		t.Errorf("Op should target the second text node (index 2), got path %v", op.Path)
+	}
+
+	patched, err := Patch(oldHTML, delta)
+	if err != nil {
+		t.Fatalf("Patch error: %v", err)
+	}
+	if !compareHTML(t, patched, newHTML) {
+		t.Errorf("Patch produced wrong result")
+	}
+}
+
+func TestDiffNodeEqualPredicate(t *testing.T) {
+	oldHTML := `<ul><li class="a" data-ts="1">A</li><li class="b" data-ts="1">B</li></ul>`
+	newHTML := `<ul><li class="b" data-ts="2">B</li></ul>`
+
+	// Match on tag and every attribute except the volatile data-ts.
+	ignoreTimestamp := func(a, b *html.Node) bool {
+		if a.Type != b.Type || a.Data != b.Data {
+			return false
+		}
+		strip := func(n *html.Node) map[string]string {
+			m := make(map[string]string)
+			for _, attr := range n.Attr {
+				if attr.Key != "data-ts" {
+					m[attr.Key] = attr.Val
+				}
+			}
+			return m
+		}
+		ma, mb := strip(a), strip(b)
+		if len(ma) != len(mb) {
+			return false
+		}
+		for k, v := range ma {
+			if mb[k] != v {
+				return false
+			}
+		}
+		return true
+	}
+
+	delta, err := DiffWithOptions(oldHTML, newHTML, "tester", DiffOptions{NodeEqual: ignoreTimestamp})
+	if err != nil {
+		t.Fatalf("Diff error: %v", err)
+	}
+
+	// The second <li> is recognised as the surviving node: only its timestamp
+	// changes and the first <li> is deleted.
+	var types []OpType
+	for _, op := range delta.Operations {
+		types = append(types, op.Type)
+		if op.Type == OpUpdateAttr && op.Key != "data-ts" {
+			t.Errorf("Unexpected attribute update: %+v", op)
+		}
+	}
+	if len(types) != 2 || types[0] != OpUpdateAttr || types[1] != OpDeleteNode {
+		t.Errorf("Want [UPDATE_ATTR DELETE_NODE], got %v", types)
+	}
+
+	patched, err := Patch(oldHTML, delta)
+	if err != nil {
+		t.Fatalf("Patch error: %v", err)
+	}
+	if !compareHTML(t, patched, newHTML) {
+		t.Errorf("Patch produced wrong result")
+	}
+}
+
+func TestDiffBodyRelativePaths(t *testing.T) {
+	oldHTML := `<div><section><p>Hello</p></section></div>`
+	newHTML := `<div><section><p class="lead">Hello</p></section></div>`
+
+	delta, err := DiffWithOptions(oldHTML, newHTML, "tester", DiffOptions{Root: PathRootBody})
+	if err != nil {
+		t.Fatalf("Diff error: %v", err)
+	}
+	if delta.Root != PathRootBody {
+		t.Errorf("Delta should record its path root, got %q", delta.Root)
+	}
+	if len(delta.Operations) != 1 {
+		t.Fatalf("Want 1 op, got %v", delta.Operations)
+	}
+
+	// body -> div (0) -> section (0) -> p (0), without the html/body prefix.
+	want := NodePath{0, 0, 0}
+	if !pathEqual(delta.Operations[0].Path, want) {
+		t.Errorf("Want body-relative path %v, got %v", want, delta.Operations[0].Path)
+	}
+
+	patched, err := Patch(oldHTML, delta)
+	if err != nil {
+		t.Fatalf("Patch error: %v", err)
+	}
+	if !compareHTML(t, patched, newHTML) {
+		t.Errorf("Patch produced wrong result")
+	}
+}
+
+func TestDiffRemovedAttribute(t *testing.T) {
+	oldHTML := `<a href="/home" title="Home">Home</a>`
+	newHTML := `<a href="/home">Home</a>`
+
+	delta, err := Diff(oldHTML, newHTML, "tester")
+	if err != nil {
+		t.Fatalf("Diff error: %v", err)
+	}
+	if len(delta.Operations) != 1 {
+		t.Fatalf("Want 1 op, got %v", delta.Operations)
+	}
+	op := delta.Operations[0]
+	if op.Type != OpUpdateAttr || op.Key != "title" || !op.Removed || op.OldValue != "Home" {
+		t.Errorf("Expected UPDATE_ATTR removal of title, got %+v", op)
+	}
+
+	patched, err := Patch(oldHTML, delta)
+	if err != nil {
+		t.Fatalf("Patch error: %v", err)
+	}
+	if !compareHTML(t, patched, newHTML) {
+		t.Errorf("Attribute should be removed, got %s", patched)
+	}
+}
+
+func TestDiffHeadReorder(t *testing.T) {
+	oldHTML := `<html><head><meta name="description" content="A page"><meta name="author" content="Dan"><link rel="stylesheet" href="a.css"></head><body></body></html>`
+	newHTML := `<html><head><link rel="stylesheet" href="a.css"><meta name="author" content="Dan"><meta name="description" content="A page"></head><body></body></html>`
+
+	delta, err := Diff(oldHTML, newHTML, "tester")
+	if err != nil {
+		t.Fatalf("Diff error: %v", err)
+	}
+	if len(delta.Operations) != 0 {
+		t.Errorf("Reordering head metadata should produce no ops, got %v", delta.Operations)
+	}
+
+	// A real change to one of the reordered tags is still picked up in place.
+	changedHTML := `<html><head><meta name="author" content="Danny"><meta name="description" content="A page"></head><body></body></html>`
+	base := `<html><head><meta name="description" content="A page"><meta name="author" content="Dan"></head><body></body></html>`
+	delta, err = Diff(base, changedHTML, "tester")
+	if err != nil {
+		t.Fatalf("Diff error: %v", err)
+	}
+	if len(delta.Operations) != 1 || delta.Operations[0].Key != "content" || delta.Operations[0].NewValue != "Danny" {
+		t.Errorf("Want a single content update, got %v", delta.Operations)
+	}
+}
+
+func TestDiffDeterministicOrder(t *testing.T) {
+	oldHTML := `<div a="1" b="1" c="1" d="1" hidden><p title="x">Hi</p></div>`
+	newHTML := `<div a="2" c="2" e="2" f="2" g="2"><p title="y" lang="en">Hello</p><p>New</p></div>`
+
+	var first []byte
+	for i := 0; i < 20; i++ {
+		delta, err := Diff(oldHTML, newHTML, "tester")
+		if err != nil {
+			t.Fatalf("Diff error: %v", err)
+		}
+		delta.Timestamp = 0
+		encoded, err := json.Marshal(delta)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if first == nil {
+			first = encoded
+			continue
+		}
+		if !bytes.Equal(first, encoded) {
+			t.Fatalf("Run %d produced a different delta:\n%s\n%s", i, first, encoded)
+		}
+	}
+
+	// The canonical order must still apply correctly.
+	delta, _ := Diff(oldHTML, newHTML, "tester")
+	patched, err := Patch(oldHTML, delta)
+	if err != nil {
+		t.Fatalf("Patch error: %v", err)
+	}
+	if !compareHTML(t, patched, newHTML) {
+		t.Errorf("Patch produced wrong result")
+	}
+}
+
+func TestDiffWrapText(t *testing.T) {
+	tests := []struct {
+		name     string
+		oldHTML  string
+		newHTML  string
+		want     []OpType // By default
+		wantWrap []OpType // With WrapText
+	}{
+		{
+			name:     "Wrap End",
+			oldHTML:  `<p>Hello world</p>`,
+			newHTML:  `<p>Hello <b>world</b></p>`,
+			want:     []OpType{OpSplitText, OpDeleteNode, OpInsertNode},
+			wantWrap: []OpType{OpSplitText, OpWrapNode},
+		},
+		{
+			name:     "Wrap Middle",
+			oldHTML:  `<p>Hello big world</p>`,
+			newHTML:  `<p>Hello <em class="x">big</em> world</p>`,
+			want:     []OpType{OpSplitText, OpSplitText, OpDeleteNode, OpInsertNode},
+			wantWrap: []OpType{OpSplitText, OpSplitText, OpWrapNode},
+		},
+		{
+			name:     "Wrap Start",
+			oldHTML:  `<p>Hello world</p>`,
+			newHTML:  `<p><b>Hello</b> world</p>`,
+			want:     []OpType{OpSplitText, OpDeleteNode, OpInsertNode},
+			wantWrap: []OpType{OpSplitText, OpWrapNode},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for _, wrap := range []bool{false, true} {
+				delta, err := DiffWithOptions(tt.oldHTML, tt.newHTML, "tester", DiffOptions{WrapText: wrap})
+				if err != nil {
+					t.Fatalf("Diff error: %v", err)
+				}
+				want := tt.want
+				if wrap {
+					want = tt.wantWrap
+				}
+				var got []OpType
+				for _, op := range delta.Operations {
+					got = append(got, op.Type)
+					// The text is split off, never deleted or re-inserted.
+					if op.Type == OpInsertText || op.Type == OpDeleteText || (op.Type == OpInsertNode && !strings.HasPrefix(op.NodeData, "<")) {
+						t.Errorf("Wrapped text must not be re-inserted: %+v", op)
+					}
+				}
+				if fmt.Sprint(got) != fmt.Sprint(want) {
+					t.Errorf("WrapText=%v: want %v, got %v", wrap, want, got)
+				}
+
+				for _, preserve := range []bool{false, true} {
+					patched, err := PatchWithOptions(tt.oldHTML, delta, PatchOptions{PreserveSource: preserve})
+					if err != nil {
+						t.Fatalf("WrapText=%v, PreserveSource=%v: patch error: %v", wrap, preserve, err)
+					}
+					if !compareHTML(t, patched, tt.newHTML) {
+						t.Errorf("WrapText=%v, PreserveSource=%v: patch produced wrong result", wrap, preserve)
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestDiffFragmentTopLevel(t *testing.T) {
+	oldHTML := `<p>a</p><p>b</p>`
+	newHTML := `<p>a</p>`
+
+	delta, err := DiffFragment(oldHTML, newHTML, "tester")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if delta.Root != PathRootFragment {
+		t.Errorf("Expected fragment root, got %q", delta.Root)
+	}
+	if len(delta.Operations) != 1 {
+		t.Fatalf("Expected 1 op, got %d: %+v", len(delta.Operations), delta.Operations)
+	}
+	op := delta.Operations[0]
+	if op.Type != OpDeleteNode || !pathEqual(op.Path, NodePath{1}) {
+		t.Errorf("Expected DELETE_NODE at [1], got %s at %v", op.Type, op.Path)
+	}
+
+	patched, err := Patch(oldHTML, delta)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if patched != newHTML {
+		t.Errorf("Patch = %q, want %q", patched, newHTML)
+	}
+
+	// The reverse is a top-level insert into the virtual root.
+	delta, err = DiffFragment(newHTML, oldHTML, "tester")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(delta.Operations) != 1 || delta.Operations[0].Type != OpInsertNode || len(delta.Operations[0].Path) != 0 || delta.Operations[0].Position != 1 {
+		t.Fatalf("Expected a top-level INSERT_NODE at 1, got %+v", delta.Operations)
+	}
+	patched, err = Patch(newHTML, delta)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if patched != oldHTML {
+		t.Errorf("Patch = %q, want %q", patched, oldHTML)
+	}
+}
+
+func TestDiffTemplateContents(t *testing.T) {
+	cases := []struct{ name, oldHTML, newHTML string }{
+		{"Head", `<head><template id="t"><p>Hello</p></template></head>`, `<head><template id="t"><p>Hello there</p></template></head>`},
+		{"Body", `<div><template><p>Hi</p></template></div>`, `<div><template><p>Hi <b>you</b></p><li>new</li></template></div>`},
+		{"Rows", `<template><tr><td>x</td></tr></template>`, `<template><tr><td>y</td></tr><tr><td>z</td></tr></template>`},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			delta, err := Diff(c.oldHTML, c.newHTML, "tester")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(delta.Operations) == 0 {
+				t.Fatal("Expected ops for an edit inside <template>")
+			}
+			patched, err := Patch(c.oldHTML, delta)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !compareHTML(t, patched, c.newHTML) {
+				t.Errorf("Template edit did not round-trip")
+			}
+		})
+	}
+}
+
+func TestDiffStructuredSrcset(t *testing.T) {
+	oldHTML := `<img srcset="small.png 1x, big.png 2x">`
+	newHTML := `<img srcset="small.png 1x, huge.png 2x, wide.png 800w">`
+
+	delta, err := DiffWithOptions(oldHTML, newHTML, "tester", DiffOptions{StructuredAttrs: []string{"srcset"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []Operation{
+		{Type: OpUpdateAttr, Key: "srcset", SubKey: "2x", OldValue: "big.png", NewValue: "huge.png"},
+		{Type: OpUpdateAttr, Key: "srcset", SubKey: "800w", NewValue: "wide.png"},
+	}
+	if len(delta.Operations) != len(want) {
+		t.Fatalf("Expected %d ops, got %+v", len(want), delta.Operations)
+	}
+	for i, op := range delta.Operations {
+		if op.SubKey != want[i].SubKey || op.OldValue != want[i].OldValue || op.NewValue != want[i].NewValue {
+			t.Errorf("op %d = %+v, want %+v", i, op, want[i])
+		}
+	}
+
+	patched, err := Patch(oldHTML, delta)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !compareHTML(t, patched, newHTML) {
+		t.Errorf("Structured srcset edit did not round-trip")
+	}
+
+	// Separators inside data: URLs, parentheses and quotes don't split.
+	cases := []struct {
+		attr, old, new, subKey string
+	}{
+		{"style", `background: url(data:image/png;base64,AAAA); color: red`, `background: url(data:image/png;base64,AAAA); color: blue`, "color"},
+		{"style", `content: "a;b"; color: red`, `content: "a;b"; color: blue`, "color"},
+		{"srcset", `data:image/png;base64,AAAA 1x, big.png 2x`, `data:image/png;base64,AAAA 1x, huge.png 2x`, "2x"},
+		{"srcset", `a.png 1x,b.png 2x`, `a.png 1x, c.png 2x`, "2x"},
+	}
+	for _, c := range cases {
+		oldHTML := `<img ` + c.attr + `="` + strings.ReplaceAll(c.old, `"`, "&quot;") + `">`
+		newHTML := `<img ` + c.attr + `="` + strings.ReplaceAll(c.new, `"`, "&quot;") + `">`
+		delta, err := DiffWithOptions(oldHTML, newHTML, "tester", DiffOptions{StructuredAttrs: []string{c.attr}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(delta.Operations) != 1 || delta.Operations[0].SubKey != c.subKey {
+			t.Errorf("%s %q: expected one %s op, got %+v", c.attr, c.new, c.subKey, delta.Operations)
+			continue
+		}
+		patched, err := Patch(oldHTML, delta)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !compareHTML(t, patched, newHTML) {
+			t.Errorf("%s %q: patched = %s", c.attr, c.new, patched)
+		}
+	}
+}
+
+func TestDiffAnchorPaths(t *testing.T) {
+	oldHTML := `<header>Site</header><div id="main"><p>Hello</p><ul><li>One</li></ul></div>`
+	newHTML := `<header>Site</header><div id="main"><p class="x">Hello world</p><ul><li>One</li><li>Two</li></ul></div>`
+
+	delta, err := DiffWithOptions(oldHTML, newHTML, "tester", DiffOptions{AnchorPaths: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, op := range delta.Operations {
+		if op.Anchor != "main" {
+			t.Errorf("Expected %s at %v to be anchored at #main, got %q", op.Type, op.Path, op.Anchor)
+		}
+	}
+
+	patched, err := Patch(oldHTML, delta)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !compareHTML(t, patched, newHTML) {
+		t.Errorf("Anchored delta did not reproduce the new document")
+	}
+
+	// The same delta still targets the right nodes once #main is moved under
+	// extra wrappers and preceded by other content.
+	reshaped := `<nav>Menu</nav><div class="wrap"><div><aside>Ad</aside><div id="main"><p>Hello</p><ul><li>One</li></ul></div></div></div>`
+	want := `<nav>Menu</nav><div class="wrap"><div><aside>Ad</aside><div id="main"><p class="x">Hello world</p><ul><li>One</li><li>Two</li></ul></div></div></div>`
+	patched, err = PatchWithOptions(reshaped, delta, PatchOptions{IgnoreBaseHash: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !compareHTML(t, patched, want) {
+		t.Errorf("Anchored delta missed its targets in the reshaped document")
+	}
+
+	// Without anchors the absolute paths land on the wrong nodes.
+	plain, _ := Diff(oldHTML, newHTML, "tester")
+	if patched, err := PatchWithOptions(reshaped, plain, PatchOptions{IgnoreBaseHash: true}); err == nil && compareHTML(t, patched, want) {
+		t.Error("Expected absolute paths to miss in the reshaped document")
+	}
+}
+
+func TestDiffMaxTextDiffLen(t *testing.T) {
+	oldText := strings.Repeat("abcdefghij", 10000)
+	newText := strings.Repeat("jihgfedcba", 10000)
+	oldHTML := "<pre>" + oldText + "</pre>"
+	newHTML := "<pre>" + newText + "</pre>"
+
+	start := time.Now()
+	delta, err := DiffWithOptions(oldHTML, newHTML, "tester", DiffOptions{MaxTextDiffLen: 64 * 1024})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("Diff took %v", elapsed)
+	}
+	if len(delta.Operations) != 1 || delta.Operations[0].Type != OpUpdateText {
+		t.Fatalf("Expected a single UPDATE_TEXT, got %d ops", len(delta.Operations))
+	}
+	if op := delta.Operations[0]; op.OldValue != oldText || op.NewValue != newText {
+		t.Error("UPDATE_TEXT does not carry the full old and new text")
+	}
+	patched, err := Patch(oldHTML, delta)
+	if err != nil {
+		t.Fatalf("Patch failed: %v", err)
+	}
+	if !compareHTML(t, patched, newHTML) {
+		t.Error("Patched output mismatch")
+	}
+
+	// Below the limit the change stays granular.
+	delta, _ = DiffWithOptions(`<pre>short text</pre>`, `<pre>short new text</pre>`, "tester", DiffOptions{MaxTextDiffLen: 64 * 1024})
+	if len(delta.Operations) != 1 || delta.Operations[0].Type != OpInsertText {
+		t.Errorf("Expected a granular INSERT_TEXT, got %+v", delta.Operations)
+	}
+}
+
+func TestDiffChangeTag(t *testing.T) {
+	oldHTML := `<p>a <b class="k">x</b> c</p>`
+	newHTML := `<p>a <strong class="k">x</strong> c</p>`
+
+	delta, err := Diff(oldHTML, newHTML, "tester")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(delta.Operations) != 1 {
+		t.Fatalf("Expected 1 op, got %d: %+v", len(delta.Operations), delta.Operations)
+	}
+	op := delta.Operations[0]
+	if op.Type != OpChangeTag || op.OldValue != "b" || op.NewValue != "strong" || !pathEqual(op.Path, NodePath{0, 1, 0, 1}) {
+		t.Fatalf("Unexpected op: %+v", op)
+	}
+
+	// The rename keeps the element's children: the text node is the same node.
+	doc, _ := ParseHTML(oldHTML)
+	text, _ := GetNode(doc, NodePath{0, 1, 0, 1, 0})
+	if err := PatchTree(doc, delta); err != nil {
+		t.Fatalf("PatchTree failed: %v", err)
+	}
+	elem, _ := GetNode(doc, NodePath{0, 1, 0, 1})
+	if elem.Data != "strong" || elem.DataAtom != atom.Strong || elem.FirstChild != text {
+		t.Errorf("Expected <strong> holding the original text node, got %s", renderOrEmpty(elem))
+	}
+
+	patched, err := PatchWithOptions(oldHTML, delta, PatchOptions{PreserveSource: true})
+	if err != nil {
+		t.Fatalf("Patch failed: %v", err)
+	}
+	if patched != newHTML {
+		t.Errorf("PreserveSource patch = %s, want %s", patched, newHTML)
+	}
+
+	// A rename keeps its place in document order among its siblings' edits.
+	delta, err = Diff(`<p><b>x</b> c</p>`, `<p><strong>x</strong> d</p>`, "tester")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(delta.Operations) < 2 || delta.Operations[0].Type != OpChangeTag {
+		t.Errorf("Expected the rename before the text edit after it, got %+v", delta.Operations)
+	}
+}
+
+func TestDiffIgnoreAttrs(t *testing.T) {
+	oldHTML := `<div data-reactid="1" class="box"><p data-v-3f2a="" ng-click="a()">Hi</p></div>`
+	newHTML := `<div data-reactid="7" class="box"><p data-v-9c1e="" NG-CLICK="b()">Hi</p></div>`
+	opts := DiffOptions{IgnoreAttrs: []string{"data-reactid", "data-v-*", "ng-*"}}
+
+	delta, err := DiffWithOptions(oldHTML, newHTML, "tester", opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(delta.Operations) != 0 {
+		t.Errorf("Expected no ops, got %+v", delta.Operations)
+	}
+
+	// Other attributes are still diffed.
+	delta, _ = DiffWithOptions(oldHTML, strings.Replace(newHTML, `class="box"`, `class="card"`, 1), "tester", opts)
+	if len(delta.Operations) != 1 || delta.Operations[0].Key != "class" {
+		t.Errorf("Expected a single class update, got %+v", delta.Operations)
+	}
+}
+
+func TestDiffDetectMoves(t *testing.T) {
+	oldHTML := `<ul id="todo"><li id="1">one</li><li id="2"><b>two</b></li><li id="3">three</li></ul><ul id="done"><li id="4">four</li></ul>`
+	newHTML := `<ul id="todo"><li id="1">one</li><li id="3">three!</li></ul><ul id="done"><li id="4">four</li><li id="2"><b>two</b></li></ul>`
+
+	delta, err := DiffWithOptions(oldHTML, newHTML, "tester", DiffOptions{DetectMoves: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var moves []Operation
+	for _, op := range delta.Operations {
+		switch op.Type {
+		case OpMoveNode:
+			moves = append(moves, op)
+		case OpInsertNode, OpDeleteNode:
+			t.Errorf("Unexpected %s", op)
+		}
+	}
+	if len(moves) != 1 {
+		t.Fatalf("Expected 1 move, got %v", delta.Operations)
+	}
+	if m := moves[0]; !pathEqual(m.Path, NodePath{0, 1, 0, 1}) || !pathEqual(m.To, NodePath{0, 1, 1}) || m.Position != 1 {
+		t.Errorf("Unexpected move: %s", m)
+	}
+
+	// Applying the move keeps the moved node itself.
+	doc, _ := ParseHTML(oldHTML)
+	item, _ := GetNode(doc, NodePath{0, 1, 0, 1})
+	if err := PatchTree(doc, delta); err != nil {
+		t.Fatalf("PatchTree failed: %v", err)
+	}
+	if moved, _ := GetNode(doc, NodePath{0, 1, 1, 1}); moved != item {
+		t.Error("Expected the original <li> under the second list")
+	}
+	for _, preserve := range []bool{false, true} {
+		patched, err := PatchWithOptions(oldHTML, delta, PatchOptions{PreserveSource: preserve})
+		if err != nil {
+			t.Fatalf("Patch failed (PreserveSource=%v): %v", preserve, err)
+		}
+		if !compareHTML(t, patched, newHTML) {
+			t.Errorf("Patched output mismatch (PreserveSource=%v)", preserve)
+		}
+	}
+}
+
+func TestCollapseMoves(t *testing.T) {
+	oldHTML := `<ul id="todo"><li id="1">one</li><li id="2"><b>two</b></li><li id="3">three</li></ul><ul id="done"><li id="4">four</li></ul>`
+	newHTML := `<ul id="todo"><li id="1">one</li><li id="3">three!</li></ul><ul id="done"><li id="4">four</li><li id="2"><b>two</b></li></ul>`
+
+	delta, err := Diff(oldHTML, newHTML, "tester")
+	if err != nil {
+		t.Fatal(err)
+	}
+	collapsed, err := CollapseMoves(oldHTML, delta)
+	if err != nil {
+		t.Fatal(err)
+	}
+	moves := 0
+	for _, op := range collapsed.Operations {
+		switch op.Type {
+		case OpMoveNode:
+			moves++
+		case OpInsertNode, OpDeleteNode:
+			t.Errorf("Unexpected %s", op)
+		}
+	}
+	if moves != 1 {
+		t.Fatalf("Expected 1 move, got %v", collapsed.Operations)
+	}
+	detected, _ := DiffWithOptions(oldHTML, newHTML, "tester", DiffOptions{DetectMoves: true})
+	if !reflect.DeepEqual(collapsed.Operations, detected.Operations) {
+		t.Errorf("Collapsed %v, DetectMoves gives %v", collapsed.Operations, detected.Operations)
+	}
+	patched, err := Patch(oldHTML, collapsed)
+	if err != nil {
+		t.Fatalf("Patch failed: %v", err)
+	}
+	if !compareHTML(t, patched, newHTML) {
+		t.Errorf("Patched = %s", patched)
+	}
+	for _, op := range delta.Operations {
+		if op.Type == OpMoveNode {
+			t.Error("CollapseMoves modified its input")
+		}
+	}
+
+	if _, err := CollapseMoves(newHTML, delta); err == nil {
+		t.Error("Expected a base hash mismatch")
+	}
+}
+
+func TestDiffNormalizeUnicode(t *testing.T) {
+	composed := "Caf\u00e9 cr\u00e8me"
+	decomposed := "Cafe\u0301 cre\u0300me"
+	opts := DiffOptions{NormalizeUnicode: true}
+
+	delta, err := DiffWithOptions(`<p>`+composed+`</p>`, `<p>`+decomposed+`</p>`, "tester", opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(delta.Operations) != 0 {
+		t.Errorf("Expected no ops, got %v", delta.Operations)
+	}
+	if delta, _ = Diff(`<p>`+composed+`</p>`, `<p>`+decomposed+`</p>`, "tester"); len(delta.Operations) == 0 {
+		t.Error("Expected ops without normalization")
+	}
+
+	// A real change next to a decomposed character is addressed in the
+	// original (decomposed) bytes.
+	oldHTML := `<p>` + decomposed + `</p>`
+	delta, _ = DiffWithOptions(oldHTML, "<p>Caf\u00e9 br\u00fbl\u00e9e</p>", "tester", opts)
+	if len(delta.Operations) != 2 {
+		t.Fatalf("Expected a delete and an insert, got %v", delta.Operations)
+	}
+	if del := delta.Operations[0]; del.Type != OpDeleteText || del.Position != len("Cafe\u0301 ") || del.OldValue != "cre\u0300m" {
+		t.Errorf("Unexpected delete: %s", del)
+	}
+	patched, err := Patch(oldHTML, delta)
+	if err != nil {
+		t.Fatalf("Patch failed: %v", err)
+	}
+	// The unchanged "Café" keeps its original, decomposed spelling.
+	if !compareHTML(t, patched, "<p>Cafe\u0301 br\u00fbl\u00e9e</p>") {
+		t.Error("Patched output mismatch")
+	}
+}
+
+func TestDiffGranularAttrs(t *testing.T) {
+	path := "M10 10 " + strings.Repeat("L20 20 L30 10 ", 40) + "Z"
+	svg := func(d string) string {
+		return `<svg viewBox="0 0 100 100"><path d="` + d + `"></path></svg>`
+	}
+	oldHTML := svg(path)
+	edited := strings.Replace(path, "M10 10", "M12 10", 1)
+	opts := DiffOptions{GranularAttrs: true}
+
+	delta, err := DiffWithOptions(oldHTML, svg(edited), "tester", opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(delta.Operations) != 2 {
+		t.Fatalf("Expected a delete and an insert, got %v", delta.Operations)
+	}
+	del, ins := delta.Operations[0], delta.Operations[1]
+	if del.Type != OpDeleteAttrText || del.Key != "d" || del.Position != 2 || del.OldValue != "0" ||
+		ins.Type != OpInsertAttrText || ins.Position != 2 || ins.NewValue != "2" {
+		t.Errorf("Unexpected ops: %v", delta.Operations)
+	}
+	patched, err := Patch(oldHTML, delta)
+	if err != nil {
+		t.Fatalf("Patch failed: %v", err)
+	}
+	if !compareHTML(t, patched, svg(edited)) {
+		t.Error("Patched output mismatch")
+	}
+
+	// Granular edits of different parts of the value merge.
+	other, _ := DiffWithOptions(oldHTML, svg(strings.TrimSuffix(path, "Z")+"L0 0 Z"), "other", opts)
+	merged, _, conflicts, err := Merge(oldHTML, delta, other)
+	if err != nil || len(conflicts) > 0 {
+		t.Fatalf("Merge failed: %v %v", err, conflicts)
+	}
+	if !compareHTML(t, merged, svg(strings.TrimSuffix(edited, "Z")+"L0 0 Z")) {
+		t.Error("Merged output mismatch")
+	}
+}
+
+func TestReconcile(t *testing.T) {
+	current := `<html><head><meta name="a" content="1"><meta name="b" content="2"><title>Old</title></head>` +
+		`<body class="x" data-stale="1"><div id="main"><h1>Title</h1><p>Intro <b>bold</b></p></div>` +
+		`<ul><li>one</li><li>two</li></ul><!-- note --></body></html>`
+	target := `<html lang="en"><head><meta name="b" content="2"><meta name="a" content="1"><title>New</title></head>` +
+		`<body class="y"><section id="main"><h2>Title</h2><p>Intro <i>italic</i> and more</p></section>` +
+		`<ol start="3"><li>three</li></ol>text<p>tail</p></body></html>`
+
+	delta, err := Reconcile(current, target)
+	if err != nil {
+		t.Fatalf("Reconcile failed: %v", err)
+	}
+	if delta.BaseHash != hashString(current) {
+		t.Error("Expected the delta to be based on the current document")
+	}
+	patched, err := Patch(current, delta)
+	if err != nil {
+		t.Fatalf("Patch failed: %v", err)
+	}
+	got, _ := ParseHTML(patched)
+	want, _ := ParseHTML(target)
+	if HashNode(got) != HashNode(want) {
+		t.Errorf("Patched output mismatch:\n got %s\nwant %s", patched, target)
+	}
+
+	// Identical documents reconcile to an empty delta.
+	delta, err = Reconcile(target, target)
+	if err != nil || len(delta.Operations) != 0 {
+		t.Errorf("Expected no ops, got %v %v", delta, err)
+	}
+}
+
+func TestDiffTagHandlers(t *testing.T) {
+	oldHTML := `<div><canvas width="100"><p>Fallback</p></canvas><p>After</p></div>`
+	newHTML := `<div><canvas width="200"><p>Your browser has no canvas</p></canvas><p>After</p></div>`
+	opts := DiffOptions{TagHandlers: map[string]TagHandler{"canvas": {Opaque: true}}}
+
+	delta, err := DiffWithOptions(oldHTML, newHTML, "tester", opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(delta.Operations) != 2 {
+		t.Fatalf("Expected the canvas to be replaced, got %v", delta.Operations)
+	}
+	del, ins := delta.Operations[0], delta.Operations[1]
+	if del.Type != OpDeleteNode || !pathEqual(del.Path, NodePath{0, 1, 0, 0}) ||
+		ins.Type != OpInsertNode || !pathEqual(ins.Path, NodePath{0, 1, 0}) || ins.Position != 0 ||
+		ins.NodeData != `<canvas width="200"><p>Your browser has no canvas</p></canvas>` {
+		t.Errorf("Unexpected ops: %v", delta.Operations)
+	}
+	patched, err := Patch(oldHTML, delta)
+	if err != nil {
+		t.Fatalf("Patch failed: %v", err)
+	}
+	if !compareHTML(t, patched, newHTML) {
+		t.Error("Patched output mismatch")
+	}
+
+	// An unchanged opaque element is left alone.
+	delta, _ = DiffWithOptions(oldHTML, strings.Replace(oldHTML, "After", "Later", 1), "tester", opts)
+	for _, op := range delta.Operations {
+		if op.Type == OpDeleteNode || op.Type == OpInsertNode {
+			t.Errorf("Unexpected structural op %v", op)
+		}
+	}
+}
+
+func TestDiffNormalizeFunc(t *testing.T) {
+	sortClasses := func(root *html.Node) {
+		var walk func(n *html.Node)
+		walk = func(n *html.Node) {
+			if n.Type == html.ElementNode && hasAttr(n, "class") {
+				classes := strings.Fields(getAttr(n, "class"))
+				sort.Strings(classes)
+				setAttr(n, "class", strings.Join(classes, " "))
+			}
+			for c := n.FirstChild; c != nil; c = c.NextSibling {
+				walk(c)
+			}
+		}
+		walk(root)
+	}
+	oldHTML := `<div class="card  wide active"><p class="b a">Text</p></div>`
+	newHTML := `<div class="active card wide"><p class="a b">Text</p></div>`
+
+	delta, err := DiffWithOptions(oldHTML, newHTML, "tester", DiffOptions{NormalizeFunc: sortClasses})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(delta.Operations) != 0 {
+		t.Errorf("Expected no ops, got %v", delta.Operations)
+	}
+
+	// Without the normalizer the class order is a change.
+	delta, _ = Diff(oldHTML, newHTML, "tester")
+	if len(delta.Operations) != 2 {
+		t.Errorf("Expected two attribute ops, got %v", delta.Operations)
+	}
+
+	// DiffNodes leaves normalizing the caller's trees to the caller.
+	oldDoc, _ := ParseHTML(oldHTML)
+	newDoc, _ := ParseHTML(newHTML)
+	ops, err := DiffNodes(oldDoc, newDoc, DiffOptions{NormalizeFunc: sortClasses})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ops) != 2 || getAttr(oldDoc.FirstChild.LastChild.FirstChild, "class") != "card  wide active" {
+		t.Errorf("Expected DiffNodes to ignore NormalizeFunc, got %v", ops)
+	}
+	sortClasses(oldDoc)
+	sortClasses(newDoc)
+	if ops, _ := DiffNodes(oldDoc, newDoc, DiffOptions{}); len(ops) != 0 {
+		t.Errorf("Expected no ops after normalizing, got %v", ops)
+	}
+}
+
+func TestDiffNamespacedAttrs(t *testing.T) {
+	use := func(href, xlink string) string {
+		return `<svg xmlns:xlink="http://www.w3.org/1999/xlink"><use href="` + href + `" xlink:href="` + xlink + `"></use></svg>`
+	}
+	oldHTML := use("#a", "#a")
+	newHTML := use("#a", "#b")
+
+	delta, err := Diff(oldHTML, newHTML, "tester")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(delta.Operations) != 1 {
+		t.Fatalf("Expected one op, got %v", delta.Operations)
+	}
+	op := delta.Operations[0]
+	if op.Type != OpUpdateAttr || op.Key != "xlink:href" || op.OldValue != "#a" || op.NewValue != "#b" {
+		t.Errorf("Expected xlink:href update, got %+v", op)
+	}
+
+	patched, err := Patch(oldHTML, delta)
+	if err != nil {
+		t.Fatalf("Patch failed: %v", err)
+	}
+	doc, _ := html.Parse(strings.NewReader(patched))
+	useNode, err := QuerySelector(doc, "use")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, a := range useNode.Attr {
+		if a.Key == "href" && a.Namespace == "" && a.Val != "#a" {
+			t.Errorf("Plain href changed to %q", a.Val)
+		}
+		if a.Key == "href" && a.Namespace == "xlink" && a.Val != "#b" {
+			t.Errorf("xlink:href is %q, want #b", a.Val)
+		}
+	}
+
+	// Adding the namespaced attribute creates it in its namespace.
+	oldHTML = `<svg><use href="#a"></use></svg>`
+	delta, _ = Diff(oldHTML, use("#a", "#c"), "tester")
+	patched, err = Patch(oldHTML, delta)
+	if err != nil {
+		t.Fatalf("Patch failed: %v", err)
+	}
+	if !compareHTML(t, patched, use("#a", "#c")) {
+		t.Errorf("Patched = %s", patched)
+	}
+}
+
+func TestDiffRootCount(t *testing.T) {
+	cases := []struct{ oldHTML, newHTML string }{
+		{`<div>a</div>`, `<div>a</div><div>b</div>`},
+		{`<div>a</div><div>b</div>`, `<div>a</div>`},
+		{`<div>a</div>`, `<p>new</p><div>a</div>`},
+		{``, `<div>a</div>`},
+		{`<div>a</div>`, ``},
+	}
+	for _, c := range cases {
+		for _, preserve := range []bool{false, true} {
+			opts := PatchOptions{PreserveSource: preserve}
+
+			delta, err := DiffFragment(c.oldHTML, c.newHTML, "tester")
+			if err != nil {
+				t.Fatal(err)
+			}
+			patched, err := PatchWithOptions(c.oldHTML, delta, opts)
+			if err != nil {
+				t.Errorf("%q -> %q (fragment, PreserveSource=%v): %v", c.oldHTML, c.newHTML, preserve, err)
+			} else if patched != c.newHTML {
+				t.Errorf("%q -> %q (fragment, PreserveSource=%v): got %q", c.oldHTML, c.newHTML, preserve, patched)
+			}
+
+			delta, err = Diff(c.oldHTML, c.newHTML, "tester")
+			if err != nil {
+				t.Fatal(err)
+			}
+			patched, err = PatchWithOptions(c.oldHTML, delta, opts)
+			if err != nil {
+				t.Errorf("%q -> %q (document, PreserveSource=%v): %v", c.oldHTML, c.newHTML, preserve, err)
+			} else if !compareHTML(t, patched, c.newHTML) {
+				t.Errorf("%q -> %q (document, PreserveSource=%v): got %q", c.oldHTML, c.newHTML, preserve, patched)
+			}
+		}
+	}
+
+	// A second root is one top-level insert.
+	delta, _ := DiffFragment(`<div>a</div>`, `<div>a</div><div>b</div>`, "tester")
+	if len(delta.Operations) != 1 {
+		t.Fatalf("Expected one op, got %+v", delta.Operations)
+	}
+	if op := delta.Operations[0]; op.Type != OpInsertNode || len(op.Path) != 0 || op.Position != 1 || op.NodeData != `<div>b</div>` {
+		t.Errorf("Expected a top-level INSERT_NODE of <div>b</div> at 1, got %+v", op)
+	}
+}
+
+func TestDiffScopeSelector(t *testing.T) {
+	page := func(nav, title, body string) string {
+		return `<header><nav>` + nav + `</nav></header><main><div contenteditable="true"><h1>` + title +
+			`</h1><p>` + body + `</p></div><aside>Ad</aside></main>`
+	}
+	oldHTML := page(`<a>Home</a>`, "Title", "Body")
+	newHTML := `<div class="banner">Sale</div>` + page(`<a>Home</a><a>Shop</a>`, "New title", "Body text")
+
+	delta, err := DiffWithOptions(oldHTML, newHTML, "tester", DiffOptions{ScopeSelector: "[contenteditable]"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	scope, _ := ParseHTML(oldHTML)
+	editable, err := PathFromSelector(scope, "[contenteditable]")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, op := range delta.Operations {
+		if len(op.Path) <= len(editable) || !pathEqual(op.Path[:len(editable)], editable) {
+			t.Errorf("Op outside the editable region: %+v", op)
+		}
+	}
+
+	// Only the editable region changes; the chrome keeps its old content.
+	patched, err := Patch(oldHTML, delta)
+	if err != nil {
+		t.Fatalf("Patch failed: %v", err)
+	}
+	if want := page(`<a>Home</a>`, "New title", "Body text"); !compareHTML(t, patched, want) {
+		t.Errorf("Patched = %s", patched)
+	}
+
+	// Regions are paired in order, so their number must not change.
+	_, err = DiffWithOptions(oldHTML, oldHTML+`<div contenteditable>More</div>`, "tester", DiffOptions{ScopeSelector: "[contenteditable]"})
+	if err == nil {
+		t.Error("Expected an error when the number of scopes differs")
+	}
+
+	// Options are checked even when the documents are identical.
+	if _, err := DiffWithOptions(oldHTML, oldHTML, "tester", DiffOptions{ScopeSelector: "p >"}); err == nil {
+		t.Error("Expected an error for an invalid scope selector on identical documents")
+	}
+	if _, err := DiffWithOptions(oldHTML, oldHTML, "tester", DiffOptions{ElementIndexOnly: true, AnchorPaths: true}); err == nil {
+		t.Error("Expected ElementIndexOnly with AnchorPaths to be rejected on identical documents")
+	}
+}
+
+func TestDiffReplaceText(t *testing.T) {
+	oldHTML := `<p>The Old house stands</p>`
+	newHTML := `<p>The New house stands</p>`
+
+	delta, err := DiffWithOptions(oldHTML, newHTML, "tester", DiffOptions{ReplaceText: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(delta.Operations) != 1 {
+		t.Fatalf("Expected one op, got %v", delta.Operations)
+	}
+	if op := delta.Operations[0]; op.Type != OpReplaceText || op.Position != 4 || op.OldValue != "Old" || op.NewValue != "New" {
+		t.Errorf("Expected REPLACE_TEXT @4 \"Old\" -> \"New\", got %s", op)
+	}
+	for _, preserve := range []bool{false, true} {
+		patched, err := PatchWithOptions(oldHTML, delta, PatchOptions{PreserveSource: preserve})
+		if err != nil {
+			t.Fatalf("Patch failed (PreserveSource=%v): %v", preserve, err)
+		}
+		if !compareHTML(t, patched, newHTML) {
+			t.Errorf("Patched = %s (PreserveSource=%v)", patched, preserve)
+		}
+	}
+
+	// Text that is only added or only removed keeps its own op.
+	delta, _ = DiffWithOptions(oldHTML, `<p>The Old house</p>`, "tester", DiffOptions{ReplaceText: true})
+	if len(delta.Operations) != 1 || delta.Operations[0].Type != OpDeleteText {
+		t.Errorf("Expected a single DELETE_TEXT, got %v", delta.Operations)
+	}
+}
+
+func TestDiffTextSplitAroundInsert(t *testing.T) {
+	oldHTML := `<p>ab</p>`
+	newHTML := `<p>a<b>x</b>b</p>`
+	delta, err := Diff(oldHTML, newHTML, "tester")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []Operation{
+		{Type: OpSplitText, Path: NodePath{0, 1, 0, 0}, Position: 1},
+		{Type: OpInsertNode, Path: NodePath{0, 1, 0}, Position: 1, NodeData: `<b>x</b>`, ParentTag: "p"},
+	}
+	if !reflect.DeepEqual(delta.Operations, want) {
+		t.Errorf("Got %v, want %v", delta.Operations, want)
+	}
+
+	for _, c := range []struct{ oldHTML, newHTML string }{
+		{oldHTML, newHTML},
+		{`<p>ab</p>`, `<p>a<i>1</i><!-- c --><i>2</i>b</p>`},
+		{`<p>hello world</p>`, `<p>hello <img> world</p>`},
+		{`<p>ab</p>`, `<p>a<b>x</b>bc</p>`},
+		{`<p>Some  text here</p>`, `<p>Some  <b>text</b> here</p>`},
+		{`<p>one <em>x</em> two three</p>`, `<p>one <em>x</em> two <br>three</p>`},
+	} {
+		delta, err := Diff(c.oldHTML, c.newHTML, "tester")
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, op := range delta.Operations {
+			if op.Type == OpDeleteText || (op.Type == OpInsertNode && !strings.HasPrefix(op.NodeData, "<")) {
+				t.Errorf("%s -> %s: text re-inserted instead of split: %v", c.oldHTML, c.newHTML, delta.Operations)
+				break
+			}
+		}
+		for _, preserve := range []bool{false, true} {
+			patched, err := PatchWithOptions(c.oldHTML, delta, PatchOptions{PreserveSource: preserve})
+			if err != nil {
+				t.Fatalf("%s -> %s (PreserveSource=%v): %v", c.oldHTML, c.newHTML, preserve, err)
+			}
+			if !compareHTML(t, patched, c.newHTML) {
+				t.Errorf("%s -> %s (PreserveSource=%v): got %s", c.oldHTML, c.newHTML, preserve, patched)
+			}
+		}
+	}
+
+	// The tail keeps its identity, so a concurrent edit of it merges.
+	edit, _ := Diff(oldHTML, `<p>abc</p>`, "B")
+	merged, _, conflicts, err := Merge(oldHTML, delta, edit)
+	if err != nil || len(conflicts) > 0 {
+		t.Fatalf("Merge failed: %v %v", err, conflicts)
+	}
+	if !compareHTML(t, merged, `<p>a<b>x</b>bc</p>`) {
+		t.Errorf("Merged = %s", merged)
+	}
+}
+
+func TestDiffIdentityFunc(t *testing.T) {
+	base := `<ul><li>Apple</li><li>Banana</li><li>Cherry</li></ul>`
+	edited := `<ul><li>Cherry</li><li>Apple</li><li>Banana!</li></ul>`
+	oldDoc, _ := ParseHTML(base)
+	newDoc, _ := ParseHTML(edited)
+
+	// The caller tracks its items by UUID outside the markup.
+	ids := make(map[*html.Node]string)
+	label := func(doc *html.Node, uuids ...string) {
+		ul, err := QuerySelector(doc, "ul")
+		if err != nil {
+			t.Fatal(err)
+		}
+		for li, i := ul.FirstChild, 0; li != nil; li, i = li.NextSibling, i+1 {
+			ids[li] = uuids[i]
+		}
+	}
+	label(oldDoc, "apple", "banana", "cherry")
+	label(newDoc, "cherry", "apple", "banana")
+
+	// Positional matching edits every item's text in place.
+	plain, err := DiffNodes(oldDoc, newDoc, DiffOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, op := range plain {
+		if op.Type == OpInsertNode || op.Type == OpDeleteNode {
+			t.Fatalf("Expected in-place edits without hints, got %v", plain)
+		}
+	}
+
+	ops, err := DiffNodes(oldDoc, newDoc, DiffOptions{IdentityFunc: func(n *html.Node) string { return ids[n] }})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []Operation{
+		{Type: OpInsertText, Path: NodePath{0, 1, 0, 1, 0}, Position: 6, NewValue: "!"},
+		{Type: OpDeleteNode, Path: NodePath{0, 1, 0, 2}},
+		{Type: OpInsertNode, Path: NodePath{0, 1, 0}, Position: 0, NodeData: "<li>Cherry</li>", ParentTag: "ul"},
+	}
+	if !reflect.DeepEqual(ops, want) {
+		t.Errorf("ops = %v\nwant  %v", ops, want)
+	}
+
+	patched, err := Patch(base, &Delta{BaseHash: hashString(base), Operations: ops})
+	if err != nil {
+		t.Fatalf("Patch failed: %v", err)
+	}
+	if !compareHTML(t, patched, edited) {
+		t.Errorf("Patched = %s", patched)
+	}
+}
+
+func TestDiffIdenticalIsEmpty(t *testing.T) {
+	doc := `<div id="x"><p>Same</p></div>`
+	for _, root := range []PathRoot{PathRootDocument, PathRootBody, PathRootFragment} {
+		delta, err := DiffWithOptions(doc, doc, "A", DiffOptions{Root: root})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !delta.IsEmpty() || delta.BaseHash != hashString(doc) || delta.Root != root {
+			t.Errorf("Root %q: expected an empty delta on the base, got %+v", root, delta)
+		}
+		patched, err := Patch(doc, delta)
+		if err != nil || !compareHTML(t, patched, doc) {
+			t.Errorf("Root %q: empty delta patched to %s (%v)", root, patched, err)
+		}
+	}
+
+	changed, _ := Diff(doc, `<div id="x"><p>Other</p></div>`, "A")
+	if changed.IsEmpty() {
+		t.Error("Delta with ops reported empty")
+	}
+	var none *Delta
+	if !none.IsEmpty() {
+		t.Error("nil delta should be empty")
+	}
+}
+
+func TestDiffBestBase(t *testing.T) {
+	edited := `<ul><li>one</li><li>two</li><li>three</li><li>four!</li></ul>`
+	candidates := []string{
+		`<p>An old draft</p>`,
+		`<ul><li>one</li><li>two</li><li>three</li><li>four</li></ul>`,
+	}
+
+	delta, index, err := DiffBestBase(candidates, edited, "A")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if index != 1 || len(delta.Operations) != 1 || delta.Author != "A" {
+		t.Fatalf("Expected the one-op delta on candidate 1, got candidate %d with %v", index, delta.Operations)
+	}
+	patched, err := Patch(candidates[index], delta)
+	if err != nil || !compareHTML(t, patched, edited) {
+		t.Errorf("Patched = %s (%v)", patched, err)
+	}
+
+	// Equally good bases go to the first.
+	if _, index, _ := DiffBestBase([]string{candidates[1], candidates[1]}, edited, "A"); index != 0 {
+		t.Errorf("Expected the tie to go to candidate 0, got %d", index)
+	}
+	if _, _, err := DiffBestBase(nil, edited, "A"); err == nil {
+		t.Error("Expected an error without candidates")
+	}
+}
+
+func TestDiffNoscriptAndConditionalComments(t *testing.T) {
+	cases := []struct{ base, edited string }{
+		// With scripting enabled, as ParseHTML parses, <noscript> holds its
+		// markup as one raw text node, edited like any text.
+		{`<p>a</p><noscript><p>Enable JS</p></noscript>`, `<p>a</p><noscript><p>Please enable JS</p></noscript>`},
+		{`<html><head><noscript><style>a{}</style></noscript></head><body></body></html>`, `<html><head><noscript><style>b{}</style></noscript></head><body></body></html>`},
+		// A conditional comment is a comment node and is replaced whole.
+		{`<p>a</p><!--[if IE]><p>Old IE</p><![endif]--><p>b</p>`, `<p>a</p><!--[if IE]><p>Upgrade IE</p><![endif]--><p>b</p>`},
+		{`<p>a</p><!-- note -->`, `<p>a</p><!-- revised note -->`},
+	}
+	for _, c := range cases {
+		delta, err := Diff(c.base, c.edited, "A")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if delta.IsEmpty() {
+			t.Errorf("%s: the edit was lost", c.edited)
+			continue
+		}
+		for _, opts := range []PatchOptions{{}, {PreserveSource: true}} {
+			patched, err := PatchWithOptions(c.base, delta, opts)
+			if err != nil {
+				t.Fatalf("%s: patch failed (PreserveSource=%v): %v", c.edited, opts.PreserveSource, err)
+			}
+			if !compareHTML(t, patched, c.edited) {
+				t.Errorf("%s: patched to %s (PreserveSource=%v)", c.edited, patched, opts.PreserveSource)
+			}
+		}
+	}
+}
+
+func TestDiffSnapshots(t *testing.T) {
+	page := func(body ...Snapshot) Snapshot {
+		return Snapshot{Tag: "HTML", Children: []Snapshot{{Tag: "HEAD"}, {Tag: "BODY", Children: body}}}
+	}
+	var item Snapshot
+	if err := json.Unmarshal([]byte(`{"tag":"P","attrs":{"id":"a"},"children":[{"text":"Hello"}]}`), &item); err != nil {
+		t.Fatal(err)
+	}
+	oldSnap := page(item)
+	newSnap := page(
+		Snapshot{Tag: "P", Attrs: map[string]string{"id": "a", "title": "lead"}, Children: []Snapshot{{Text: "Hello world"}}},
+		Snapshot{Comment: true, Text: " note "},
+	)
+
+	delta, err := DiffSnapshots(oldSnap, newSnap, "tester", DiffOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []Operation{
+		{Type: OpUpdateAttr, Path: NodePath{0, 1, 0}, Key: "title", NewValue: "lead", Added: true},
+		{Type: OpInsertText, Path: NodePath{0, 1, 0, 0}, Position: 5, NewValue: " world"},
+		{Type: OpInsertNode, Path: NodePath{0, 1}, Position: 1, NodeData: "<!-- note -->", ParentTag: "body"},
+	}
+	if !reflect.DeepEqual(delta.Operations, want) {
+		t.Fatalf("got %v, want %v", delta.Operations, want)
+	}
+
+	base, err := SnapshotHTML(oldSnap, PathRootDocument)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if base != `<html><head></head><body><p id="a">Hello</p></body></html>` {
+		t.Errorf("Unexpected base %s", base)
+	}
+	expected, _ := SnapshotHTML(newSnap, PathRootDocument)
+	if got, err := Patch(base, delta); err != nil || !compareHTML(t, got, expected) {
+		t.Errorf("Patch: got %s, %v", got, err)
+	}
+}
+
+func TestDiffElementIndexOnly(t *testing.T) {
+	base := "<ul>\n  <li>One</li>\n  <li>Two</li>\n  <li>Three</li>\n</ul>"
+	edited := "<ul>\n  <li>One</li>\n  <li>Two too</li>\n  <li>Three</li>\n  <li>Four</li>\n</ul>"
+	delta, err := DiffWithOptions(base, edited, "tester", DiffOptions{Root: PathRootBody, ElementIndexOnly: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !delta.ElementIndex {
+		t.Error("Expected the delta to record element indexing")
+	}
+	want := []Operation{
+		{Type: OpInsertText, Path: NodePath{0, 1, 0}, Position: 3, NewValue: " too"},
+		{Type: OpInsertNode, Path: NodePath{0}, Position: 3, NodeData: "<li>Four</li>", ParentTag: "ul"},
+	}
+	if !reflect.DeepEqual(delta.Operations, want) {
+		t.Fatalf("got %v, want %v", delta.Operations, want)
+	}
+	got, err := Patch(base, delta)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "<ul>\n  <li>One</li>\n  <li>Two too</li>\n  <li>Three</li>\n<li>Four</li></ul>"; !strings.Contains(got, want) {
+		t.Errorf("Patch: got %s", got)
+	}
+	if source, err := PatchWithOptions(base, delta, PatchOptions{PreserveSource: true}); err != nil || !compareHTML(t, source, got) {
+		t.Errorf("PreserveSource: got %s, %v", source, err)
+	}
+
+	// A concurrent element-indexed delete merges with it.
+	removal := &Delta{BaseHash: delta.BaseHash, Root: PathRootBody, ElementIndex: true, Operations: []Operation{
+		{Type: OpDeleteNode, Path: NodePath{0, 0}},
+	}}
+	merged, _, conflicts, err := Merge(base, delta, removal)
+	if err != nil || len(conflicts) != 0 {
+		t.Fatalf("Merge: %v, %v", conflicts, err)
+	}
+	if !strings.Contains(merged, "<li>Two too</li>\n  <li>Three</li>\n<li>Four</li></ul>") || strings.Contains(merged, "One") {
+		t.Errorf("Merged: got %s", merged)
+	}
+	if _, _, _, err := Merge(base, delta, &Delta{BaseHash: delta.BaseHash, Root: PathRootBody, Operations: removal.Operations}); err == nil {
+		t.Error("Expected an error merging element-indexed and raw deltas")
+	}
+}
+
+func TestDiffWarnings(t *testing.T) {
+	var warnings []string
+	opts := DiffOptions{
+		IgnoreAttrs: []string{"data-v-*"},
+		OnWarning: func(path NodePath, message string) {
+			warnings = append(warnings, path.String()+": "+message)
+		},
+	}
+	base := `<p title="x" hidden data-v-1="a">Hi</p>`
+	edited := `<p data-v-1="b">Hi</p>`
+	delta, err := DiffWithOptions(base, edited, "tester", opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(delta.Operations) != 2 {
+		t.Fatalf("Expected two removals, got %v", delta.Operations)
+	}
+	sort.Strings(warnings)
+	want := []string{
+		`[0,1,0]: attribute "title" removal is sent as UPDATE_ATTR with removed set; clients that ignore it set the value to ""`,
+		`[0,1,0]: change to ignored attribute "data-v-1" is left out`,
+	}
+	if !reflect.DeepEqual(warnings, want) {
+		t.Errorf("got %q, want %q", warnings, want)
+	}
+
+	warnings = nil
+	if _, err := DiffWithOptions(base, base+" ", "tester", opts); err != nil || warnings != nil {
+		t.Errorf("Expected no warnings, got %q, %v", warnings, err)
+	}
+}
+
+func TestDiffDetectAttrMoves(t *testing.T) {
+	base := `<div id="main">A</div><div>B</div><div>C</div>`
+	moved := `<div>A</div><div id="main">B</div><div>C</div>`
+	// The default matching pairs by id, so a moving id needs elements
+	// paired by tag alone.
+	byTag := func(a, b *html.Node) bool {
+		if a.Type == html.ElementNode && b.Type == html.ElementNode {
+			return a.Data == b.Data
+		}
+		return DefaultNodeEqual(a, b)
+	}
+	opts := DiffOptions{DetectAttrMoves: true, NodeEqual: byTag}
+	parse := func(content string) *html.Node {
+		doc, err := ParseHTML(content)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return doc
+	}
+	delta, err := DiffWithOptions(base, moved, "A", opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(delta.Operations) != 2 {
+		t.Fatalf("Expected a removal and an addition, got %v", delta.Operations)
+	}
+	var removal, addition Operation
+	for _, op := range delta.Operations {
+		if op.Removed {
+			removal = op
+		} else {
+			addition = op
+		}
+	}
+	if removal.Key != "id" || removal.OldValue != "main" || !pathEqual(removal.Path, NodePath{0, 1, 0}) {
+		t.Errorf("Unexpected removal %+v", removal)
+	}
+	if addition.Key != "id" || addition.NewValue != "main" || !addition.Added || !pathEqual(addition.Path, NodePath{0, 1, 1}) {
+		t.Errorf("Unexpected addition %+v", addition)
+	}
+	if !pathEqual(addition.MovedFrom, removal.Path) || removal.MovedFrom != nil {
+		t.Errorf("Expected the addition to come from %v, got %v", removal.Path, addition.MovedFrom)
+	}
+	got, err := Patch(base, delta)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !compareHTML(t, got, `<html><head></head><body>`+moved+`</body></html>`) {
+		t.Errorf("got %s", got)
+	}
+	if plain, _ := Diff(base, moved, "A"); plain.Operations[0].MovedFrom != nil || plain.Operations[1].MovedFrom != nil {
+		t.Errorf("Expected no moves without DetectAttrMoves, got %v", plain.Operations)
+	}
+
+	// Both users moving the id, to different elements, conflict.
+	other, err := DiffWithOptions(base, `<div>A</div><div>B</div><div id="main">C</div>`, "B", opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _, conflicts, err := Merge(base, delta, other)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(conflicts) != 1 || conflicts[0].Type != ConflictDirect {
+		t.Errorf("Expected one conflict, got %v", conflicts)
+	}
+
+	// With the default matching, attributes other than the id move too. The
+	// source is addressed after the insert before it, as the addition sees it.
+	nav := `<div><a aria-current="page">1</a></div><div><a>2</a></div>`
+	current, err := DiffWithOptions(nav, `<div><p>0</p><a>1</a></div><div><a aria-current="page">2</a></div>`, "A", DiffOptions{DetectAttrMoves: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	added := current.Operations[len(current.Operations)-1]
+	if added.NewValue != "page" || !pathEqual(added.MovedFrom, NodePath{0, 1, 0, 1}) {
+		t.Fatalf("Unexpected addition %+v in %v", added, current.Operations)
+	}
+	if err := CheckPathConsistency(current); err != nil {
+		t.Error(err)
+	}
+
+	// A concurrent insert before the source element shifts moved_from like
+	// the op's path.
+	concurrent, err := Diff(base, `<p>new</p>`+base, "B")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, mergedDelta, conflicts, err := Merge(base, concurrent, delta)
+	if err != nil || len(conflicts) > 0 {
+		t.Fatalf("Merge failed: %v %v", err, conflicts)
+	}
+	last := mergedDelta.Operations[len(mergedDelta.Operations)-1]
+	if !pathEqual(last.MovedFrom, NodePath{0, 1, 1}) {
+		t.Errorf("Expected moved_from to follow the source element, got %+v", last)
+	}
+
+	// Anchored paths resolve moved_from from the same anchor.
+	wrapped := `<section id="s">` + base + `</section>`
+	anchored, err := DiffWithOptions(wrapped, `<section id="s">`+moved+`</section>`, "A", DiffOptions{DetectAttrMoves: true, NodeEqual: byTag, AnchorPaths: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The anchored delta applies to a page whose outer structure changed.
+	doc := parse(`<header>h</header>` + wrapped)
+	for _, op := range anchored.Operations {
+		if op.MovedFrom == nil {
+			continue
+		}
+		resolved, err := resolveAnchor(doc, op)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if from, _ := GetNode(doc, resolved.MovedFrom); from == nil || getAttr(from, "id") != "main" {
+			t.Errorf("Anchored moved_from %v (anchor %q) does not resolve to the source", op.MovedFrom, op.Anchor)
+		}
+	}
+}
+
+func TestDiffStreaming(t *testing.T) {
+	page := func(body string) string {
+		return "<!DOCTYPE html>\n<html><head><title>Log</title></head>\n<body>\n" + body + "\n</body></html>\n"
+	}
+	for _, tc := range []struct {
+		name     string
+		root     PathRoot
+		old, new string
+		streamed bool
+	}{
+		{"append entry", "", page(`<ul id="log"><li>one</li></ul>`), page(`<ul id="log"><li>one</li><li>two</li></ul>`), true},
+		{"append several", "", page("<div>\n<p>a</p>\n</div>"), page("<div>\n<p>a</p>\n<p>b</p>\n<p>c <b>d</b></p>\n</div>"), true},
+		{"insert in the middle", "", page("<p>a</p><p>c</p>"), page("<p>a</p><p>b</p><p>c</p>"), true},
+		{"append at end of file", "", `<html><head></head><body><p>a</p>`, `<html><head></head><body><p>a</p><p>b</p>`, true},
+		{"table row", "", page(`<table><tbody><tr><td>1</td></tr></tbody></table>`), page(`<table><tbody><tr><td>1</td></tr><tr><td>2</td></tr></tbody></table>`), true},
+		{"body root", PathRootBody, page(`<ol><li>a</li></ol>`), page(`<ol><li>a</li><li>b</li></ol>`), true},
+		{"fragment", PathRootFragment, `<p>a</p>`, `<p>a</p><p>b</p>`, true},
+		{"text edit", "", page(`<p>aa</p>`), page(`<p>aaa</p>`), false},
+		{"text joining text", "", page(`<p>a<br>b</p>`), page(`<p>a<br>b c</p>`), false},
+		{"implied tbody", "", page(`<table><tr><td>1</td></tr></table>`), page(`<table><tr><td>1</td></tr><tr><td>2</td></tr></table>`), false},
+		{"unclosed paragraph", "", page(`<p>a<p>b`), page(`<p>a<p>b<p>c`), false},
+		{"div in paragraph", "", page(`<p>a</p>`), page(`<p>a<div>b</div></p>`), false},
+		{"no head", "", `<p>a</p>`, `<p>a</p><p>b</p>`, false},
+		{"removal", "", page(`<p>a</p><p>b</p>`), page(`<p>a</p>`), false},
+		{"misnested later", "", page(`<div><p>a</p></div><b><i>x</b></i>`), page(`<div><p>a</p><p>b</p></div><b><i>x</b></i>`), false},
+	} {
+		_, streamed := streamInserts(tc.old, tc.new, tc.root)
+		if streamed != tc.streamed {
+			t.Errorf("%s: streamed = %v, want %v", tc.name, streamed, tc.streamed)
+		}
+		delta, err := DiffWithOptions(tc.old, tc.new, "tester", DiffOptions{Streaming: true, Root: tc.root})
+		if err != nil {
+			t.Fatalf("%s: %v", tc.name, err)
+		}
+		got, err := Patch(tc.old, delta)
+		if err != nil {
+			t.Fatalf("%s: patch: %v", tc.name, err)
+		}
+		newDoc, _ := parseForRoot(tc.new, tc.root)
+		want, _ := renderForRoot(newDoc, tc.root)
+		if got != want {
+			t.Errorf("%s: got %s, want %s", tc.name, got, want)
+		}
+	}
+}
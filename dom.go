@@ -4,9 +4,12 @@ import (
 	"bytes"
 	"errors"
 	"fmt"
+	"strconv"
 	"strings"
+	"unicode/utf8"
 
 	"golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
 )
 
 // ParseHTML parses a string into an HTML node tree.
@@ -21,6 +24,62 @@ func ParseHTML(content string) (*html.Node, error) {
 	return html.Parse(strings.NewReader(content))
 }
 
+// ParseFragment parses an HTML fragment in a <body> context and returns a
+// virtual root element whose children are the fragment's top-level nodes, so
+// paths to them start at [0] rather than under html/body.
+func ParseFragment(content string) (*html.Node, error) {
+	root := &html.Node{Type: html.ElementNode, Data: "body", DataAtom: atom.Body}
+	nodes, err := html.ParseFragment(strings.NewReader(content), root)
+	if err != nil {
+		return nil, err
+	}
+	for _, n := range nodes {
+		root.AppendChild(n)
+	}
+	return root, nil
+}
+
+// RenderFragment renders the children of a root returned by ParseFragment.
+func RenderFragment(root *html.Node) (string, error) {
+	var buf bytes.Buffer
+	for c := root.FirstChild; c != nil; c = c.NextSibling {
+		if err := html.Render(&buf, c); err != nil {
+			return "", err
+		}
+	}
+	return buf.String(), nil
+}
+
+// parseForRoot parses content as a fragment for PathRootFragment deltas and
+// as a full document otherwise.
+func parseForRoot(content string, root PathRoot) (*html.Node, error) {
+	if root == PathRootFragment {
+		return ParseFragment(content)
+	}
+	return ParseHTML(content)
+}
+
+// renderForRoot is the inverse of parseForRoot.
+func renderForRoot(doc *html.Node, root PathRoot) (string, error) {
+	return renderForRootWith(doc, root, RenderOptions{})
+}
+
+// renderForRootWith is renderForRoot writing text as opts says.
+func renderForRootWith(doc *html.Node, root PathRoot, opts RenderOptions) (string, error) {
+	if root == PathRootFragment && doc.Type != html.DocumentNode {
+		var buf strings.Builder
+		for c := doc.FirstChild; c != nil; c = c.NextSibling {
+			s, err := RenderNodeWithOptions(c, opts)
+			if err != nil {
+				return "", err
+			}
+			buf.WriteString(s)
+		}
+		return buf.String(), nil
+	}
+	return RenderNodeWithOptions(doc, opts)
+}
+
 // RenderNode converts a node tree back to a string.
 func RenderNode(n *html.Node) (string, error) {
 	var buf bytes.Buffer
@@ -30,9 +89,113 @@ func RenderNode(n *html.Node) (string, error) {
 	return buf.String(), nil
 }
 
+// RenderOptions customizes how text is written by RenderNodeWithOptions. Both
+// hooks apply only to text html.Render escapes, not to the contents of
+// <script>, <style> and other raw text elements.
+type RenderOptions struct {
+	// RawText reports the text nodes to write exactly as they are, such as
+	// those holding template placeholders ({{ a && b }}) that escaping would
+	// alter. The text must not contain markup it isn't meant to produce.
+	RawText func(n *html.Node) bool
+	// EscapeText, if set, escapes the other text nodes in place of
+	// html.Render, which escapes & ' < > " and carriage returns.
+	EscapeText func(text string) string
+}
+
+// RenderNodeWithOptions is RenderNode with the text escaping set by opts.
+func RenderNodeWithOptions(n *html.Node, opts RenderOptions) (string, error) {
+	if opts.RawText == nil && opts.EscapeText == nil {
+		return RenderNode(n)
+	}
+
+	// Custom text is swapped for markers html.Render leaves alone, which are
+	// replaced by the text once rendered. The markers use a private-use rune
+	// found nowhere in the tree.
+	sentinel := unusedRune(n)
+	var texts []*html.Node
+	var saved, replacements []string
+	var collect func(n *html.Node)
+	collect = func(n *html.Node) {
+		if n.Type == html.TextNode && (n.Parent == nil || n.Parent.Type != html.ElementNode || !rawTextElements[n.Parent.Data]) {
+			text := n.Data
+			// html.Render writes an extra newline before a <pre>'s leading
+			// one, so keep that in the node.
+			prefix := ""
+			if strings.HasPrefix(text, "\n") && n.Parent != nil && n.Parent.FirstChild == n {
+				prefix = "\n"
+			}
+			var out string
+			switch {
+			case opts.RawText != nil && opts.RawText(n):
+				out = text[len(prefix):]
+			case opts.EscapeText != nil:
+				out = opts.EscapeText(text[len(prefix):])
+			default:
+				return
+			}
+			texts, saved = append(texts, n), append(saved, text)
+			n.Data = prefix + string(sentinel) + strconv.Itoa(len(replacements)) + string(sentinel)
+			replacements = append(replacements, out)
+			return
+		}
+		for c := n.FirstChild; c != nil; c = c.NextSibling {
+			collect(c)
+		}
+	}
+	collect(n)
+	defer func() {
+		for i, t := range texts {
+			t.Data = saved[i]
+		}
+	}()
+
+	rendered, err := RenderNode(n)
+	if err != nil {
+		return "", err
+	}
+	pairs := make([]string, 0, 2*len(replacements))
+	for i, out := range replacements {
+		pairs = append(pairs, string(sentinel)+strconv.Itoa(i)+string(sentinel), out)
+	}
+	return strings.NewReplacer(pairs...).Replace(rendered), nil
+}
+
+// unusedRune returns the first private-use rune that appears in no text,
+// comment or attribute under n.
+func unusedRune(n *html.Node) rune {
+	used := make(map[rune]bool)
+	var walk func(n *html.Node)
+	walk = func(n *html.Node) {
+		note := func(s string) {
+			for _, r := range s {
+				if r >= 0xE000 && r <= 0xF8FF {
+					used[r] = true
+				}
+			}
+		}
+		note(n.Data)
+		for _, a := range n.Attr {
+			note(a.Val)
+		}
+		for c := n.FirstChild; c != nil; c = c.NextSibling {
+			walk(c)
+		}
+	}
+	walk(n)
+	r := rune(0xE000)
+	for used[r] {
+		r++
+	}
+	return r
+}
+
 // GetNode traverses the tree using the provided path to find a specific node.
 // The path indices generally refer to element/text nodes in the Child traversal.
+// An empty (or nil) path addresses root itself.
 func GetNode(root *html.Node, path NodePath) (*html.Node, error) {
+	if len(path) == 0 {
+		return root, nil
+	}
 	current := root
 	for i, index := range path {
 		// Find the child at 'index'
@@ -45,6 +208,56 @@ func GetNode(root *html.Node, path NodePath) (*html.Node, error) {
 	return current, nil
 }
 
+// RootElement returns the document element (<html>) of a parsed document
+// together with its path. The document node itself is skipped, since all
+// content lives under the <html> element.
+func RootElement(doc *html.Node) (*html.Node, NodePath, error) {
+	index := 0
+	for c := doc.FirstChild; c != nil; c = c.NextSibling {
+		if c.Type == html.ElementNode {
+			return c, NodePath{index}, nil
+		}
+		index++
+	}
+	return nil, nil, errors.New("document has no root element")
+}
+
+// BodyElement returns the <body> element of a parsed document together with
+// its path from the document node.
+func BodyElement(doc *html.Node) (*html.Node, NodePath, error) {
+	root, path, err := RootElement(doc)
+	if err != nil {
+		return nil, nil, err
+	}
+	index := 0
+	for c := root.FirstChild; c != nil; c = c.NextSibling {
+		if c.Type == html.ElementNode && c.Data == "body" {
+			return c, append(path, index), nil
+		}
+		index++
+	}
+	return nil, nil, errors.New("document has no body element")
+}
+
+// resolvePathRoot returns the node that paths relative to root start from.
+func resolvePathRoot(doc *html.Node, root PathRoot) (*html.Node, error) {
+	switch root {
+	case PathRootDocument:
+		return doc, nil
+	case PathRootBody:
+		body, _, err := BodyElement(doc)
+		return body, err
+	case PathRootFragment:
+		// A full document holds its top-level content in <body>.
+		if doc.Type == html.DocumentNode {
+			body, _, err := BodyElement(doc)
+			return body, err
+		}
+		return doc, nil
+	}
+	return nil, fmt.Errorf("unknown path root: %q", root)
+}
+
 // getChildAtIndex finds the Nth child of a node.
 // Note: html.Node's children are a linked list (FirstChild, NextSibling).
 func getChildAtIndex(parent *html.Node, index int) *html.Node {
@@ -93,3 +306,50 @@ func getChildIndex(parent, child *html.Node) int {
 	}
 	return -1
 }
+
+// maxPreview is the longest text preview Inspect returns before truncating.
+const maxPreview = 80
+
+// NodeInfo describes a node for debugging and tooling (see Inspect).
+type NodeInfo struct {
+	Type       html.NodeType
+	Tag        string           // Element tag name; empty for other nodes
+	Namespace  string           // "svg" or "math" for foreign elements
+	Attributes []html.Attribute // Element attributes, in source order
+	Text       string           // The node's text (its TextContent for elements), cut at maxPreview bytes with "…"
+	Children   int              // Number of child nodes
+}
+
+// Inspect parses baseHTML and describes the node at path (from the document
+// node, as in SourceOffset). It never modifies anything, so it suits
+// debuggers asking what an op's path points at.
+func Inspect(baseHTML string, path NodePath) (NodeInfo, error) {
+	doc, err := ParseHTML(baseHTML)
+	if err != nil {
+		return NodeInfo{}, err
+	}
+	n, err := GetNode(doc, path)
+	if err != nil {
+		return NodeInfo{}, err
+	}
+
+	info := NodeInfo{Type: n.Type, Children: len(getChildrenList(n))}
+	text := n.Data
+	if n.Type == html.ElementNode || n.Type == html.DocumentNode {
+		text = TextContent(n)
+	}
+	if n.Type == html.ElementNode {
+		info.Tag = n.Data
+		info.Namespace = n.Namespace
+		info.Attributes = append([]html.Attribute(nil), n.Attr...)
+	}
+	if len(text) > maxPreview {
+		cut := maxPreview
+		for cut > 0 && !utf8.RuneStart(text[cut]) {
+			cut--
+		}
+		text = text[:cut] + "…"
+	}
+	info.Text = text
+	return info, nil
+}
@@ -1,6 +1,8 @@
 package vchtml
 
 import (
+	"reflect"
+	"strings"
 	"testing"
 
 	"golang.org/x/net/html"
@@ -47,3 +49,194 @@ func TestPathing(t *testing.T) {
 		}
 	}
 }
+
+func TestRootElement(t *testing.T) {
+	doc, err := ParseHTML(`<div><p>Hello</p></div>`)
+	if err != nil {
+		t.Fatalf("Failed to parse HTML: %v", err)
+	}
+
+	node, path, err := RootElement(doc)
+	if err != nil {
+		t.Fatalf("RootElement failed: %v", err)
+	}
+	if node.Type != html.ElementNode || node.Data != "html" {
+		t.Errorf("Expected <html> element, got type=%d data=%q", node.Type, node.Data)
+	}
+	if len(path) != 1 || path[0] != 0 {
+		t.Errorf("Expected path [0], got %v", path)
+	}
+
+	// The returned path must resolve back to the same node.
+	resolved, err := GetNode(doc, path)
+	if err != nil {
+		t.Fatalf("GetNode failed: %v", err)
+	}
+	if resolved != node {
+		t.Errorf("GetNode(%v) did not return the root element", path)
+	}
+
+	// Empty path addresses the document itself.
+	self, err := GetNode(doc, NodePath{})
+	if err != nil || self != doc {
+		t.Errorf("GetNode with empty path should return root, got %v (err=%v)", self, err)
+	}
+}
+
+func TestPathFromSelector(t *testing.T) {
+	doc, err := ParseHTML(`<html><head></head><body><div id="other"><ul><li>x</li><li>y</li></ul></div>` +
+		`<div id="main"><p>Intro</p><ul class="list"><li>one</li>` + "\n" + `<li class="item">two</li><li>three</li></ul></div></body></html>`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	path, err := PathFromSelector(doc, "div#main > ul > li:nth-child(2)")
+	if err != nil {
+		t.Fatalf("PathFromSelector failed: %v", err)
+	}
+	// html > body > div#main (1) > ul (1) > second li, after a text node (2)
+	if !pathEqual(path, NodePath{0, 1, 1, 1, 2}) {
+		t.Errorf("Got %v", path)
+	}
+	node, _ := GetNode(doc, path)
+	if node.FirstChild.Data != "two" {
+		t.Errorf("Resolved the wrong node: %q", node.FirstChild.Data)
+	}
+
+	if p, err := PathFromSelector(doc, "body ul.list .item"); err != nil || !pathEqual(p, path) {
+		t.Errorf("Descendant selector: got %v %v", p, err)
+	}
+	if p, err := PathFromSelector(doc, `[id="main"] ul[class=list] > li[class]`); err != nil || !pathEqual(p, path) {
+		t.Errorf("Attribute selector: got %v %v", p, err)
+	}
+	// Spaces, ">" and "]" inside quoted attribute values are part of the value.
+	quoted, err := ParseHTML(`<p title="a b">1</p><p data-x="a>b">2</p><p data-y="[x]">3</p>`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for selector, want := range map[string]string{`p[title="a b"]`: "1", `body > [data-x="a>b"]`: "2", `p[data-y='[x]']`: "3"} {
+		if n, err := QuerySelector(quoted, selector); err != nil || n.FirstChild.Data != want {
+			t.Errorf("%s: got %v %v", selector, n, err)
+		}
+	}
+	for _, bad := range []string{"", "div >", "> li", "li:hover", "li:nth-child(0)", "div#nope", "div[id", "div[=x]", `p[title="a b]`} {
+		if _, err := PathFromSelector(doc, bad); err == nil {
+			t.Errorf("Expected an error for %q", bad)
+		}
+	}
+}
+
+func TestFindAll(t *testing.T) {
+	doc, err := ParseHTML(`<html><head></head><body><p><a href="/x">x</a> and <a target="_self">y</a></p>` +
+		`<div><span><a href="/z">z</a></span></div></body></html>`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	found := FindAll(doc, func(n *html.Node) bool { return n.Type == html.ElementNode && n.Data == "a" })
+	want := []NodePath{{0, 1, 0, 0}, {0, 1, 0, 2}, {0, 1, 1, 0, 0}}
+	if len(found) != len(want) {
+		t.Fatalf("Got %d matches, want %d", len(found), len(want))
+	}
+	for i, m := range found {
+		if !pathEqual(m.Path, want[i]) {
+			t.Errorf("Match %d: got path %v, want %v", i, m.Path, want[i])
+		}
+		if n, err := GetNode(doc, m.Path); err != nil || n != m.Node {
+			t.Errorf("Match %d: path %v does not resolve to the node: %v", i, m.Path, err)
+		}
+	}
+
+	// Walk skips the children of nodes fn declines to descend into.
+	var visited int
+	Walk(doc, func(n *html.Node, path NodePath) bool {
+		visited++
+		return n.Data != "p"
+	})
+	if all := len(FindAll(doc, func(*html.Node) bool { return true })); visited != all-5 {
+		t.Errorf("Walk visited %d nodes, want %d", visited, all-5)
+	}
+}
+
+func TestInspect(t *testing.T) {
+	base := `<div id="main" class="a"><p>Hello <b>world</b></p><!-- note --></div>`
+
+	// [0] html, [0,1] body, [0,1,0] div.
+	info, err := Inspect(base, NodePath{0, 1, 0})
+	if err != nil {
+		t.Fatalf("Inspect failed: %v", err)
+	}
+	if info.Type != html.ElementNode || info.Tag != "div" {
+		t.Errorf("Expected <div> element, got type=%d tag=%q", info.Type, info.Tag)
+	}
+	wantAttrs := []html.Attribute{{Key: "id", Val: "main"}, {Key: "class", Val: "a"}}
+	if !reflect.DeepEqual(info.Attributes, wantAttrs) {
+		t.Errorf("Attributes = %v, want %v", info.Attributes, wantAttrs)
+	}
+	if info.Text != "Hello world" || info.Children != 2 {
+		t.Errorf("Expected text %q with 2 children, got %q with %d", "Hello world", info.Text, info.Children)
+	}
+
+	comment, err := Inspect(base, NodePath{0, 1, 0, 1})
+	if err != nil {
+		t.Fatalf("Inspect failed: %v", err)
+	}
+	if comment.Type != html.CommentNode || comment.Tag != "" || comment.Text != " note " {
+		t.Errorf("Unexpected comment info: %+v", comment)
+	}
+
+	// Long text is cut on a rune boundary.
+	long, err := Inspect("<p>"+strings.Repeat("é", 100)+"</p>", NodePath{0, 1, 0, 0})
+	if err != nil {
+		t.Fatalf("Inspect failed: %v", err)
+	}
+	if long.Type != html.TextNode || long.Text != strings.Repeat("é", 40)+"…" {
+		t.Errorf("Unexpected preview %q", long.Text)
+	}
+
+	if _, err := Inspect(base, NodePath{0, 1, 5}); err == nil {
+		t.Error("Expected an error for a path that does not exist")
+	}
+}
+
+func TestRenderOptions(t *testing.T) {
+	const placeholder = `{{ name | default: "a & b" }}`
+	base := `<p>Hello ` + placeholder + `</p><p>Bye</p>`
+	doc, err := ParseHTML(base)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := RenderNode(doc); strings.Contains(got, placeholder) {
+		t.Fatalf("Expected default rendering to escape the placeholder, got %s", got)
+	}
+
+	templates := RenderOptions{RawText: func(n *html.Node) bool { return strings.Contains(n.Data, "{{") }}
+	got, err := RenderNodeWithOptions(doc, templates)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := `<html><head></head><body><p>Hello ` + placeholder + `</p><p>Bye</p></body></html>`; got != want {
+		t.Errorf("got %s, want %s", got, want)
+	}
+
+	// The placeholder survives a patch of the other paragraph.
+	delta, err := Diff(base, `<p>Hello `+placeholder+`</p><p>See you</p>`, "tester")
+	if err != nil {
+		t.Fatal(err)
+	}
+	patched, err := PatchWithOptions(base, delta, PatchOptions{Render: templates})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(patched, `<p>Hello `+placeholder+`</p><p>See you</p>`) {
+		t.Errorf("got %s", patched)
+	}
+
+	// A custom escaper replaces html.Render's; the newline html.Render
+	// doubles at the start of a <pre> is kept.
+	pre, _ := ParseHTML("<pre>\n\nx > y</pre>")
+	shout := RenderOptions{EscapeText: strings.ToUpper}
+	if got, _ := RenderNodeWithOptions(pre, shout); !strings.Contains(got, "<pre>\n\nX > Y</pre>") {
+		t.Errorf("got %q", got)
+	}
+}
@@ -0,0 +1,120 @@
+package vchtml
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"golang.org/x/net/html"
+)
+
+// preformattedElements keep their whitespace-only text as content.
+var preformattedElements = map[string]bool{"pre": true, "textarea": true, "listing": true}
+
+// indexedChild reports whether c takes an index among parent's children in an
+// element-indexed path (see DiffOptions.ElementIndexOnly). Whitespace-only
+// text is skipped, except where whitespace is content. Empty text, which
+// only a delete leaves behind, still counts.
+func indexedChild(parent, c *html.Node) bool {
+	if c.Type != html.TextNode || c.Data == "" || strings.Trim(c.Data, " \t\n\f\r") != "" {
+		return true
+	}
+	return parent.Type == html.ElementNode && (preformattedElements[parent.Data] || rawTextElements[parent.Data])
+}
+
+// stripWhitespace removes the children under n that indexedChild skips.
+func stripWhitespace(n *html.Node) {
+	for c := n.FirstChild; c != nil; {
+		next := c.NextSibling
+		if indexedChild(n, c) {
+			stripWhitespace(c)
+		} else {
+			n.RemoveChild(c)
+		}
+		c = next
+	}
+}
+
+// rawChildIndex returns the raw index of the child of parent with element
+// index index, and the child, leaving out skip as if it had been removed. An
+// index past the last child maps past the raw end by as much, so range checks
+// on the result still fail.
+func rawChildIndex(parent *html.Node, index int, skip *html.Node) (int, *html.Node) {
+	if index < 0 {
+		return index, nil
+	}
+	raw, counted := 0, 0
+	for c := parent.FirstChild; c != nil; c = c.NextSibling {
+		if c == skip {
+			continue
+		}
+		if indexedChild(parent, c) {
+			if counted == index {
+				return raw, c
+			}
+			counted++
+		}
+		raw++
+	}
+	return raw + index - counted, nil
+}
+
+// rawPath converts the element-indexed path under root to raw child indices,
+// leaving out skip, and returns the node it addresses.
+func rawPath(root *html.Node, path NodePath, skip *html.Node) (NodePath, *html.Node, error) {
+	out := make(NodePath, len(path))
+	n := root
+	for i, index := range path {
+		raw, c := rawChildIndex(n, index, skip)
+		if c == nil {
+			return nil, nil, fmt.Errorf("node not found at element path %v (failed at index %d, step %d)", path, index, i)
+		}
+		out[i] = raw
+		n = c
+	}
+	return out, n, nil
+}
+
+// rawIndices rewrites the element-indexed paths (including MovedFrom) and
+// child positions of op for the tree under root as it is now. MOVE_NODE's destination is converted
+// as if the moved node were already removed, matching how it is resolved.
+func rawIndices(root *html.Node, op Operation) (Operation, error) {
+	if op.Anchor != "" {
+		return op, errors.New("anchored ops cannot use element indices")
+	}
+	path, node, err := rawPath(root, op.Path, nil)
+	if err != nil {
+		return op, err
+	}
+	op.Path = path
+	if op.MovedFrom != nil {
+		// An annotation: if it doesn't resolve, it is dropped.
+		from, _, err := rawPath(root, op.MovedFrom, nil)
+		if err != nil {
+			from = nil
+		}
+		op.MovedFrom = from
+	}
+	switch {
+	case op.Type == OpInsertNode && op.Placement == PlaceAtIndex:
+		op.Position, _ = rawChildIndex(node, op.Position, nil)
+	case op.Type == OpMoveNode:
+		to, parent, err := rawPath(root, op.To, node)
+		if err != nil {
+			return op, fmt.Errorf("destination: %w", err)
+		}
+		op.To = to
+		op.Position, _ = rawChildIndex(parent, op.Position, node)
+	}
+	return op, nil
+}
+
+// resolveOp returns op from d with paths from root in raw child indices:
+// converted from element indices for an element-indexed delta, and from its
+// anchor otherwise.
+func resolveOp(root *html.Node, d *Delta, op Operation) (Operation, error) {
+	if d.ElementIndex {
+		return rawIndices(root, op)
+	}
+	return resolveAnchor(root, op)
+}
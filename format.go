@@ -0,0 +1,127 @@
+package vchtml
+
+import (
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// maxFormatValue is the longest value String prints before truncating it.
+const maxFormatValue = 60
+
+// String returns a compact, human-readable form of op for logs and debugging,
+// such as `UPDATE_TEXT [0,1,0] "old" -> "new"`.
+func (op Operation) String() string {
+	var b strings.Builder
+	b.WriteString(string(op.Type))
+	b.WriteByte(' ')
+	if op.Anchor != "" {
+		b.WriteString("#" + op.Anchor)
+	}
+	b.WriteString(op.Path.String())
+
+	key := op.Key
+	if op.SubKey != "" {
+		key += "." + op.SubKey
+	}
+	switch op.Type {
+	case OpUpdateText:
+		fmt.Fprintf(&b, " %s -> %s", quoteValue(op.OldValue), quoteValue(op.NewValue))
+	case OpInsertText:
+		fmt.Fprintf(&b, " @%d %s", op.Position, quoteValue(op.NewValue))
+	case OpDeleteText:
+		fmt.Fprintf(&b, " @%d %s", op.Position, quoteValue(op.OldValue))
+	case OpReplaceText:
+		fmt.Fprintf(&b, " @%d %s -> %s", op.Position, quoteValue(op.OldValue), quoteValue(op.NewValue))
+	case OpSplitText:
+		fmt.Fprintf(&b, " @%d", op.Position)
+	case OpUpdateAttr:
+		if op.Removed {
+			fmt.Fprintf(&b, " %s %s -> (removed)", key, quoteValue(op.OldValue))
+		} else if op.Added {
+			fmt.Fprintf(&b, " %s (absent) -> %s", key, quoteValue(op.NewValue))
+		} else {
+			fmt.Fprintf(&b, " %s %s -> %s", key, quoteValue(op.OldValue), quoteValue(op.NewValue))
+		}
+		if op.MovedFrom != nil {
+			fmt.Fprintf(&b, " (moved from %s)", op.MovedFrom)
+		}
+	case OpInsertAttrText:
+		fmt.Fprintf(&b, " %s @%d %s", key, op.Position, quoteValue(op.NewValue))
+	case OpDeleteAttrText:
+		fmt.Fprintf(&b, " %s @%d %s", key, op.Position, quoteValue(op.OldValue))
+	case OpDeleteAttr:
+		fmt.Fprintf(&b, " %s %s", key, quoteValue(op.OldValue))
+	case OpAddClass, OpRemoveClass:
+		fmt.Fprintf(&b, " %s", quoteValue(classToken(op)))
+	case OpInsertNode:
+		if op.Placement != PlaceAtIndex {
+			fmt.Fprintf(&b, " %s %s", op.Placement, quoteValue(op.NodeData))
+		} else {
+			fmt.Fprintf(&b, " @%d %s", op.Position, quoteValue(op.NodeData))
+		}
+		if op.OrderKey != "" {
+			fmt.Fprintf(&b, " key=%s", op.OrderKey)
+		}
+	case OpWrapNode:
+		fmt.Fprintf(&b, " %s", quoteValue(op.NodeData))
+	case OpMoveNode:
+		fmt.Fprintf(&b, " -> %s @%d", op.To, op.Position)
+	case OpChangeTag:
+		fmt.Fprintf(&b, " %s -> %s", op.OldValue, op.NewValue)
+	}
+	return b.String()
+}
+
+// String formats p as a comma-separated index list, e.g. [0,1,3].
+func (p NodePath) String() string {
+	parts := make([]string, len(p))
+	for i, index := range p {
+		parts[i] = strconv.Itoa(index)
+	}
+	return "[" + strings.Join(parts, ",") + "]"
+}
+
+// String returns a header line describing d followed by one line per op, as
+// written by DumpDelta.
+func (d *Delta) String() string {
+	var b strings.Builder
+	DumpDelta(&b, d)
+	return b.String()
+}
+
+// DumpDelta writes a human-readable description of d to w: a header with
+// the delta's metadata, then each op on its own numbered line.
+func DumpDelta(w io.Writer, d *Delta) error {
+	base := d.BaseHash
+	if len(base) > 12 {
+		base = base[:12]
+	}
+	header := fmt.Sprintf("Delta base=%s author=%q ts=%d ops=%d", base, d.Author, d.Timestamp, len(d.Operations))
+	if d.Root != PathRootDocument {
+		header += " root=" + string(d.Root)
+	}
+	if _, err := fmt.Fprintln(w, header); err != nil {
+		return err
+	}
+	for i, op := range d.Operations {
+		if _, err := fmt.Fprintf(w, "  %d: %s\n", i, op); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// quoteValue quotes s, truncating long values so ops stay on one short line.
+func quoteValue(s string) string {
+	if len(s) <= maxFormatValue {
+		return strconv.Quote(s)
+	}
+	cut := maxFormatValue
+	for cut > 0 && !utf8.RuneStart(s[cut]) {
+		cut--
+	}
+	return strconv.Quote(s[:cut]) + fmt.Sprintf("...(%d bytes)", len(s))
+}
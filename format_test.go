@@ -0,0 +1,149 @@
+package vchtml
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestDumpDelta(t *testing.T) {
+	delta := &Delta{
+		BaseHash:  "0123456789abcdef0123",
+		Author:    "alice",
+		Timestamp: 42,
+		Operations: []Operation{
+			{Type: OpUpdateText, Path: NodePath{0, 1, 0}, OldValue: "old", NewValue: "new"},
+			{Type: OpInsertText, Path: NodePath{0, 1, 2, 0}, Position: 5, NewValue: " world"},
+			{Type: OpUpdateAttr, Path: NodePath{0, 1, 1}, Key: "class", OldValue: "a", Removed: true},
+			{Type: OpUpdateAttr, Path: NodePath{0, 1, 1}, Key: "style", SubKey: "color", OldValue: "red", NewValue: "blue"},
+			{Type: OpInsertNode, Path: NodePath{0, 1}, Position: 3, NodeData: "<li>" + strings.Repeat("x", 80) + "</li>"},
+			{Type: OpDeleteNode, Anchor: "main", Path: NodePath{2}},
+		},
+	}
+
+	var buf bytes.Buffer
+	if err := DumpDelta(&buf, delta); err != nil {
+		t.Fatal(err)
+	}
+	out := buf.String()
+	for _, line := range []string{
+		`Delta base=0123456789ab author="alice" ts=42 ops=6`,
+		`  0: UPDATE_TEXT [0,1,0] "old" -> "new"`,
+		`  1: INSERT_TEXT [0,1,2,0] @5 " world"`,
+		`  2: UPDATE_ATTR [0,1,1] class "a" -> (removed)`,
+		`  3: UPDATE_ATTR [0,1,1] style.color "red" -> "blue"`,
+		`  4: INSERT_NODE [0,1] @3 "<li>xxxx`,
+		`...(89 bytes)`,
+		`  5: DELETE_NODE #main[2]`,
+	} {
+		if !strings.Contains(out, line) {
+			t.Errorf("Dump is missing %q:\n%s", line, out)
+		}
+	}
+	if delta.String() != out {
+		t.Errorf("Delta.String() differs from DumpDelta output")
+	}
+}
+
+func TestChangeReport(t *testing.T) {
+	base := `<div id="main"><h1>Welcome</h1><p>Intro</p></div><aside id="side"><ul><li>One</li></ul></aside>`
+	edited := `<div id="main"><h1>Welcome back</h1><p>Intro</p><p>More</p></div><aside id="side" class="wide"><ul></ul></aside>`
+	delta, err := DiffWithOptions(base, edited, "tester", DiffOptions{Root: PathRootBody})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	report, err := ChangeReport(base, delta)
+	if err != nil {
+		t.Fatalf("ChangeReport failed: %v", err)
+	}
+	want := []ElementChange{
+		{Element: "div#main", Path: NodePath{0}, Changes: []string{`inserted " back"`, `added <p>`}},
+		{Element: "aside#side", Path: NodePath{1}, Changes: []string{`set class to "wide"`, `removed <li>`}},
+	}
+	if len(report) != len(want) {
+		t.Fatalf("Expected %d groups, got %+v", len(want), report)
+	}
+	for i, group := range report {
+		if group.Element != want[i].Element || !pathEqual(group.Path, want[i].Path) {
+			t.Errorf("Group %d is %s %v, want %s %v", i, group.Element, group.Path, want[i].Element, want[i].Path)
+		}
+		if strings.Join(group.Changes, "; ") != strings.Join(want[i].Changes, "; ") {
+			t.Errorf("Group %d changes = %q, want %q", i, group.Changes, want[i].Changes)
+		}
+	}
+
+	// Without an id above it, a change is reported on its own element.
+	delta, _ = Diff(`<h1>Title</h1>`, `<h1>New title</h1>`, "tester")
+	report, err = ChangeReport(`<h1>Title</h1>`, delta)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report) != 1 || report[0].Element != "h1" {
+		t.Errorf("Expected one h1 group, got %+v", report)
+	}
+}
+
+func TestRenderVisualDiff(t *testing.T) {
+	cases := []struct {
+		name, base, edited, want string
+		opts                     DiffOptions
+	}{
+		{"inserted text", `<p>Hello world</p>`, `<p>Hello brave world</p>`, `<p>Hello <ins>brave </ins>world</p>`, DiffOptions{}},
+		{"replaced text", `<p>Hello world</p>`, `<p>Hello there</p>`, `<p>Hello <del>world</del><ins>there</ins></p>`, DiffOptions{ReplaceText: true}},
+		{"whole characters", `<p>café</p>`, `<p>cafè</p>`, `<p>caf<del>é</del><ins>è</ins></p>`, DiffOptions{}},
+		{"inserted element", `<p>ab</p>`, `<p>a<b>x</b>b</p>`, `<p>a<ins><b>x</b></ins>b</p>`, DiffOptions{}},
+		{"deleted element", `<div><p>a</p><hr><p>b</p></div>`, `<div><p>a</p><p>b</p></div>`, `<div><p>a</p><del><hr/></del><p>b</p></div>`, DiffOptions{}},
+		{"list items", `<ul><li>a</li></ul><ol></ol>`, `<ul></ul><ol><li>a</li></ol>`, `<ul><li><del>a</del></li></ul><ol><li><ins>a</ins></li></ol>`, DiffOptions{DetectMoves: true}},
+		{"table row", `<table><tr><td>1</td></tr><tr><td>2</td></tr></table>`, `<table><tr><td>1</td></tr></table>`, `<table><tbody><tr><td>1</td></tr><tr><td><del>2</del></td></tr></tbody></table>`, DiffOptions{}},
+		{"attribute", `<p class="a">x</p>`, `<p class="b">x</p>`, `<p class="b">x</p>`, DiffOptions{}},
+	}
+	for _, c := range cases {
+		d, err := DiffWithOptions(c.base, c.edited, "A", c.opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := RenderVisualDiff(c.base, d)
+		if err != nil {
+			t.Fatalf("%s: RenderVisualDiff failed: %v", c.name, err)
+		}
+		if !compareHTML(t, got, c.want) {
+			t.Errorf("%s: got %s, want %s", c.name, got, c.want)
+		}
+	}
+
+	// Deleted nodes stay in document order, whatever order they went in, and
+	// edits inside a node that is deleted later show its base content.
+	base := `<div><p>one</p><p>two</p><p>three</p></div>`
+	d := &Delta{BaseHash: hashString(base), Operations: []Operation{
+		{Type: OpInsertText, Path: NodePath{0, 1, 0, 1, 0}, Position: 3, NewValue: "!"},
+		{Type: OpDeleteNode, Path: NodePath{0, 1, 0, 2}},
+		{Type: OpDeleteNode, Path: NodePath{0, 1, 0, 1}},
+		{Type: OpInsertNode, Path: NodePath{0, 1, 0}, Position: 1, NodeData: "<p>new</p>"},
+	}}
+	got, err := RenderVisualDiff(base, d)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `<div><p>one</p><ins><p>new</p></ins><del><p>two</p></del><del><p>three</p></del></div>`
+	if !compareHTML(t, got, want) {
+		t.Errorf("got %s, want %s", got, want)
+	}
+
+	if _, err := RenderVisualDiff(`<p>other</p>`, d); err == nil {
+		t.Error("Expected a base hash mismatch")
+	}
+
+	// A text op whose context puts it elsewhere is marked where it applies.
+	base = `<p>Hello world</p>`
+	d = &Delta{BaseHash: hashString(base), Operations: []Operation{
+		{Type: OpInsertText, Path: NodePath{0, 1, 0, 0}, Position: 0, NewValue: "brave ", ContextBefore: "Hello ", ContextAfter: "world"},
+	}}
+	got, err = RenderVisualDiff(base, d)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := `<p>Hello <ins>brave </ins>world</p>`; !compareHTML(t, got, want) {
+		t.Errorf("got %s, want %s", got, want)
+	}
+}
@@ -3,3 +3,5 @@ module github.com/dannyswat/vchtml
 go 1.24.3
 
 require golang.org/x/net v0.49.0
+
+require golang.org/x/text v0.33.0
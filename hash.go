@@ -0,0 +1,84 @@
+package vchtml
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"hash"
+	"sort"
+
+	"golang.org/x/net/html"
+)
+
+// HashNode returns a structural hash of the subtree rooted at n. Two subtrees
+// hash equally when they have the same node types, tags, text, and attributes
+// (compared independently of attribute order) in the same child order.
+func HashNode(n *html.Node) string {
+	return hashSubtree(n, nil)
+}
+
+// TreeHash returns a Merkle-style hash for every node in the tree rooted at
+// root. A node's hash covers its entire subtree, so two trees can be compared
+// top-down, descending only into children whose hashes differ. Hashes are
+// stable across parse/render round-trips since attribute order is ignored.
+func TreeHash(root *html.Node) map[*html.Node]string {
+	hashes := make(map[*html.Node]string)
+	hashSubtree(root, hashes)
+	return hashes
+}
+
+// hashSubtree computes the hash of n, recording the hash of every node in the
+// subtree into cache when it is non-nil. Child hashes are reused from cache.
+func hashSubtree(n *html.Node, cache map[*html.Node]string) string {
+	if cache != nil {
+		if h, ok := cache[n]; ok {
+			return h
+		}
+	}
+
+	w := hashWriter{h: sha256.New()}
+	w.uint(uint64(n.Type))
+	w.string(n.Namespace)
+	w.string(n.Data)
+
+	// Attribute order carries no meaning, so hash them sorted.
+	attrs := append([]html.Attribute(nil), n.Attr...)
+	sort.Slice(attrs, func(i, j int) bool {
+		if attrs[i].Namespace != attrs[j].Namespace {
+			return attrs[i].Namespace < attrs[j].Namespace
+		}
+		return attrs[i].Key < attrs[j].Key
+	})
+	w.uint(uint64(len(attrs)))
+	for _, a := range attrs {
+		w.string(a.Namespace)
+		w.string(a.Key)
+		w.string(a.Val)
+	}
+
+	for c := n.FirstChild; c != nil; c = c.NextSibling {
+		w.string(hashSubtree(c, cache))
+	}
+
+	sum := hex.EncodeToString(w.h.Sum(nil))
+	if cache != nil {
+		cache[n] = sum
+	}
+	return sum
+}
+
+// hashWriter writes length-prefixed fields so that adjacent values cannot
+// run together and collide.
+type hashWriter struct {
+	h   hash.Hash
+	buf [binary.MaxVarintLen64]byte
+}
+
+func (w *hashWriter) uint(v uint64) {
+	w.h.Write(w.buf[:binary.PutUvarint(w.buf[:], v)])
+}
+
+func (w *hashWriter) string(s string) {
+	w.uint(uint64(len(s)))
+	w.h.Write([]byte(s))
+}
@@ -0,0 +1,59 @@
+package vchtml
+
+import (
+	"testing"
+
+	"golang.org/x/net/html"
+)
+
+func TestHashNode(t *testing.T) {
+	a, _ := ParseHTML(`<div id="x" class="y"><p>Hello</p></div>`)
+	b, _ := ParseHTML(`<div class="y" id="x"><p>Hello</p></div>`)
+	c, _ := ParseHTML(`<div id="x" class="y"><p>Hello!</p></div>`)
+
+	if HashNode(a) != HashNode(b) {
+		t.Errorf("Attribute order should not affect the hash")
+	}
+	if HashNode(a) == HashNode(c) {
+		t.Errorf("Different text should produce a different hash")
+	}
+}
+
+func TestTreeHash(t *testing.T) {
+	src := `<div id="main" class="page"><ul><li>A</li><li>B</li></ul><p>Footer</p></div>`
+	a, _ := ParseHTML(src)
+	rendered, _ := RenderNode(a)
+	b, _ := ParseHTML(rendered)
+
+	hashesA, hashesB := TreeHash(a), TreeHash(b)
+	if hashesA[a] != hashesB[b] {
+		t.Errorf("Round-tripped documents should have identical root hashes")
+	}
+
+	// Change the text of the second <li>.
+	c, _ := ParseHTML(`<div id="main" class="page"><ul><li>A</li><li>B!</li></ul><p>Footer</p></div>`)
+	changedLeaf, err := GetNode(c, NodePath{0, 1, 0, 0, 1, 0})
+	if err != nil {
+		t.Fatal(err)
+	}
+	hashesC := TreeHash(c)
+
+	// Only the changed leaf and its ancestors should have different hashes.
+	onSpine := make(map[*html.Node]bool)
+	for n := changedLeaf; n != nil; n = n.Parent {
+		onSpine[n] = true
+	}
+
+	var walk func(x, y *html.Node)
+	walk = func(x, y *html.Node) {
+		differs := hashesA[x] != hashesC[y]
+		if differs != onSpine[y] {
+			path, _ := GetPath(c, y)
+			t.Errorf("Node at %v: hash differs=%v, want %v", path, differs, onSpine[y])
+		}
+		for cx, cy := x.FirstChild, y.FirstChild; cx != nil && cy != nil; cx, cy = cx.NextSibling, cy.NextSibling {
+			walk(cx, cy)
+		}
+	}
+	walk(a, c)
+}
@@ -0,0 +1,225 @@
+package vchtml
+
+import (
+	"fmt"
+	"slices"
+	"time"
+
+	"golang.org/x/net/html"
+)
+
+// InvertDelta returns the delta that undoes d: it is based on the document d
+// produces from baseHTML and takes it back to baseHTML, e.g. for undo. The
+// ops of d are replayed on baseHTML to capture what they remove (deleted
+// nodes, prior attribute values, where a moved node came from). Attribute
+// updates invert from their own fields: an addition (Operation.Added) turns
+// into a removal, a removal into an addition and a change into the reverse
+// change. The inverse uses plain child indices from d's path root.
+func InvertDelta(baseHTML string, d *Delta) (*Delta, error) {
+	if hash := hashFunc(baseHTML); hash != d.BaseHash {
+		return nil, fmt.Errorf("base hash mismatch: expected %s, got %s", d.BaseHash, hash)
+	}
+	doc, err := parseForRoot(baseHTML, d.Root)
+	if err != nil {
+		return nil, err
+	}
+	root, err := resolvePathRoot(doc, d.Root)
+	if err != nil {
+		return nil, err
+	}
+
+	cur := NewCursor(root)
+	var inverse []Operation
+	for i, op := range d.Operations {
+		op, err := resolveOp(root, d, op)
+		if err != nil {
+			return nil, fmt.Errorf("op %d (%s): %w", i, op.Type, err)
+		}
+		if op, err = atIndex(op); err != nil {
+			return nil, fmt.Errorf("op %d (%s): %w", i, op.Type, err)
+		}
+		undo, err := invertOp(root, cur, op)
+		if err != nil {
+			return nil, fmt.Errorf("op %d (%s): %w", i, op.Type, err)
+		}
+		// The last op is undone first.
+		inverse = append(undo, inverse...)
+	}
+
+	patched, err := renderForRoot(doc, d.Root)
+	if err != nil {
+		return nil, err
+	}
+	return &Delta{
+		BaseHash:   hashFunc(patched),
+		Operations: inverse,
+		Timestamp:  time.Now().Unix(),
+		Author:     d.Author,
+		Root:       d.Root,
+	}, nil
+}
+
+// invertOp applies op to the tree under root and returns the ops that undo
+// it, in application order.
+func invertOp(root *html.Node, cur *Cursor, op Operation) ([]Operation, error) {
+	node, err := GetNode(root, op.Path)
+	if err != nil {
+		return nil, err
+	}
+	if node.Type == html.TextNode && isContextOp(op) {
+		op.Position = relocateText(node.Data, op)
+	}
+
+	var undo []Operation
+	var after func() error
+	switch op.Type {
+	case OpUpdateText:
+		undo = []Operation{{Type: OpUpdateText, Path: op.Path, OldValue: op.NewValue, NewValue: node.Data}}
+	case OpInsertText:
+		undo = []Operation{{Type: OpDeleteText, Path: op.Path, Position: op.Position, OldValue: op.NewValue}}
+	case OpDeleteText:
+		undo = []Operation{{Type: OpInsertText, Path: op.Path, Position: op.Position, NewValue: op.OldValue}}
+	case OpReplaceText:
+		undo = []Operation{{Type: OpReplaceText, Path: op.Path, Position: op.Position, OldValue: op.NewValue, NewValue: op.OldValue}}
+	case OpSplitText:
+		if len(op.Path) == 0 {
+			return nil, fmt.Errorf("cannot split the root")
+		}
+		tail := siblingPath(op.Path, 1)
+		undo = []Operation{
+			{Type: OpDeleteNode, Path: tail},
+			{Type: OpUpdateText, Path: op.Path, OldValue: prefixOf(node.Data, op.Position), NewValue: node.Data},
+		}
+	case OpUpdateAttr:
+		undo = []Operation{invertAttr(node, op)}
+	case OpDeleteAttr:
+		if node.Type == html.ElementNode && hasAttr(node, op.Key) {
+			undo = []Operation{{Type: OpUpdateAttr, Path: op.Path, Key: op.Key, NewValue: getAttr(node, op.Key), Added: true}}
+		}
+	case OpInsertAttrText:
+		undo = []Operation{{Type: OpDeleteAttrText, Path: op.Path, Key: op.Key, Position: op.Position, OldValue: op.NewValue}}
+	case OpDeleteAttrText:
+		undo = []Operation{{Type: OpInsertAttrText, Path: op.Path, Key: op.Key, Position: op.Position, NewValue: op.OldValue}}
+	case OpAddClass, OpRemoveClass:
+		// The class list is restored whole, keeping its order.
+		had, prior := hasAttr(node, "class"), getAttr(node, "class")
+		after = func() error {
+			value := getAttr(node, "class")
+			switch {
+			case !had && hasAttr(node, "class"):
+				undo = []Operation{{Type: OpUpdateAttr, Path: op.Path, Key: "class", OldValue: value, Removed: true}}
+			case value != prior || had != hasAttr(node, "class"):
+				undo = []Operation{{Type: OpUpdateAttr, Path: op.Path, Key: "class", OldValue: value, NewValue: prior, Added: !hasAttr(node, "class")}}
+			}
+			return nil
+		}
+	case OpChangeTag:
+		undo = []Operation{{Type: OpChangeTag, Path: op.Path, OldValue: op.NewValue, NewValue: node.Data}}
+	case OpWrapNode:
+		// Move the node out in front of its wrapper, then drop the wrapper.
+		if len(op.Path) == 0 {
+			return nil, fmt.Errorf("cannot wrap the root")
+		}
+		last := len(op.Path) - 1
+		parent := op.Path[:last:last]
+		undo = []Operation{
+			{Type: OpMoveNode, Path: append(slices.Clone(op.Path), 0), To: slices.Clone(parent), Position: op.Path[last]},
+			{Type: OpDeleteNode, Path: siblingPath(op.Path, 1)},
+		}
+	case OpInsertNode:
+		before := getChildrenList(node)
+		after = func() error {
+			for i, c := range getChildrenList(node) {
+				if !slices.Contains(before, c) {
+					undo = []Operation{{Type: OpDeleteNode, Path: append(slices.Clone(op.Path), i)}}
+					break
+				}
+			}
+			return nil
+		}
+	case OpDeleteNode:
+		data, err := RenderNode(node)
+		if err != nil {
+			return nil, err
+		}
+		last := len(op.Path) - 1
+		if last < 0 {
+			return nil, fmt.Errorf("cannot delete the root")
+		}
+		parentTag := ""
+		if node.Parent != nil && node.Parent.Type == html.ElementNode {
+			parentTag = node.Parent.Data
+		}
+		undo = []Operation{{Type: OpInsertNode, Path: slices.Clone(op.Path[:last]), Position: op.Path[last], NodeData: data, ParentTag: parentTag}}
+	case OpMoveNode:
+		oldParent := node.Parent
+		if oldParent == nil {
+			return nil, fmt.Errorf("cannot move the root")
+		}
+		oldIndex := getChildIndex(oldParent, node)
+		after = func() error {
+			from, err := GetPath(root, node)
+			if err != nil {
+				return err
+			}
+			// The way back is resolved with the node taken out again.
+			parent, next := node.Parent, node.NextSibling
+			parent.RemoveChild(node)
+			to, err := GetPath(root, oldParent)
+			parent.InsertBefore(node, next)
+			if err != nil {
+				return err
+			}
+			undo = []Operation{{Type: OpMoveNode, Path: from, To: to, Position: oldIndex}}
+			return nil
+		}
+	default:
+		return nil, fmt.Errorf("cannot invert %s", op.Type)
+	}
+
+	if err := applyOp(cur, op, PatchOptions{}); err != nil {
+		return nil, err
+	}
+	if after != nil {
+		if err := after(); err != nil {
+			return nil, err
+		}
+	}
+	return undo, nil
+}
+
+// invertAttr returns the UPDATE_ATTR that undoes op on node, which op has
+// not been applied to yet.
+func invertAttr(node *html.Node, op Operation) Operation {
+	undo := Operation{Type: OpUpdateAttr, Path: op.Path, Key: op.Key, SubKey: op.SubKey}
+	added := op.Added
+	if !op.Added && !op.Removed && op.OldValue == "" {
+		// An added structured component has no Added flag, and deltas from
+		// before it was recorded don't either: ask the tree for those.
+		added = op.SubKey != "" || !hasAttr(node, op.Key)
+	}
+	switch {
+	case added:
+		undo.OldValue, undo.Removed = op.NewValue, true
+	case op.Removed:
+		undo.NewValue, undo.Added = op.OldValue, true
+	default:
+		undo.OldValue, undo.NewValue = op.NewValue, op.OldValue
+	}
+	return undo
+}
+
+// siblingPath returns path with its last index moved by delta.
+func siblingPath(path NodePath, delta int) NodePath {
+	out := slices.Clone(path)
+	out[len(out)-1] += delta
+	return out
+}
+
+// prefixOf returns s cut to its first n bytes, or s if it is shorter.
+func prefixOf(s string, n int) string {
+	if n < 0 || n > len(s) {
+		return s
+	}
+	return s[:n]
+}
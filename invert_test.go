@@ -0,0 +1,98 @@
+package vchtml
+
+import (
+	"testing"
+)
+
+func TestInvertAttrAddition(t *testing.T) {
+	base := `<p>Hi</p>`
+	edited := `<p title="greeting">Hi</p>`
+	delta, err := Diff(base, edited, "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	inverse, err := InvertDelta(base, delta)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := Operation{Type: OpUpdateAttr, Path: NodePath{0, 1, 0}, Key: "title", OldValue: "greeting", Removed: true}
+	if len(inverse.Operations) != 1 || inverse.Operations[0].String() != want.String() {
+		t.Fatalf("got %v, want %v", inverse.Operations, want)
+	}
+	patched, err := Patch(base, delta)
+	if err != nil {
+		t.Fatal(err)
+	}
+	undone, err := Patch(patched, inverse)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !compareHTML(t, undone, `<html><head></head><body><p>Hi</p></body></html>`) {
+		t.Errorf("Undo: got %s", undone)
+	}
+
+	// An attribute set to the empty string is changed back, not removed.
+	empty := `<p title="">Hi</p>`
+	delta, _ = Diff(empty, edited, "alice")
+	inverse, err = InvertDelta(empty, delta)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if op := inverse.Operations[0]; op.Removed || op.NewValue != "" || op.OldValue != "greeting" {
+		t.Errorf("Expected a change back to the empty value, got %v", op)
+	}
+}
+
+func TestInvertDeltaRoundTrip(t *testing.T) {
+	cases := []struct {
+		name      string
+		old, new  string
+		opts      DiffOptions
+		transform func(*Delta)
+	}{
+		{name: "text", old: `<p>Hello world</p>`, new: `<p>Hello brave new world!</p>`},
+		{name: "replace", old: `<p>Hello world</p>`, new: `<p>Goodbye world</p>`, opts: DiffOptions{ReplaceText: true}},
+		{name: "structure", old: `<ul><li>A</li><li>B</li><li>C</li></ul><p>x</p>`, new: `<ul><li>A</li><li>C</li><li>D</li></ul><div>y</div>`},
+		{name: "attributes", old: `<a href="/a" class="x" title="t">A</a>`, new: `<a href="/b" class="x y">A</a>`},
+		{name: "granular attrs", old: `<svg><path d="M0 0 L10 10"></path></svg>`, new: `<svg><path d="M0 0 L5 5 L10 10"></path></svg>`, opts: DiffOptions{GranularAttrs: true}},
+		{name: "style", old: `<p style="color: red; margin: 0">x</p>`, new: `<p style="color: blue; padding: 1px">x</p>`, opts: DiffOptions{StructuredAttrs: []string{"style"}}},
+		{name: "move", old: `<ul id="a"><li id="x">X</li><li>Y</li></ul><ul id="b"><li>Z</li></ul>`, new: `<ul id="a"><li>Y</li></ul><ul id="b"><li>Z</li><li id="x">X</li></ul>`, opts: DiffOptions{DetectMoves: true}},
+		{name: "element index", old: "<ul>\n <li>A</li>\n <li>B</li>\n</ul>", new: "<ul>\n <li>A</li>\n <li>B!</li>\n <li>C</li>\n</ul>", opts: DiffOptions{ElementIndexOnly: true}},
+		{name: "class and wrap", old: `<p class="btn">one two</p>`, new: `<p>one two</p>`, transform: func(d *Delta) {
+			d.Operations = []Operation{
+				{Type: OpAddClass, Path: NodePath{0, 1, 0}, NewValue: "active"},
+				{Type: OpRemoveClass, Path: NodePath{0, 1, 0}, OldValue: "btn"},
+				{Type: OpSplitText, Path: NodePath{0, 1, 0, 0}, Position: 4},
+				{Type: OpWrapNode, Path: NodePath{0, 1, 0, 1}, NodeData: `<b></b>`},
+				{Type: OpChangeTag, Path: NodePath{0, 1, 0}, OldValue: "p", NewValue: "div"},
+			}
+		}},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			delta, err := DiffWithOptions(c.old, c.new, "alice", c.opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if c.transform != nil {
+				c.transform(delta)
+			}
+			patched, err := Patch(c.old, delta)
+			if err != nil {
+				t.Fatal(err)
+			}
+			inverse, err := InvertDelta(c.old, delta)
+			if err != nil {
+				t.Fatal(err)
+			}
+			undone, err := Patch(patched, inverse)
+			if err != nil {
+				t.Fatalf("%v\n%v", err, inverse)
+			}
+			base, _ := Patch(c.old, &Delta{BaseHash: hashString(c.old), Root: c.opts.Root})
+			if !compareHTML(t, undone, base) {
+				t.Errorf("inverse %v", inverse)
+			}
+		})
+	}
+}
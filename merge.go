@@ -1,83 +1,293 @@
 package vchtml
 
 import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
 	"fmt"
 	"strconv"
 	"strings"
+	"time"
 )
 
+// defaultMergeAuthor is recorded on merged deltas when no author is configured.
+const defaultMergeAuthor = "system-merge"
+
+// MergeOptions controls optional behavior of MergeWithOptions.
+type MergeOptions struct {
+	// Author is recorded on the merged delta. Defaults to "system-merge".
+	Author string
+	// TimestampFunc supplies the merged delta's timestamp. Defaults to time.Now().Unix.
+	TimestampFunc func() int64
+	// IntermediateDeltas, when set, lets either input delta be based on an
+	// older revision. It is the chain of deltas leading from that revision to
+	// baseHTML; a stale delta is rebased along it before merging.
+	IntermediateDeltas []*Delta
+	// Strategy resolves conflicts automatically by dropping the losing side's
+	// conflicting operations. Defaults to StrategyFail.
+	Strategy ResolutionStrategy
+	// AnnotateResolutions inserts an HTML comment before each change that won
+	// an auto-resolved conflict, so the resolution is visible in the document.
+	AnnotateResolutions bool
+	// BaseHash, when set, is used as the hash of baseHTML instead of hashing
+	// it, for callers that store each revision's hash alongside it. It must
+	// be the hash of baseHTML (see Delta.BaseMatches).
+	BaseHash string
+	// MaxConflicts, when positive, stops conflict detection once more than
+	// this many conflicts are found: the merge fails with
+	// ErrTooManyConflicts and the first MaxConflicts conflicts, whatever the
+	// Strategy, so hopeless merges are rejected without listing every clash.
+	MaxConflicts int
+	// MergeText resolves two atomic UPDATE_TEXTs of the same text node from
+	// the same old text three-way: when the edits each makes to the old text
+	// don't overlap (e.g. one appends and the other prepends), both are
+	// turned into granular edits and merged. Overlapping edits still
+	// conflict.
+	MergeText bool
+}
+
+// ErrTooManyConflicts is returned, with a partial conflict list, by merges
+// that find more than MergeOptions.MaxConflicts conflicts.
+var ErrTooManyConflicts = errors.New("too many merge conflicts")
+
+func (o MergeOptions) author() string {
+	if o.Author == "" {
+		return defaultMergeAuthor
+	}
+	return o.Author
+}
+
+func (o MergeOptions) baseHash(baseHTML string) string {
+	if o.BaseHash == "" {
+		return hashFunc(baseHTML)
+	}
+	return o.BaseHash
+}
+
+func (o MergeOptions) timestamp() int64 {
+	if o.TimestampFunc == nil {
+		return time.Now().Unix()
+	}
+	return o.TimestampFunc()
+}
+
 // Merge combines two concurrent deltas.
 func Merge(baseHTML string, deltaA, deltaB *Delta) (string, *Delta, []Conflict, error) {
-	// Verify base
-	baseHash := hashString(baseHTML)
-	if deltaA.BaseHash != baseHash || deltaB.BaseHash != baseHash {
-		return "", nil, nil, fmt.Errorf("base hash mismatch")
+	return MergeWithOptions(baseHTML, deltaA, deltaB, MergeOptions{})
+}
+
+// MergeWithOptions combines two concurrent deltas using opts.
+// With a resolution strategy other than StrategyFail, conflicts do not stop the
+// merge: the returned conflicts are the ones that were resolved, alongside the
+// merged document.
+func MergeWithOptions(baseHTML string, deltaA, deltaB *Delta, opts MergeOptions) (string, *Delta, []Conflict, error) {
+	baseHash := opts.baseHash(baseHTML)
+	mergedDelta, conflicts, annotations, err := mergeDeltas(baseHTML, baseHash, deltaA, deltaB, opts)
+	if err != nil || mergedDelta == nil {
+		return "", nil, conflicts, err
+	}
+	if len(annotations) > 0 {
+		patched, extra, err := patchWithAnnotations(baseHTML, mergedDelta, annotations)
+		if err != nil {
+			return "", nil, nil, err
+		}
+		mergedDelta.Operations = append(mergedDelta.Operations, extra...)
+		return patched, mergedDelta, conflicts, nil
 	}
 
-	conflicts := detectConflicts(deltaA.Operations, deltaB.Operations)
-	if len(conflicts) > 0 {
-		return "", nil, conflicts, nil
+	// Apply. The merged delta is based on baseHash, so it isn't hashed again.
+	patched, err := patchVerified(baseHTML, mergedDelta, PatchOptions{})
+	return patched, mergedDelta, conflicts, err
+}
+
+// mergeDeltas computes the merged delta of MergeWithOptions without applying
+// it, for a baseHTML whose hash is baseHash. It returns a nil delta when the
+// merge stops at conflicts, and the annotations for resolved conflicts that
+// opts.AnnotateResolutions asks for, keyed by merged op index.
+func mergeDeltas(baseHTML, baseHash string, deltaA, deltaB *Delta, opts MergeOptions) (*Delta, []Conflict, map[int]string, error) {
+	if len(opts.IntermediateDeltas) > 0 {
+		var err error
+		var conflicts []Conflict
+		if deltaA, conflicts, err = rebaseIfStale(baseHTML, baseHash, deltaA, opts.IntermediateDeltas); err != nil || len(conflicts) > 0 {
+			return nil, conflicts, nil, err
+		}
+		if deltaB, conflicts, err = rebaseIfStale(baseHTML, baseHash, deltaB, opts.IntermediateDeltas); err != nil || len(conflicts) > 0 {
+			return nil, conflicts, nil, err
+		}
+	}
+	if !deltaA.BaseMatches(baseHash) || !deltaB.BaseMatches(baseHash) {
+		return nil, nil, nil, fmt.Errorf("base hash mismatch")
+	}
+	if deltaA.IsEmpty() || deltaB.IsEmpty() {
+		// An empty delta changes nothing, so the merge is the other delta,
+		// whatever its path root.
+		other := deltaA
+		if other.IsEmpty() {
+			other = deltaB
+		}
+		return &Delta{
+			BaseHash:     baseHash,
+			Operations:   append([]Operation(nil), other.Operations...),
+			Author:       opts.author(),
+			Timestamp:    opts.timestamp(),
+			Root:         other.Root,
+			ElementIndex: other.ElementIndex,
+		}, nil, nil, nil
+	}
+	if deltaA.Root != deltaB.Root {
+		return nil, nil, nil, fmt.Errorf("path root mismatch: %q vs %q", deltaA.Root, deltaB.Root)
+	}
+	if deltaA.ElementIndex != deltaB.ElementIndex {
+		return nil, nil, nil, errors.New("path indexing mismatch: only one delta uses element indices")
+	}
+
+	// An atomic text replacement only merges with the other side's granular
+	// edits of the same node once it is granular itself.
+	textA, convertedA := granularText(deltaA.Operations, deltaB.Operations)
+	textB, convertedB := granularText(deltaB.Operations, deltaA.Operations)
+	if opts.MergeText {
+		var converted bool
+		textA, textB, converted = mergeTextUpdates(textA, textB)
+		convertedA = convertedA || converted
+	}
+	if convertedA || convertedB {
+		copyA, copyB := *deltaA, *deltaB
+		copyA.Operations, copyB.Operations = textA, textB
+		deltaA, deltaB = &copyA, &copyB
 	}
 
-	// Transform B against A
-	opsA := deltaA.Operations
+	opsA, opsB := deltaA.Operations, deltaB.Operations
+	var conflicts []Conflict
+	var resolutions []resolution
+	if pairs, truncated := findConflictsUpTo(opsA, opsB, opts.MaxConflicts); len(pairs) > 0 {
+		conflicts = make([]Conflict, len(pairs))
+		for i, p := range pairs {
+			conflicts[i] = p.Conflict
+		}
+		if truncated {
+			return nil, conflicts, nil, ErrTooManyConflicts
+		}
+		if opts.Strategy == StrategyFail {
+			return nil, conflicts, nil, nil
+		}
+		opsA, opsB, resolutions = resolveConflicts(pairs, deltaA, deltaB, opts.Strategy)
+	}
 
-	// We might expand operations during transform, so we use a list that can grow?
-	// But usually we transform B against A one by one.
 	// Since we are returning a combined delta, we take A as-is (applied first),
-	// and then B (transformed).
+	// and then B (transformed against A). The transformed form of each B op
+	// is kept apart so the merged index at which it starts is known.
+	transformedB, _, err := transformSeqs(opsB, opsA)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	mergedOps := make([]Operation, 0, len(opsA)+len(opsB))
+	mergedOps = append(mergedOps, opsA...)
+	bStart := make([]int, len(opsB))
+	for i, transformed := range transformedB {
+		bStart[i] = len(mergedOps)
+		mergedOps = append(mergedOps, transformed...)
+	}
 
-	var opsBTransformed []Operation
-	for _, opB := range deltaB.Operations {
-		currentOps := []Operation{opB}
+	mergedDelta := &Delta{
+		BaseHash:     baseHash,
+		Operations:   mergedOps,
+		Author:       opts.author(),
+		Timestamp:    opts.timestamp(),
+		Root:         deltaA.Root,
+		ElementIndex: deltaA.ElementIndex,
+	}
 
-		for _, opA := range opsA {
-			var nextOps []Operation
-			for _, curr := range currentOps {
-				transformed, err := transformOp(curr, opA)
-				if err != nil {
-					return "", nil, nil, err
-				}
-				nextOps = append(nextOps, transformed...)
+	var annotations map[int]string
+	if opts.AnnotateResolutions && len(resolutions) > 0 {
+		annotations = make(map[int]string)
+		for _, r := range resolutions {
+			index := r.winnerIndex
+			if !r.winnerIsA {
+				index = bStart[r.winnerIndex]
+			}
+			if index < len(mergedOps) {
+				annotations[index] = annotationText(opts.Strategy, r.loserAuthor)
 			}
-			currentOps = nextOps
 		}
-		opsBTransformed = append(opsBTransformed, currentOps...)
 	}
+	return mergedDelta, conflicts, annotations, nil
+}
 
-	mergedOps := append(opsA, opsBTransformed...)
-
-	mergedDelta := &Delta{
-		BaseHash:   baseHash,
-		Operations: mergedOps,
-		Author:     "system-merge",
-		Timestamp:  deltaA.Timestamp, // or current
+// rebaseIfStale rebases delta onto baseHTML unless it is already based on it.
+func rebaseIfStale(baseHTML, baseHash string, delta *Delta, intermediate []*Delta) (*Delta, []Conflict, error) {
+	if delta.BaseHash == baseHash {
+		return delta, nil, nil
 	}
+	return Rebase(baseHTML, delta, intermediate)
+}
+
+// DetectAllConflicts checks every delta against the changes of the deltas
+// before it and returns all conflicts found, without stopping at the first
+// conflicting delta. Each delta's non-conflicting ops join the accumulated set
+// that later deltas are checked against. Deltas not based on baseHTML are
+// skipped.
+func DetectAllConflicts(baseHTML string, deltas []*Delta) []Conflict {
+	baseHash := hashFunc(baseHTML)
+	var all []Conflict
+	var accumulated []Operation
+	var first *Delta
+	for _, delta := range deltas {
+		if delta.BaseHash != baseHash || (first != nil && (delta.Root != first.Root || delta.ElementIndex != first.ElementIndex)) {
+			continue
+		}
+		if first == nil {
+			accumulated = append(accumulated, delta.Operations...)
+			first = delta
+			continue
+		}
 
-	// Apply
-	patched, err := Patch(baseHTML, mergedDelta)
-	return patched, mergedDelta, nil, err
+		// Text updates are made granular first, as Merge does.
+		ops, _ := granularText(delta.Operations, accumulated)
+		accumulated, _ = granularText(accumulated, delta.Operations)
+		pairs := findConflicts(accumulated, ops)
+		conflicting := make(map[int]bool)
+		for _, p := range pairs {
+			all = append(all, p.Conflict)
+			conflicting[p.indexB] = true
+		}
+		var kept []Operation
+		for i, op := range ops {
+			if !conflicting[i] {
+				kept = append(kept, op)
+			}
+		}
+		transformed, err := transformOps(kept, accumulated)
+		if err != nil {
+			continue
+		}
+		accumulated = append(accumulated, transformed...)
+	}
+	return all
 }
 
 // MergeAll merges a list of deltas sequentially.
 func MergeAll(baseHTML string, deltas []*Delta) (string, *Delta, []Conflict, error) {
+	return MergeAllWithHash(baseHTML, hashFunc(baseHTML), deltas)
+}
+
+// MergeAllWithHash is MergeAll for a baseHTML whose hash the caller already
+// holds, so the base is not hashed at all.
+func MergeAllWithHash(baseHTML, baseHash string, deltas []*Delta) (string, *Delta, []Conflict, error) {
 	if len(deltas) == 0 {
-		return baseHTML, &Delta{BaseHash: hashString(baseHTML)}, nil, nil
+		return baseHTML, &Delta{BaseHash: baseHash}, nil, nil
 	}
 
+	// Only the final merged delta is applied; each merged delta starts with
+	// the ops of the one before it, so it fails to apply wherever an
+	// intermediate one would.
 	merged := deltas[0]
-
-	if len(deltas) == 1 {
-		patched, err := Patch(baseHTML, merged)
-		return patched, merged, nil, err
+	if !merged.BaseMatches(baseHash) {
+		return "", nil, nil, fmt.Errorf("base hash mismatch")
 	}
-
-	var patched string
-	var err error
-	var conflicts []Conflict
-
 	for i := 1; i < len(deltas); i++ {
-		patched, merged, conflicts, err = Merge(baseHTML, merged, deltas[i])
+		var conflicts []Conflict
+		var err error
+		merged, conflicts, _, err = mergeDeltas(baseHTML, baseHash, merged, deltas[i], MergeOptions{})
 		if err != nil {
 			return "", nil, nil, err
 		}
@@ -86,53 +296,182 @@ func MergeAll(baseHTML string, deltas []*Delta) (string, *Delta, []Conflict, err
 		}
 	}
 
+	patched, err := patchVerified(baseHTML, merged, PatchOptions{})
+	if err != nil {
+		return "", nil, nil, err
+	}
 	return patched, merged, nil, nil
 }
 
+// VerifyMergeConsistency checks that merging a and b, which must not
+// conflict, does not depend on the order their effects are applied in:
+// Merge applies a and then b transformed past a, and the result must equal
+// applying b and then a transformed past b. A difference means the
+// transform lost or misplaced one side's change. It is meant for tests of
+// merge-heavy code; concurrent inserts at the same place are ordered the
+// same way on both paths, so they do not count as a difference.
+func VerifyMergeConsistency(baseHTML string, a, b *Delta) error {
+	merged, _, conflicts, err := Merge(baseHTML, a, b)
+	if err != nil {
+		return fmt.Errorf("merge failed: %w", err)
+	}
+	if len(conflicts) > 0 {
+		return fmt.Errorf("deltas conflict: %s", conflicts[0].Description)
+	}
+
+	// Prepare the ops as Merge does, then take the other path.
+	opsA, _ := granularText(a.Operations, b.Operations)
+	opsB, _ := granularText(b.Operations, a.Operations)
+	_, aAfterB, err := transformSeqs(opsB, opsA)
+	if err != nil {
+		return fmt.Errorf("transform failed: %w", err)
+	}
+	bFirst, err := Patch(baseHTML, b)
+	if err != nil {
+		return fmt.Errorf("failed to apply b: %w", err)
+	}
+	bFirst, err = patchVerified(bFirst, &Delta{Operations: aAfterB, Root: a.Root, ElementIndex: a.ElementIndex}, PatchOptions{})
+	if err != nil {
+		return fmt.Errorf("failed to apply a after b: %w", err)
+	}
+
+	mergedDoc, err := parseForRoot(merged, a.Root)
+	if err != nil {
+		return err
+	}
+	otherDoc, err := parseForRoot(bFirst, a.Root)
+	if err != nil {
+		return err
+	}
+	if HashNode(mergedDoc) != HashNode(otherDoc) {
+		return fmt.Errorf("merge depends on order:\na then b: %s\nb then a: %s", merged, bFirst)
+	}
+	return nil
+}
+
 func detectConflicts(opsA, opsB []Operation) []Conflict {
-	var conflicts []Conflict
-	mapA := make(map[string]Operation)
-	for _, op := range opsA {
-		mapA[pathKey(op)] = op
+	pairs := findConflicts(opsA, opsB)
+	if len(pairs) == 0 {
+		return nil
+	}
+	conflicts := make([]Conflict, len(pairs))
+	for i, p := range pairs {
+		conflicts[i] = p.Conflict
 	}
+	return conflicts
+}
 
-	for _, opB := range opsB {
+// conflictPair is a detected conflict together with the indices of the two
+// operations in their respective op lists.
+type conflictPair struct {
+	Conflict
+	indexA, indexB int
+}
+
+func findConflicts(opsA, opsB []Operation) []conflictPair {
+	conflicts, _ := findConflictsUpTo(opsA, opsB, 0)
+	return conflicts
+}
+
+// findConflictsUpTo is findConflicts stopping once more than limit conflicts
+// are found, when limit is positive. It then returns the first limit and
+// true.
+func findConflictsUpTo(opsA, opsB []Operation, limit int) ([]conflictPair, bool) {
+	var conflicts []conflictPair
+	full := func() bool { return limit > 0 && len(conflicts) > limit }
+	add := func(ia, ib int, c Conflict) {
+		c.Ops = []Operation{opsA[ia], opsB[ib]}
+		conflicts = append(conflicts, conflictPair{Conflict: c, indexA: ia, indexB: ib})
+	}
+
+	// Several ops may share a key (e.g. multiple attribute updates on one
+	// node), so each key maps to all of A's ops under it.
+	mapA := make(map[string][]int)
+	for i, op := range opsA {
+		key := pathKey(op)
+		mapA[key] = append(mapA[key], i)
+	}
+
+	for ib, opB := range opsB {
 		keyB := pathKey(opB)
-		if opA, exists := mapA[keyB]; exists {
+		for _, ia := range mapA[keyB] {
+			opA := opsA[ia]
 			if isConflict(opA, opB) {
-				conflicts = append(conflicts, Conflict{
-					Type:        "Direct",
+				conflictType := ConflictDirect
+				if opA.Type == OpDeleteNode || opB.Type == OpDeleteNode {
+					conflictType = ConflictDeleteModify
+				}
+				add(ia, ib, Conflict{
+					Type:        conflictType,
 					Description: fmt.Sprintf("Conflict on node %v: %s vs %s", opB.Path, opA.Type, opB.Type),
 					Path:        opB.Path,
-					Ops:         []Operation{opA, opB},
 				})
+				if full() {
+					return conflicts[:limit], true
+				}
 			}
 		}
 
-		for _, opA := range opsA {
+		for ia, opA := range opsA {
+			if textRangesOverlap(opA, opB) {
+				add(ia, ib, Conflict{
+					Type:        ConflictPosition,
+					Description: fmt.Sprintf("Overlapping text edits on node %v", opB.Path),
+					Path:        opB.Path,
+				})
+			}
+			if replaceOverlaps(opA, opB) {
+				add(ia, ib, Conflict{
+					Type:        ConflictPosition,
+					Description: fmt.Sprintf("Overlapping text edits on node %v", opB.Path),
+					Path:        opB.Path,
+				})
+			}
+			if mixedText(opA, opB) || mixedText(opB, opA) {
+				add(ia, ib, Conflict{
+					Type:        ConflictDirect,
+					Description: fmt.Sprintf("Wholesale and granular text edits on node %v", opB.Path),
+					Path:        opB.Path,
+				})
+			}
+			if splitInDeletion(opA, opB) || splitInDeletion(opB, opA) {
+				add(ia, ib, Conflict{
+					Type:        ConflictPosition,
+					Description: fmt.Sprintf("Split of deleted text on node %v", opB.Path),
+					Path:        opB.Path,
+				})
+			}
+			if claimsMovedAttr(opA, opB) {
+				add(ia, ib, Conflict{
+					Type:        ConflictDirect,
+					Description: fmt.Sprintf("Attribute %s=%q moved to both %v and %v", opB.Key, opB.NewValue, opA.Path, opB.Path),
+					Path:        opB.Path,
+				})
+			}
 			if opA.Type == OpDeleteNode {
-				if isDescendant(opA.Path, opB.Path) {
-					conflicts = append(conflicts, Conflict{
-						Type:        "Structure",
+				if modifiesDeleted(opA, opB) {
+					add(ia, ib, Conflict{
+						Type:        ConflictStructure,
 						Description: "Modification of deleted node",
 						Path:        opB.Path,
-						Ops:         []Operation{opA, opB},
 					})
 				}
 			}
 			if opB.Type == OpDeleteNode {
-				if isDescendant(opB.Path, opA.Path) {
-					conflicts = append(conflicts, Conflict{
-						Type:        "Structure",
+				if modifiesDeleted(opB, opA) {
+					add(ia, ib, Conflict{
+						Type:        ConflictStructure,
 						Description: "Modification of deleted node",
 						Path:        opA.Path,
-						Ops:         []Operation{opA, opB},
 					})
 				}
 			}
+			if full() {
+				return conflicts[:limit], true
+			}
 		}
 	}
-	return conflicts
+	return conflicts, false
 }
 
 func isConflict(a, b Operation) bool {
@@ -142,13 +481,19 @@ func isConflict(a, b Operation) bool {
 		}
 		return true
 	}
+	if a.Type == OpMoveNode && b.Type == OpMoveNode {
+		return !pathEqual(a.To, b.To) || a.Position != b.Position
+	}
+	if a.Type == OpChangeTag && b.Type == OpChangeTag {
+		return !strings.EqualFold(a.NewValue, b.NewValue)
+	}
 	// Atomic update conflict
 	if a.Type == OpUpdateText && b.Type == OpUpdateText {
 		return a.NewValue != b.NewValue
 	}
 
 	// Granular text conflict?
-	if (a.Type == OpInsertText || a.Type == OpDeleteText) && (b.Type == OpInsertText || b.Type == OpDeleteText) {
+	if isGranularText(a) && isGranularText(b) {
 		// We allow granular merging unless logic fails.
 		// For now assume NO conflict, let transform handle it.
 		// If transform fails (e.g. overlapping delete/insert that is ambiguous), it should return error there?
@@ -157,16 +502,40 @@ func isConflict(a, b Operation) bool {
 		return false
 	}
 	// Mixed Atomic/Granular?
-	if (a.Type == OpUpdateText && (b.Type == OpInsertText || b.Type == OpDeleteText)) ||
-		(b.Type == OpUpdateText && (a.Type == OpInsertText || a.Type == OpDeleteText)) {
+	if (a.Type == OpUpdateText && isGranularText(b)) || (b.Type == OpUpdateText && isGranularText(a)) {
 		return true // Mixing modes is dangerous
 	}
 
-	if a.Type == OpUpdateAttr && b.Type == OpUpdateAttr {
-		if a.Key == b.Key {
-			return a.NewValue != b.NewValue
+	if isClassOp(a) || isClassOp(b) {
+		if isClassOp(a) && isClassOp(b) {
+			// Class ops commute unless one adds the class the other removes.
+			return a.Type != b.Type && classToken(a) == classToken(b)
 		}
-		return false
+		// A class op and an op on the whole class attribute don't mix.
+		other := a
+		if isClassOp(a) {
+			other = b
+		}
+		return isAttrOp(other) && strings.EqualFold(other.Key, "class")
+	}
+	if isAttrOp(a) && isAttrOp(b) {
+		if !strings.EqualFold(a.Key, b.Key) {
+			return false
+		}
+		if isAttrTextOp(a) && isAttrTextOp(b) {
+			return false // Merged like text ops, by transformOp
+		}
+		if a.SubKey != "" && b.SubKey != "" && !strings.EqualFold(a.SubKey, b.SubKey) {
+			return false // Different components of a structured attribute
+		}
+		if a.Type != b.Type || (a.SubKey == "") != (b.SubKey == "") {
+			return true // One side removed the attribute the other updated
+		}
+		if a.Type == OpDeleteAttr {
+			return false // Both removed it
+		}
+		// Two adds of one attribute conflict unless they set the same value.
+		return a.Removed != b.Removed || a.Added != b.Added || a.NewValue != b.NewValue
 	}
 	if a.Type == OpInsertNode && b.Type == OpInsertNode {
 		if a.Position == b.Position {
@@ -179,9 +548,114 @@ func isConflict(a, b Operation) bool {
 	return false
 }
 
+// deleteAfterDelete rewrites text deletion b to apply after deletion a on the
+// same node. The part of b that a already removed is dropped; b vanishes if
+// nothing is left.
+func deleteAfterDelete(b, a Operation) []Operation {
+	bEnd, aEnd := b.Position+len(b.OldValue), a.Position+len(a.OldValue)
+	switch {
+	case bEnd <= a.Position:
+		return []Operation{b}
+	case b.Position >= aEnd:
+		b.Position -= len(a.OldValue)
+		return []Operation{b}
+	}
+	rest := ""
+	if b.Position < a.Position {
+		rest += b.OldValue[:a.Position-b.Position]
+	}
+	if bEnd > aEnd {
+		rest += b.OldValue[aEnd-b.Position:]
+	}
+	if rest == "" {
+		return nil
+	}
+	b.Position = min(b.Position, a.Position)
+	b.OldValue = rest
+	return []Operation{b}
+}
+
+// textRangesOverlap reports whether a and b are text deletions on the same node
+// whose ranges overlap in a way transformOp cannot handle. B is transformed
+// against A, and a B deletion that reaches outside A's range would have the
+// remainder silently dropped. B deletions nested within A are simply absorbed.
+func textRangesOverlap(a, b Operation) bool {
+	if a.Type != OpDeleteText || b.Type != OpDeleteText || !pathEqual(a.Path, b.Path) {
+		return false
+	}
+	aEnd := a.Position + len(a.OldValue)
+	bEnd := b.Position + len(b.OldValue)
+	if aEnd <= b.Position || bEnd <= a.Position {
+		return false // Disjoint
+	}
+	return b.Position < a.Position || bEnd > aEnd
+}
+
+// splitInDeletion reports whether split is a SPLIT_TEXT strictly inside the
+// range del deletes from the same node. The split usually prepares a wrap of
+// the text on one side of it, which the deletion removed.
+func splitInDeletion(split, del Operation) bool {
+	if split.Type != OpSplitText || del.Type != OpDeleteText || !pathEqual(split.Path, del.Path) {
+		return false
+	}
+	return split.Position > del.Position && split.Position < del.Position+len(del.OldValue)
+}
+
+// replaceOverlaps reports whether a and b are edits of the same text node, at
+// least one a REPLACE_TEXT, whose ranges overlap or where one's insertion
+// point lies strictly inside the other's range. A replacement is atomic, so
+// neither can be cut around the other. Identical replacements don't count.
+func replaceOverlaps(a, b Operation) bool {
+	if (a.Type != OpReplaceText && b.Type != OpReplaceText) || !pathEqual(a.Path, b.Path) {
+		return false
+	}
+	if (!isGranularText(a) && a.Type != OpSplitText) || (!isGranularText(b) && b.Type != OpSplitText) || isDuplicateOp(a, b) {
+		return false
+	}
+	aEnd, bEnd := a.Position+len(a.OldValue), b.Position+len(b.OldValue)
+	if a.Type == OpInsertText || a.Type == OpSplitText {
+		aEnd = a.Position
+	}
+	if b.Type == OpInsertText || b.Type == OpSplitText {
+		bEnd = b.Position
+	}
+	return a.Position < bEnd && b.Position < aEnd
+}
+
+// editsTextAt reports whether op changes the text of the node at path.
+func editsTextAt(op Operation, path NodePath) bool {
+	return (isGranularText(op) || op.Type == OpSplitText || op.Type == OpUpdateText) && pathEqual(op.Path, path)
+}
+
+// mixedText reports whether update is an UPDATE_TEXT that granularText left
+// whole and edit an in-place edit of the same text node, which it can't be
+// placed among.
+func mixedText(update, edit Operation) bool {
+	return update.Type == OpUpdateText && (isGranularText(edit) || edit.Type == OpSplitText) && pathEqual(update.Path, edit.Path)
+}
+
+// isGranularText reports whether op edits part of a text node.
+func isGranularText(op Operation) bool {
+	return op.Type == OpInsertText || op.Type == OpDeleteText || op.Type == OpReplaceText
+}
+
+// insertsAt reports whether op only adds text at its position, which makes
+// it tie with another insertion there.
+func insertsAt(op Operation) bool {
+	return op.Type == OpInsertText || (op.Type == OpReplaceText && op.OldValue == "")
+}
+
+func isAttrOp(op Operation) bool {
+	return op.Type == OpUpdateAttr || op.Type == OpDeleteAttr || isAttrTextOp(op)
+}
+
+func isAttrTextOp(op Operation) bool {
+	return op.Type == OpInsertAttrText || op.Type == OpDeleteAttrText
+}
+
 func pathKey(op Operation) string {
 	s := strings.Trim(fmt.Sprint(op.Path), "[]")
-	if op.Type == OpInsertNode {
+	if op.Type == OpInsertNode && op.Placement == PlaceAtIndex {
 		return s + ":I:" + strconv.Itoa(op.Position)
 	}
 	// For text operations, conflict is checked on the node (path)
@@ -194,12 +668,35 @@ func pathKey(op Operation) string {
 	// So we return a key that includes Op index? No.
 	// We'll append suffix to key for text ops so they don't overwrite each other in the map,
 	// effectively disabling map-based conflict check for them, leaving it to manual check or `transformOp`.
-	if op.Type == OpInsertText || op.Type == OpDeleteText {
+	if isGranularText(op) {
 		return s + ":T:" + strconv.Itoa(op.Position) + ":" + op.NewValue + ":" + op.OldValue
 	}
 	return s
 }
 
+// claimsMovedAttr reports whether a and b give different elements the same
+// attribute value, at least one of them by moving it there (see
+// DiffOptions.DetectAttrMoves).
+func claimsMovedAttr(a, b Operation) bool {
+	if a.Type != OpUpdateAttr || b.Type != OpUpdateAttr || a.Removed || b.Removed || a.SubKey != "" || b.SubKey != "" {
+		return false
+	}
+	if a.MovedFrom == nil && b.MovedFrom == nil {
+		return false
+	}
+	return !pathEqual(a.Path, b.Path) && strings.EqualFold(a.Key, b.Key) && a.NewValue == b.NewValue
+}
+
+// modifiesDeleted reports whether op changes something inside the node that
+// the delete del removes: a descendant, or the node's own children or text,
+// as an insert into it does. Ops keyed like del are left to isConflict.
+func modifiesDeleted(del, op Operation) bool {
+	if isDescendant(del.Path, op.Path) {
+		return true
+	}
+	return pathEqual(del.Path, op.Path) && pathKey(op) != pathKey(del)
+}
+
 func isDescendant(ancestor, child NodePath) bool {
 	if len(child) <= len(ancestor) {
 		return false
@@ -212,9 +709,217 @@ func isDescendant(ancestor, child NodePath) bool {
 	return true
 }
 
-func transformOp(b, a Operation) ([]Operation, error) {
+// transformOps rewrites ops so they apply after the already-applied ops in
+// 'against'. Both lists must originate from the same document state.
+func transformOps(ops, against []Operation) ([]Operation, error) {
+	each, _, err := transformSeqs(ops, against)
+	if err != nil {
+		return nil, err
+	}
+	var result []Operation
+	for _, transformed := range each {
+		result = append(result, transformed...)
+	}
+	return result, nil
+}
+
+// maxTransformExpansion caps the ops one op may become while it is
+// transformed past another sequence, and how many ops that sequence may gain
+// on the way. Each text insert inside a concurrent deletion splits the
+// deletion in two, so a large delete against many small edits grows with
+// every edit, whichever side it is on; past the cap the merge fails instead.
+const maxTransformExpansion = 256
+
+// transformSeqs transforms two sequences of ops made against the same state
+// past each other. It returns, for each op of bs, the ops it became after as,
+// and as rewritten to apply after bs. Every op of bs is transformed against
+// as already moved past the bs ops before it, so an op that depends on an
+// earlier op of its own sequence still lines up. Ties between concurrent
+// inserts at the same position are broken by content (see insertsFirst), so
+// merging bs and as gives the same order as merging as and bs.
+func transformSeqs(bs, as []Operation) ([][]Operation, []Operation, error) {
+	each := make([][]Operation, len(bs))
+	initial := len(as)
+	for i, b := range bs {
+		// b may expand (or vanish) as it passes each op of as.
+		current := []Operation{b}
+		var movedAs []Operation
+		for _, a := range as {
+			var nextB, nextA []Operation
+			if len(current) == 1 {
+				bFirst := insertsFirst(current[0], a)
+				var err error
+				if nextB, err = transformOp(current[0], a, bFirst); err != nil {
+					return nil, nil, err
+				}
+				if nextA, err = transformOp(a, current[0], !bFirst); err != nil {
+					return nil, nil, err
+				}
+			} else {
+				parts, aAfter, err := transformSeqs(current, []Operation{a})
+				if err != nil {
+					return nil, nil, err
+				}
+				for _, part := range parts {
+					nextB = append(nextB, part...)
+				}
+				nextA = aAfter
+			}
+			current = nextB
+			movedAs = append(movedAs, nextA...)
+			if len(current) > maxTransformExpansion || len(nextA) > maxTransformExpansion {
+				return nil, nil, fmt.Errorf("transforming %s at %v produced more than %d ops", b.Type, b.Path, maxTransformExpansion)
+			}
+		}
+		each[i] = current
+		as = movedAs
+		// Each b may split as a little further, so the cap is on the total.
+		if len(as)-initial > maxTransformExpansion {
+			return nil, nil, fmt.Errorf("transforming past %d ops produced more than %d extra ops", i+1, maxTransformExpansion)
+		}
+	}
+	return each, as, nil
+}
+
+// insertsFirst reports whether b goes in front of a when both insert at the
+// same position. The order compares a hash of what each inserts (and, for a
+// move, where from), so it depends neither on which side an op came from nor
+// on the text itself; equal content, which renders the same either way, goes
+// to a.
+func insertsFirst(b, a Operation) bool {
+	key := func(op Operation) [sha256.Size]byte {
+		return sha256.Sum256([]byte(string(op.Type) + "\x00" + op.Path.String() + "\x00" + op.NodeData + "\x00" + op.NewValue))
+	}
+	kb, ka := key(b), key(a)
+	return bytes.Compare(kb[:], ka[:]) < 0
+}
+
+// transformOp rewrites b to apply after a, where both were made against the
+// same state. When both insert at the same position, bWins keeps b in front
+// of a; otherwise b goes after it.
+func transformOp(b, a Operation, bWins bool) ([]Operation, error) {
+	// MovedFrom addresses an element like a path of B's and shifts with it;
+	// it is dropped if A removed the element.
+	if b.MovedFrom != nil {
+		from, err := transformOp(Operation{Type: OpDeleteNode, Path: b.MovedFrom}, a, bWins)
+		if err != nil {
+			return nil, err
+		}
+		b.MovedFrom = nil
+		transformed, err := transformOp(b, a, bWins)
+		if len(from) == 1 {
+			for i := range transformed {
+				transformed[i].MovedFrom = from[0].Path
+			}
+		}
+		return transformed, err
+	}
+
+	// Both sides made the same change; applying it again would fail its
+	// precondition (or, for a delete, remove the next sibling too).
+	if isDuplicateOp(a, b) {
+		return nil, nil
+	}
+
+	// A concurrent edit of the same text changes what is around B, so B's
+	// context would pull it back to where it was before the transform.
+	if isContextOp(b) && editsTextAt(a, b.Path) {
+		b.ContextBefore, b.ContextAfter = "", ""
+	}
+
 	newB := b
 
+	// Case: attribute text ops on the same attribute shift like text ops.
+	if isAttrTextOp(a) && isAttrTextOp(b) && pathEqual(b.Path, a.Path) && strings.EqualFold(a.Key, b.Key) {
+		a.Type, b.Type = attrTextTypes[a.Type], attrTextTypes[b.Type]
+		transformed, err := transformOp(b, a, bWins)
+		for i := range transformed {
+			transformed[i].Type = attrTextTypes[transformed[i].Type]
+		}
+		return transformed, err
+	}
+
+	// Case: relative inserts (see Placement). A relative A shifts B like the
+	// index insert it amounts to, except that it stays next to its sibling:
+	// an index insert at the same spot goes on the far side of it. A relative
+	// B keeps to its sibling, which shifts like any node path; if A removed
+	// the sibling, B falls back to the index it stood at.
+	if a.Type == OpInsertNode && a.Placement != PlaceAtIndex {
+		if b.Type == OpInsertNode && b.Placement == a.Placement && pathEqual(b.Path, a.Path) {
+			// Both inserts name the same sibling: break the tie by index.
+			indexedA, err := atIndex(a)
+			if err != nil {
+				return nil, err
+			}
+			indexedB, err := atIndex(b)
+			if err != nil {
+				return nil, err
+			}
+			return transformOp(indexedB, indexedA, bWins)
+		}
+		indexed, err := atIndex(a)
+		if err != nil {
+			return nil, err
+		}
+		return transformOp(b, indexed, a.Placement == PlaceBefore)
+	}
+	if b.Type == OpInsertNode && b.Placement != PlaceAtIndex {
+		sibling, err := transformOp(Operation{Type: OpDeleteNode, Path: b.Path}, a, bWins)
+		if err != nil {
+			return nil, err
+		}
+		if len(sibling) == 1 {
+			newB.Path = sibling[0].Path
+			return []Operation{newB}, nil
+		}
+		indexed, err := atIndex(b)
+		if err != nil {
+			return nil, err
+		}
+		return transformOp(indexed, a, bWins)
+	}
+
+	// Case: A moved a node. Ops inside the moved subtree follow it; others
+	// shift as if the node was deleted from its old place and inserted at
+	// its new one.
+	if a.Type == OpMoveNode {
+		if pathEqual(b.Path, a.Path) || isDescendant(a.Path, b.Path) {
+			newB.Path = append(append(append(NodePath(nil), a.To...), a.Position), b.Path[len(a.Path):]...)
+			if b.Type == OpMoveNode {
+				return moveTargetAfter(newB, b, a, bWins)
+			}
+			return []Operation{newB}, nil
+		}
+		removed, err := transformOp(b, Operation{Type: OpDeleteNode, Path: a.Path}, bWins)
+		if err != nil || len(removed) != 1 {
+			return removed, err
+		}
+		return transformOp(removed[0], Operation{Type: OpInsertNode, Path: a.To, Position: a.Position}, bWins)
+	}
+
+	// Case: B moves a node. Its source shifts like any node path; its
+	// destination is addressed once the node is gone, so it shifts past A
+	// as A looks with the node removed.
+	if b.Type == OpMoveNode {
+		from, err := transformOp(Operation{Type: OpDeleteNode, Path: b.Path}, a, bWins)
+		if err != nil || len(from) != 1 {
+			return nil, err
+		}
+		newB.Path = from[0].Path
+		return moveTargetAfter(newB, b, a, bWins)
+	}
+
+	// Case: A replaced text. Replacements are atomic: an edit overlapping
+	// one is a conflict, so B lies wholly before or after A's range and
+	// shifts by the change in length when after it.
+	if a.Type == OpReplaceText && pathEqual(b.Path, a.Path) && (isGranularText(b) || b.Type == OpSplitText) {
+		aEnd := a.Position + len(a.OldValue)
+		if b.Position >= aEnd && !(b.Position == a.Position && bWins && insertsAt(b)) {
+			newB.Position += len(a.NewValue) - len(a.OldValue)
+		}
+		return []Operation{newB}, nil
+	}
+
 	// Case: Text Ops
 	if (a.Type == OpInsertText || a.Type == OpDeleteText) && pathEqual(b.Path, a.Path) {
 		// Both on same text node.
@@ -222,7 +927,16 @@ func transformOp(b, a Operation) ([]Operation, error) {
 		if a.Type == OpInsertText {
 			// A Inserted at a.Position.
 			// B is Insert or Delete.
-			if b.Position >= a.Position {
+			if b.Type == OpDeleteText && b.Position < a.Position && a.Position < b.Position+len(b.OldValue) {
+				// A inserted inside B's range: B deletes around the new text.
+				cut := a.Position - b.Position
+				before, after := b, b
+				before.OldValue = b.OldValue[:cut]
+				after.Position = b.Position + len(a.NewValue)
+				after.OldValue = b.OldValue[cut:]
+				return []Operation{before, after}, nil
+			}
+			if b.Position > a.Position || (b.Position == a.Position && !(bWins && insertsAt(b))) {
 				// Shift B forward
 				newB.Position += len(a.NewValue)
 			}
@@ -231,47 +945,53 @@ func transformOp(b, a Operation) ([]Operation, error) {
 			delLen := len(a.OldValue)
 			aEnd := a.Position + delLen
 
+			if b.Type == OpDeleteText {
+				return deleteAfterDelete(b, a), nil
+			}
 			if b.Position >= aEnd {
 				// B is after deleted range. Shift back.
 				newB.Position -= delLen
-			} else if b.Position >= a.Position {
-				// B starts inside deleted range.
-				// If B is Insert:
-				//   It inserts inside something that is gone.
-				//   Usually we collapse it to insertion point a.Position.
-				if b.Type == OpInsertText {
-					newB.Position = a.Position
-				} else if b.Type == OpDeleteText {
-					// B deletes something that overlaps with A's deletion.
-					// A: Delete [5, 10). B: Delete [6, 8).
-					// B is redundant. Return empty.
-					// B: Delete [8, 12).
-					// Remaining of B is [10, 12) (shifted to 5 -> [5, 7)).
-					// This overlap logic is complex.
-					// For invalid/overlapping deletes, let's error or no-op.
-					return nil, nil // Return empty (consumed).
-				}
-			} else {
-				// B starts before A.
-				// If B Delete ends after A starts?
-				if b.Type == OpDeleteText {
-					bLen := len(b.OldValue)
-					bEnd := b.Position + bLen
-					if bEnd > a.Position {
-						// Overlap from left.
-						// Similar complexity.
-						return nil, nil
-					}
-				}
+			} else if b.Position >= a.Position && (b.Type == OpInsertText || b.Type == OpSplitText) {
+				// B inserts or splits inside something that is gone:
+				// collapse it to the insertion point a.Position.
+				newB.Position = a.Position
 			}
 		}
 		return []Operation{newB}, nil
 	}
 
-	// Case 1: A Inserted a node
+	// Case: A split a text node. The tail becomes a new sibling right after it,
+	// which shifts later siblings like an insert, and B's text edits in the
+	// tail move onto the new node.
+	if a.Type == OpSplitText && len(a.Path) > 0 {
+		parentPath := a.Path[:len(a.Path)-1]
+		index := a.Path[len(a.Path)-1]
+		shifted, err := transformOp(b, Operation{Type: OpInsertNode, Path: parentPath, Position: index + 1}, false)
+		if err != nil {
+			return nil, err
+		}
+		newB = shifted[0]
+		if pathEqual(newB.Path, a.Path) {
+			return splitTextOp(newB, index, a.Position), nil
+		}
+		return []Operation{newB}, nil
+	}
+
+	// Case: A wrapped a node. Everything at or below it moves one level down.
+	if a.Type == OpWrapNode && len(b.Path) >= len(a.Path) && pathEqual(b.Path[:len(a.Path)], a.Path) {
+		newB.Path = make(NodePath, 0, len(b.Path)+1)
+		newB.Path = append(newB.Path, a.Path...)
+		newB.Path = append(newB.Path, 0)
+		newB.Path = append(newB.Path, b.Path[len(a.Path):]...)
+		return []Operation{newB}, nil
+	}
+
+	// Case 1: A Inserted a node. A node at the insert index, or after it,
+	// moves up one, so a delete of the node at that index goes to the node,
+	// not to A's new one.
 	if a.Type == OpInsertNode {
 		if pathEqual(b.Path, a.Path) {
-			if a.Position <= b.Position {
+			if a.Position < b.Position || (a.Position == b.Position && !(bWins && b.Type == OpInsertNode)) {
 				newB.Position++
 			}
 		} else if isSiblingAffected(a.Path, a.Position, b.Path) {
@@ -284,7 +1004,9 @@ func transformOp(b, a Operation) ([]Operation, error) {
 		}
 	}
 
-	// Case 2: A Deleted a node
+	// Case 2: A Deleted a node. Positions after it move down one; an insert
+	// at its index stays put, landing where the node was, before its next
+	// sibling, as it would have with the node still there.
 	if a.Type == OpDeleteNode {
 		parentPath := a.Path[:len(a.Path)-1]
 		delIndex := a.Path[len(a.Path)-1]
@@ -306,6 +1028,223 @@ func transformOp(b, a Operation) ([]Operation, error) {
 	return []Operation{newB}, nil
 }
 
+// moveTargetAfter sets the destination of moved, the move b with its source
+// already transformed, to b's destination shifted past a. b's destination is
+// addressed in the tree without b's node, so a is first moved past the
+// removal of that node. bWins breaks a tie with an insert as in transformOp.
+func moveTargetAfter(moved, b, a Operation, bWins bool) ([]Operation, error) {
+	if pathEqual(a.Path, b.Path) || isDescendant(b.Path, a.Path) {
+		// a edits inside the moved node, which leaves the destination alone.
+		return []Operation{moved}, nil
+	}
+	aWithout, err := transformOp(a, Operation{Type: OpDeleteNode, Path: b.Path}, false)
+	if err != nil {
+		return nil, err
+	}
+	target := Operation{Type: OpInsertNode, Path: b.To, Position: b.Position}
+	for _, op := range aWithout {
+		shifted, err := transformOp(target, op, bWins)
+		if err != nil || len(shifted) != 1 {
+			return nil, err
+		}
+		target = shifted[0]
+	}
+	moved.To, moved.Position = target.Path, target.Position
+	return []Operation{moved}, nil
+}
+
+// splitTextOp rewrites a text op on a node that was split at offset 'at' into
+// the node at 'index' (head) and 'index+1' (tail). A deletion spanning the
+// split point becomes one deletion on each side.
+func splitTextOp(b Operation, index, at int) []Operation {
+	toTail := func(op Operation) Operation {
+		op.Path = append(NodePath(nil), op.Path...)
+		op.Path[len(op.Path)-1] = index + 1
+		op.Position -= at
+		return op
+	}
+
+	switch b.Type {
+	case OpInsertText, OpSplitText:
+		// An insert exactly at the split point stays at the end of the head.
+		if b.Position > at {
+			return []Operation{toTail(b)}
+		}
+	case OpReplaceText:
+		// Like an insert when nothing is removed; a range spanning the split
+		// point conflicts and is not transformed.
+		if b.Position > at || (b.Position == at && b.OldValue != "") {
+			return []Operation{toTail(b)}
+		}
+	case OpDeleteText:
+		end := b.Position + len(b.OldValue)
+		if b.Position >= at {
+			return []Operation{toTail(b)}
+		}
+		if end > at {
+			head, tail := b, b
+			head.OldValue = b.OldValue[:at-b.Position]
+			tail.OldValue = b.OldValue[at-b.Position:]
+			tail.Position = at
+			return []Operation{head, toTail(tail)}
+		}
+	}
+	return []Operation{b}
+}
+
+// granularText replaces each UPDATE_TEXT in ops on a text node that other
+// edits in place (INSERT_TEXT, DELETE_TEXT, REPLACE_TEXT, SPLIT_TEXT) by the
+// equivalent delete and insert, so both sides are edits at byte offsets of
+// the node's text that transform against each other instead of conflicting.
+// A node's updates are only replaced when the first op on it is an
+// UPDATE_TEXT whose old text other's first edit of the node fits; an update
+// without its old text can't be replaced and still conflicts. It reports
+// whether anything was replaced.
+func granularText(ops, other []Operation) ([]Operation, bool) {
+	firstEdit := make(map[string]Operation)
+	for _, op := range other {
+		key := op.Path.String()
+		if _, seen := firstEdit[key]; !seen {
+			firstEdit[key] = op
+		}
+	}
+	convert := make(map[string]bool)
+	seen := make(map[string]bool)
+	for _, op := range ops {
+		key := op.Path.String()
+		if seen[key] {
+			continue
+		}
+		seen[key] = true
+		edit, ok := firstEdit[key]
+		if ok && op.Type == OpUpdateText && (isGranularText(edit) || edit.Type == OpSplitText) && editFits(edit, op.OldValue) {
+			convert[key] = true
+		}
+	}
+	if len(convert) == 0 {
+		return ops, false
+	}
+	var out []Operation
+	for _, op := range ops {
+		if op.Type == OpUpdateText && convert[op.Path.String()] {
+			out = append(out, diffText(op.OldValue, op.NewValue, op.Path)...)
+			continue
+		}
+		out = append(out, op)
+	}
+	return out, true
+}
+
+// editFits reports whether the granular text op op could apply to text: its
+// offset is in range and any text it removes is there.
+func editFits(op Operation, text string) bool {
+	if op.Position < 0 || op.Position > len(text) {
+		return false
+	}
+	if op.Type == OpInsertText || op.Type == OpSplitText {
+		return true
+	}
+	end := op.Position + len(op.OldValue)
+	return end <= len(text) && text[op.Position:end] == op.OldValue
+}
+
+// mergeTextUpdates replaces the UPDATE_TEXTs of opsA and opsB that change
+// the same text node from the same old text, in ways whose edits don't
+// overlap, by the equivalent granular edits (see MergeOptions.MergeText). It
+// reports whether anything was replaced.
+func mergeTextUpdates(opsA, opsB []Operation) ([]Operation, []Operation, bool) {
+	updates := func(ops []Operation) map[string]Operation {
+		byPath := make(map[string]Operation)
+		count := make(map[string]int)
+		for _, op := range ops {
+			if op.Type == OpUpdateText {
+				key := op.Path.String()
+				byPath[key] = op
+				count[key]++
+			}
+		}
+		for key, n := range count {
+			if n > 1 {
+				delete(byPath, key) // Successive updates have no single base
+			}
+		}
+		return byPath
+	}
+	updatesA, updatesB := updates(opsA), updates(opsB)
+	mergeable := make(map[string]bool)
+	for key, a := range updatesA {
+		b, ok := updatesB[key]
+		if ok && a.OldValue == b.OldValue && a.NewValue != b.NewValue && !textEditsOverlap(a, b) {
+			mergeable[key] = true
+		}
+	}
+	if len(mergeable) == 0 {
+		return opsA, opsB, false
+	}
+	expand := func(ops []Operation) []Operation {
+		var out []Operation
+		for _, op := range ops {
+			if op.Type == OpUpdateText && mergeable[op.Path.String()] {
+				out = append(out, diffText(op.OldValue, op.NewValue, op.Path)...)
+				continue
+			}
+			out = append(out, op)
+		}
+		return out
+	}
+	return expand(opsA), expand(opsB), true
+}
+
+// textEditsOverlap reports whether the stretches of the common old text that
+// UPDATE_TEXTs a and b replace overlap, or are insertions at the same offset,
+// so that no order of the two edits is clearly right.
+func textEditsOverlap(a, b Operation) bool {
+	span := func(op Operation) (int, int) {
+		prefix, suffix := commonAffixes(op.OldValue, op.NewValue)
+		return prefix, len(op.OldValue) - suffix
+	}
+	as, ae := span(a)
+	bs, be := span(b)
+	switch {
+	case as == ae && bs == be:
+		return as == bs
+	case as == ae:
+		return bs < as && as < be
+	case bs == be:
+		return as < bs && bs < ae
+	}
+	return max(as, bs) < min(ae, be)
+}
+
+// isDuplicateOp reports whether a and b are the same idempotent change to the
+// same node, so that b has no effect once a is applied. Concurrent inserts are
+// never duplicates: two users adding the same text or node add it twice.
+func isDuplicateOp(a, b Operation) bool {
+	if a.Type != b.Type || !pathEqual(a.Path, b.Path) {
+		return false
+	}
+	switch a.Type {
+	case OpUpdateText:
+		return a.NewValue == b.NewValue
+	case OpReplaceText:
+		return a.Position == b.Position && a.OldValue == b.OldValue && a.NewValue == b.NewValue
+	case OpChangeTag:
+		return strings.EqualFold(a.NewValue, b.NewValue)
+	case OpUpdateAttr:
+		return strings.EqualFold(a.Key, b.Key) && strings.EqualFold(a.SubKey, b.SubKey) &&
+			a.Removed == b.Removed && a.Added == b.Added && (a.Removed || a.NewValue == b.NewValue)
+	case OpDeleteAttr:
+		return strings.EqualFold(a.Key, b.Key)
+	case OpAddClass, OpRemoveClass:
+		return classToken(a) == classToken(b)
+	case OpDeleteNode:
+		return true
+	case OpMoveNode:
+		return pathEqual(a.To, b.To) && a.Position == b.Position
+	}
+	return false
+}
+
 func pathEqual(a, b NodePath) bool {
 	if len(a) != len(b) {
 		return false
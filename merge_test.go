@@ -1,6 +1,10 @@
 package vchtml
 
 import (
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
 	"testing"
 )
 
@@ -87,3 +91,975 @@ func compareHTML(t *testing.T, got, want string) bool {
 	}
 	return true
 }
+
+func TestMergeConflictTypes(t *testing.T) {
+	baseHTML := `<ul><li>Item 1</li></ul>`
+
+	// A edits the text inside the <li>, B deletes the <li>.
+	deltaA, err := Diff(baseHTML, `<ul><li>Item 1 Modified</li></ul>`, "A")
+	if err != nil {
+		t.Fatal(err)
+	}
+	deltaB, err := Diff(baseHTML, `<ul></ul>`, "B")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, _, conflicts, err := Merge(baseHTML, deltaA, deltaB)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(conflicts) == 0 {
+		t.Fatalf("Expected a conflict")
+	}
+	if conflicts[0].Type != ConflictStructure {
+		t.Errorf("Want %s, got %s", ConflictStructure, conflicts[0].Type)
+	}
+
+	// Deleting a node while the other side updates its attribute is a direct
+	// delete-vs-modify on the same node.
+	baseHTML = `<ul><li class="a">Item 1</li></ul>`
+	deltaA, _ = Diff(baseHTML, `<ul><li class="b">Item 1</li></ul>`, "A")
+	deltaB, _ = Diff(baseHTML, `<ul></ul>`, "B")
+
+	_, _, conflicts, err = Merge(baseHTML, deltaA, deltaB)
+	if err != nil {
+		t.Fatal(err)
+	}
+	found := false
+	for _, c := range conflicts {
+		if c.Type == ConflictDeleteModify {
+			found = true
+		}
+	}
+	if !found {
+		t.Errorf("Expected a %s conflict, got %v", ConflictDeleteModify, conflicts)
+	}
+}
+
+func TestMergeOverlappingTextDeletes(t *testing.T) {
+	baseHTML := `<p>ABCDEFGH</p>`
+
+	// A deletes "CDE", B deletes "DEFG": B reaches past A's range.
+	deltaA, _ := Diff(baseHTML, `<p>ABFGH</p>`, "A")
+	deltaB, _ := Diff(baseHTML, `<p>ABCH</p>`, "B")
+
+	_, _, conflicts, err := Merge(baseHTML, deltaA, deltaB)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(conflicts) != 1 || conflicts[0].Type != ConflictPosition {
+		t.Errorf("Expected one %s conflict, got %v", ConflictPosition, conflicts)
+	}
+}
+
+func TestMergeOptionsProvenance(t *testing.T) {
+	baseHTML := `<div><p>Hello</p></div>`
+	deltaA, _ := Diff(baseHTML, `<div><p>Hi</p></div>`, "Alice")
+	deltaB, _ := Diff(baseHTML, `<div class="greeting"><p>Hello</p></div>`, "Bob")
+	deltaA.Timestamp = 1
+	deltaB.Timestamp = 2
+
+	opts := MergeOptions{
+		Author:        "merge-bot",
+		TimestampFunc: func() int64 { return 1700000000 },
+	}
+	_, merged, conflicts, err := MergeWithOptions(baseHTML, deltaA, deltaB, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(conflicts) > 0 {
+		t.Fatalf("Unexpected conflicts: %v", conflicts)
+	}
+	if merged.Author != "merge-bot" {
+		t.Errorf("Want author merge-bot, got %s", merged.Author)
+	}
+	if merged.Timestamp != 1700000000 {
+		t.Errorf("Want timestamp 1700000000, got %d", merged.Timestamp)
+	}
+
+	// Defaults: system author and a fresh timestamp rather than deltaA's.
+	_, merged, _, err = Merge(baseHTML, deltaA, deltaB)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if merged.Author != "system-merge" {
+		t.Errorf("Want default author system-merge, got %s", merged.Author)
+	}
+	if merged.Timestamp == deltaA.Timestamp {
+		t.Errorf("Merged delta reused deltaA's timestamp")
+	}
+}
+
+func TestMergeWrapWithTextEdit(t *testing.T) {
+	baseHTML := `<p>Hello world</p>`
+
+	// A bolds "world" as a wrap, B appends "!" to the same text.
+	deltaA, _ := DiffWithOptions(baseHTML, `<p>Hello <b>world</b></p>`, "A", DiffOptions{WrapText: true})
+	deltaB, _ := Diff(baseHTML, `<p>Hello world!</p>`, "B")
+
+	merged, _, conflicts, err := Merge(baseHTML, deltaA, deltaB)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(conflicts) > 0 {
+		t.Fatalf("Unexpected conflicts: %v", conflicts)
+	}
+	// B's insert follows the text into the wrapper.
+	if !compareHTML(t, merged, `<p>Hello <b>world!</b></p>`) {
+		t.Errorf("Merge incorrect")
+	}
+}
+
+func TestMergeAnnotateResolutions(t *testing.T) {
+	baseHTML := `<div><p>Hello world</p><p>Other</p></div>`
+	baseHash := hashString(baseHTML)
+
+	deltaA := &Delta{BaseHash: baseHash, Author: "alice", Timestamp: 1, Operations: []Operation{
+		{Type: OpUpdateText, Path: NodePath{0, 1, 0, 0, 0}, OldValue: "Hello world", NewValue: "Hello there"},
+	}}
+	deltaB := &Delta{BaseHash: baseHash, Author: "bob", Timestamp: 2, Operations: []Operation{
+		{Type: OpUpdateText, Path: NodePath{0, 1, 0, 0, 0}, OldValue: "Hello world", NewValue: "Hello moon"},
+		{Type: OpInsertText, Path: NodePath{0, 1, 0, 1, 0}, Position: 5, NewValue: "!"},
+	}}
+
+	// Without a strategy the conflict is reported and nothing is merged.
+	_, _, conflicts, err := Merge(baseHTML, deltaA, deltaB)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(conflicts) != 1 {
+		t.Fatalf("Expected 1 conflict without a resolution strategy, got %v", conflicts)
+	}
+
+	merged, mergedDelta, conflicts, err := MergeWithOptions(baseHTML, deltaA, deltaB, MergeOptions{
+		Strategy:            StrategyLastWriterWins,
+		AnnotateResolutions: true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(conflicts) != 1 {
+		t.Errorf("Expected the resolved conflict to be returned, got %v", conflicts)
+	}
+
+	wanted := `<div><p><!-- vchtml: resolved last-writer-wins, dropped alice's edit -->Hello moon</p><p>Other!</p></div>`
+	if !compareHTML(t, merged, wanted) {
+		t.Errorf("Annotation not adjacent to resolved text change")
+	}
+
+	replayed, err := Patch(baseHTML, mergedDelta)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if replayed != merged {
+		t.Errorf("Merged delta does not reproduce the annotated document:\n%s\n%s", replayed, merged)
+	}
+
+	// Annotations are opt-in.
+	plain, _, _, err := MergeWithOptions(baseHTML, deltaA, deltaB, MergeOptions{Strategy: StrategyLastWriterWins})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !compareHTML(t, plain, `<div><p>Hello moon</p><p>Other!</p></div>`) {
+		t.Errorf("Unexpected plain merge result")
+	}
+}
+
+func TestMergeIdenticalEdits(t *testing.T) {
+	baseHTML := `<ul><li class="a">One</li><li>Two</li><li>Three</li></ul>`
+	baseHash := hashString(baseHTML)
+
+	cases := []struct {
+		name   string
+		op     Operation
+		wanted string
+	}{
+		{"UpdateText", Operation{Type: OpUpdateText, Path: NodePath{0, 1, 0, 0, 0}, OldValue: "One", NewValue: "X"},
+			`<ul><li class="a">X</li><li>Two</li><li>Three</li></ul>`},
+		{"UpdateAttr", Operation{Type: OpUpdateAttr, Path: NodePath{0, 1, 0, 0}, Key: "class", OldValue: "a", NewValue: "b"},
+			`<ul><li class="b">One</li><li>Two</li><li>Three</li></ul>`},
+		{"DeleteNode", Operation{Type: OpDeleteNode, Path: NodePath{0, 1, 0, 0}},
+			`<ul><li>Two</li><li>Three</li></ul>`},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			deltaA := &Delta{BaseHash: baseHash, Author: "A", Operations: []Operation{c.op}}
+			deltaB := &Delta{BaseHash: baseHash, Author: "B", Operations: []Operation{c.op}}
+
+			merged, mergedDelta, conflicts, err := Merge(baseHTML, deltaA, deltaB)
+			if err != nil {
+				t.Fatalf("Merge failed: %v", err)
+			}
+			if len(conflicts) > 0 {
+				t.Fatalf("Unexpected conflicts: %v", conflicts)
+			}
+			if len(mergedDelta.Operations) != 1 {
+				t.Errorf("Expected the change once, got %d ops", len(mergedDelta.Operations))
+			}
+			if !compareHTML(t, merged, c.wanted) {
+				t.Errorf("Merge incorrect.")
+			}
+		})
+	}
+}
+
+func TestMergeStructuredStyle(t *testing.T) {
+	baseHTML := `<p style="color: red; font-size: 12px">Text</p>`
+	opts := DiffOptions{StructuredAttrs: []string{"style"}}
+
+	deltaA, err := DiffWithOptions(baseHTML, `<p style="color: blue; font-size: 12px">Text</p>`, "A", opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	deltaB, err := DiffWithOptions(baseHTML, `<p style="color:red;font-size:14px">Text</p>`, "B", opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(deltaA.Operations) != 1 || deltaA.Operations[0].SubKey != "color" {
+		t.Fatalf("Expected a single color op, got %+v", deltaA.Operations)
+	}
+
+	merged, _, conflicts, err := Merge(baseHTML, deltaA, deltaB)
+	if err != nil {
+		t.Fatalf("Merge failed: %v", err)
+	}
+	if len(conflicts) > 0 {
+		t.Fatalf("Unexpected conflicts: %v", conflicts)
+	}
+	if !compareHTML(t, merged, `<p style="color: blue; font-size: 14px">Text</p>`) {
+		t.Errorf("Merge incorrect.")
+	}
+
+	// Without structured diffing the whole attribute conflicts.
+	deltaA, _ = Diff(baseHTML, `<p style="color: blue; font-size: 12px">Text</p>`, "A")
+	deltaB, _ = Diff(baseHTML, `<p style="color: red; font-size: 14px">Text</p>`, "B")
+	if _, _, conflicts, _ := Merge(baseHTML, deltaA, deltaB); len(conflicts) == 0 {
+		t.Error("Expected whole-attribute edits to conflict")
+	}
+}
+
+func TestDetectAllConflicts(t *testing.T) {
+	baseHTML := `<p>One</p><p class="x">Two</p>`
+	baseHash := hashString(baseHTML)
+	text := NodePath{0, 1, 0, 0}
+	second := NodePath{0, 1, 1}
+
+	d1 := &Delta{BaseHash: baseHash, Author: "A", Operations: []Operation{
+		{Type: OpUpdateText, Path: text, OldValue: "One", NewValue: "X"},
+	}}
+	d2 := &Delta{BaseHash: baseHash, Author: "B", Operations: []Operation{
+		{Type: OpUpdateText, Path: text, OldValue: "One", NewValue: "Y"},
+		{Type: OpUpdateAttr, Path: second, Key: "class", OldValue: "x", NewValue: "b"},
+	}}
+	d3 := &Delta{BaseHash: baseHash, Author: "C", Operations: []Operation{
+		{Type: OpUpdateAttr, Path: second, Key: "class", OldValue: "x", NewValue: "c"},
+	}}
+
+	// MergeAll stops at the first conflict.
+	if _, _, conflicts, _ := MergeAll(baseHTML, []*Delta{d1, d2, d3}); len(conflicts) != 1 {
+		t.Fatalf("Expected MergeAll to report 1 conflict, got %v", conflicts)
+	}
+
+	conflicts := DetectAllConflicts(baseHTML, []*Delta{d1, d2, d3})
+	if len(conflicts) != 2 {
+		t.Fatalf("Expected 2 conflicts, got %d: %v", len(conflicts), conflicts)
+	}
+	if conflicts[0].Ops[1].NewValue != "Y" || conflicts[1].Ops[0].NewValue != "b" || conflicts[1].Ops[1].NewValue != "c" {
+		t.Errorf("Unexpected conflicts: %+v", conflicts)
+	}
+}
+
+func TestMergeAtomicTextWithGranularEdit(t *testing.T) {
+	baseHTML := `<p>The quick fox</p>`
+	text := NodePath{0, 1, 0, 0}
+
+	// A replaces the whole text atomically, B appends to it.
+	deltaA := &Delta{BaseHash: hashString(baseHTML), Author: "A", Operations: []Operation{
+		{Type: OpUpdateText, Path: text, OldValue: "The quick fox", NewValue: "The slow fox"},
+	}}
+	deltaB, err := Diff(baseHTML, `<p>The quick fox jumps</p>`, "B")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, order := range [][2]*Delta{{deltaA, deltaB}, {deltaB, deltaA}} {
+		merged, _, conflicts, err := Merge(baseHTML, order[0], order[1])
+		if err != nil {
+			t.Fatalf("Merge failed: %v", err)
+		}
+		if len(conflicts) > 0 {
+			t.Fatalf("Unexpected conflicts: %v", conflicts)
+		}
+		if !compareHTML(t, merged, `<p>The slow fox jumps</p>`) {
+			t.Errorf("Merge incorrect.")
+		}
+	}
+
+}
+
+func TestMergeAtomicTextMixedEdits(t *testing.T) {
+	baseHTML := `<p>Hello world</p>`
+	text := NodePath{0, 1, 0, 0}
+	update := func(old, new string) Operation {
+		return Operation{Type: OpUpdateText, Path: text, OldValue: old, NewValue: new}
+	}
+
+	tests := []struct {
+		name     string
+		granular Operation
+		atomic   Operation
+		want     string
+	}{
+		{"InsertIntoReplaced", Operation{Type: OpInsertText, Path: text, Position: 11, NewValue: "!"}, update("Hello world", "Hi"), `<p>Hi!</p>`},
+		{"Split", Operation{Type: OpSplitText, Path: text, Position: 6}, update("Hello world", "Hello brave world"), `<p>Hello brave world</p>`},
+		{"Replace", Operation{Type: OpReplaceText, Path: text, Position: 0, OldValue: "Hello", NewValue: "Howdy"}, update("Hello world", "Hello world, again"), `<p>Howdy world, again</p>`},
+	}
+	for _, tt := range tests {
+		deltaA := &Delta{BaseHash: hashString(baseHTML), Operations: []Operation{tt.granular}}
+		deltaB := &Delta{BaseHash: hashString(baseHTML), Operations: []Operation{tt.atomic}}
+		for _, order := range [][2]*Delta{{deltaA, deltaB}, {deltaB, deltaA}} {
+			merged, _, conflicts, err := Merge(baseHTML, order[0], order[1])
+			if err != nil || len(conflicts) > 0 {
+				t.Fatalf("%s: Merge failed: %v %v", tt.name, err, conflicts)
+			}
+			if !compareHTML(t, merged, tt.want) {
+				t.Errorf("%s: Merge incorrect.", tt.name)
+			}
+		}
+	}
+
+	// DetectAllConflicts converts the update the same way.
+	appended := &Delta{BaseHash: hashString(baseHTML), Operations: []Operation{{Type: OpInsertText, Path: text, Position: 11, NewValue: "!"}}}
+	replaced := &Delta{BaseHash: hashString(baseHTML), Operations: []Operation{update("Hello world", "Hi")}}
+	if conflicts := DetectAllConflicts(baseHTML, []*Delta{appended, replaced}); len(conflicts) > 0 {
+		t.Errorf("DetectAllConflicts: unexpected conflicts %v", conflicts)
+	}
+	if merged, _, conflicts, err := MergeAll(baseHTML, []*Delta{appended, replaced}); err != nil || len(conflicts) > 0 || !compareHTML(t, merged, `<p>Hi!</p>`) {
+		t.Errorf("MergeAll: got %s %v %v", merged, conflicts, err)
+	}
+
+	// An update without its old text can't be converted to edits.
+	deltaA := &Delta{BaseHash: hashString(baseHTML), Operations: []Operation{{Type: OpInsertText, Path: text, Position: 5, NewValue: ","}}}
+	deltaB := &Delta{BaseHash: hashString(baseHTML), Operations: []Operation{update("", "Goodbye")}}
+	_, _, conflicts, err := Merge(baseHTML, deltaA, deltaB)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(conflicts) != 1 || conflicts[0].Type != ConflictDirect {
+		t.Errorf("Expected a direct conflict, got %v", conflicts)
+	}
+}
+
+func TestMergeTextContext(t *testing.T) {
+	baseHTML := `<p>The quick fox</p>`
+	diff := func(newHTML string) *Delta {
+		d, err := DiffWithOptions(baseHTML, newHTML, "A", DiffOptions{TextContext: 6})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return d
+	}
+	deltaA, deltaB := diff(`<p>The quick red fox</p>`), diff(`<p>The quick big fox</p>`)
+
+	// The transformed insert must not be pulled back by its old context, or
+	// the order of the inserts would depend on the order of the deltas.
+	ab, _, _, err := Merge(baseHTML, deltaA, deltaB)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ba, _, _, err := Merge(baseHTML, deltaB, deltaA)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ab != ba {
+		t.Errorf("Merge depends on order: %s vs %s", ab, ba)
+	}
+}
+
+func TestMergeAssociative(t *testing.T) {
+	baseHTML := `<ul><li id="a">a</li><li id="b">b</li><li id="c">c</li></ul>`
+	diff := func(newHTML, author string) *Delta {
+		d, err := Diff(baseHTML, newHTML, author)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return d
+	}
+	deltaA := diff(`<ul><li id="a">a</li><li id="b">b</li><li id="x">x</li><li id="c">c</li></ul>`, "A")
+	deltaB := diff(`<ul><li id="b">b</li><li id="c">c</li></ul>`, "B")
+	deltaC := diff(`<ul><li id="a">a</li><li id="b">b</li><li id="c">c!</li></ul>`, "C")
+	want := `<ul><li id="b">b</li><li id="x">x</li><li id="c">c!</li></ul>`
+
+	merge := func(a, b *Delta) (string, *Delta) {
+		out, merged, conflicts, err := Merge(baseHTML, a, b)
+		if err != nil {
+			t.Fatalf("Merge failed: %v", err)
+		}
+		if len(conflicts) > 0 {
+			t.Fatalf("Unexpected conflicts: %v", conflicts)
+		}
+		return out, merged
+	}
+
+	_, ab := merge(deltaA, deltaB)
+	left, _ := merge(ab, deltaC)
+	_, bc := merge(deltaB, deltaC)
+	right, _ := merge(deltaA, bc)
+
+	if !compareHTML(t, left, want) {
+		t.Error("Merge(Merge(A, B), C) incorrect")
+	}
+	if !compareHTML(t, right, want) {
+		t.Error("Merge(A, Merge(B, C)) incorrect")
+	}
+}
+
+func TestMergeCommutative(t *testing.T) {
+	baseHTML := `<ul><li>a</li></ul><p>Hi</p>`
+	insert := func(author string, ops ...Operation) *Delta {
+		return &Delta{BaseHash: hashString(baseHTML), Author: author, Operations: ops}
+	}
+	list, text := NodePath{0, 1, 0}, NodePath{0, 1, 1, 0}
+	for _, tc := range []struct {
+		name           string
+		deltaA, deltaB *Delta
+	}{
+		{"nodes",
+			insert("A", Operation{Type: OpInsertNode, Path: list, Position: 0, NodeData: `<li>x</li>`, ParentTag: "ul"}),
+			insert("B", Operation{Type: OpInsertNode, Path: list, Position: 0, NodeData: `<li>y</li>`, ParentTag: "ul"})},
+		{"text",
+			insert("A", Operation{Type: OpInsertText, Path: text, Position: 2, NewValue: "!"}),
+			insert("B", Operation{Type: OpInsertText, Path: text, Position: 2, NewValue: "?"})},
+	} {
+		ab, _, conflicts, err := Merge(baseHTML, tc.deltaA, tc.deltaB)
+		if err != nil || len(conflicts) != 0 {
+			t.Fatalf("%s: Merge(A, B): %v, %v", tc.name, conflicts, err)
+		}
+		ba, _, conflicts, err := Merge(baseHTML, tc.deltaB, tc.deltaA)
+		if err != nil || len(conflicts) != 0 {
+			t.Fatalf("%s: Merge(B, A): %v, %v", tc.name, conflicts, err)
+		}
+		if ab != ba {
+			t.Errorf("%s: Merge(A, B) = %s, Merge(B, A) = %s", tc.name, ab, ba)
+		}
+	}
+}
+
+func TestMergeBaseHash(t *testing.T) {
+	baseHTML := `<ul><li id="a">a</li><li id="b">b</li><li id="c">c</li></ul>`
+	stored := hashString(baseHTML)
+	var deltas []*Delta
+	for _, newHTML := range []string{
+		`<ul><li id="a">a!</li><li id="b">b</li><li id="c">c</li></ul>`,
+		`<ul><li id="a">a</li><li id="b">b!</li><li id="c">c</li></ul>`,
+		`<ul><li id="a">a</li><li id="b">b</li><li id="c">c!</li></ul>`,
+	} {
+		d, err := Diff(baseHTML, newHTML, "tester")
+		if err != nil {
+			t.Fatal(err)
+		}
+		deltas = append(deltas, d)
+	}
+
+	if !deltas[0].BaseMatches(stored) {
+		t.Error("Expected the delta to match its base hash")
+	}
+	if deltas[0].BaseMatches(hashString(baseHTML + " ")) {
+		t.Error("Expected a different revision not to match")
+	}
+
+	// With the hash supplied, the base is never hashed.
+	hashed := countHashes(t)
+	got, _, conflicts, err := MergeAllWithHash(baseHTML, stored, deltas)
+	if *hashed != 0 {
+		t.Errorf("MergeAllWithHash hashed %d documents", *hashed)
+	}
+	if err != nil || len(conflicts) > 0 {
+		t.Fatalf("MergeAllWithHash failed: %v %v", err, conflicts)
+	}
+	want, _, _, _ := MergeAll(baseHTML, deltas)
+	if got != want {
+		t.Errorf("MergeAllWithHash = %s, MergeAll = %s", got, want)
+	}
+
+	*hashed = 0
+	if _, _, _, err := MergeWithOptions(baseHTML, deltas[0], deltas[1], MergeOptions{BaseHash: stored}); err != nil {
+		t.Fatalf("Merge failed: %v", err)
+	}
+	if *hashed != 0 {
+		t.Errorf("MergeWithOptions hashed %d documents", *hashed)
+	}
+
+	if _, _, _, err := MergeAllWithHash(baseHTML, hashString("other"), deltas); err == nil {
+		t.Error("Expected a base hash mismatch")
+	}
+}
+
+// countHashes makes hashFunc count the documents it hashes until tb ends.
+func countHashes(tb testing.TB) *int {
+	count := new(int)
+	hash := hashFunc
+	hashFunc = func(s string) string {
+		*count++
+		return hash(s)
+	}
+	tb.Cleanup(func() { hashFunc = hash })
+	return count
+}
+
+func TestMergeMoveWithEdit(t *testing.T) {
+	baseHTML := `<ul><li>one</li><li>two</li><li>three</li></ul>`
+	list := NodePath{0, 1, 0}
+	// A drags the third item to the top.
+	deltaA := &Delta{BaseHash: hashString(baseHTML), Author: "A", Operations: []Operation{
+		{Type: OpMoveNode, Path: NodePath{0, 1, 0, 2}, To: list, Position: 0},
+	}}
+	deltaB, err := Diff(baseHTML, `<ul><li>one</li><li>two</li><li>three (edited)</li></ul>`, "B")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `<ul><li>three (edited)</li><li>one</li><li>two</li></ul>`
+
+	for _, order := range [][2]*Delta{{deltaA, deltaB}, {deltaB, deltaA}} {
+		merged, _, conflicts, err := Merge(baseHTML, order[0], order[1])
+		if err != nil {
+			t.Fatalf("Merge failed: %v", err)
+		}
+		if len(conflicts) > 0 {
+			t.Fatalf("Unexpected conflicts: %v", conflicts)
+		}
+		if !compareHTML(t, merged, want) {
+			t.Errorf("Merge(%s, %s) incorrect", order[0].Author, order[1].Author)
+		}
+	}
+
+	// A sibling inserted concurrently shifts both the source and the
+	// destination of the move. Both land at the top, in the same order
+	// whichever delta comes first.
+	deltaC := &Delta{BaseHash: hashString(baseHTML), Author: "C", Operations: []Operation{
+		{Type: OpInsertNode, Path: list, Position: 0, NodeData: `<li>zero</li>`, ParentTag: "ul"},
+	}}
+	for _, tc := range []struct {
+		first, second *Delta
+		want          string
+	}{
+		{deltaA, deltaC, `<ul><li>three</li><li>zero</li><li>one</li><li>two</li></ul>`},
+		{deltaC, deltaA, `<ul><li>three</li><li>zero</li><li>one</li><li>two</li></ul>`},
+	} {
+		merged, _, conflicts, err := Merge(baseHTML, tc.first, tc.second)
+		if err != nil || len(conflicts) > 0 {
+			t.Fatalf("Merge failed: %v %v", err, conflicts)
+		}
+		if !compareHTML(t, merged, tc.want) {
+			t.Errorf("Merge(%s, %s) incorrect", tc.first.Author, tc.second.Author)
+		}
+	}
+}
+
+func TestVerifyMergeConsistency(t *testing.T) {
+	base := `<div id="a"><p>Alpha text</p><ul><li id="i1">one</li><li id="i2">two</li><li id="i3">three</li></ul></div>` +
+		`<div id="b"><p>Beta text</p><p>Gamma</p></div>`
+	cases := []struct {
+		name       string
+		editA      string
+		editB      string
+		wantMerged string
+	}{
+		{
+			"inserts in both subtrees",
+			`<div id="a"><p>Alpha text</p><ul><li>zero</li><li id="i1">one</li><li id="i2">two</li><li id="i3">three</li></ul></div><div id="b"><p>Beta text</p><p>Gamma</p></div>`,
+			`<div id="a"><p>Alpha text</p><ul><li id="i1">one</li><li id="i2">two</li><li id="i3">three</li></ul></div><div id="b"><p>Beta text</p><p>Gamma</p><p>Delta</p></div>`,
+			`<div id="a"><p>Alpha text</p><ul><li>zero</li><li id="i1">one</li><li id="i2">two</li><li id="i3">three</li></ul></div><div id="b"><p>Beta text</p><p>Gamma</p><p>Delta</p></div>`,
+		},
+		{
+			"delete beside an insert",
+			`<div id="a"><p>Alpha text</p><ul><li id="i1">one</li><li id="i3">three</li></ul></div><div id="b"><p>Beta text</p><p>Gamma</p></div>`,
+			`<div id="a"><p>Alpha text</p><ul><li id="i1">one</li><li id="i2">two</li><li id="i3">three</li></ul><p>Note</p></div><div id="b"><p>Beta text</p><p>Gamma</p></div>`,
+			`<div id="a"><p>Alpha text</p><ul><li id="i1">one</li><li id="i3">three</li></ul><p>Note</p></div><div id="b"><p>Beta text</p><p>Gamma</p></div>`,
+		},
+		{
+			"text edits and a delete",
+			`<div id="a"><p>Alpha text, edited</p><ul><li id="i1">one</li><li id="i2">two</li><li id="i3">three</li></ul></div><div id="b"><p>Beta text</p><p>Gamma</p></div>`,
+			`<div id="a"><p>Alpha text</p><ul><li id="i1">one</li><li id="i2">two</li><li id="i3">three</li></ul></div><div id="b"><p>Beta</p></div>`,
+			`<div id="a"><p>Alpha text, edited</p><ul><li id="i1">one</li><li id="i2">two</li><li id="i3">three</li></ul></div><div id="b"><p>Beta</p></div>`,
+		},
+		{
+			"same text node, different words",
+			`<div id="a"><p>Big Alpha text</p><ul><li id="i1">one</li><li id="i2">two</li><li id="i3">three</li></ul></div><div id="b"><p>Beta text</p><p>Gamma</p></div>`,
+			`<div id="a"><p>Alpha text here</p><ul><li id="i1">one</li><li id="i2">two</li><li id="i3">three</li></ul></div><div id="b"><p>Beta text</p><p>Gamma</p></div>`,
+			`<div id="a"><p>Big Alpha text here</p><ul><li id="i1">one</li><li id="i2">two</li><li id="i3">three</li></ul></div><div id="b"><p>Beta text</p><p>Gamma</p></div>`,
+		},
+		{
+			"attributes and deletes in one list",
+			`<div id="a" class="x"><p>Alpha text</p><ul><li id="i2">two</li><li id="i3">three</li></ul></div><div id="b"><p>Beta text</p><p>Gamma</p></div>`,
+			`<div id="a"><p>Alpha text</p><ul><li id="i1">one</li><li id="i2">two</li></ul></div><div id="b" title="t"><p>Beta text</p><p>Gamma</p></div>`,
+			`<div id="a" class="x"><p>Alpha text</p><ul><li id="i2">two</li></ul></div><div id="b" title="t"><p>Beta text</p><p>Gamma</p></div>`,
+		},
+		{
+			"bold beside a deleted word",
+			`<div id="a"><p>Alpha</p><ul><li id="i1">one</li><li id="i2">two</li><li id="i3">three</li></ul></div><div id="b"><p>Beta text</p><p>Gamma</p></div>`,
+			`<div id="a"><p><b>Alpha</b> text</p><ul><li id="i1">one</li><li id="i2">two</li><li id="i3">three</li></ul></div><div id="b"><p>Beta text</p><p>Gamma</p></div>`,
+			`<div id="a"><p><b>Alpha</b></p><ul><li id="i1">one</li><li id="i2">two</li><li id="i3">three</li></ul></div><div id="b"><p>Beta text</p><p>Gamma</p></div>`,
+		},
+	}
+	for _, c := range cases {
+		opts := DiffOptions{WrapText: true}
+		deltaA, _ := DiffWithOptions(base, c.editA, "A", opts)
+		deltaB, _ := DiffWithOptions(base, c.editB, "B", opts)
+		for _, order := range [][2]*Delta{{deltaA, deltaB}, {deltaB, deltaA}} {
+			if err := VerifyMergeConsistency(base, order[0], order[1]); err != nil {
+				t.Errorf("%s (%s first): %v", c.name, order[0].Author, err)
+			}
+			merged, _, _, err := Merge(base, order[0], order[1])
+			if err != nil {
+				t.Fatalf("%s: merge failed: %v", c.name, err)
+			}
+			if !compareHTML(t, merged, c.wantMerged) {
+				t.Errorf("%s (%s first): merged document is missing a change", c.name, order[0].Author)
+			}
+		}
+	}
+}
+
+func TestMergeSplitInDeletedText(t *testing.T) {
+	base := `<p>Alpha text</p>`
+	deltaA, _ := Diff(base, `<p>A</p>`, "A")
+	deltaB, _ := Diff(base, `<p>Alpha <b>text</b></p>`, "B")
+	_, _, conflicts, err := Merge(base, deltaA, deltaB)
+	if err != nil {
+		t.Fatalf("Merge failed: %v", err)
+	}
+	if len(conflicts) == 0 {
+		t.Error("expected a conflict for wrapping text the other side deleted")
+	}
+}
+
+func TestMergeTransformExpansionCap(t *testing.T) {
+	text := strings.Repeat("a", 2*maxTransformExpansion)
+	base := "<p>" + text + "</p>"
+	path := NodePath{0, 1, 0, 0}
+
+	// A scatters single-character inserts through the text, and B deletes
+	// all of it: B's deletion splits around every one of A's inserts.
+	deltaA := &Delta{BaseHash: hashString(base), Author: "A"}
+	for i := 0; i <= maxTransformExpansion; i++ {
+		deltaA.Operations = append(deltaA.Operations, Operation{Type: OpInsertText, Path: path, Position: 1 + 2*i, NewValue: "x"})
+	}
+	deltaB := &Delta{BaseHash: hashString(base), Author: "B", Operations: []Operation{
+		{Type: OpDeleteText, Path: path, Position: 0, OldValue: text},
+	}}
+
+	_, _, _, err := Merge(base, deltaA, deltaB)
+	if err == nil || !strings.Contains(err.Error(), "more than") {
+		t.Fatalf("Expected the expansion guard to fail the merge, got %v", err)
+	}
+
+	// Below the cap the same shape merges: only A's inserts survive.
+	deltaA.Operations = deltaA.Operations[:3]
+	merged, _, _, err := Merge(base, deltaA, deltaB)
+	if err != nil {
+		t.Fatalf("Merge failed: %v", err)
+	}
+	if !compareHTML(t, merged, "<p>xxx</p>") {
+		t.Errorf("Merged = %s", merged)
+	}
+
+	// The other way round each insert splits the deletion only once, but
+	// the splits add up.
+	inserts := make([]Operation, maxTransformExpansion+1)
+	for i := range inserts {
+		inserts[i] = Operation{Type: OpInsertText, Path: path, Position: 1 + 2*i, NewValue: "x"}
+	}
+	if _, _, err := transformSeqs(inserts, deltaB.Operations); err == nil || !strings.Contains(err.Error(), "more than") {
+		t.Errorf("Expected the running total to hit the cap, got %v", err)
+	}
+}
+
+func TestMergeReplaceText(t *testing.T) {
+	baseHTML := `<p>The Old house stands</p>`
+	replaced, err := DiffWithOptions(baseHTML, `<p>The New house stands</p>`, "A", DiffOptions{ReplaceText: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct{ other, want string }{
+		{`<p>The Old house still stands</p>`, `<p>The New house still stands</p>`},
+		{`<p>Here The Old house stands</p>`, `<p>Here The New house stands</p>`},
+		{`<p>The Old <b>house</b> stands</p>`, `<p>The New <b>house</b> stands</p>`},
+	}
+	for _, c := range cases {
+		other, _ := Diff(baseHTML, c.other, "B")
+		for _, pair := range [][2]*Delta{{replaced, other}, {other, replaced}} {
+			got, _, conflicts, err := Merge(baseHTML, pair[0], pair[1])
+			if err != nil || len(conflicts) > 0 {
+				t.Fatalf("Merge with %s failed: %v %v", c.other, err, conflicts)
+			}
+			if !compareHTML(t, got, c.want) {
+				t.Errorf("Merge with %s = %s, want %s", c.other, got, c.want)
+			}
+			if err := VerifyMergeConsistency(baseHTML, pair[0], pair[1]); err != nil {
+				t.Errorf("Merge with %s: %v", c.other, err)
+			}
+		}
+	}
+
+	// The replacement is atomic: an edit inside its range conflicts.
+	overlapping, _ := Diff(baseHTML, `<p>The Bold house stands</p>`, "B")
+	_, _, conflicts, err := Merge(baseHTML, replaced, overlapping)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(conflicts) == 0 || conflicts[0].Type != ConflictPosition {
+		t.Errorf("Expected a position conflict, got %v", conflicts)
+	}
+
+	// Both sides making the same replacement is one change.
+	got, _, conflicts, err := Merge(baseHTML, replaced, replaced)
+	if err != nil || len(conflicts) > 0 {
+		t.Fatalf("Merge failed: %v %v", err, conflicts)
+	}
+	if !compareHTML(t, got, `<p>The New house stands</p>`) {
+		t.Errorf("Duplicate replace merged to %s", got)
+	}
+}
+
+func TestMergeInsertDeleteSameIndex(t *testing.T) {
+	items := []string{"a", "b", "c", "d"}
+	render := func(items []string) string {
+		var sb strings.Builder
+		sb.WriteString("<ul>")
+		for _, item := range items {
+			sb.WriteString("<li>" + item + "</li>")
+		}
+		sb.WriteString("</ul>")
+		return sb.String()
+	}
+	base := render(items)
+	ul := NodePath{0, 1, 0}
+
+	// A inserts before item ins (at the end when ins == len(items)); B
+	// deletes item del. Either way round, the new item keeps its place
+	// among the surviving items and the deleted one is gone.
+	for ins := 0; ins <= len(items); ins++ {
+		for del := 0; del < len(items); del++ {
+			deltaA := &Delta{BaseHash: hashString(base), Author: "A", Operations: []Operation{
+				{Type: OpInsertNode, Path: ul, Position: ins, NodeData: "<li>x</li>", ParentTag: "ul"},
+			}}
+			deltaB := &Delta{BaseHash: hashString(base), Author: "B", Operations: []Operation{
+				{Type: OpDeleteNode, Path: append(append(NodePath(nil), ul...), del)},
+			}}
+			var want []string
+			for i, item := range items {
+				if i == ins {
+					want = append(want, "x")
+				}
+				if i != del {
+					want = append(want, item)
+				}
+			}
+			if ins == len(items) {
+				want = append(want, "x")
+			}
+
+			// Transforming each op past the other gives the same document in
+			// both orders.
+			insert, remove := deltaA.Operations[0], deltaB.Operations[0]
+			for _, order := range [][2]Operation{{insert, remove}, {remove, insert}} {
+				moved, err := transformOp(order[1], order[0], false)
+				if err != nil || len(moved) != 1 {
+					t.Fatalf("insert@%d, delete %d: transform failed: %v %v", ins, del, moved, err)
+				}
+				got, err := Patch(base, &Delta{BaseHash: hashString(base), Operations: []Operation{order[0], moved[0]}})
+				if err != nil {
+					t.Fatalf("insert@%d, delete %d: patch failed: %v", ins, del, err)
+				}
+				if !compareHTML(t, got, render(want)) {
+					t.Errorf("insert@%d, delete %d (%s first): got %s, want %s", ins, del, order[0].Type, got, render(want))
+				}
+			}
+
+			for _, pair := range [][2]*Delta{{deltaA, deltaB}, {deltaB, deltaA}} {
+				got, _, conflicts, err := Merge(base, pair[0], pair[1])
+				if err != nil || len(conflicts) > 0 {
+					t.Fatalf("insert@%d, delete %d: merge failed: %v %v", ins, del, err, conflicts)
+				}
+				if !compareHTML(t, got, render(want)) {
+					t.Errorf("insert@%d, delete %d (%s first): got %s, want %s", ins, del, pair[0].Author, got, render(want))
+				}
+				if err := VerifyMergeConsistency(base, pair[0], pair[1]); err != nil {
+					t.Errorf("insert@%d, delete %d (%s first): %v", ins, del, pair[0].Author, err)
+				}
+			}
+		}
+	}
+}
+
+func TestMergeDeleteParentInsertChild(t *testing.T) {
+	base := `<ul><li>a</li></ul><p>Hi</p>`
+	ul := NodePath{0, 1, 0}
+	deleteList := &Delta{BaseHash: hashString(base), Author: "A", Operations: []Operation{
+		{Type: OpDeleteNode, Path: ul},
+	}}
+	insertItem := &Delta{BaseHash: hashString(base), Author: "B", Operations: []Operation{
+		{Type: OpInsertNode, Path: ul, Position: 1, NodeData: "<li>b</li>", ParentTag: "ul"},
+	}}
+	for _, pair := range [][2]*Delta{{deleteList, insertItem}, {insertItem, deleteList}} {
+		_, _, conflicts, err := Merge(base, pair[0], pair[1])
+		if err != nil {
+			t.Fatalf("%s first: %v", pair[0].Author, err)
+		}
+		if len(conflicts) != 1 || conflicts[0].Type != ConflictStructure || !pathEqual(conflicts[0].Path, ul) {
+			t.Errorf("%s first: expected a structure conflict on %v, got %v", pair[0].Author, ul, conflicts)
+		}
+	}
+}
+
+func TestMergeEmptyDelta(t *testing.T) {
+	base := `<p>Hello</p>`
+	edit, _ := DiffWithOptions(base, `<p>Hello world</p>`, "A", DiffOptions{Root: PathRootBody})
+	empty, _ := Diff(base, base, "B")
+	if !empty.IsEmpty() {
+		t.Fatalf("Expected an empty delta, got %v", empty.Operations)
+	}
+
+	// In either order, merging with the empty delta yields the edit, even
+	// though the two deltas use different path roots.
+	for _, pair := range [][2]*Delta{{edit, empty}, {empty, edit}} {
+		got, merged, conflicts, err := Merge(base, pair[0], pair[1])
+		if err != nil || len(conflicts) > 0 {
+			t.Fatalf("Merge failed: %v %v", err, conflicts)
+		}
+		if !compareHTML(t, got, `<p>Hello world</p>`) {
+			t.Errorf("Merged = %s", got)
+		}
+		if !reflect.DeepEqual(merged.Operations, edit.Operations) || merged.Root != edit.Root {
+			t.Errorf("Merged delta = %+v, want the edit's ops", merged)
+		}
+	}
+
+	got, merged, _, err := MergeAll(base, []*Delta{empty, edit, empty})
+	if err != nil || !compareHTML(t, got, `<p>Hello world</p>`) || len(merged.Operations) != len(edit.Operations) {
+		t.Errorf("MergeAll with empty deltas = %s, %v (%v)", got, merged, err)
+	}
+	got, merged, _, err = MergeAll(base, []*Delta{empty, empty})
+	if err != nil || !compareHTML(t, got, base) || !merged.IsEmpty() {
+		t.Errorf("MergeAll of empty deltas = %s, %v (%v)", got, merged, err)
+	}
+}
+
+func TestMergeAttrAddVsAdd(t *testing.T) {
+	baseHTML := `<p>Hi</p>`
+	diff := func(newHTML, author string) *Delta {
+		d, err := Diff(baseHTML, newHTML, author)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return d
+	}
+	addX := diff(`<p title="x">Hi</p>`, "A")
+	addY := diff(`<p title="y">Hi</p>`, "B")
+	if op := addX.Operations[0]; op.Type != OpUpdateAttr || !op.Added {
+		t.Fatalf("Expected an UPDATE_ATTR marked as an add, got %s", op)
+	}
+
+	// Different values for the same new attribute conflict, in either order.
+	for _, pair := range [][2]*Delta{{addX, addY}, {addY, addX}} {
+		_, _, conflicts, err := Merge(baseHTML, pair[0], pair[1])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(conflicts) != 1 || conflicts[0].Type != ConflictDirect {
+			t.Errorf("Expected one direct conflict, got %v", conflicts)
+		}
+	}
+
+	// The same value added on both sides is one change.
+	got, merged, conflicts, err := Merge(baseHTML, addX, diff(`<p title="x">Hi</p>`, "B"))
+	if err != nil || len(conflicts) > 0 {
+		t.Fatalf("Merge failed: %v %v", err, conflicts)
+	}
+	if len(merged.Operations) != 1 || !compareHTML(t, got, `<p title="x">Hi</p>`) {
+		t.Errorf("Duplicate add merged to %s with ops %v", got, merged.Operations)
+	}
+
+	// An add is not an update of an attribute that is present but empty.
+	emptyBase := `<p title="">Hi</p>`
+	setX, _ := Diff(emptyBase, `<p title="x">Hi</p>`, "B")
+	if _, _, conflicts, _ := Merge(emptyBase, &Delta{BaseHash: hashString(emptyBase), Operations: addX.Operations}, setX); len(conflicts) != 1 {
+		t.Errorf("Expected add vs update to conflict, got %v", conflicts)
+	}
+	if _, err := PatchWithOptions(emptyBase, &Delta{BaseHash: hashString(emptyBase), Operations: addX.Operations}, PatchOptions{VerifyAttrPreconditions: true}); err == nil {
+		t.Error("Expected the add to fail its precondition on a present attribute")
+	}
+	if _, err := PatchWithOptions(baseHTML, addX, PatchOptions{VerifyAttrPreconditions: true}); err != nil {
+		t.Errorf("Add failed its precondition on an absent attribute: %v", err)
+	}
+}
+
+func TestMergeMaxConflicts(t *testing.T) {
+	// Both sides rewrite each of 50 paragraphs differently: 50 conflicts.
+	var base, a, b strings.Builder
+	for i := 0; i < 50; i++ {
+		fmt.Fprintf(&base, "<p>item %d</p>", i)
+		fmt.Fprintf(&a, "<p>A wrote %d</p>", i)
+		fmt.Fprintf(&b, "<p>B wrote %d</p>", i)
+	}
+	deltaA, _ := DiffWithOptions(base.String(), a.String(), "A", DiffOptions{MaxTextDiffLen: 1})
+	deltaB, _ := DiffWithOptions(base.String(), b.String(), "B", DiffOptions{MaxTextDiffLen: 1})
+
+	_, _, all, err := Merge(base.String(), deltaA, deltaB)
+	if err != nil || len(all) != 50 {
+		t.Fatalf("Expected 50 conflicts without a limit, got %d (%v)", len(all), err)
+	}
+
+	for _, strategy := range []ResolutionStrategy{StrategyFail, StrategyKeepYours} {
+		_, merged, conflicts, err := MergeWithOptions(base.String(), deltaA, deltaB, MergeOptions{MaxConflicts: 5, Strategy: strategy})
+		if !errors.Is(err, ErrTooManyConflicts) {
+			t.Errorf("%s: expected ErrTooManyConflicts, got %v", strategy, err)
+		}
+		if len(conflicts) != 5 || merged != nil {
+			t.Errorf("%s: expected the first 5 conflicts and no merge, got %d and %v", strategy, len(conflicts), merged)
+		}
+		if len(conflicts) > 0 && !reflect.DeepEqual(conflicts[0], all[0]) {
+			t.Errorf("%s: partial list starts with %v, want %v", strategy, conflicts[0], all[0])
+		}
+	}
+
+	// At the limit the merge proceeds as usual.
+	_, _, conflicts, err := MergeWithOptions(base.String(), deltaA, deltaB, MergeOptions{MaxConflicts: 50})
+	if err != nil || len(conflicts) != 50 {
+		t.Errorf("Expected all 50 conflicts at the limit, got %d (%v)", len(conflicts), err)
+	}
+}
+
+func TestMergeTextThreeWay(t *testing.T) {
+	base := `<p>Hello</p>`
+	update := func(text string) *Delta {
+		return &Delta{BaseHash: hashString(base), Operations: []Operation{
+			{Type: OpUpdateText, Path: NodePath{0, 1, 0, 0}, OldValue: "Hello", NewValue: text},
+		}}
+	}
+	appended, prepended := update("Hello world"), update("Oh, Hello")
+
+	if _, _, conflicts, _ := Merge(base, appended, prepended); len(conflicts) != 1 {
+		t.Fatalf("Expected atomic updates to conflict by default, got %v", conflicts)
+	}
+	opts := MergeOptions{MergeText: true}
+	merged, _, conflicts, err := MergeWithOptions(base, appended, prepended, opts)
+	if err != nil || len(conflicts) != 0 {
+		t.Fatalf("Merge: %v, %v", conflicts, err)
+	}
+	if !compareHTML(t, merged, `<html><head></head><body><p>Oh, Hello world</p></body></html>`) {
+		t.Errorf("got %s", merged)
+	}
+
+	// Both sides rewriting the same letter still conflict.
+	if _, _, conflicts, _ := MergeWithOptions(base, update("Hallo"), update("Hullo"), opts); len(conflicts) != 1 {
+		t.Errorf("Expected overlapping edits to conflict, got %v", conflicts)
+	}
+	// As do two insertions at the same place.
+	if _, _, conflicts, _ := MergeWithOptions(base, update("Hello!"), update("Hello?"), opts); len(conflicts) != 1 {
+		t.Errorf("Expected same-offset insertions to conflict, got %v", conflicts)
+	}
+}
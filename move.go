@@ -0,0 +1,361 @@
+package vchtml
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"golang.org/x/net/html"
+)
+
+// CollapseMoves returns a copy of d in which each DELETE_NODE of an element
+// that an INSERT_NODE re-creates, rendering identically, under a different
+// parent is replaced by a single MOVE_NODE, as DiffOptions.DetectMoves would
+// have produced. It works on deltas from any source, such as one diffed
+// without move detection. The deleted content is not part of the delta, so
+// baseHTML, the document d applies to, is needed to find the pairs.
+//
+// A delta with anchored or relative ops, or one whose rewritten ops would not
+// produce the same document, is returned unchanged. The copy is unsigned.
+func CollapseMoves(baseHTML string, d *Delta) (*Delta, error) {
+	if d.ElementIndex {
+		return nil, errors.New("CollapseMoves does not support element-indexed deltas")
+	}
+	if hash := hashFunc(baseHTML); hash != d.BaseHash {
+		return nil, fmt.Errorf("base hash mismatch: expected %s, got %s", d.BaseHash, hash)
+	}
+	doc, err := parseForRoot(baseHTML, d.Root)
+	if err != nil {
+		return nil, err
+	}
+	root, err := resolvePathRoot(doc, d.Root)
+	if err != nil {
+		return nil, err
+	}
+
+	collapsed := *d
+	collapsed.Signature = nil
+	collapsed.Operations = append([]Operation(nil), d.Operations...)
+	for _, op := range d.Operations {
+		if op.Anchor != "" || op.Placement != PlaceAtIndex {
+			return &collapsed, nil
+		}
+	}
+	collapsed.Operations = detectMoves(root, collapsed.Operations)
+	return &collapsed, nil
+}
+
+// detectMoves replaces each DELETE_NODE of a subtree that ops re-insert,
+// unchanged, under a different parent with a single MOVE_NODE, placed where
+// the insert was. The ops around a move are re-addressed for the tree in
+// which the node was never deleted, by replaying ops on an old tree and on a
+// tree with moves side by side and translating paths by node identity. If the
+// two trees end up different, ops are returned unchanged.
+func detectMoves(oldRoot *html.Node, ops []Operation) []Operation {
+	moves := pairMoves(oldRoot, ops)
+	if len(moves) == 0 {
+		return ops
+	}
+
+	// a replays ops as they are; b replays the rewritten ops. byA maps a's
+	// nodes to their counterpart in b.
+	rootA, origA := cloneTree(oldRoot)
+	rootB, origB := cloneTree(oldRoot)
+	byA := make(map[*html.Node]*html.Node)
+	for orig, a := range origA {
+		byA[a] = origB[orig]
+	}
+	pathB := func(a *html.Node) (NodePath, bool) {
+		b, ok := byA[a]
+		if !ok {
+			return nil, false
+		}
+		path, err := GetPath(rootB, b)
+		return path, err == nil
+	}
+
+	deleteSlots := make(map[int]bool)
+	for _, m := range moves {
+		deleteSlots[m.deleteIndex] = true
+	}
+
+	var out []Operation
+	for i, op := range ops {
+		target, err := GetNode(rootA, op.Path)
+		if err != nil {
+			return ops
+		}
+		var before []*html.Node
+		if op.Type == OpInsertNode {
+			before = getChildrenList(target)
+		}
+		if applyOp(NewCursor(rootA), op, PatchOptions{}) != nil {
+			return ops
+		}
+		if deleteSlots[i] {
+			continue // The node stays in b until its move.
+		}
+
+		if m, ok := moves[i]; ok {
+			moved := origB[m.node]
+			if m.deleteIndex > i {
+				// a still holds the original, which b no longer has.
+				unmapTree(byA, origA[m.node])
+			}
+			from, err := GetPath(rootB, moved)
+			if err != nil {
+				return ops
+			}
+			moved.Parent.RemoveChild(moved)
+			to, ok := pathB(target)
+			if !ok {
+				return ops
+			}
+			position := positionB(byA, before, op.Position, byA[target])
+			insertChildAt(byA[target], moved, position)
+			mapTrees(byA, insertedChild(target, before), moved)
+			out = append(out, Operation{Type: OpMoveNode, Path: from, To: to, Position: position})
+			continue
+		}
+
+		path, ok := pathB(target)
+		if !ok {
+			return ops
+		}
+		translated := op
+		translated.Path = path
+		if op.MovedFrom != nil {
+			// The source element is addressed as it is when op applies.
+			translated.MovedFrom = nil
+			if src, err := GetNode(rootA, op.MovedFrom); err == nil {
+				if from, ok := pathB(src); ok {
+					translated.MovedFrom = from
+				}
+			}
+		}
+		var beforeB []*html.Node
+		if op.Type == OpInsertNode {
+			translated.Position = positionB(byA, before, op.Position, byA[target])
+			beforeB = getChildrenList(byA[target])
+		}
+		if applyOp(NewCursor(rootB), translated, PatchOptions{}) != nil {
+			return ops
+		}
+		switch op.Type {
+		case OpInsertNode:
+			mapTrees(byA, insertedChild(target, before), insertedChild(byA[target], beforeB))
+		case OpSplitText:
+			byA[target.NextSibling] = byA[target].NextSibling
+		case OpWrapNode:
+			byA[target.Parent] = byA[target].Parent
+		}
+		out = append(out, translated)
+	}
+
+	renderedA, errA := RenderNode(rootA)
+	renderedB, errB := RenderNode(rootB)
+	if errA != nil || errB != nil || renderedA != renderedB {
+		return ops
+	}
+	return out
+}
+
+// movePair is a deleted subtree that is re-inserted by the op at its key in
+// the map pairMoves returns.
+type movePair struct {
+	deleteIndex int
+	node        *html.Node // The deleted node in the original old tree
+}
+
+// pairMoves replays ops on a copy of oldRoot and pairs each plain
+// INSERT_NODE with an earlier or later unpaired DELETE_NODE of a node that
+// renders identically and had a different parent. Only elements move.
+func pairMoves(oldRoot *html.Node, ops []Operation) map[int]movePair {
+	root, origOf := cloneTree(oldRoot)
+	orig := make(map[*html.Node]*html.Node, len(origOf))
+	for o, c := range origOf {
+		orig[c] = o
+	}
+
+	type removal struct {
+		index    int
+		node     *html.Node
+		parent   *html.Node
+		rendered string
+	}
+	type addition struct {
+		index  int
+		parent *html.Node
+		data   string
+	}
+	var removals []removal
+	var additions []addition
+	for i, op := range ops {
+		target, err := GetNode(root, op.Path)
+		if err != nil {
+			return nil
+		}
+		switch {
+		case op.Type == OpDeleteNode:
+			if o, ok := orig[target]; ok && target.Type == html.ElementNode && target.Parent != nil {
+				if rendered, err := RenderNode(target); err == nil {
+					removals = append(removals, removal{i, o, target.Parent, rendered})
+				}
+			}
+		case op.Type == OpInsertNode && op.OrderKey == "" && target.Type == html.ElementNode:
+			additions = append(additions, addition{i, target, op.NodeData})
+		}
+		if applyOp(NewCursor(root), op, PatchOptions{}) != nil {
+			return nil
+		}
+	}
+
+	moves := make(map[int]movePair)
+	used := make([]bool, len(removals))
+	for _, add := range additions {
+		for k, rem := range removals {
+			if !used[k] && rem.rendered == add.data && rem.parent != add.parent {
+				used[k] = true
+				moves[add.index] = movePair{deleteIndex: rem.index, node: rem.node}
+				break
+			}
+		}
+	}
+	return moves
+}
+
+// positionB translates a child index in a's parent, whose children were
+// before, into an index among the children of parentB: the index of the
+// first child from position on that b also holds under parentB, or the end.
+func positionB(byA map[*html.Node]*html.Node, before []*html.Node, position int, parentB *html.Node) int {
+	for _, a := range before[min(max(position, 0), len(before)):] {
+		if b, ok := byA[a]; ok && b.Parent == parentB {
+			return getChildIndex(parentB, b)
+		}
+	}
+	return len(getChildrenList(parentB))
+}
+
+// insertedChild returns the child of parent that is not in before (nil if
+// none).
+func insertedChild(parent *html.Node, before []*html.Node) *html.Node {
+	seen := make(map[*html.Node]bool, len(before))
+	for _, c := range before {
+		seen[c] = true
+	}
+	for _, c := range getChildrenList(parent) {
+		if !seen[c] {
+			return c
+		}
+	}
+	return nil
+}
+
+// cloneTree deep-copies n and returns the copy with a map from each original
+// node to its copy.
+func cloneTree(n *html.Node) (*html.Node, map[*html.Node]*html.Node) {
+	copies := make(map[*html.Node]*html.Node)
+	var clone func(n *html.Node) *html.Node
+	clone = func(n *html.Node) *html.Node {
+		c := &html.Node{Type: n.Type, DataAtom: n.DataAtom, Data: n.Data, Namespace: n.Namespace, Attr: append([]html.Attribute(nil), n.Attr...)}
+		copies[n] = c
+		for child := n.FirstChild; child != nil; child = child.NextSibling {
+			c.AppendChild(clone(child))
+		}
+		return c
+	}
+	return clone(n), copies
+}
+
+// mapTrees maps each node of the subtree a to the node at the same place in
+// the identically shaped subtree b.
+func mapTrees(byA map[*html.Node]*html.Node, a, b *html.Node) {
+	if a == nil || b == nil {
+		return
+	}
+	byA[a] = b
+	for ca, cb := a.FirstChild, b.FirstChild; ca != nil && cb != nil; ca, cb = ca.NextSibling, cb.NextSibling {
+		mapTrees(byA, ca, cb)
+	}
+}
+
+// unmapTree drops the subtree a from byA.
+func unmapTree(byA map[*html.Node]*html.Node, a *html.Node) {
+	delete(byA, a)
+	for c := a.FirstChild; c != nil; c = c.NextSibling {
+		unmapTree(byA, c)
+	}
+}
+
+// detectAttrMoves sets MovedFrom on each op in ops that gives an element an
+// attribute value another op takes from a different element, where each is
+// the only op to do so. Empty values, as of boolean attributes, and
+// components of structured attributes are not paired. MovedFrom addresses
+// the source element as it is when the op carrying it applies, which ops in
+// between may have shifted, so ops are replayed on copies of oldRoot: one to
+// find each source element, one to address it as each target op sees it.
+func detectAttrMoves(oldRoot *html.Node, ops []Operation) {
+	key := func(name, value string) string { return strings.ToLower(name) + "\x00" + value }
+	sources := make(map[string][]int)
+	targets := make(map[string][]int)
+	for i, op := range ops {
+		if op.SubKey != "" {
+			continue
+		}
+		switch {
+		case op.Type == OpDeleteAttr, op.Type == OpUpdateAttr && op.Removed:
+			if op.OldValue != "" {
+				sources[key(op.Key, op.OldValue)] = append(sources[key(op.Key, op.OldValue)], i)
+			}
+		case op.Type == OpUpdateAttr:
+			if op.OldValue != "" {
+				sources[key(op.Key, op.OldValue)] = append(sources[key(op.Key, op.OldValue)], i)
+			}
+			if op.NewValue != "" {
+				targets[key(op.Key, op.NewValue)] = append(targets[key(op.Key, op.NewValue)], i)
+			}
+		}
+	}
+	sourceOf := make(map[int]int) // Target op index to source op index
+	isSource := make(map[int]bool)
+	for k, to := range targets {
+		from := sources[k]
+		if len(to) != 1 || len(from) != 1 || pathEqual(ops[to[0]].Path, ops[from[0]].Path) {
+			continue
+		}
+		sourceOf[to[0]] = from[0]
+		isSource[from[0]] = true
+	}
+	if len(sourceOf) == 0 {
+		return
+	}
+
+	// The source elements are matched ones, so they are in the old tree.
+	rootA, copiesA := cloneTree(oldRoot)
+	orig := make(map[*html.Node]*html.Node, len(copiesA))
+	for o, c := range copiesA {
+		orig[c] = o
+	}
+	element := make(map[int]*html.Node) // Source op index to old element
+	for i, op := range ops {
+		if isSource[i] {
+			if n, err := GetNode(rootA, op.Path); err == nil {
+				element[i] = orig[n]
+			}
+		}
+		if applyOp(NewCursor(rootA), op, PatchOptions{}) != nil {
+			return
+		}
+	}
+	rootB, copiesB := cloneTree(oldRoot)
+	for i, op := range ops {
+		if r, ok := sourceOf[i]; ok && element[r] != nil {
+			if path, err := GetPath(rootB, copiesB[element[r]]); err == nil {
+				ops[i].MovedFrom = path
+			}
+		}
+		if applyOp(NewCursor(rootB), op, PatchOptions{}) != nil {
+			return
+		}
+	}
+}
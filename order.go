@@ -0,0 +1,99 @@
+package vchtml
+
+import (
+	"strings"
+
+	"golang.org/x/net/html"
+)
+
+// OrderKeyAttr is the attribute that stores an element's order key once an
+// INSERT_NODE carrying Operation.OrderKey has placed it.
+const OrderKeyAttr = "data-order-key"
+
+// orderDigits are the characters generated keys are built from, in byte order.
+const orderDigits = "0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz"
+
+// KeyBetween returns an order key that sorts strictly between before and
+// after, for inserting a node between siblings carrying those keys. An empty
+// before or after means there is no bound on that side. site identifies the
+// client and makes keys generated concurrently for the same gap distinct:
+// they are ordered by site instead of colliding.
+//
+// Keys compare as plain strings, so every replica places keyed inserts in the
+// same order no matter in which order it applies them.
+func KeyBetween(before, after, site string) string {
+	return midKey(before, after) + "." + site
+}
+
+// midKey returns a key m with before < m < after (after == "" meaning no
+// upper bound). m is never a prefix of after, so any suffix keeps m < after;
+// the "." site separator sorts below every digit, so a suffix keeps m > before.
+func midKey(before, after string) string {
+	var out []byte
+	bounded := after != ""
+	for i := 0; ; i++ {
+		lo := -1 // before has no more characters
+		if i < len(before) {
+			lo = int(before[i])
+		}
+		hi := 256 // no upper bound from here on
+		if bounded && i < len(after) {
+			hi = int(after[i])
+		}
+
+		if lo == hi {
+			out = append(out, byte(lo))
+			continue
+		}
+		if d, ok := digitBetween(lo, hi); ok {
+			return string(append(out, d))
+		}
+		if lo == -1 {
+			// Nothing in the alphabet sorts below after[i]; use the byte below.
+			return string(append(out, byte(hi-1)))
+		}
+		// Keep before's character; the key now sorts below after, so only
+		// before bounds the remaining characters.
+		out = append(out, byte(lo))
+		bounded = false
+	}
+}
+
+// digitBetween returns the middle digit d with lo < d < hi, if any.
+func digitBetween(lo, hi int) (byte, bool) {
+	first := strings.IndexFunc(orderDigits, func(r rune) bool { return int(r) > lo })
+	if first < 0 {
+		return 0, false
+	}
+	last := strings.LastIndexFunc(orderDigits, func(r rune) bool { return int(r) < hi })
+	if last < first {
+		return 0, false
+	}
+	return orderDigits[(first+last)/2], true
+}
+
+// keyedPosition returns where a node with order key key goes among parent's
+// children: after the last keyed sibling that sorts before it, or before the
+// first keyed sibling when none does. Without keyed siblings the integer
+// position is used.
+func keyedPosition(parent *html.Node, key string, position int) int {
+	index, after, firstKeyed := 0, -1, -1
+	for c := parent.FirstChild; c != nil; c = c.NextSibling {
+		if c.Type == html.ElementNode && hasAttr(c, OrderKeyAttr) {
+			if firstKeyed < 0 {
+				firstKeyed = index
+			}
+			if getAttr(c, OrderKeyAttr) < key {
+				after = index
+			}
+		}
+		index++
+	}
+	switch {
+	case after >= 0:
+		return after + 1
+	case firstKeyed >= 0:
+		return firstKeyed
+	}
+	return position
+}
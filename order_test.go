@@ -0,0 +1,92 @@
+package vchtml
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestKeyBetween(t *testing.T) {
+	cases := [][2]string{
+		{"", ""},
+		{"", "U.alice"},
+		{"U.alice", ""},
+		{"U.alice", "U.bob"},
+		{"U.alice", "V.bob"},
+		{"A", "B"},
+		{"Uz.x", "V"},
+		{"zzz", ""},
+	}
+	for _, c := range cases {
+		key := KeyBetween(c[0], c[1], "carol")
+		if c[0] != "" && key <= c[0] {
+			t.Errorf("KeyBetween(%q, %q) = %q, not after the lower bound", c[0], c[1], key)
+		}
+		if c[1] != "" && key >= c[1] {
+			t.Errorf("KeyBetween(%q, %q) = %q, not before the upper bound", c[0], c[1], key)
+		}
+	}
+
+	if KeyBetween("A", "B", "alice") == KeyBetween("A", "B", "bob") {
+		t.Error("Concurrent keys from different sites must differ")
+	}
+}
+
+func TestOrderKeyConcurrentInsertsConverge(t *testing.T) {
+	baseHTML := `<ul><li>a</li><li>b</li></ul>`
+	baseHash := hashString(baseHTML)
+	listPath := NodePath{0, 1, 0}
+
+	insert := func(author, text string) *Delta {
+		return &Delta{BaseHash: baseHash, Author: author, Operations: []Operation{{
+			Type:     OpInsertNode,
+			Path:     listPath,
+			Position: 1,
+			NodeData: "<li>" + text + "</li>",
+			OrderKey: KeyBetween("", "", author),
+		}}}
+	}
+	deltaA := insert("alice", "x")
+	deltaB := insert("bob", "y")
+
+	mergedAB, _, conflicts, err := Merge(baseHTML, deltaA, deltaB)
+	if err != nil || len(conflicts) > 0 {
+		t.Fatalf("Merge(A, B): err=%v conflicts=%v", err, conflicts)
+	}
+	mergedBA, _, conflicts, err := Merge(baseHTML, deltaB, deltaA)
+	if err != nil || len(conflicts) > 0 {
+		t.Fatalf("Merge(B, A): err=%v conflicts=%v", err, conflicts)
+	}
+	if mergedAB != mergedBA {
+		t.Fatalf("Merge orders diverged:\n%s\n%s", mergedAB, mergedBA)
+	}
+	if !strings.Contains(mergedAB, `<li>a</li><li data-order-key="U.alice">x</li><li data-order-key="U.bob">y</li><li>b</li>`) {
+		t.Errorf("Unexpected merged order: %s", mergedAB)
+	}
+
+	// A second round inserting into the same gap between the keyed items.
+	base2 := mergedAB
+	round2 := func(author, text string) *Delta {
+		return &Delta{BaseHash: hashString(base2), Author: author, Operations: []Operation{{
+			Type:     OpInsertNode,
+			Path:     listPath,
+			Position: 2,
+			NodeData: "<li>" + text + "</li>",
+			OrderKey: KeyBetween("U.alice", "U.bob", author),
+		}}}
+	}
+	deltaC, deltaD := round2("carol", "p"), round2("dave", "q")
+	mergedCD, _, _, err := Merge(base2, deltaC, deltaD)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mergedDC, _, _, err := Merge(base2, deltaD, deltaC)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mergedCD != mergedDC {
+		t.Fatalf("Second round diverged:\n%s\n%s", mergedCD, mergedDC)
+	}
+	if !strings.Contains(mergedCD, `>x</li><li data-order-key="U.as.carol">p</li><li data-order-key="U.as.dave">q</li><li data-order-key="U.bob">y</li>`) {
+		t.Errorf("Unexpected second round order: %s", mergedCD)
+	}
+}
@@ -3,56 +3,559 @@ package vchtml
 import (
 	"errors"
 	"fmt"
+	"slices"
+	"sort"
 	"strings"
 
 	"golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
 )
 
+// PatchOptions controls optional behavior of PatchWithOptions.
+type PatchOptions struct {
+	// SortAttributes reorders the attributes of every element alphabetically
+	// after the delta is applied. By default attributes keep their source order
+	// and newly added attributes are appended at the end.
+	SortAttributes bool
+	// ClampInsertPosition makes INSERT_NODE tolerate out-of-range positions by
+	// clamping them into [0, childCount] (so an overflow appends). By default
+	// such positions are rejected as a sign of a corrupted delta.
+	ClampInsertPosition bool
+	// SkipDeletedTargets makes an op that fails because its target lies under
+	// a node deleted earlier in the same delta a no-op instead of an error.
+	// OnSkip, if set, is called with the index of each skipped op.
+	SkipDeletedTargets bool
+	OnSkip             func(index int, op Operation)
+	// PreserveSource applies the delta as byte-range edits of baseHTML instead
+	// of re-rendering the tree, so everything outside the changed regions is
+	// returned byte for byte. Ops whose target cannot be located exactly in
+	// the source (e.g. a node the parser implied) make the patch fail. The
+	// source is parsed again for every op, so large deltas on large
+	// documents are much slower than a tree patch.
+	PreserveSource bool
+	// IgnoreBaseHash skips the check that baseHTML is the document the delta
+	// was made against, e.g. to apply an anchored delta (see
+	// DiffOptions.AnchorPaths) to a reshaped copy. Per-op checks still apply.
+	IgnoreBaseHash bool
+	// VerifyTreeHash makes PatchTreeWithOptions render the tree and check it
+	// against the delta's base hash first. Only useful when the tree is known
+	// to render back to the exact string the delta was made against.
+	VerifyTreeHash bool
+	// NormalizeText removes empty text nodes and merges adjacent ones after
+	// the delta is applied, leaving the tree as a fresh parse of its rendering
+	// would be. Rendered output is unaffected (the parser normalizes text the
+	// same way), but a tree kept across PatchTree calls must be normalized for
+	// the paths of the next delta, which are computed from the rendered
+	// document, to resolve to the same nodes.
+	NormalizeText bool
+	// IgnoreTextPreconditions applies UPDATE_TEXT whatever the node's current
+	// text, turning it into an unconditional set (e.g. for a last-writer-wins
+	// import). By default OldValue must match. Granular text ops keep their
+	// checks, since their offsets are only meaningful against OldValue.
+	IgnoreTextPreconditions bool
+	// VerifyAttrPreconditions makes UPDATE_ATTR and DELETE_ATTR fail unless
+	// the attribute (or, with SubKey, the component) currently has the op's
+	// OldValue, an absent one counting as empty. An UPDATE_ATTR with Added
+	// set fails if the attribute is present at all, even with an empty value.
+	// By default attribute ops overwrite whatever value the attribute has
+	// drifted to.
+	VerifyAttrPreconditions bool
+	// AutoOrder applies the ops in a canonical order instead of the order
+	// they are listed in, so a delta whose ops arrive shuffled still applies.
+	// For each node the order is its own attribute and text ops, then the
+	// ops inside its children (first child first), then deletes of its
+	// children from the last to the first, then inserts, splits and wraps
+	// from the first to the last. A SPLIT_TEXT stays together with the run
+	// of ops listed right after it on its pieces (their edits, splits, wraps
+	// and deletes), in that order, so those must not be shuffled apart. Paths
+	// must be written for this order; Diff's are. MOVE_NODE, anchored and
+	// relative ops cannot be ordered and make the patch fail. Op indices in
+	// errors and OnSkip are those of the delta.
+	AutoOrder bool
+	// ValidateHTML runs ValidateTree on the patched tree (from the delta's
+	// path root) and fails with ErrInvalidHTML, listing the violations, if
+	// the delta broke a content model, e.g. put a <div> inside a <p>. With
+	// PreserveSource the delta is also applied to a parsed copy to check it.
+	ValidateHTML bool
+	// Render sets how text is escaped when the patched tree is rendered, e.g.
+	// to leave template placeholders as they are (see RenderOptions). It has
+	// no effect with PreserveSource, which keeps the source text.
+	Render RenderOptions
+}
+
+// ErrInvalidHTML is returned (wrapped) when PatchOptions.ValidateHTML finds
+// content-model violations in the patched tree.
+var ErrInvalidHTML = errors.New("patched HTML violates content models")
+
 // Patch applies the changes in 'delta' to 'baseHTML'.
 func Patch(baseHTML string, delta *Delta) (string, error) {
+	return PatchWithOptions(baseHTML, delta, PatchOptions{})
+}
+
+// BaseMatches reports whether d is based on the revision with the given
+// hash, such as one stored with each revision, without needing its HTML.
+func (d *Delta) BaseMatches(hash string) bool {
+	return d.BaseHash == hash
+}
+
+// IsEmpty reports whether d has no operations, such as a Diff of identical
+// documents, so callers can skip storing or sending it. A nil delta is empty.
+func (d *Delta) IsEmpty() bool {
+	return d == nil || len(d.Operations) == 0
+}
+
+// PatchWithOptions applies the changes in 'delta' to 'baseHTML' using opts.
+func PatchWithOptions(baseHTML string, delta *Delta, opts PatchOptions) (string, error) {
 	// 1. Verify Hash
-	currentHash := hashString(baseHTML)
-	if currentHash != delta.BaseHash {
-		return "", fmt.Errorf("base hash mismatch: expected %s, got %s", delta.BaseHash, currentHash)
+	if !opts.IgnoreBaseHash {
+		if currentHash := hashFunc(baseHTML); currentHash != delta.BaseHash {
+			return "", fmt.Errorf("base hash mismatch: expected %s, got %s", delta.BaseHash, currentHash)
+		}
 	}
+	return patchVerified(baseHTML, delta, opts)
+}
 
+// patchVerified is PatchWithOptions for a baseHTML whose hash has already been
+// checked, or need not be.
+func patchVerified(baseHTML string, delta *Delta, opts PatchOptions) (string, error) {
+	if opts.PreserveSource {
+		patched, err := patchSource(baseHTML, delta, opts)
+		if err != nil || !opts.ValidateHTML {
+			return patched, err
+		}
+		doc, err := parseForRoot(baseHTML, delta.Root)
+		if err != nil {
+			return "", err
+		}
+		if err := applyDelta(doc, delta, PatchOptions{SkipDeletedTargets: opts.SkipDeletedTargets, AutoOrder: opts.AutoOrder, ValidateHTML: true}); err != nil {
+			return "", err
+		}
+		return patched, nil
+	}
+
+	doc, err := parseForRoot(baseHTML, delta.Root)
+	if err != nil {
+		return "", err
+	}
+
+	if err := applyDelta(doc, delta, opts); err != nil {
+		return "", err
+	}
+
+	return renderForRootWith(doc, delta.Root, opts.Render)
+}
+
+// PatchTree applies delta in place to a tree the caller already holds, such as
+// a document from ParseHTML (or a root from ParseFragment for fragment deltas),
+// without parsing or rendering. The base hash is not checked, since it
+// describes a string; each op's own preconditions still are.
+func PatchTree(root *html.Node, delta *Delta) error {
+	return PatchTreeWithOptions(root, delta, PatchOptions{})
+}
+
+// PatchTreeWithOptions applies delta in place to root using opts.
+// PreserveSource does not apply to trees.
+func PatchTreeWithOptions(root *html.Node, delta *Delta, opts PatchOptions) error {
+	if opts.PreserveSource {
+		return errors.New("PreserveSource cannot be used when patching a tree")
+	}
+	if opts.VerifyTreeHash {
+		rendered, err := renderForRoot(root, delta.Root)
+		if err != nil {
+			return err
+		}
+		if currentHash := hashFunc(rendered); currentHash != delta.BaseHash {
+			return fmt.Errorf("base hash mismatch: expected %s, got %s", delta.BaseHash, currentHash)
+		}
+	}
+	return applyDelta(root, delta, opts)
+}
+
+// AppliesTo patches baseHTML with delta and diffs the result against
+// expectedHTML. It reports whether they match and, if not, returns the
+// residual delta that takes the patched result to expectedHTML (based on the
+// patched result, with the paths of delta.Root).
+func AppliesTo(baseHTML string, delta *Delta, expectedHTML string) (bool, *Delta, error) {
+	patched, err := Patch(baseHTML, delta)
+	if err != nil {
+		return false, nil, err
+	}
+	residual, err := DiffWithOptions(patched, expectedHTML, delta.Author, DiffOptions{Root: delta.Root, ElementIndexOnly: delta.ElementIndex})
+	if err != nil {
+		return false, nil, err
+	}
+	if len(residual.Operations) == 0 {
+		return true, nil, nil
+	}
+	return false, residual, nil
+}
+
+// PatchSubtree applies delta to the subtree at rootPath (from the document
+// node, as in SourceOffset) of baseHTML, such as one <section> of a large
+// page edited on its own. The delta's paths are relative to that node and its
+// base hash is that of the node's inner HTML, as DiffFragment of the
+// section's old and new content produces, so the delta must use
+// PathRootFragment. The rest of the document is left as it is.
+func PatchSubtree(baseHTML string, rootPath NodePath, delta *Delta) (string, error) {
+	return PatchSubtreeWithOptions(baseHTML, rootPath, delta, PatchOptions{})
+}
+
+// PatchSubtreeWithOptions is PatchSubtree using opts. PreserveSource does not
+// apply to subtrees.
+func PatchSubtreeWithOptions(baseHTML string, rootPath NodePath, delta *Delta, opts PatchOptions) (string, error) {
+	if delta.Root != PathRootFragment {
+		return "", fmt.Errorf("subtree deltas must use path root %q, got %q", PathRootFragment, delta.Root)
+	}
+	if opts.PreserveSource {
+		return "", errors.New("PreserveSource cannot be used when patching a subtree")
+	}
 	doc, err := ParseHTML(baseHTML)
 	if err != nil {
 		return "", err
 	}
+	root, err := GetNode(doc, rootPath)
+	if err != nil {
+		return "", err
+	}
+	if !opts.IgnoreBaseHash {
+		inner, err := RenderFragment(root)
+		if err != nil {
+			return "", err
+		}
+		if currentHash := hashFunc(inner); currentHash != delta.BaseHash {
+			return "", fmt.Errorf("base hash mismatch: expected %s, got %s", delta.BaseHash, currentHash)
+		}
+	}
+	if err := applyDeltaAt(doc, root, delta, opts); err != nil {
+		return "", err
+	}
+	return RenderNodeWithOptions(doc, opts.Render)
+}
+
+// applyDelta applies every operation in delta to the parsed tree rooted at doc.
+func applyDelta(doc *html.Node, delta *Delta, opts PatchOptions) error {
+	root, err := resolvePathRoot(doc, delta.Root)
+	if err != nil {
+		return err
+	}
+	return applyDeltaAt(doc, root, delta, opts)
+}
+
+// applyDeltaAt is applyDelta with the paths of delta relative to root, a
+// node of the tree rooted at doc.
+func applyDeltaAt(doc, root *html.Node, delta *Delta, opts PatchOptions) error {
+	// Consecutive ops usually share a path prefix, so resolve them through a
+	// cursor rather than walking from root each time.
+	order, err := opOrder(delta.Operations, opts)
+	if err != nil {
+		return err
+	}
+	cur := NewCursor(root)
+	var deleted []NodePath
+	for _, i := range order {
+		// Element-indexed ops are checked against earlier deletes as
+		// written, since their raw paths may not resolve at all.
+		tracked := delta.Operations[i]
+		op, err := resolveOp(root, delta, tracked)
+		if err == nil {
+			err = applyOp(cur, op, opts)
+		} else if !delta.ElementIndex {
+			return fmt.Errorf("failed to apply op %d (%s): %w", i, op.Type, err)
+		}
+		if !delta.ElementIndex {
+			tracked = op
+		}
+		if err != nil {
+			ancestor, ok := deletedAncestor(deleted, tracked)
+			if !ok {
+				return fmt.Errorf("failed to apply op %d (%s): %w", i, op.Type, err)
+			}
+			if !opts.SkipDeletedTargets {
+				return fmt.Errorf("failed to apply op %d (%s): target under deleted subtree %v: %w", i, op.Type, ancestor, err)
+			}
+			if opts.OnSkip != nil {
+				opts.OnSkip(i, op)
+			}
+			continue
+		}
+		deleted = shiftDeleted(deleted, tracked)
+	}
+
+	if opts.SortAttributes {
+		sortAttributes(doc)
+	}
+	if opts.NormalizeText {
+		normalizeText(doc)
+	}
+	if opts.ValidateHTML {
+		if violations := ValidateTree(root); len(violations) > 0 {
+			return fmt.Errorf("%w: %s", ErrInvalidHTML, strings.Join(violations, "; "))
+		}
+	}
+	return nil
+}
+
+// Phases of the ops under one node in the AutoOrder order.
+const (
+	phaseSelf   = iota // The node's own attribute and text ops
+	phaseChild         // Ops inside a child, keyed by its index
+	phaseDelete        // Deletes of children, last first
+	phaseInsert        // Inserts, splits and wraps of children, first first
+)
 
-	for i, op := range delta.Operations {
-		if err := applyOp(doc, op); err != nil {
-			return "", fmt.Errorf("failed to apply op %d (%s): %w", i, op.Type, err)
+// opOrder returns the indices of ops in the order to apply them: as listed,
+// or with opts.AutoOrder the canonical order (see PatchOptions.AutoOrder).
+func opOrder(ops []Operation, opts PatchOptions) ([]int, error) {
+	order := make([]int, len(ops))
+	for i := range order {
+		order[i] = i
+	}
+	if !opts.AutoOrder {
+		return order, nil
+	}
+	keys := make([][]int, len(ops))
+	for i, op := range ops {
+		if op.Anchor != "" || op.Placement != PlaceAtIndex || op.Type == OpMoveNode {
+			return nil, fmt.Errorf("op %d (%s) cannot be auto-ordered", i, op.Type)
 		}
+		keys[i] = orderKey(op)
 	}
+	groupSplits(ops, keys)
+	sort.SliceStable(order, func(x, y int) bool {
+		a, b := ops[order[x]], ops[order[y]]
+		if c := slices.Compare(keys[order[x]], keys[order[y]]); c != 0 {
+			return c < 0
+		}
+		return selfOpLess(a, b)
+	})
+	return order, nil
+}
 
-	return RenderNode(doc)
+// OrderedOperations returns the ops of d in the order Patch applies them with
+// PatchOptions.AutoOrder, without applying them: each node's own ops, then
+// those inside its children, then deletes of its children from the last to
+// the first, then inserts, splits and wraps from the first to the last, with
+// each SPLIT_TEXT followed by the ops on its pieces. A delta that cannot be
+// auto-ordered (MOVE_NODE, anchored or relative ops) is returned as listed,
+// the order Patch applies it in by default.
+func OrderedOperations(d *Delta) []Operation {
+	order, err := opOrder(d.Operations, PatchOptions{AutoOrder: true})
+	if err != nil {
+		return slices.Clone(d.Operations)
+	}
+	ops := make([]Operation, len(order))
+	for i, index := range order {
+		ops[i] = d.Operations[index]
+	}
+	return ops
 }
 
-func applyOp(root *html.Node, op Operation) error {
+// groupSplits gives each SPLIT_TEXT and the run of ops listed right after
+// it on its pieces keys at the split's place that keep their listed order.
+// An edit or delete of a piece must follow the split that made it, and a
+// piece past the first has the index of a sibling the canonical order would
+// put before the split.
+func groupSplits(ops []Operation, keys [][]int) {
+	for i := 0; i < len(ops); i++ {
+		split := ops[i]
+		if split.Type != OpSplitText || len(split.Path) == 0 {
+			continue
+		}
+		last := len(split.Path) - 1
+		parent := split.Path[:last]
+		first, end := split.Path[last], split.Path[last]+1 // Pieces, inclusive
+		base := keys[i]
+		keys[i] = append(slices.Clone(base), 0)
+		j := i + 1
+		for ; j < len(ops); j++ {
+			op := ops[j]
+			onPiece := len(op.Path) == len(split.Path) && pathEqual(op.Path[:last], parent) && op.Path[last] >= first && op.Path[last] <= end
+			if !onPiece || !(op.Type == OpSplitText || op.Type == OpWrapNode || op.Type == OpDeleteNode || op.Type == OpUpdateText || isGranularText(op)) {
+				break
+			}
+			switch op.Type {
+			case OpSplitText:
+				end++
+			case OpDeleteNode:
+				end--
+			}
+			keys[j] = append(slices.Clone(base), j-i)
+		}
+		i = j - 1
+	}
+}
+
+// orderKey locates op in the canonical order: a (phase, index) pair for each
+// level of the tree down to the node whose children it changes, or to its
+// target for the node's own ops.
+func orderKey(op Operation) []int {
+	var key []int
+	descend := func(path NodePath) {
+		for _, index := range path {
+			key = append(key, phaseChild, index)
+		}
+	}
+	last := len(op.Path) - 1
+	if last < 0 && op.Type != OpInsertNode {
+		return []int{phaseSelf} // Fails when applied, unless it is a self op
+	}
+	switch op.Type {
+	case OpInsertNode:
+		descend(op.Path)
+		key = append(key, phaseInsert, op.Position, 2)
+	case OpDeleteNode:
+		descend(op.Path[:last])
+		key = append(key, phaseDelete, -op.Path[last])
+	case OpSplitText, OpWrapNode:
+		// Diff splits the text before wrapping the part at the same index.
+		rank := 0
+		if op.Type == OpWrapNode {
+			rank = 1
+		}
+		descend(op.Path[:last])
+		key = append(key, phaseInsert, op.Path[last], rank)
+	default:
+		descend(op.Path)
+		key = append(key, phaseSelf)
+	}
+	return key
+}
+
+// selfOpLess orders two ops on the same node: a rename first, then attribute
+// removals, then the other attribute ops by key and component, then text
+// ops. Deletions of text come before insertions, the later one first.
+func selfOpLess(a, b Operation) bool {
+	rank := func(op Operation) int {
+		switch {
+		case op.Type == OpChangeTag:
+			return 0
+		case op.Type == OpDeleteAttr:
+			return 1
+		case isAttrOp(op), isClassOp(op):
+			return 2
+		}
+		return 3
+	}
+	if rank(a) != rank(b) {
+		return rank(a) < rank(b)
+	}
+	if a.Key != b.Key {
+		return a.Key < b.Key
+	}
+	if a.SubKey != b.SubKey {
+		return a.SubKey < b.SubKey
+	}
+	removes := func(op Operation) bool {
+		return op.Type == OpDeleteText || op.Type == OpReplaceText || op.Type == OpDeleteAttrText || op.Type == OpUpdateText
+	}
+	if removes(a) != removes(b) {
+		return removes(a)
+	}
+	if removes(a) {
+		return a.Position > b.Position
+	}
+	return a.Position < b.Position
+}
+
+// deletedAncestor reports which earlier DELETE_NODE path, if any, removed the
+// subtree op targets. For INSERT_NODE the target is the parent at op.Path.
+// The paths must be kept up to date with shiftDeleted.
+func deletedAncestor(deleted []NodePath, op Operation) (NodePath, bool) {
+	for _, path := range deleted {
+		if isDescendant(path, op.Path) || (op.Type == OpInsertNode && pathEqual(path, op.Path)) {
+			return path, true
+		}
+	}
+	return nil, false
+}
+
+// shiftDeleted returns the paths of the nodes deleted so far as they read
+// after op, which has just been applied, adding op's own path if it is a
+// DELETE_NODE. A deleted node keeps its place before the sibling that took
+// its index, so inserts there shift it and deletes of that sibling don't.
+func shiftDeleted(deleted []NodePath, op Operation) []NodePath {
+	op, err := atIndex(op)
+	if err != nil {
+		return deleted
+	}
+	shifted := deleted[:0]
+	for _, path := range deleted {
+		shifted = append(shifted, shiftPast(path, op))
+	}
+	if op.Type == OpDeleteNode {
+		shifted = append(shifted, slices.Clone(op.Path))
+	}
+	return shifted
+}
+
+// shiftPast returns path as it reads after the structural op has been
+// applied. It never modifies path.
+func shiftPast(path NodePath, op Operation) NodePath {
+	bump := func(parent NodePath, index, by int) NodePath {
+		if !isSiblingAffected(parent, index, path) {
+			return path
+		}
+		path = slices.Clone(path)
+		path[len(parent)] += by
+		return path
+	}
+	switch op.Type {
+	case OpInsertNode:
+		return bump(op.Path, op.Position, 1)
+	case OpSplitText:
+		if len(op.Path) > 0 {
+			last := len(op.Path) - 1
+			return bump(op.Path[:last], op.Path[last]+1, 1)
+		}
+	case OpDeleteNode:
+		if len(op.Path) > 0 {
+			last := len(op.Path) - 1
+			return bump(op.Path[:last], op.Path[last]+1, -1)
+		}
+	case OpWrapNode:
+		if isDescendant(op.Path, path) {
+			return slices.Concat(op.Path, NodePath{0}, path[len(op.Path):])
+		}
+	case OpMoveNode:
+		if len(op.Path) == 0 {
+			return path
+		}
+		if isDescendant(op.Path, path) {
+			return slices.Concat(op.To, NodePath{op.Position}, path[len(op.Path):])
+		}
+		last := len(op.Path) - 1
+		path = bump(op.Path[:last], op.Path[last]+1, -1)
+		return bump(op.To, op.Position, 1)
+	}
+	return path
+}
+
+// applyOp applies a single operation, resolving paths through cur and
+// invalidating it after structural changes.
+func applyOp(cur *Cursor, op Operation, opts PatchOptions) error {
 	switch op.Type {
 	case OpUpdateText:
-		node, err := GetNode(root, op.Path)
+		node, err := cur.Resolve(op.Path)
 		if err != nil {
 			return err
 		}
 		if node.Type != html.TextNode {
 			return fmt.Errorf("target node for UPDATE_TEXT is not a text node (type=%d)", node.Type)
 		}
-		if node.Data != op.OldValue {
+		if node.Data != op.OldValue && !opts.IgnoreTextPreconditions {
 			return fmt.Errorf("UPDATE_TEXT old value mismatch: want '%s', got '%s'", op.OldValue, node.Data)
 		}
 		node.Data = op.NewValue
 
 	case OpInsertText:
-		node, err := GetNode(root, op.Path)
+		node, err := cur.Resolve(op.Path)
 		if err != nil {
 			return err
 		}
 		if node.Type != html.TextNode {
 			return fmt.Errorf("target node for INSERT_TEXT is not a text node (type=%d)", node.Type)
 		}
+		op.Position = relocateText(node.Data, op)
 		if op.Position < 0 || op.Position > len(node.Data) {
 			return fmt.Errorf("INSERT_TEXT position out of bounds: pos=%d, len=%d", op.Position, len(node.Data))
 		}
@@ -60,13 +563,14 @@ func applyOp(root *html.Node, op Operation) error {
 		node.Data = node.Data[:op.Position] + op.NewValue + node.Data[op.Position:]
 
 	case OpDeleteText:
-		node, err := GetNode(root, op.Path)
+		node, err := cur.Resolve(op.Path)
 		if err != nil {
 			return err
 		}
 		if node.Type != html.TextNode {
 			return fmt.Errorf("target node for DELETE_TEXT is not a text node (type=%d)", node.Type)
 		}
+		op.Position = relocateText(node.Data, op)
 		// Verify
 		deleteLen := len(op.OldValue)
 		if op.Position < 0 || op.Position+deleteLen > len(node.Data) {
@@ -79,26 +583,191 @@ func applyOp(root *html.Node, op Operation) error {
 		// Delete
 		node.Data = node.Data[:op.Position] + node.Data[op.Position+deleteLen:]
 
+	case OpReplaceText:
+		node, err := cur.Resolve(op.Path)
+		if err != nil {
+			return err
+		}
+		if node.Type != html.TextNode {
+			return fmt.Errorf("target node for REPLACE_TEXT is not a text node (type=%d)", node.Type)
+		}
+		op.Position = relocateText(node.Data, op)
+		end := op.Position + len(op.OldValue)
+		if op.Position < 0 || end > len(node.Data) {
+			return fmt.Errorf("REPLACE_TEXT position out of bounds: pos=%d, len=%d, oldLen=%d", op.Position, len(node.Data), len(op.OldValue))
+		}
+		if actual := node.Data[op.Position:end]; actual != op.OldValue {
+			return fmt.Errorf("REPLACE_TEXT old value mismatch: want '%s', got '%s'", op.OldValue, actual)
+		}
+		node.Data = node.Data[:op.Position] + op.NewValue + node.Data[end:]
+
+	case OpSplitText:
+		node, err := cur.Resolve(op.Path)
+		if err != nil {
+			return err
+		}
+		if node.Type != html.TextNode {
+			return fmt.Errorf("target node for SPLIT_TEXT is not a text node (type=%d)", node.Type)
+		}
+		if op.Position < 0 || op.Position > len(node.Data) {
+			return fmt.Errorf("SPLIT_TEXT position out of bounds: pos=%d, len=%d", op.Position, len(node.Data))
+		}
+		if len(op.Path) == 0 || node.Parent == nil {
+			return errors.New("cannot split an orphan text node")
+		}
+		tail := &html.Node{Type: html.TextNode, Data: node.Data[op.Position:]}
+		node.Data = node.Data[:op.Position]
+		node.Parent.InsertBefore(tail, node.NextSibling)
+		cur.Invalidate(op.Path[:len(op.Path)-1])
+
+	case OpChangeTag:
+		node, err := cur.Resolve(op.Path)
+		if err != nil {
+			return err
+		}
+		if node.Type != html.ElementNode {
+			return fmt.Errorf("target node for CHANGE_TAG is not an element node (type=%d)", node.Type)
+		}
+		if !strings.EqualFold(node.Data, op.OldValue) {
+			return fmt.Errorf("CHANGE_TAG old value mismatch: want '%s', got '%s'", op.OldValue, node.Data)
+		}
+		if op.NewValue == "" {
+			return errors.New("CHANGE_TAG requires a new tag name")
+		}
+		node.Data = strings.ToLower(op.NewValue)
+		node.DataAtom = atom.Lookup([]byte(node.Data))
+
+	case OpWrapNode:
+		node, err := cur.Resolve(op.Path)
+		if err != nil {
+			return err
+		}
+		parent := node.Parent
+		if len(op.Path) == 0 || parent == nil || parent.Type != html.ElementNode {
+			return errors.New("WRAP_NODE target must be a child of an element")
+		}
+		nodes, err := html.ParseFragment(strings.NewReader(op.NodeData), parent)
+		if err != nil {
+			return fmt.Errorf("failed to parse wrapper: %w", err)
+		}
+		if len(nodes) != 1 || nodes[0].Type != html.ElementNode || nodes[0].FirstChild != nil {
+			return fmt.Errorf("WRAP_NODE data must be a single empty element, got %q", op.NodeData)
+		}
+		wrapper := nodes[0]
+		parent.InsertBefore(wrapper, node)
+		parent.RemoveChild(node)
+		wrapper.AppendChild(node)
+		cur.Invalidate(op.Path[:len(op.Path)-1])
+
 	case OpUpdateAttr:
-		node, err := GetNode(root, op.Path)
+		node, err := cur.Resolve(op.Path)
 		if err != nil {
 			return err
 		}
 		if node.Type != html.ElementNode {
 			return fmt.Errorf("target node for UPDATE_ATTR is not an element node")
 		}
+		if opts.VerifyAttrPreconditions {
+			if err := checkAttrValue(node, op); err != nil {
+				return err
+			}
+		}
+
+		if op.SubKey != "" {
+			f, ok := structuredFormats[strings.ToLower(op.Key)]
+			if !ok {
+				return fmt.Errorf("attribute %q has no structured format", op.Key)
+			}
+			value := setComponent(f, getAttr(node, op.Key), op.SubKey, op.NewValue, op.Removed)
+			if value == "" {
+				removeAttr(node, op.Key)
+			} else {
+				setAttr(node, op.Key, value)
+			}
+			break
+		}
 
 		// Apply new value
-		setAttr(node, op.Key, op.NewValue)
+		if op.Removed {
+			removeAttr(node, op.Key)
+		} else {
+			setAttr(node, op.Key, op.NewValue)
+		}
+
+	case OpInsertAttrText, OpDeleteAttrText:
+		node, err := cur.Resolve(op.Path)
+		if err != nil {
+			return err
+		}
+		value, err := spliceAttr(node, op)
+		if err != nil {
+			return err
+		}
+		setAttr(node, op.Key, value)
+
+	case OpAddClass, OpRemoveClass:
+		node, err := cur.Resolve(op.Path)
+		if err != nil {
+			return err
+		}
+		value, err := spliceClass(node, op)
+		if err != nil {
+			return err
+		}
+		if value == "" {
+			removeAttr(node, "class")
+		} else {
+			setAttr(node, "class", value)
+		}
+
+	case OpDeleteAttr:
+		node, err := cur.Resolve(op.Path)
+		if err != nil {
+			return err
+		}
+		if node.Type != html.ElementNode {
+			return fmt.Errorf("target node for DELETE_ATTR is not an element node")
+		}
+		if opts.VerifyAttrPreconditions {
+			if err := checkAttrValue(node, op); err != nil {
+				return err
+			}
+		}
+		removeAttr(node, op.Key)
 
 	case OpInsertNode:
+		if op.Placement != PlaceAtIndex {
+			// The sibling must exist; the insert then goes next to it.
+			if _, err := cur.Resolve(op.Path); err != nil {
+				return fmt.Errorf("sibling of %s insert: %w", op.Placement, err)
+			}
+			var err error
+			if op, err = atIndex(op); err != nil {
+				return err
+			}
+		}
 		// Path is Parent
-		parent, err := GetNode(root, op.Path)
+		parent, err := cur.Resolve(op.Path)
 		if err != nil {
 			return err
 		}
 
-		nodes, err := html.ParseFragment(strings.NewReader(op.NodeData), parent)
+		position := op.Position
+		childCount := len(getChildrenList(parent))
+		if position < 0 || position > childCount {
+			if !opts.ClampInsertPosition {
+				return fmt.Errorf("INSERT_NODE position out of bounds: pos=%d, children=%d", position, childCount)
+			}
+			position = max(0, min(position, childCount))
+		}
+
+		// Existing children at or after position shift right.
+		cur.Invalidate(op.Path)
+		if parent.Type == html.DocumentNode {
+			return insertDocumentChild(parent, op.NodeData, position)
+		}
+
+		nodes, err := html.ParseFragment(strings.NewReader(op.NodeData), insertContext(parent, op.ParentTag))
 		if err != nil {
 			return fmt.Errorf("failed to parse node data: %w", err)
 		}
@@ -107,18 +776,55 @@ func applyOp(root *html.Node, op Operation) error {
 		}
 		newNode := nodes[0] // We assume 1 node for now.
 
-		insertChildAt(parent, newNode, op.Position)
+		if op.OrderKey != "" {
+			if newNode.Type != html.ElementNode {
+				return errors.New("INSERT_NODE with an order key must insert an element")
+			}
+			setAttr(newNode, OrderKeyAttr, op.OrderKey)
+			position = keyedPosition(parent, op.OrderKey, position)
+		}
+		insertChildAt(parent, newNode, position)
+
+	case OpMoveNode:
+		node, err := cur.Resolve(op.Path)
+		if err != nil {
+			return err
+		}
+		oldParent := node.Parent
+		if len(op.Path) == 0 || oldParent == nil {
+			return errors.New("cannot move root node or orphan")
+		}
+		next := node.NextSibling
+		oldParent.RemoveChild(node)
+		cur.Invalidate(op.Path[:len(op.Path)-1])
+
+		parent, err := cur.Resolve(op.To)
+		if err == nil && (op.Position < 0 || op.Position > len(getChildrenList(parent))) {
+			err = fmt.Errorf("MOVE_NODE position out of bounds: pos=%d, children=%d", op.Position, len(getChildrenList(parent)))
+		}
+		if err != nil {
+			// Put the node back so a failed move leaves the tree unchanged.
+			oldParent.InsertBefore(node, next)
+			cur.Invalidate(op.Path[:len(op.Path)-1])
+			return err
+		}
+		insertChildAt(parent, node, op.Position)
+		cur.Invalidate(op.To)
 
 	case OpDeleteNode:
 		// Path is the node itself
-		node, err := GetNode(root, op.Path)
+		node, err := cur.Resolve(op.Path)
 		if err != nil {
 			return err
 		}
-		if node.Parent == nil {
+		if len(op.Path) == 0 || node.Parent == nil {
 			return errors.New("cannot delete root node or orphan")
 		}
+		if node.Parent.Type == html.DocumentNode && node.Type == html.ElementNode {
+			return errors.New("cannot delete the document element")
+		}
 		node.Parent.RemoveChild(node)
+		cur.Invalidate(op.Path[:len(op.Path)-1])
 
 	default:
 		return fmt.Errorf("unknown operation type: %s", op.Type)
@@ -127,26 +833,286 @@ func applyOp(root *html.Node, op Operation) error {
 	return nil
 }
 
+// insertContext returns the element NodeData of an INSERT_NODE is parsed in:
+// the live parent, unless the op names a different intended parent tag (the
+// content of a <tr> only parses as cells in a <tr> context).
+func insertContext(parent *html.Node, parentTag string) *html.Node {
+	if parentTag == "" || strings.EqualFold(parent.Data, parentTag) {
+		return parent
+	}
+	return &html.Node{Type: html.ElementNode, Data: parentTag, DataAtom: atom.Lookup([]byte(parentTag))}
+}
+
+// insertDocumentChild inserts a node directly under the document node. Only
+// comments and a doctype may live there besides the <html> element, and the
+// doctype must stay first, so anything else (or an insert ahead of the
+// doctype) is rejected rather than letting the renderer reorder the document.
+func insertDocumentChild(doc *html.Node, data string, position int) error {
+	z := html.NewTokenizer(strings.NewReader(data))
+	var newNode *html.Node
+	switch z.Next() {
+	case html.CommentToken:
+		newNode = &html.Node{Type: html.CommentNode, Data: string(z.Text())}
+	case html.DoctypeToken:
+		newNode = &html.Node{Type: html.DoctypeNode, Data: string(z.Text())}
+	default:
+		return fmt.Errorf("only comments and doctypes can be inserted at document level, got %q", data)
+	}
+	if z.Next() != html.ErrorToken {
+		return fmt.Errorf("document-level node data must contain a single node, got %q", data)
+	}
+
+	doctypeIndex := -1
+	index := 0
+	for c := doc.FirstChild; c != nil; c = c.NextSibling {
+		if c.Type == html.DoctypeNode {
+			doctypeIndex = index
+		}
+		index++
+	}
+
+	if newNode.Type == html.DoctypeNode {
+		if doctypeIndex >= 0 {
+			return errors.New("document already has a doctype")
+		}
+		if position != 0 {
+			return fmt.Errorf("doctype must be inserted at position 0, got %d", position)
+		}
+	} else if position <= doctypeIndex {
+		return fmt.Errorf("cannot insert before the doctype: pos=%d", position)
+	}
+
+	insertChildAt(doc, newNode, position)
+	return nil
+}
+
+// attrName returns the qualified name of a, the form attribute keys take in
+// ops: a namespaced attribute of foreign content, stored by x/net/html as
+// Namespace "xlink" and Key "href", is "xlink:href", so it never collides
+// with a plain "href".
+func attrName(a html.Attribute) string {
+	if a.Namespace != "" {
+		return a.Namespace + ":" + a.Key
+	}
+	return a.Key
+}
+
+// foreignAttrPrefixes are the namespace prefixes x/net/html splits off
+// attribute names in SVG and MathML.
+var foreignAttrPrefixes = map[string]bool{"xlink": true, "xml": true, "xmlns": true}
+
+// atIndex rewrites a relative INSERT_NODE (see Placement) as the equivalent
+// index insert into the sibling's parent. Other ops are returned unchanged.
+func atIndex(op Operation) (Operation, error) {
+	if op.Type != OpInsertNode || op.Placement == PlaceAtIndex {
+		return op, nil
+	}
+	if len(op.Path) == 0 {
+		return op, fmt.Errorf("%s insert needs a sibling, not the root", op.Placement)
+	}
+	last := len(op.Path) - 1
+	position := op.Path[last]
+	switch op.Placement {
+	case PlaceBefore:
+	case PlaceAfter:
+		position++
+	default:
+		return op, fmt.Errorf("unknown insert placement %q", op.Placement)
+	}
+	op.Path = append(NodePath(nil), op.Path[:last]...)
+	op.Position = position
+	op.Placement = PlaceAtIndex
+	return op, nil
+}
+
+// getAttr returns the value of n's attribute key, or "" if it has none.
+// Attribute names are case-insensitive in HTML, so here and in hasAttr,
+// setAttr and removeAttr keys are matched with strings.EqualFold. The parser
+// already lowercases HTML attribute names while keeping the canonical mixed
+// case of foreign (SVG/MathML) ones like viewBox.
 func getAttr(n *html.Node, key string) string {
 	for _, a := range n.Attr {
-		if a.Key == key {
+		if strings.EqualFold(attrName(a), key) {
 			return a.Val
 		}
 	}
 	return ""
 }
 
+// checkAttrValue reports an error unless the attribute (or structured
+// component) op targets has the op's OldValue. A missing one reads as empty.
+func checkAttrValue(n *html.Node, op Operation) error {
+	if op.Added && op.SubKey == "" {
+		if hasAttr(n, op.Key) {
+			return fmt.Errorf("%s expected %q to be absent, got '%s'", op.Type, op.Key, getAttr(n, op.Key))
+		}
+		return nil
+	}
+	current := getAttr(n, op.Key)
+	if op.SubKey != "" {
+		f, ok := structuredFormats[strings.ToLower(op.Key)]
+		if !ok {
+			return fmt.Errorf("attribute %q has no structured format", op.Key)
+		}
+		value := current
+		current = ""
+		for _, c := range parseComponents(f, value) {
+			if strings.EqualFold(c.key, op.SubKey) {
+				current = c.value
+				break
+			}
+		}
+	}
+	if current != op.OldValue {
+		return fmt.Errorf("%s old value mismatch for %q: want '%s', got '%s'", op.Type, op.Key, op.OldValue, current)
+	}
+	return nil
+}
+
+func hasAttr(n *html.Node, key string) bool {
+	for _, a := range n.Attr {
+		if strings.EqualFold(attrName(a), key) {
+			return true
+		}
+	}
+	return false
+}
+
 func setAttr(n *html.Node, key, val string) {
 	for i, a := range n.Attr {
-		if a.Key == key {
+		if strings.EqualFold(attrName(a), key) {
 			n.Attr[i].Val = val
 			return
 		}
 	}
 	// Add if not found
+	if n.Namespace == "" {
+		n.Attr = append(n.Attr, html.Attribute{Key: strings.ToLower(key), Val: val})
+		return
+	}
+	if prefix, local, ok := strings.Cut(key, ":"); ok && foreignAttrPrefixes[strings.ToLower(prefix)] {
+		n.Attr = append(n.Attr, html.Attribute{Namespace: strings.ToLower(prefix), Key: local, Val: val})
+		return
+	}
 	n.Attr = append(n.Attr, html.Attribute{Key: key, Val: val})
 }
 
+// removeAttr deletes the attribute with the given key. Missing keys are ignored.
+func removeAttr(n *html.Node, key string) {
+	for i, a := range n.Attr {
+		if strings.EqualFold(attrName(a), key) {
+			n.Attr = append(n.Attr[:i], n.Attr[i+1:]...)
+			return
+		}
+	}
+}
+
+// attrTextTypes maps the text ops to the attribute text ops and back.
+var attrTextTypes = map[OpType]OpType{
+	OpInsertText:     OpInsertAttrText,
+	OpDeleteText:     OpDeleteAttrText,
+	OpInsertAttrText: OpInsertText,
+	OpDeleteAttrText: OpDeleteText,
+}
+
+// spliceAttr returns the value of node's attribute op.Key after the attribute
+// text op op.
+func spliceAttr(node *html.Node, op Operation) (string, error) {
+	if node.Type != html.ElementNode {
+		return "", fmt.Errorf("target node for %s is not an element node", op.Type)
+	}
+	if !hasAttr(node, op.Key) {
+		return "", fmt.Errorf("%s: attribute %q not found", op.Type, op.Key)
+	}
+	value := getAttr(node, op.Key)
+	if op.Type == OpInsertAttrText {
+		if op.Position < 0 || op.Position > len(value) {
+			return "", fmt.Errorf("INSERT_ATTR_TEXT position out of bounds: pos=%d, len=%d", op.Position, len(value))
+		}
+		return value[:op.Position] + op.NewValue + value[op.Position:], nil
+	}
+	end := op.Position + len(op.OldValue)
+	if op.Position < 0 || end > len(value) {
+		return "", fmt.Errorf("DELETE_ATTR_TEXT position out of bounds: pos=%d, len=%d, delLen=%d", op.Position, len(value), len(op.OldValue))
+	}
+	if value[op.Position:end] != op.OldValue {
+		return "", fmt.Errorf("DELETE_ATTR_TEXT old value mismatch: want '%s', got '%s'", op.OldValue, value[op.Position:end])
+	}
+	return value[:op.Position] + value[end:], nil
+}
+
+// spliceClass returns node's class attribute after the class op op: the
+// token is appended unless present, or every occurrence of it removed. ""
+// means the attribute goes.
+func spliceClass(node *html.Node, op Operation) (string, error) {
+	if node.Type != html.ElementNode {
+		return "", fmt.Errorf("target node for %s is not an element node", op.Type)
+	}
+	token := classToken(op)
+	if token == "" || strings.ContainsAny(token, " \t\n\f\r") {
+		return "", fmt.Errorf("%s: invalid class %q", op.Type, token)
+	}
+	classes := strings.Fields(getAttr(node, "class"))
+	var kept []string
+	for _, c := range classes {
+		if c == token {
+			if op.Type == OpAddClass {
+				return getAttr(node, "class"), nil
+			}
+			continue
+		}
+		kept = append(kept, c)
+	}
+	if op.Type == OpAddClass {
+		kept = append(kept, token)
+	} else if len(kept) == len(classes) {
+		return getAttr(node, "class"), nil
+	}
+	return strings.Join(kept, " "), nil
+}
+
+// classToken returns the class an ADD_CLASS or REMOVE_CLASS op names.
+func classToken(op Operation) string {
+	if op.Type == OpRemoveClass {
+		return op.OldValue
+	}
+	return op.NewValue
+}
+
+func isClassOp(op Operation) bool {
+	return op.Type == OpAddClass || op.Type == OpRemoveClass
+}
+
+// normalizeText removes the empty text nodes under n and merges each run of
+// adjacent text nodes into its first node.
+func normalizeText(n *html.Node) {
+	for c := n.FirstChild; c != nil; {
+		next := c.NextSibling
+		switch {
+		case c.Type == html.TextNode && c.Data == "":
+			n.RemoveChild(c)
+		case c.Type == html.TextNode && c.PrevSibling != nil && c.PrevSibling.Type == html.TextNode:
+			c.PrevSibling.Data += c.Data
+			n.RemoveChild(c)
+		default:
+			normalizeText(c)
+		}
+		c = next
+	}
+}
+
+// sortAttributes orders the attributes of n and all its descendants by key.
+func sortAttributes(n *html.Node) {
+	if n.Type == html.ElementNode {
+		sort.SliceStable(n.Attr, func(i, j int) bool {
+			return attrName(n.Attr[i]) < attrName(n.Attr[j])
+		})
+	}
+	for c := n.FirstChild; c != nil; c = c.NextSibling {
+		sortAttributes(c)
+	}
+}
+
 func insertChildAt(parent, child *html.Node, index int) {
 	// Find the Sibling at index
 	ref := getChildAtIndex(parent, index)
@@ -1,7 +1,13 @@
 package vchtml
 
 import (
+	"errors"
+	"reflect"
+	"slices"
+	"strings"
 	"testing"
+
+	"golang.org/x/net/html"
 )
 
 func TestPatchTextOps(t *testing.T) {
@@ -60,3 +66,937 @@ func TestPatchTextOps(t *testing.T) {
 		})
 	}
 }
+
+func TestPatchAttributeOrder(t *testing.T) {
+	oldHTML := `<div id="a" class="b"></div>`
+	newHTML := `<div id="a" class="b" title="t"></div>`
+
+	delta, err := Diff(oldHTML, newHTML, "tester")
+	if err != nil {
+		t.Fatalf("Diff() error = %v", err)
+	}
+
+	// Default: existing attributes keep their source order, new ones are appended.
+	patched, err := Patch(oldHTML, delta)
+	if err != nil {
+		t.Fatalf("Patch() error = %v", err)
+	}
+	if !strings.Contains(patched, `<div id="a" class="b" title="t">`) {
+		t.Errorf("Source order not preserved: %s", patched)
+	}
+
+	// SortAttributes: alphabetical order regardless of source.
+	patched, err = PatchWithOptions(oldHTML, delta, PatchOptions{SortAttributes: true})
+	if err != nil {
+		t.Fatalf("PatchWithOptions() error = %v", err)
+	}
+	if !strings.Contains(patched, `<div class="b" id="a" title="t">`) {
+		t.Errorf("Attributes not sorted: %s", patched)
+	}
+}
+
+func TestPatchInsertPositionBounds(t *testing.T) {
+	baseHTML := `<ul><li>A</li></ul>`
+
+	delta := &Delta{
+		BaseHash: hashString(baseHTML),
+		Operations: []Operation{{
+			Type:     OpInsertNode,
+			Path:     NodePath{0, 1, 0}, // html -> body -> ul
+			Position: 5,                 // <ul> only has one child
+			NodeData: "<li>B</li>",
+		}},
+	}
+
+	// Strict (default): out-of-range positions are rejected.
+	if _, err := Patch(baseHTML, delta); err == nil {
+		t.Errorf("Expected out-of-bounds error in strict mode")
+	}
+
+	// Lenient: the position is clamped, appending the node.
+	patched, err := PatchWithOptions(baseHTML, delta, PatchOptions{ClampInsertPosition: true})
+	if err != nil {
+		t.Fatalf("PatchWithOptions() error = %v", err)
+	}
+	if !compareHTML(t, patched, `<ul><li>A</li><li>B</li></ul>`) {
+		t.Errorf("Lenient insert should append")
+	}
+}
+
+func TestPatchAttributeKeyCaseInsensitive(t *testing.T) {
+	baseHTML := `<div class="a"></div>`
+	delta := &Delta{
+		BaseHash: hashString(baseHTML),
+		Operations: []Operation{{
+			Type:     OpUpdateAttr,
+			Path:     NodePath{0, 1, 0}, // html -> body -> div
+			Key:      "CLASS",
+			OldValue: "a",
+			NewValue: "b",
+		}},
+	}
+
+	patched, err := Patch(baseHTML, delta)
+	if err != nil {
+		t.Fatalf("Patch() error = %v", err)
+	}
+	// The existing lowercase attribute is updated rather than a duplicate added.
+	if !compareHTML(t, patched, `<div class="b"></div>`) {
+		t.Errorf("CLASS should update the existing class attribute")
+	}
+}
+
+func TestPatchDocumentLevelComment(t *testing.T) {
+	baseHTML := `<!DOCTYPE html><html><head></head><body><p>Hi</p></body></html>`
+	newHTML := `<!DOCTYPE html><!-- generated --><html><head></head><body><p>Hi</p></body></html>`
+
+	delta, err := Diff(baseHTML, newHTML, "tester")
+	if err != nil {
+		t.Fatalf("Diff() error = %v", err)
+	}
+	patched, err := Patch(baseHTML, delta)
+	if err != nil {
+		t.Fatalf("Patch() error = %v", err)
+	}
+	if !strings.HasPrefix(patched, "<!DOCTYPE html><!-- generated --><html>") {
+		t.Errorf("Doctype must remain first, got %s", patched)
+	}
+
+	// Inserting ahead of the doctype is rejected.
+	delta = &Delta{
+		BaseHash: hashString(baseHTML),
+		Operations: []Operation{{
+			Type:     OpInsertNode,
+			Path:     NodePath{},
+			Position: 0,
+			NodeData: "<!-- too early -->",
+		}},
+	}
+	if _, err := Patch(baseHTML, delta); err == nil {
+		t.Errorf("Expected error inserting before the doctype")
+	}
+
+	// Elements cannot be inserted at document level.
+	delta.Operations[0].Position = 1
+	delta.Operations[0].NodeData = "<p>stray</p>"
+	if _, err := Patch(baseHTML, delta); err == nil {
+		t.Errorf("Expected error inserting an element at document level")
+	}
+}
+
+func TestPatchTargetUnderDeletedSubtree(t *testing.T) {
+	baseHTML := `<div><p>Gone <b>bold</b></p></div><p>Kept</p>`
+
+	delta := &Delta{
+		BaseHash: hashString(baseHTML),
+		Operations: []Operation{
+			{Type: OpDeleteNode, Path: NodePath{0, 1, 0}}, // the <div>
+			{Type: OpUpdateAttr, Path: NodePath{0, 1, 0, 0, 1}, Key: "class", NewValue: "x"},
+			{Type: OpUpdateText, Path: NodePath{0, 1, 0, 0, 1, 0}, OldValue: "bold", NewValue: "BOLD"},
+			{Type: OpInsertText, Path: NodePath{0, 1, 0, 0}, Position: 0, NewValue: "Still "},
+		},
+	}
+
+	// Strict (default): the patch fails, naming the deleted subtree.
+	_, err := Patch(baseHTML, delta)
+	if err == nil || !strings.Contains(err.Error(), "target under deleted subtree [0,1,0]") {
+		t.Fatalf("Expected a deleted subtree error, got %v", err)
+	}
+
+	// Lenient: ops into the deleted subtree are skipped and reported, while
+	// ops that still resolve after the delete are applied.
+	var skipped []int
+	patched, err := PatchWithOptions(baseHTML, delta, PatchOptions{
+		SkipDeletedTargets: true,
+		OnSkip:             func(index int, op Operation) { skipped = append(skipped, index) },
+	})
+	if err != nil {
+		t.Fatalf("PatchWithOptions() error = %v", err)
+	}
+	if len(skipped) != 2 || skipped[0] != 1 || skipped[1] != 2 {
+		t.Errorf("Expected ops 1 and 2 to be skipped, got %v", skipped)
+	}
+	if !compareHTML(t, patched, `<p>Still Kept</p>`) {
+		t.Errorf("Unexpected lenient result")
+	}
+
+	// Later sibling inserts and deletes shift the deleted subtree's path.
+	baseHTML = `<p>A</p><div><b>x</b></div><p>Kept</p>`
+	delta = &Delta{
+		BaseHash: hashString(baseHTML),
+		Operations: []Operation{
+			{Type: OpDeleteNode, Path: NodePath{0, 1, 1}}, // the <div>
+			{Type: OpInsertNode, Path: NodePath{0, 1}, Position: 0, NodeData: "<h1>T</h1>"},
+			{Type: OpInsertNode, Path: NodePath{0, 1}, Position: 0, NodeData: "<h1>U</h1>"},
+			{Type: OpDeleteNode, Path: NodePath{0, 1, 1}}, // <h1>T</h1>
+			{Type: OpUpdateText, Path: NodePath{0, 1, 2, 0, 0}, OldValue: "x", NewValue: "y"},
+		},
+	}
+	_, err = Patch(baseHTML, delta)
+	if err == nil || !strings.Contains(err.Error(), "target under deleted subtree [0,1,2]") {
+		t.Fatalf("Expected a shifted deleted subtree error, got %v", err)
+	}
+	skipped = nil
+	patched, err = PatchWithOptions(baseHTML, delta, PatchOptions{
+		SkipDeletedTargets: true,
+		OnSkip:             func(index int, op Operation) { skipped = append(skipped, index) },
+	})
+	if err != nil {
+		t.Fatalf("PatchWithOptions() error = %v", err)
+	}
+	if len(skipped) != 1 || skipped[0] != 4 {
+		t.Errorf("Expected op 4 to be skipped, got %v", skipped)
+	}
+	if !compareHTML(t, patched, `<h1>U</h1><p>A</p><p>Kept</p>`) {
+		t.Errorf("Unexpected lenient result %s", patched)
+	}
+}
+
+func TestPatchPreserveSource(t *testing.T) {
+	baseHTML := "<!doctype html>\n<HTML>\n<body>\n  <p CLASS=intro>Caf&eacute; &amp; more</p>\n  <ul>\n    <li>One\n    <li>Two</li>\n  </ul>\n  <p id='target'>Hello world</p>\n  <br/>\n</body>\n</HTML>\n"
+	newHTML := strings.Replace(baseHTML, "Hello world", "Hello brave world", 1)
+
+	delta, err := Diff(baseHTML, newHTML, "tester")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A regular Patch re-renders the whole document.
+	rendered, err := Patch(baseHTML, delta)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rendered == newHTML {
+		t.Fatal("Expected re-rendering to normalize the source")
+	}
+
+	patched, err := PatchWithOptions(baseHTML, delta, PatchOptions{PreserveSource: true})
+	if err != nil {
+		t.Fatalf("PatchWithOptions() error = %v", err)
+	}
+	if patched != newHTML {
+		t.Fatalf("Only the changed region should differ:\n got %q\nwant %q", patched, newHTML)
+	}
+
+	// Attribute edits rewrite only the attribute itself.
+	attrDelta := &Delta{
+		BaseHash: hashString(baseHTML),
+		Operations: []Operation{
+			{Type: OpUpdateAttr, Path: NodePath{1, 1, 1}, Key: "class", OldValue: "intro", NewValue: "lead"},
+			{Type: OpUpdateAttr, Path: NodePath{1, 1, 5}, Key: "title", NewValue: `a "quote"`},
+			{Type: OpUpdateAttr, Path: NodePath{1, 1, 5}, Key: "id", OldValue: "target", Removed: true},
+		},
+	}
+	patched, err = PatchWithOptions(baseHTML, attrDelta, PatchOptions{PreserveSource: true})
+	if err != nil {
+		t.Fatalf("PatchWithOptions() error = %v", err)
+	}
+	want := strings.Replace(baseHTML, `<p CLASS=intro>`, `<p CLASS="lead">`, 1)
+	want = strings.Replace(want, `<p id='target'>`, `<p title="a &#34;quote&#34;">`, 1)
+	if patched != want {
+		t.Errorf("Unexpected attribute edit:\n got %q\nwant %q", patched, want)
+	}
+
+	// The first <li> has an implied end tag, so it cannot be deleted exactly.
+	deleteDelta := &Delta{
+		BaseHash:   hashString(baseHTML),
+		Operations: []Operation{{Type: OpDeleteNode, Path: NodePath{1, 1, 3, 1}}},
+	}
+	if _, err := PatchWithOptions(baseHTML, deleteDelta, PatchOptions{PreserveSource: true}); err == nil {
+		t.Error("Expected an error deleting a node without an exact source range")
+	}
+
+	// Replacing all of a text node's text is a delete and an insert at one
+	// offset; the emptied node must still take the insert.
+	for _, c := range [][2]string{{`<p>abc</p>`, `<p>xyz</p>`}, {`<p>a <b>bc</b></p>`, `<p>a <b>xy</b></p>`}} {
+		delta, err := Diff(c[0], c[1], "tester")
+		if err != nil {
+			t.Fatal(err)
+		}
+		patched, err := PatchWithOptions(c[0], delta, PatchOptions{PreserveSource: true})
+		if err != nil {
+			t.Fatalf("%s -> %s: %v", c[0], c[1], err)
+		}
+		if patched != c[1] {
+			t.Errorf("%s -> %s: got %q", c[0], c[1], patched)
+		}
+	}
+}
+
+func TestPatchInsertParentTagContext(t *testing.T) {
+	oldHTML := `<table><tbody><tr><td>a</td></tr></tbody></table>`
+	newHTML := `<table><tbody><tr><td>a</td></tr><tr><td>b</td></tr></tbody></table>`
+
+	delta, err := Diff(oldHTML, newHTML, "tester")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(delta.Operations) != 1 || delta.Operations[0].ParentTag != "tbody" {
+		t.Fatalf("Expected one insert recording its <tbody> parent, got %+v", delta.Operations)
+	}
+
+	// A component framework renders the table body as a custom element. The
+	// ParentTag context still parses the row as a row rather than loose text.
+	liveHTML := `<x-rows><tr><td>a</td></tr></x-rows>`
+	op := delta.Operations[0]
+	op.Path = NodePath{0, 1, 0}
+
+	doc, err := ParseHTML(liveHTML)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := applyDelta(doc, &Delta{Operations: []Operation{op}}, PatchOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	row, err := GetNode(doc, NodePath{0, 1, 0, 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if row.Type != html.ElementNode || row.Data != "tr" || row.FirstChild == nil || row.FirstChild.Data != "td" {
+		t.Errorf("Expected an inserted <tr><td>, got %s", renderOrEmpty(row))
+	}
+
+	// Without the context the live <x-rows> parent drops the table markup.
+	op.ParentTag = ""
+	doc, _ = ParseHTML(liveHTML)
+	if err := applyDelta(doc, &Delta{Operations: []Operation{op}}, PatchOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if row, _ := GetNode(doc, NodePath{0, 1, 0, 1}); row == nil || row.Type != html.TextNode {
+		t.Errorf("Expected the row to parse as text without a context, got %s", renderOrEmpty(row))
+	}
+}
+
+func renderOrEmpty(n *html.Node) string {
+	if n == nil {
+		return "<nil>"
+	}
+	s, _ := RenderNode(n)
+	return s
+}
+
+func TestPatchTree(t *testing.T) {
+	baseHTML := `<ul><li>One</li><li>Two</li></ul>`
+	newHTML := `<ul><li class="first">One!</li><li>Two</li><li>Three</li></ul>`
+	delta, err := Diff(baseHTML, newHTML, "tester")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	doc, err := ParseHTML(baseHTML)
+	if err != nil {
+		t.Fatal(err)
+	}
+	first, _ := GetNode(doc, NodePath{0, 1, 0, 0})
+
+	if err := PatchTree(doc, delta); err != nil {
+		t.Fatalf("PatchTree() error = %v", err)
+	}
+	// The tree is patched in place: existing nodes are kept, not replaced.
+	if got, _ := GetNode(doc, NodePath{0, 1, 0, 0}); got != first {
+		t.Error("Expected the first <li> to be the same node after patching")
+	}
+	rendered, err := RenderNode(doc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !compareHTML(t, rendered, newHTML) {
+		t.Errorf("Unexpected patched tree")
+	}
+
+	// The optional hash check compares the rendered tree.
+	doc, _ = ParseHTML(`<ul><li>Other</li></ul>`)
+	if err := PatchTreeWithOptions(doc, delta, PatchOptions{VerifyTreeHash: true}); err == nil {
+		t.Error("Expected a base hash mismatch for a different tree")
+	}
+}
+
+func TestPatchAttrValueEncoding(t *testing.T) {
+	baseHTML := `<p><a href="/old">link</a></p>`
+	link := NodePath{0, 1, 0, 0}
+
+	for _, value := range []string{`/q?a=1&b=<2>`, `say "hi" & 'bye'`, `&amp; stays literal`} {
+		delta := &Delta{BaseHash: hashString(baseHTML), Operations: []Operation{
+			{Type: OpUpdateAttr, Path: link, Key: "href", OldValue: "/old", NewValue: value},
+		}}
+		for _, preserve := range []bool{false, true} {
+			out, err := PatchWithOptions(baseHTML, delta, PatchOptions{PreserveSource: preserve})
+			if err != nil {
+				t.Fatalf("Patch failed: %v", err)
+			}
+			doc, err := ParseHTML(out)
+			if err != nil {
+				t.Fatal(err)
+			}
+			a, err := GetNode(doc, link)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := getAttr(a, "href"); got != value {
+				t.Errorf("PreserveSource=%v: href decodes to %q, want %q (output %s)", preserve, got, value, out)
+			}
+		}
+	}
+}
+
+func TestAppliesTo(t *testing.T) {
+	baseHTML := `<div><p class="a">Hello world</p></div>`
+	expectedHTML := `<div><p class="b">Hello there world</p></div>`
+
+	delta, err := Diff(baseHTML, expectedHTML, "migration")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ok, residual, err := AppliesTo(baseHTML, delta, expectedHTML)
+	if err != nil {
+		t.Fatalf("AppliesTo failed: %v", err)
+	}
+	if !ok || residual != nil {
+		t.Errorf("Expected a match, got residual %v", residual)
+	}
+
+	// The wrong delta forgets the class change.
+	wrong, _ := Diff(baseHTML, `<div><p class="a">Hello there world</p></div>`, "migration")
+	ok, residual, err = AppliesTo(baseHTML, wrong, expectedHTML)
+	if err != nil {
+		t.Fatalf("AppliesTo failed: %v", err)
+	}
+	if ok || residual == nil || len(residual.Operations) != 1 {
+		t.Fatalf("Expected a one-op residual, got ok=%v residual=%v", ok, residual)
+	}
+	if op := residual.Operations[0]; op.Type != OpUpdateAttr || op.Key != "class" || op.OldValue != "a" || op.NewValue != "b" {
+		t.Errorf("Unexpected residual op: %s", op)
+	}
+
+	// The residual completes the wrong delta.
+	patched, _ := Patch(baseHTML, wrong)
+	fixed, err := Patch(patched, residual)
+	if err != nil {
+		t.Fatalf("Patch with residual failed: %v", err)
+	}
+	if !compareHTML(t, fixed, expectedHTML) {
+		t.Error("Residual does not reach the expected HTML")
+	}
+}
+
+func TestPatchNormalizeText(t *testing.T) {
+	baseHTML := `<div><p>x<i>y</i></p><p>a<b>b</b>c</p></div>`
+	delta := &Delta{BaseHash: hashString(baseHTML), Operations: []Operation{
+		// Empties the first text node of the first paragraph.
+		{Type: OpDeleteText, Path: NodePath{0, 1, 0, 0, 0}, Position: 0, OldValue: "x"},
+		// Leaves "a" and "c" adjacent in the second.
+		{Type: OpDeleteNode, Path: NodePath{0, 1, 0, 1, 1}},
+	}}
+
+	doc, _ := ParseHTML(baseHTML)
+	if err := PatchTreeWithOptions(doc, delta, PatchOptions{NormalizeText: true}); err != nil {
+		t.Fatalf("PatchTree failed: %v", err)
+	}
+	rendered, _ := RenderNode(doc)
+
+	// The next delta is diffed from the rendered document, whose paths only
+	// match the tree once its text is normalized.
+	next, err := Diff(rendered, `<div><p><i>y!</i></p><p>ac!</p></div>`, "tester")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := PatchTree(doc, next); err != nil {
+		t.Fatalf("Second PatchTree failed: %v", err)
+	}
+	got, _ := RenderNode(doc)
+	if !compareHTML(t, got, `<div><p><i>y!</i></p><p>ac!</p></div>`) {
+		t.Error("Patched tree incorrect")
+	}
+
+	// Without normalization the stale text nodes shift the paths.
+	doc, _ = ParseHTML(baseHTML)
+	if err := PatchTree(doc, delta); err != nil {
+		t.Fatal(err)
+	}
+	if err := PatchTree(doc, next); err == nil {
+		t.Error("Expected the second delta to miss its targets without NormalizeText")
+	}
+}
+
+func TestPatchIgnoreTextPreconditions(t *testing.T) {
+	baseHTML := `<p>Edited locally</p>`
+	delta := &Delta{BaseHash: hashString(baseHTML), Operations: []Operation{
+		{Type: OpUpdateText, Path: NodePath{0, 1, 0, 0}, OldValue: "Original", NewValue: "Imported"},
+	}}
+
+	if _, err := Patch(baseHTML, delta); err == nil || !strings.Contains(err.Error(), "old value mismatch") {
+		t.Errorf("Expected an old value mismatch, got %v", err)
+	}
+	for _, preserve := range []bool{false, true} {
+		patched, err := PatchWithOptions(baseHTML, delta, PatchOptions{IgnoreTextPreconditions: true, PreserveSource: preserve})
+		if err != nil {
+			t.Fatalf("Patch failed (PreserveSource=%v): %v", preserve, err)
+		}
+		if !compareHTML(t, patched, `<p>Imported</p>`) {
+			t.Errorf("Patched output mismatch (PreserveSource=%v)", preserve)
+		}
+	}
+}
+
+func TestPatchVerifyAttrPreconditions(t *testing.T) {
+	// The delta was made when the link pointed at /old; it has since drifted.
+	baseHTML := `<a href="/drifted" style="color: blue">Link</a>`
+	delta := &Delta{BaseHash: hashString(baseHTML), Operations: []Operation{
+		{Type: OpUpdateAttr, Path: NodePath{0, 1, 0}, Key: "href", OldValue: "/old", NewValue: "/new"},
+	}}
+
+	// Lenient by default: the drifted value is overwritten.
+	for _, preserve := range []bool{false, true} {
+		patched, err := PatchWithOptions(baseHTML, delta, PatchOptions{PreserveSource: preserve})
+		if err != nil {
+			t.Fatalf("Patch failed (PreserveSource=%v): %v", preserve, err)
+		}
+		if !compareHTML(t, patched, `<a href="/new" style="color: blue">Link</a>`) {
+			t.Errorf("Patched output mismatch (PreserveSource=%v)", preserve)
+		}
+	}
+
+	// Strict: the mismatch is an error.
+	for _, preserve := range []bool{false, true} {
+		_, err := PatchWithOptions(baseHTML, delta, PatchOptions{VerifyAttrPreconditions: true, PreserveSource: preserve})
+		if err == nil || !strings.Contains(err.Error(), "old value mismatch") {
+			t.Errorf("Expected an old value mismatch (PreserveSource=%v), got %v", preserve, err)
+		}
+	}
+
+	// Matching values, including a style component and an absent attribute,
+	// pass the check.
+	delta.Operations = []Operation{
+		{Type: OpUpdateAttr, Path: NodePath{0, 1, 0}, Key: "href", OldValue: "/drifted", NewValue: "/new"},
+		{Type: OpUpdateAttr, Path: NodePath{0, 1, 0}, Key: "style", SubKey: "color", OldValue: "blue", NewValue: "red"},
+		{Type: OpUpdateAttr, Path: NodePath{0, 1, 0}, Key: "title", NewValue: "Go"},
+	}
+	patched, err := PatchWithOptions(baseHTML, delta, PatchOptions{VerifyAttrPreconditions: true})
+	if err != nil {
+		t.Fatalf("Patch failed: %v", err)
+	}
+	if !compareHTML(t, patched, `<a href="/new" style="color: red" title="Go">Link</a>`) {
+		t.Error("Patched output mismatch")
+	}
+}
+
+func TestCheckPathConsistency(t *testing.T) {
+	oldHTML := `<ul><li>one</li><li>two</li></ul><p>Hello world</p>`
+	newHTML := `<ul><li>zero</li><li>one</li><li>two!</li></ul><p>Hello <b>big</b> world</p>`
+	delta, err := Diff(oldHTML, newHTML, "tester")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := CheckPathConsistency(delta); err != nil {
+		t.Errorf("Generated delta reported inconsistent: %v", err)
+	}
+
+	list := NodePath{0, 1, 0}
+	for _, tc := range []struct {
+		name string
+		ops  []Operation
+		want string
+	}{
+		{"past inserted children", []Operation{
+			{Type: OpInsertNode, Path: list, Position: 0, NodeData: `<li>new</li>`, ParentTag: "ul"},
+			{Type: OpUpdateText, Path: NodePath{0, 1, 0, 0, 1}, OldValue: "x", NewValue: "y"},
+		}, "op 1 (UPDATE_TEXT)"},
+		{"attribute on text", []Operation{
+			{Type: OpInsertText, Path: NodePath{0, 1, 1, 0}, Position: 0, NewValue: "Oh, "},
+			{Type: OpUpdateAttr, Path: NodePath{0, 1, 1, 0}, Key: "class", NewValue: "x"},
+		}, "not an element"},
+		{"through a text node", []Operation{
+			{Type: OpSplitText, Path: NodePath{0, 1, 1, 0}, Position: 5},
+			{Type: OpDeleteNode, Path: NodePath{0, 1, 1, 1, 0}},
+		}, "has no children"},
+		{"negative index", []Operation{
+			{Type: OpDeleteNode, Path: NodePath{0, 1, -1}},
+		}, "negative index"},
+	} {
+		err := CheckPathConsistency(&Delta{Operations: tc.ops})
+		if err == nil || !strings.Contains(err.Error(), tc.want) {
+			t.Errorf("%s: expected an error containing %q, got %v", tc.name, tc.want, err)
+		}
+	}
+}
+
+func TestPatchRelativeInsert(t *testing.T) {
+	base := `<ul><li id="a">A</li><li id="b">B</li></ul>`
+	prepended := `<ul><li id="z">Z</li><li id="a">A</li><li id="b">B</li></ul>`
+	want := `<ul><li id="z">Z</li><li id="a">A</li><li id="b">B</li><li id="c">C</li></ul>`
+	item := `<li id="c">C</li>`
+
+	// Both inserts add C after B in base; applied to a copy that gained a
+	// first item in the meantime, only the relative one still lands after B.
+	byIndex := &Delta{BaseHash: hashString(base), Operations: []Operation{
+		{Type: OpInsertNode, Path: NodePath{0, 1, 0}, Position: 2, NodeData: item},
+	}}
+	relative := &Delta{BaseHash: hashString(base), Operations: []Operation{
+		{Type: OpInsertNode, Anchor: "b", Path: NodePath{}, Placement: PlaceAfter, NodeData: item},
+	}}
+	opts := PatchOptions{IgnoreBaseHash: true}
+	patched, err := PatchWithOptions(prepended, byIndex, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if compareHTML(t, patched, want) {
+		t.Fatal("Expected the index insert to land before B")
+	}
+	for _, preserve := range []bool{false, true} {
+		opts.PreserveSource = preserve
+		patched, err = PatchWithOptions(prepended, relative, opts)
+		if err != nil {
+			t.Fatalf("PreserveSource=%v: %v", preserve, err)
+		}
+		if !compareHTML(t, patched, want) {
+			t.Errorf("PreserveSource=%v: relative insert got %s", preserve, patched)
+		}
+	}
+
+	// Merged with the prepend, a relative insert by path follows B too.
+	prepend, _ := Diff(base, prepended, "other")
+	relative.Operations[0].Anchor = ""
+	relative.Operations[0].Path = NodePath{0, 1, 0, 1}
+	merged, _, conflicts, err := Merge(base, prepend, relative)
+	if err != nil || len(conflicts) > 0 {
+		t.Fatalf("Merge failed: %v %v", err, conflicts)
+	}
+	if !compareHTML(t, merged, want) {
+		t.Errorf("Merged = %s", merged)
+	}
+	if err := VerifyMergeConsistency(base, prepend, relative); err != nil {
+		t.Error(err)
+	}
+
+	// PlaceBefore goes in front of the sibling; a missing sibling fails.
+	before := &Delta{BaseHash: hashString(base), Operations: []Operation{
+		{Type: OpInsertNode, Path: NodePath{0, 1, 0, 0}, Placement: PlaceBefore, NodeData: `<li id="z">Z</li>`},
+	}}
+	if patched, err = Patch(base, before); err != nil || !compareHTML(t, patched, prepended) {
+		t.Errorf("PlaceBefore: got %s, %v", patched, err)
+	}
+	before.Operations[0].Path = NodePath{0, 1, 0, 5}
+	if _, err = Patch(base, before); err == nil {
+		t.Error("Expected an error for a missing sibling")
+	}
+}
+
+func TestPatchAutoOrder(t *testing.T) {
+	base := `<div id="main" class="a"><h1>Title</h1><ul><li>One</li><li>Two</li><li>Three</li></ul><p>Some text here</p></div>`
+	edited := `<div id="main" class="b"><p>Lead</p><h1>New title</h1><ul><li>One</li><li>Three</li><li>Four</li></ul><p>Some <b>bold</b> here</p><p>End</p></div>`
+	delta, err := DiffWithOptions(base, edited, "tester", DiffOptions{GranularAttrs: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want, err := Patch(base, delta)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Reversing the ops breaks a plain patch; AutoOrder restores the order
+	// whatever the shuffle.
+	shuffled := *delta
+	shuffled.Operations = make([]Operation, len(delta.Operations))
+	for i, op := range delta.Operations {
+		shuffled.Operations[len(delta.Operations)-1-i] = op
+	}
+	if got, err := Patch(base, &shuffled); err == nil && compareHTML(t, got, want) {
+		t.Fatal("Expected reversed ops to break a plain patch")
+	}
+	for seed := 0; seed < 20; seed++ {
+		ops := shuffled.Operations
+		for i := range ops {
+			j := (i*7 + seed*13) % len(ops)
+			ops[i], ops[j] = ops[j], ops[i]
+		}
+		got, err := PatchWithOptions(base, &shuffled, PatchOptions{AutoOrder: true})
+		if err != nil {
+			t.Fatalf("seed %d: %v", seed, err)
+		}
+		if !compareHTML(t, got, want) {
+			t.Fatalf("seed %d: got %s", seed, got)
+		}
+	}
+
+	// A split and the edits of its pieces listed after it stay together; the
+	// rest may come in any order.
+	for _, c := range []struct{ base, edited string }{
+		{`<p>abcdef</p><ul><li>One</li></ul>`, `<h1>T</h1><p>abXc<b>y</b>def</p><ul><li>One!</li></ul>`},
+		{`<p>abcdef</p><ul><li>One</li></ul>`, `<p>abc<b>y</b>dXef</p><ul><li>One</li><li>Two</li></ul>`},
+		// Wrapped text, split off and deleted before the wrapper goes in.
+		{`<p>Hello world</p><ul><li>One</li></ul>`, `<p>Hello <b>world</b></p><ul><li>One!</li></ul>`},
+		{`<p>Hello big world</p><ul><li>One</li></ul>`, `<h1>T</h1><p>Hello <em>big</em> world</p><ul><li>One</li></ul>`},
+	} {
+		delta, err := Diff(c.base, c.edited, "tester")
+		if err != nil {
+			t.Fatal(err)
+		}
+		var group, rest []Operation
+		for i, op := range delta.Operations {
+			if op.Type == OpSplitText && len(group) == 0 {
+				group = append(group, op)
+				for _, next := range delta.Operations[i+1:] {
+					if !isGranularText(next) && next.Type != OpUpdateText && next.Type != OpSplitText && next.Type != OpDeleteNode {
+						break
+					}
+					group = append(group, next)
+				}
+			}
+		}
+		for _, op := range delta.Operations {
+			if !slices.ContainsFunc(group, func(g Operation) bool { return reflect.DeepEqual(g, op) }) {
+				rest = append([]Operation{op}, rest...)
+			}
+		}
+		if len(group) < 2 {
+			t.Fatalf("Expected a split with an edit or delete of a piece, got %v", delta.Operations)
+		}
+		shuffled := *delta
+		shuffled.Operations = append(slices.Clone(rest), group...)
+		got, err := PatchWithOptions(c.base, &shuffled, PatchOptions{AutoOrder: true})
+		if err != nil {
+			t.Fatalf("%s: %v", c.edited, err)
+		}
+		if !compareHTML(t, got, c.edited) {
+			t.Errorf("%s: got %s", c.edited, got)
+		}
+	}
+
+	moved := &Delta{BaseHash: hashString(base), Operations: []Operation{{Type: OpMoveNode, Path: NodePath{0, 1, 0, 0}, To: NodePath{0, 1, 0}, Position: 1}}}
+	if _, err := PatchWithOptions(base, moved, PatchOptions{AutoOrder: true}); err == nil {
+		t.Error("Expected MOVE_NODE to be rejected")
+	}
+}
+
+func TestOrderedOperations(t *testing.T) {
+	list := NodePath{0, 1, 0}
+	delta := &Delta{Operations: []Operation{
+		{Type: OpInsertNode, Path: list, Position: 3, NodeData: `<li>d</li>`},
+		{Type: OpDeleteNode, Path: NodePath{0, 1, 0, 0}},
+		{Type: OpInsertNode, Path: list, Position: 1, NodeData: `<li>b</li>`},
+		{Type: OpUpdateText, Path: NodePath{0, 1, 0, 1, 0}, OldValue: "x", NewValue: "y"},
+		{Type: OpDeleteNode, Path: NodePath{0, 1, 0, 2}},
+		{Type: OpUpdateAttr, Path: list, Key: "class", NewValue: "menu"},
+	}}
+	// Updates first, then deletes from the last child, then inserts from
+	// the first.
+	want := []int{5, 3, 4, 1, 2, 0}
+	got := OrderedOperations(delta)
+	if len(got) != len(want) {
+		t.Fatalf("got %d ops, want %d", len(got), len(want))
+	}
+	for i, index := range want {
+		if got[i].Type != delta.Operations[index].Type || !pathEqual(got[i].Path, delta.Operations[index].Path) || got[i].Position != delta.Operations[index].Position {
+			t.Errorf("op %d: got %s %v, want op %d", i, got[i].Type, got[i].Path, index)
+		}
+	}
+
+	// Splits come with the edits and deletes of their pieces, so the order
+	// patches like the delta as listed.
+	for _, c := range []struct{ base, edited string }{
+		{`<p>abcdef</p>`, `<p>abXc<b>y</b>def</p>`},
+		{`<p>Hello world</p>`, `<h1>T</h1><p>Hello <b>world</b></p>`},
+	} {
+		split, err := Diff(c.base, c.edited, "tester")
+		if err != nil {
+			t.Fatal(err)
+		}
+		ordered := *split
+		ordered.Operations = OrderedOperations(split)
+		got, err := Patch(c.base, &ordered)
+		if err != nil {
+			t.Fatalf("%s: %v (order %v)", c.edited, err, ordered.Operations)
+		}
+		if !compareHTML(t, got, c.edited) {
+			t.Errorf("%s: got %s (order %v)", c.edited, got, ordered.Operations)
+		}
+	}
+
+	moved := &Delta{Operations: []Operation{delta.Operations[0], {Type: OpMoveNode, Path: NodePath{0, 1, 0, 0}, To: list, Position: 1}}}
+	if got := OrderedOperations(moved); len(got) != 2 || got[0].Type != OpInsertNode {
+		t.Errorf("Expected an unorderable delta as listed, got %v", got)
+	}
+}
+
+func TestPatchClassOps(t *testing.T) {
+	base := `<button class="btn">Go</button>`
+	add := &Delta{BaseHash: hashString(base), Operations: []Operation{{Type: OpAddClass, Path: NodePath{0, 1, 0}, NewValue: "active"}}}
+	for _, opts := range []PatchOptions{{}, {PreserveSource: true}} {
+		got, err := PatchWithOptions(base, add, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !compareHTML(t, got, `<button class="btn active">Go</button>`) {
+			t.Errorf("PreserveSource=%v: got %s", opts.PreserveSource, got)
+		}
+	}
+
+	// Adding a present class and removing an absent one change nothing;
+	// removing the last class drops the attribute.
+	cases := []struct {
+		op   Operation
+		want string
+	}{
+		{Operation{Type: OpAddClass, Path: NodePath{0, 1, 0}, NewValue: "btn"}, `<button class="btn">Go</button>`},
+		{Operation{Type: OpRemoveClass, Path: NodePath{0, 1, 0}, OldValue: "active"}, `<button class="btn">Go</button>`},
+		{Operation{Type: OpRemoveClass, Path: NodePath{0, 1, 0}, OldValue: "btn"}, `<button>Go</button>`},
+	}
+	for _, c := range cases {
+		got, err := Patch(base, &Delta{BaseHash: hashString(base), Operations: []Operation{c.op}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !compareHTML(t, got, c.want) {
+			t.Errorf("%s %s: got %s", c.op.Type, classToken(c.op), got)
+		}
+	}
+	bad := &Delta{BaseHash: hashString(base), Operations: []Operation{{Type: OpAddClass, Path: NodePath{0, 1, 0}, NewValue: "a b"}}}
+	if _, err := Patch(base, bad); err == nil {
+		t.Error("Expected an error for a class containing a space")
+	}
+
+	// Concurrent adds of different classes both survive; adding and
+	// removing the same class conflicts.
+	other := &Delta{BaseHash: hashString(base), Operations: []Operation{{Type: OpAddClass, Path: NodePath{0, 1, 0}, NewValue: "large"}}}
+	merged, _, conflicts, err := Merge(base, add, other)
+	if err != nil || len(conflicts) != 0 {
+		t.Fatalf("Merge: %v, %v", conflicts, err)
+	}
+	if !strings.Contains(merged, "active") || !strings.Contains(merged, "large") {
+		t.Errorf("Merged: got %s", merged)
+	}
+	remove := &Delta{BaseHash: hashString(base), Operations: []Operation{{Type: OpRemoveClass, Path: NodePath{0, 1, 0}, OldValue: "active"}}}
+	if _, _, conflicts, _ := Merge(base, add, remove); len(conflicts) != 1 {
+		t.Errorf("Expected one conflict, got %v", conflicts)
+	}
+}
+
+func TestPatchValidateHTML(t *testing.T) {
+	base := `<p>Intro</p><ul><li>One</li></ul>`
+	delta := &Delta{BaseHash: hashString(base), Operations: []Operation{
+		{Type: OpInsertNode, Path: NodePath{0, 1, 0}, Position: 1, NodeData: `<div>Block</div>`},
+	}}
+	if _, err := Patch(base, delta); err != nil {
+		t.Fatalf("Expected the unchecked patch to apply: %v", err)
+	}
+	for _, opts := range []PatchOptions{{ValidateHTML: true}, {ValidateHTML: true, PreserveSource: true}} {
+		_, err := PatchWithOptions(base, delta, opts)
+		if !errors.Is(err, ErrInvalidHTML) {
+			t.Fatalf("PreserveSource=%v: expected ErrInvalidHTML, got %v", opts.PreserveSource, err)
+		}
+		if !strings.Contains(err.Error(), "[0,1,0,1]: <div> is not allowed in <p>") {
+			t.Errorf("Unexpected message: %v", err)
+		}
+	}
+
+	doc, _ := ParseHTML(base)
+	if violations := ValidateTree(doc); violations != nil {
+		t.Errorf("Expected a parsed document to be valid, got %v", violations)
+	}
+	// The parser can't produce these, so build them by hand.
+	root := &html.Node{Type: html.ElementNode, Data: "body"}
+	root.AppendChild(&html.Node{Type: html.ElementNode, Data: "td"})
+	outer := &html.Node{Type: html.ElementNode, Data: "a"}
+	outer.AppendChild(&html.Node{Type: html.ElementNode, Data: "a"})
+	root.AppendChild(outer)
+	want := []string{"[0]: <td> must be in <tr>", "[1,0]: <a> is nested in another <a>"}
+	if got := ValidateTree(root); !reflect.DeepEqual(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestPatchTextContext(t *testing.T) {
+	base := `<p>The quick fox jumps</p>`
+	mine, err := DiffWithOptions(base, `<p>The quick brown fox jumps</p>`, "alice", DiffOptions{TextContext: 8})
+	if err != nil {
+		t.Fatal(err)
+	}
+	op := mine.Operations[0]
+	if op.Type != OpInsertText || op.ContextBefore != "e quick " || op.ContextAfter != "fox jump" {
+		t.Fatalf("Unexpected op %+v", op)
+	}
+
+	// A concurrent edit applied first shifts the text under the insert.
+	shifted := `<p>Look: The quick fox jumps</p>`
+	want := `<p>Look: The quick brown fox jumps</p>`
+	for _, opts := range []PatchOptions{{IgnoreBaseHash: true}, {IgnoreBaseHash: true, PreserveSource: true}} {
+		got, err := PatchWithOptions(shifted, mine, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !compareHTML(t, got, want) {
+			t.Errorf("PreserveSource=%v: got %s", opts.PreserveSource, got)
+		}
+	}
+	plain := *mine
+	plain.Operations = []Operation{{Type: OpInsertText, Path: op.Path, Position: op.Position, NewValue: op.NewValue}}
+	if got, _ := PatchWithOptions(shifted, &plain, PatchOptions{IgnoreBaseHash: true}); compareHTML(t, got, want) {
+		t.Error("Expected the insert without context to land at the old offset")
+	}
+
+	// A delete follows its text too, and the same delta still applies to
+	// its own base.
+	cut, err := DiffWithOptions(base, `<p>The fox jumps</p>`, "alice", DiffOptions{TextContext: 4})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, err := PatchWithOptions(shifted, cut, PatchOptions{IgnoreBaseHash: true}); err != nil || !compareHTML(t, got, `<p>Look: The fox jumps</p>`) {
+		t.Errorf("Shifted delete: got %s, %v", got, err)
+	}
+	if got, err := Patch(base, cut); err != nil || !compareHTML(t, got, `<p>The fox jumps</p>`) {
+		t.Errorf("Delete: got %s, %v", got, err)
+	}
+}
+
+func TestPatchSubtree(t *testing.T) {
+	base := `<header>H</header><nav>N</nav><section><h2>Intro</h2><p>Old text</p></section><footer>F</footer>`
+	// The client edits the section's content on its own.
+	delta, err := DiffFragment(`<h2>Intro</h2><p>Old text</p>`, `<h2>Intro</h2><p>New text</p><p>More</p>`, "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !pathEqual(delta.Operations[0].Path, NodePath{1, 0}) {
+		t.Fatalf("Expected section-relative paths, got %v", delta.Operations)
+	}
+	got, err := PatchSubtree(base, NodePath{0, 1, 2}, delta)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `<header>H</header><nav>N</nav><section><h2>Intro</h2><p>New text</p><p>More</p></section><footer>F</footer>`
+	if !compareHTML(t, got, want) {
+		t.Errorf("got %s", got)
+	}
+
+	if _, err := PatchSubtree(base, NodePath{0, 1, 1}, delta); err == nil {
+		t.Error("Expected a base hash mismatch for the wrong subtree")
+	}
+	if _, err := PatchSubtree(base, NodePath{0, 1, 9}, delta); err == nil {
+		t.Error("Expected an error for a missing subtree")
+	}
+
+	// A document-rooted delta's paths don't address the subtree.
+	docDelta, err := Diff(`<h2>Intro</h2><p>Old text</p>`, `<h2>Intro</h2><p>New text</p>`, "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := PatchSubtree(base, NodePath{0, 1, 2}, docDelta); err == nil {
+		t.Error("Expected a non-fragment delta to be rejected")
+	}
+
+	// Options reach the patch: the hash check can be skipped.
+	stale := `<header>H</header><nav>N</nav><section><h2>Intro!</h2><p>Old text</p></section><footer>F</footer>`
+	if _, err := PatchSubtree(stale, NodePath{0, 1, 2}, delta); err == nil {
+		t.Error("Expected a base hash mismatch for an edited subtree")
+	}
+	got, err = PatchSubtreeWithOptions(stale, NodePath{0, 1, 2}, delta, PatchOptions{IgnoreBaseHash: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want = `<header>H</header><nav>N</nav><section><h2>Intro!</h2><p>New text</p><p>More</p></section><footer>F</footer>`
+	if !compareHTML(t, got, want) {
+		t.Errorf("got %s", got)
+	}
+	if _, err := PatchSubtreeWithOptions(base, NodePath{0, 1, 2}, delta, PatchOptions{PreserveSource: true}); err == nil {
+		t.Error("Expected PreserveSource to be rejected")
+	}
+}
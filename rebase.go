@@ -0,0 +1,64 @@
+package vchtml
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Rebase transforms a delta made against an older revision so it applies to
+// baseHTML. 'intermediate' is the sequence of deltas that turned the delta's
+// base into baseHTML; the chain may start earlier than the delta's base, in
+// which case only the deltas from its base onward are used.
+// If the delta conflicts with an intermediate change, the conflicts are
+// returned and no delta is produced.
+func Rebase(baseHTML string, delta *Delta, intermediate []*Delta) (*Delta, []Conflict, error) {
+	start := -1
+	for i, d := range intermediate {
+		if d.BaseHash == delta.BaseHash {
+			start = i
+			break
+		}
+	}
+	if start < 0 {
+		return nil, nil, fmt.Errorf("delta base %s is not part of the intermediate chain", delta.BaseHash)
+	}
+
+	ops, conflicts, err := rebaseOps(delta, intermediate[start:])
+	if err != nil || len(conflicts) > 0 {
+		return nil, conflicts, err
+	}
+
+	return &Delta{
+		BaseHash:     hashFunc(baseHTML),
+		Operations:   ops,
+		Timestamp:    delta.Timestamp,
+		Author:       delta.Author,
+		Root:         delta.Root,
+		ElementIndex: delta.ElementIndex,
+	}, nil, nil
+}
+
+// rebaseOps transforms delta's operations past each delta in history in turn,
+// stopping at the first conflict.
+func rebaseOps(delta *Delta, history []*Delta) ([]Operation, []Conflict, error) {
+	ops := delta.Operations
+	for _, applied := range history {
+		if applied.Root != delta.Root {
+			return nil, nil, fmt.Errorf("path root mismatch: %q vs %q", applied.Root, delta.Root)
+		}
+		if applied.ElementIndex != delta.ElementIndex {
+			return nil, nil, errors.New("path indexing mismatch: only one delta uses element indices")
+		}
+		appliedOps, _ := granularText(applied.Operations, ops)
+		ops, _ = granularText(ops, applied.Operations)
+		if conflicts := detectConflicts(appliedOps, ops); len(conflicts) > 0 {
+			return nil, conflicts, nil
+		}
+		transformed, err := transformOps(ops, appliedOps)
+		if err != nil {
+			return nil, nil, err
+		}
+		ops = transformed
+	}
+	return ops, nil, nil
+}
@@ -0,0 +1,61 @@
+package vchtml
+
+import (
+	"testing"
+)
+
+func TestRebase(t *testing.T) {
+	rev0 := `<p>Hello World</p>`
+	step, _ := Diff(rev0, `<p>Hello Go World</p>`, "A")
+	rev1, err := Patch(rev0, step)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// stale was made against rev0 but must now apply to rev1.
+	stale, _ := Diff(rev0, `<p>Hello World!</p>`, "B")
+	rebased, conflicts, err := Rebase(rev1, stale, []*Delta{step})
+	if err != nil || len(conflicts) > 0 {
+		t.Fatalf("Rebase failed: %v %v", err, conflicts)
+	}
+	if rebased.BaseHash != hashString(rev1) {
+		t.Errorf("Rebased delta should be based on rev1")
+	}
+
+	patched, err := Patch(rev1, rebased)
+	if err != nil {
+		t.Fatalf("Patch failed: %v", err)
+	}
+	if !compareHTML(t, patched, `<p>Hello Go World!</p>`) {
+		t.Errorf("Rebase produced wrong result")
+	}
+}
+
+func TestMergeWithIntermediateDeltas(t *testing.T) {
+	rev0 := `<div><p>Hello World</p></div>`
+	step, _ := Diff(rev0, `<div><p>Hello Go World</p></div>`, "A")
+	rev1, err := Patch(rev0, step)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// deltaA is current, deltaB is one revision behind.
+	deltaA, _ := Diff(rev1, `<div class="x"><p>Hello Go World</p></div>`, "A")
+	deltaB, _ := Diff(rev0, `<div><p>Hello World!</p></div>`, "B")
+
+	// Without the intermediate chain the stale delta is rejected.
+	if _, _, _, err := Merge(rev1, deltaA, deltaB); err == nil {
+		t.Fatalf("Expected base hash mismatch without intermediate deltas")
+	}
+
+	merged, _, conflicts, err := MergeWithOptions(rev1, deltaA, deltaB, MergeOptions{IntermediateDeltas: []*Delta{step}})
+	if err != nil {
+		t.Fatalf("Merge failed: %v", err)
+	}
+	if len(conflicts) > 0 {
+		t.Fatalf("Unexpected conflicts: %v", conflicts)
+	}
+	if !compareHTML(t, merged, `<div class="x"><p>Hello Go World!</p></div>`) {
+		t.Errorf("Merge incorrect")
+	}
+}
@@ -0,0 +1,132 @@
+package vchtml
+
+import (
+	"errors"
+	"fmt"
+
+	"golang.org/x/net/html"
+)
+
+// Reconcile returns a delta, based on currentHTML, that turns it into
+// targetHTML whatever has drifted between them. It starts from Diff and then
+// patches up whatever the diff leaves out (such as reordered head metadata),
+// rewriting or replacing the smallest differing nodes, so applying the delta
+// to currentHTML always yields a document structurally identical to
+// targetHTML (attribute order aside, as with HashNode).
+func Reconcile(currentHTML, targetHTML string) (*Delta, error) {
+	// The fix-up ops are diffed with the same options as the delta.
+	var opts DiffOptions
+	delta, err := DiffWithOptions(currentHTML, targetHTML, "", opts)
+	if err != nil {
+		return nil, err
+	}
+
+	patched, err := ParseHTML(currentHTML)
+	if err != nil {
+		return nil, err
+	}
+	if err := applyDelta(patched, delta, PatchOptions{}); err != nil {
+		return nil, err
+	}
+	target, err := ParseHTML(targetHTML)
+	if err != nil {
+		return nil, err
+	}
+	r := &reconciler{differ: newDiffer(patched, target, opts)}
+	if err := r.reconcile(patched, target, NodePath{}); err != nil {
+		return nil, err
+	}
+	delta.Operations = append(delta.Operations, r.ops...)
+
+	// Check the result the way a client sees it: rendered and parsed again.
+	result, err := Patch(currentHTML, delta)
+	if err != nil {
+		return nil, err
+	}
+	reparsed, err := ParseHTML(result)
+	if err != nil {
+		return nil, err
+	}
+	if HashNode(reparsed) != HashNode(target) {
+		return nil, errors.New("reconciled delta does not reproduce the target")
+	}
+	return delta, nil
+}
+
+// reconciler collects the ops that make a patched tree match the target.
+type reconciler struct {
+	differ *differ // Diffs attributes; its hashes are of the patched and target trees
+	ops    []Operation
+}
+
+// reconcile emits ops turning the node p at path into t. Ops are emitted in
+// application order, so paths are those of the tree as the previous ops
+// leave it.
+func (r *reconciler) reconcile(p, t *html.Node, path NodePath) error {
+	if r.differ.oldHashes[p] == r.differ.newHashes[t] {
+		return nil
+	}
+	if p.Type != t.Type || p.Namespace != t.Namespace {
+		return r.replace(p, t, path)
+	}
+	switch p.Type {
+	case html.TextNode:
+		r.ops = append(r.ops, Operation{Type: OpUpdateText, Path: path, OldValue: p.Data, NewValue: t.Data})
+		return nil
+	case html.ElementNode:
+		if p.Data != t.Data {
+			r.ops = append(r.ops, Operation{Type: OpChangeTag, Path: path, OldValue: p.Data, NewValue: t.Data})
+		}
+		r.ops = append(r.ops, r.differ.diffAttributes(p, t, path)...)
+	case html.DocumentNode:
+	default:
+		if p.Data != t.Data {
+			return r.replace(p, t, path)
+		}
+	}
+
+	pc, tc := getChildrenList(p), getChildrenList(t)
+	if len(pc) == len(tc) {
+		for i := range pc {
+			if err := r.reconcile(pc[i], tc[i], append(append(NodePath(nil), path...), i)); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	if p.Type == html.DocumentNode {
+		return errors.New("cannot reconcile the document's top-level nodes")
+	}
+	for i := len(pc) - 1; i >= 0; i-- {
+		r.ops = append(r.ops, Operation{Type: OpDeleteNode, Path: append(append(NodePath(nil), path...), i)})
+	}
+	for i, c := range tc {
+		if err := r.insert(path, i, c, t); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// replace emits ops replacing the node p at path with t.
+func (r *reconciler) replace(p, t *html.Node, path NodePath) error {
+	if len(path) == 0 || p.Parent == nil {
+		return fmt.Errorf("cannot replace the root node with a %d node", t.Type)
+	}
+	r.ops = append(r.ops, Operation{Type: OpDeleteNode, Path: path})
+	return r.insert(path[:len(path)-1], path[len(path)-1], t, t.Parent)
+}
+
+// insert emits an INSERT_NODE of a copy of n at position under parentPath.
+func (r *reconciler) insert(parentPath NodePath, position int, n, parent *html.Node) error {
+	data, err := RenderNode(n)
+	if err != nil {
+		return err
+	}
+	op := Operation{Type: OpInsertNode, Path: append(NodePath(nil), parentPath...), Position: position, NodeData: data}
+	if parent != nil && parent.Type == html.ElementNode {
+		op.ParentTag = parent.Data
+	}
+	r.ops = append(r.ops, op)
+	return nil
+}
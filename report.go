@@ -0,0 +1,183 @@
+package vchtml
+
+import (
+	"fmt"
+	"strings"
+
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
+)
+
+// ElementChange is the part of a change report under one element.
+type ElementChange struct {
+	Element string   // The element as a short selector, e.g. "div#main" or "h1"
+	Path    NodePath // Path of the element when its first change applies
+	Changes []string // One description per op, e.g. `text changed from "a" to "b"`
+}
+
+// ChangeReport describes d, applied to baseHTML, for a review UI. Each op is
+// grouped under the nearest element with an id that contains its target
+// (the target itself included), or under the element closest to the target
+// when no ancestor has one. Groups are in the order of their first op.
+// SPLIT_TEXT ops change no visible content and are left out.
+func ChangeReport(baseHTML string, d *Delta) ([]ElementChange, error) {
+	doc, err := parseForRoot(baseHTML, d.Root)
+	if err != nil {
+		return nil, err
+	}
+	root, err := resolvePathRoot(doc, d.Root)
+	if err != nil {
+		return nil, err
+	}
+
+	var report []ElementChange
+	groups := make(map[*html.Node]int)
+	cur := NewCursor(root)
+	for i, op := range d.Operations {
+		op, err := resolveOp(root, d, op)
+		if err != nil {
+			return nil, fmt.Errorf("op %d (%s): %w", i, op.Type, err)
+		}
+		if op, err = atIndex(op); err != nil {
+			return nil, fmt.Errorf("op %d (%s): %w", i, op.Type, err)
+		}
+		target, err := cur.Resolve(op.Path)
+		if err != nil {
+			return nil, fmt.Errorf("op %d (%s): %w", i, op.Type, err)
+		}
+
+		if description := describeOp(op, target); description != "" {
+			// Ops that remove or rewrap their target are reported on its parent.
+			owner := target
+			switch op.Type {
+			case OpDeleteNode, OpMoveNode, OpWrapNode:
+				owner = target.Parent
+			}
+			owner = reportOwner(owner, root)
+			k, ok := groups[owner]
+			if !ok {
+				path, err := GetPath(root, owner)
+				if err != nil {
+					return nil, err
+				}
+				k = len(report)
+				groups[owner] = k
+				report = append(report, ElementChange{Element: elementLabel(owner), Path: path})
+			}
+			report[k].Changes = append(report[k].Changes, description)
+		}
+
+		if err := applyOp(cur, op, PatchOptions{}); err != nil {
+			return nil, fmt.Errorf("op %d (%s): %w", i, op.Type, err)
+		}
+	}
+	return report, nil
+}
+
+// reportOwner returns the element a change at n is reported under: the
+// nearest element at or above n with an id, else the nearest element, else
+// root.
+func reportOwner(n, root *html.Node) *html.Node {
+	var nearest *html.Node
+	for p := n; p != nil && p != root.Parent; p = p.Parent {
+		if p.Type != html.ElementNode {
+			continue
+		}
+		if getAttr(p, "id") != "" {
+			return p
+		}
+		if nearest == nil {
+			nearest = p
+		}
+	}
+	if nearest == nil {
+		return root
+	}
+	return nearest
+}
+
+// elementLabel names n for a report: its tag and id, like a CSS selector.
+func elementLabel(n *html.Node) string {
+	switch n.Type {
+	case html.DocumentNode:
+		return "document"
+	case html.ElementNode:
+		if id := getAttr(n, "id"); id != "" {
+			return n.Data + "#" + id
+		}
+		return n.Data
+	}
+	return "fragment"
+}
+
+// describeOp returns a short description of op, whose target is target in
+// the tree as it is before op applies.
+func describeOp(op Operation, target *html.Node) string {
+	key := op.Key
+	if op.SubKey != "" {
+		key += " " + op.SubKey
+	}
+	switch op.Type {
+	case OpInsertNode:
+		return "added " + describeMarkup(op.NodeData, insertContext(target, op.ParentTag))
+	case OpDeleteNode:
+		return "removed " + describeNode(target)
+	case OpMoveNode:
+		return "moved " + describeNode(target)
+	case OpWrapNode:
+		return fmt.Sprintf("wrapped %s in %s", describeNode(target), describeMarkup(op.NodeData, target.Parent))
+	case OpChangeTag:
+		return fmt.Sprintf("changed <%s> to <%s>", op.OldValue, strings.ToLower(op.NewValue))
+	case OpUpdateText:
+		return fmt.Sprintf("text changed from %s to %s", quoteValue(op.OldValue), quoteValue(op.NewValue))
+	case OpInsertText:
+		return "inserted " + quoteValue(op.NewValue)
+	case OpDeleteText:
+		return "deleted " + quoteValue(op.OldValue)
+	case OpReplaceText:
+		return fmt.Sprintf("replaced %s with %s", quoteValue(op.OldValue), quoteValue(op.NewValue))
+	case OpUpdateAttr:
+		switch {
+		case op.Removed:
+			return "removed " + key
+		case op.Added || op.OldValue == "" && (op.SubKey != "" || !hasAttr(target, op.Key)):
+			return fmt.Sprintf("set %s to %s", key, quoteValue(op.NewValue))
+		}
+		return fmt.Sprintf("changed %s from %s to %s", key, quoteValue(op.OldValue), quoteValue(op.NewValue))
+	case OpDeleteAttr:
+		return "removed " + key
+	case OpAddClass:
+		return "added class " + quoteValue(op.NewValue)
+	case OpRemoveClass:
+		return "removed class " + quoteValue(op.OldValue)
+	case OpInsertAttrText, OpDeleteAttrText:
+		return "edited " + key
+	}
+	return ""
+}
+
+// describeNode names n for a report: <tag> for elements, the quoted text
+// for text nodes.
+func describeNode(n *html.Node) string {
+	switch n.Type {
+	case html.ElementNode:
+		return "<" + n.Data + ">"
+	case html.TextNode:
+		return "text " + quoteValue(n.Data)
+	case html.CommentNode:
+		return "a comment"
+	}
+	return "a node"
+}
+
+// describeMarkup names the first node of an op's NodeData, parsed in context.
+func describeMarkup(data string, context *html.Node) string {
+	if context == nil || context.Type != html.ElementNode {
+		context = &html.Node{Type: html.ElementNode, Data: "body", DataAtom: atom.Body}
+	}
+	nodes, err := html.ParseFragment(strings.NewReader(data), context)
+	if err != nil || len(nodes) == 0 {
+		return quoteValue(data)
+	}
+	return describeNode(nodes[0])
+}
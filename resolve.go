@@ -0,0 +1,205 @@
+package vchtml
+
+import (
+	"fmt"
+	"strings"
+
+	"golang.org/x/net/html"
+)
+
+// ResolutionStrategy decides how MergeWithOptions handles conflicts.
+type ResolutionStrategy int
+
+const (
+	StrategyFail           ResolutionStrategy = iota // Return the conflicts without merging
+	StrategyKeepYours                                // Prefer delta A
+	StrategyKeepTheirs                               // Prefer delta B
+	StrategyLastWriterWins                           // Prefer the delta with the later Timestamp (A on ties)
+)
+
+func (s ResolutionStrategy) String() string {
+	switch s {
+	case StrategyFail:
+		return "fail"
+	case StrategyKeepYours:
+		return "keep-yours"
+	case StrategyKeepTheirs:
+		return "keep-theirs"
+	case StrategyLastWriterWins:
+		return "last-writer-wins"
+	}
+	return fmt.Sprintf("ResolutionStrategy(%d)", int(s))
+}
+
+// resolution records that a conflict was settled in favour of one operation.
+type resolution struct {
+	winnerIsA   bool
+	winnerIndex int    // Index of the winning op in its (filtered) op list
+	loserAuthor string // Author of the dropped side
+}
+
+// resolveConflicts drops the losing side's operations from every conflicting
+// pair. The strategy picks a single winning delta, so a winning op is never
+// dropped by another pair. It returns the surviving op lists and one
+// resolution per distinct winning op.
+func resolveConflicts(pairs []conflictPair, deltaA, deltaB *Delta, strategy ResolutionStrategy) ([]Operation, []Operation, []resolution) {
+	winnerIsA := true
+	switch strategy {
+	case StrategyKeepTheirs:
+		winnerIsA = false
+	case StrategyLastWriterWins:
+		winnerIsA = deltaA.Timestamp >= deltaB.Timestamp
+	}
+
+	dropped := make(map[int]bool)
+	winners := make(map[int]bool)
+	for _, p := range pairs {
+		if winnerIsA {
+			dropped[p.indexB] = true
+			winners[p.indexA] = true
+		} else {
+			dropped[p.indexA] = true
+			winners[p.indexB] = true
+		}
+	}
+
+	loser := deltaB
+	if !winnerIsA {
+		loser = deltaA
+	}
+	filter := func(ops []Operation) []Operation {
+		var kept []Operation
+		for i, op := range ops {
+			if !dropped[i] {
+				kept = append(kept, op)
+			}
+		}
+		return kept
+	}
+
+	// The winning side is never filtered, so its indices stay valid.
+	var resolutions []resolution
+	winnerOps := deltaA.Operations
+	if !winnerIsA {
+		winnerOps = deltaB.Operations
+	}
+	for i := range winnerOps {
+		if winners[i] {
+			resolutions = append(resolutions, resolution{winnerIsA: winnerIsA, winnerIndex: i, loserAuthor: loser.Author})
+		}
+	}
+
+	if winnerIsA {
+		return deltaA.Operations, filter(deltaB.Operations), resolutions
+	}
+	return filter(deltaA.Operations), deltaB.Operations, resolutions
+}
+
+// annotationText is the comment placed next to an auto-resolved change.
+func annotationText(strategy ResolutionStrategy, loserAuthor string) string {
+	author := loserAuthor
+	if author == "" {
+		author = "the other side"
+	} else {
+		author += "'s"
+	}
+	text := fmt.Sprintf(" vchtml: resolved %s, dropped %s edit ", strategy, author)
+	// "--" cannot appear inside an HTML comment.
+	return strings.ReplaceAll(text, "--", "-")
+}
+
+// patchWithAnnotations applies ops to baseHTML and inserts a comment before
+// the node touched by each op listed in annotations (keyed by op index). It
+// returns the rendered document and the INSERT_NODE ops that add the
+// comments, to be appended to the delta so it reproduces the document.
+func patchWithAnnotations(baseHTML string, delta *Delta, annotations map[int]string) (string, []Operation, error) {
+	doc, err := parseForRoot(baseHTML, delta.Root)
+	if err != nil {
+		return "", nil, err
+	}
+	root, err := resolvePathRoot(doc, delta.Root)
+	if err != nil {
+		return "", nil, err
+	}
+
+	type anchor struct {
+		parent, before *html.Node
+		text           string
+	}
+	var anchors []anchor
+
+	cur := NewCursor(root)
+	for i, op := range delta.Operations {
+		text, annotate := annotations[i]
+		var a anchor
+		if annotate && op.Type != OpInsertNode {
+			if node, err := GetNode(root, op.Path); err == nil && node.Parent != nil {
+				a = anchor{parent: node.Parent, before: node, text: text}
+				if op.Type == OpDeleteNode {
+					a.before = node.NextSibling
+				}
+			}
+		}
+
+		if err := applyOp(cur, op, PatchOptions{}); err != nil {
+			return "", nil, fmt.Errorf("failed to apply op %d (%s): %w", i, op.Type, err)
+		}
+
+		if annotate && op.Type == OpInsertNode {
+			if parent, err := GetNode(root, op.Path); err == nil {
+				a = anchor{parent: parent, before: getChildAtIndex(parent, op.Position), text: text}
+			}
+		}
+		if a.parent != nil {
+			anchors = append(anchors, a)
+		}
+	}
+
+	comments := make(map[*html.Node]bool)
+	for _, a := range anchors {
+		comment := &html.Node{Type: html.CommentNode, Data: a.text}
+		if a.before != nil && a.before.Parent != nil {
+			// The anchor may have moved (e.g. into a wrapper); follow it.
+			a.before.Parent.InsertBefore(comment, a.before)
+		} else {
+			a.parent.AppendChild(comment)
+		}
+		comments[comment] = true
+	}
+
+	// Inserting the comments in document order at their final paths is valid:
+	// a comment later in the document never shifts an earlier one's ancestors.
+	var extra []Operation
+	var walk func(n *html.Node) error
+	walk = func(n *html.Node) error {
+		for c := n.FirstChild; c != nil; c = c.NextSibling {
+			if comments[c] {
+				path, err := GetPath(root, c)
+				if err != nil {
+					return err
+				}
+				data, err := RenderNode(c)
+				if err != nil {
+					return err
+				}
+				extra = append(extra, Operation{
+					Type:     OpInsertNode,
+					Path:     path[:len(path)-1],
+					Position: path[len(path)-1],
+					NodeData: data,
+				})
+				continue
+			}
+			if err := walk(c); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	if err := walk(root); err != nil {
+		return "", nil, err
+	}
+
+	rendered, err := renderForRoot(doc, delta.Root)
+	return rendered, extra, err
+}
@@ -0,0 +1,337 @@
+package vchtml
+
+import (
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+
+	"golang.org/x/net/html"
+)
+
+// PathFromSelector returns the path from root to the first element (in
+// document order) that selector matches, so hand-written deltas can name
+// their targets readably. See QuerySelector for the supported syntax.
+func PathFromSelector(root *html.Node, selector string) (NodePath, error) {
+	n, err := QuerySelector(root, selector)
+	if err != nil {
+		return nil, err
+	}
+	return GetPath(root, n)
+}
+
+// QuerySelector returns the first element under root (in document order,
+// root excluded) that selector matches. Selectors are compound selectors of
+// a tag name or "*", "#id", ".class", "[attr]", "[attr=value]" and
+// ":nth-child(n)" (1-based, counting element siblings), joined by
+// descendant (space) or child (">") combinators; combinators only look at
+// ancestors up to root. It returns an error when the selector is malformed
+// or matches nothing.
+func QuerySelector(root *html.Node, selector string) (*html.Node, error) {
+	steps, err := parseSelector(selector)
+	if err != nil {
+		return nil, err
+	}
+	var found *html.Node
+	var walk func(n *html.Node)
+	walk = func(n *html.Node) {
+		for c := n.FirstChild; c != nil && found == nil; c = c.NextSibling {
+			if matchSelector(root, c, steps, len(steps)-1) {
+				found = c
+				return
+			}
+			walk(c)
+		}
+	}
+	walk(root)
+	if found == nil {
+		return nil, fmt.Errorf("no element matches %q", selector)
+	}
+	return found, nil
+}
+
+// Walk calls fn for root and every node under it in document order, with
+// the node's path from root. fn returns whether to descend into the node's
+// children. The path is reused between calls; clone it to keep it.
+func Walk(root *html.Node, fn func(n *html.Node, path NodePath) bool) {
+	var path NodePath
+	var walk func(n *html.Node)
+	walk = func(n *html.Node) {
+		if !fn(n, path) {
+			return
+		}
+		i := 0
+		for c := n.FirstChild; c != nil; c = c.NextSibling {
+			path = append(path, i)
+			walk(c)
+			path = path[:len(path)-1]
+			i++
+		}
+	}
+	walk(root)
+}
+
+// NodeMatch is a node found by FindAll and its path from the search root.
+type NodeMatch struct {
+	Node *html.Node
+	Path NodePath
+}
+
+// FindAll returns every node under root, root included, that pred matches,
+// in document order, for bulk edits such as updating all links' targets.
+func FindAll(root *html.Node, pred func(*html.Node) bool) []NodeMatch {
+	var found []NodeMatch
+	Walk(root, func(n *html.Node, path NodePath) bool {
+		if pred(n) {
+			found = append(found, NodeMatch{Node: n, Path: slices.Clone(path)})
+		}
+		return true
+	})
+	return found
+}
+
+// selectorStep is one compound selector and the combinator linking it to the
+// step before it.
+type selectorStep struct {
+	child    bool // ">" rather than a descendant combinator
+	tag      string
+	id       string
+	classes  []string
+	attrs    []attrSelector
+	nthChild int // 1-based; 0 when absent
+}
+
+// attrSelector is an attribute selector: "[name]" or "[name=value]".
+type attrSelector struct {
+	name     string // Lowercase
+	value    string
+	hasValue bool
+}
+
+// parseSelector splits selector into its compound selectors.
+func parseSelector(selector string) ([]selectorStep, error) {
+	fields := selectorFields(selector)
+	var steps []selectorStep
+	child := false
+	for _, field := range fields {
+		if field == ">" {
+			if child || len(steps) == 0 {
+				return nil, fmt.Errorf("misplaced '>' in selector %q", selector)
+			}
+			child = true
+			continue
+		}
+		step, err := parseCompound(field)
+		if err != nil {
+			return nil, fmt.Errorf("selector %q: %w", selector, err)
+		}
+		step.child = child
+		child = false
+		steps = append(steps, step)
+	}
+	if len(steps) == 0 || child {
+		return nil, fmt.Errorf("incomplete selector %q", selector)
+	}
+	return steps, nil
+}
+
+// selectorFields splits selector into compound selectors and ">"
+// combinators at whitespace and ">", except inside attribute selectors and
+// quotes. An unclosed bracket runs to the end, for parseCompound to reject.
+func selectorFields(selector string) []string {
+	var fields []string
+	var field strings.Builder
+	flush := func() {
+		if field.Len() > 0 {
+			fields = append(fields, field.String())
+			field.Reset()
+		}
+	}
+	inAttr := false
+	var quote rune
+	for _, r := range selector {
+		switch {
+		case quote != 0:
+			if r == quote {
+				quote = 0
+			}
+		case inAttr:
+			switch r {
+			case '"', '\'':
+				quote = r
+			case ']':
+				inAttr = false
+			}
+		case r == '[':
+			inAttr = true
+		case r == '>':
+			flush()
+			fields = append(fields, ">")
+			continue
+		case strings.ContainsRune(" \t\n\f\r", r):
+			flush()
+			continue
+		}
+		field.WriteRune(r)
+	}
+	flush()
+	return fields
+}
+
+// parseCompound parses a compound selector such as "li.item:nth-child(2)".
+func parseCompound(s string) (selectorStep, error) {
+	var step selectorStep
+	end := strings.IndexAny(s, "#.:[")
+	if end < 0 {
+		end = len(s)
+	}
+	if tag := s[:end]; tag != "*" {
+		step.tag = strings.ToLower(tag)
+	}
+	s = s[end:]
+	for s != "" {
+		kind := s[0]
+		s = s[1:]
+		if kind == '[' {
+			end := attrSelectorEnd(s)
+			if end < 0 {
+				return step, fmt.Errorf("unclosed attribute selector [%s", s)
+			}
+			body, rest := s[:end], s[end+1:]
+			a, err := parseAttrSelector(body)
+			if err != nil {
+				return step, err
+			}
+			step.attrs = append(step.attrs, a)
+			s = rest
+			continue
+		}
+		end := strings.IndexAny(s, "#.:[")
+		if end < 0 {
+			end = len(s)
+		}
+		name := s[:end]
+		s = s[end:]
+		if name == "" {
+			return step, fmt.Errorf("empty name after %q", kind)
+		}
+		switch kind {
+		case '#':
+			step.id = name
+		case '.':
+			step.classes = append(step.classes, name)
+		case ':':
+			arg, ok := strings.CutPrefix(name, "nth-child(")
+			arg, closed := strings.CutSuffix(arg, ")")
+			if !ok || !closed {
+				return step, fmt.Errorf("unsupported pseudo-class :%s", name)
+			}
+			n, err := strconv.Atoi(arg)
+			if err != nil || n < 1 {
+				return step, fmt.Errorf("invalid nth-child index %q", arg)
+			}
+			step.nthChild = n
+		}
+	}
+	return step, nil
+}
+
+// attrSelectorEnd returns the index in s of the "]" closing an attribute
+// selector whose "[" preceded s, skipping quoted values, or -1.
+func attrSelectorEnd(s string) int {
+	var quote byte
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; {
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			}
+		case c == '"' || c == '\'':
+			quote = c
+		case c == ']':
+			return i
+		}
+	}
+	return -1
+}
+
+// parseAttrSelector parses the inside of an attribute selector: a name,
+// optionally followed by "=" and a value, which may be quoted.
+func parseAttrSelector(s string) (attrSelector, error) {
+	name, value, hasValue := strings.Cut(s, "=")
+	a := attrSelector{name: strings.ToLower(strings.TrimSpace(name)), hasValue: hasValue}
+	if a.name == "" {
+		return a, fmt.Errorf("empty attribute name in [%s]", s)
+	}
+	if hasValue {
+		value = strings.TrimSpace(value)
+		if len(value) >= 2 && (value[0] == '"' || value[0] == '\'') && value[len(value)-1] == value[0] {
+			value = value[1 : len(value)-1]
+		}
+		a.value = value
+	}
+	return a, nil
+}
+
+// matchSelector reports whether n matches steps[:k+1], with the ancestors
+// searched for earlier steps bounded by root.
+func matchSelector(root, n *html.Node, steps []selectorStep, k int) bool {
+	if !steps[k].matches(n) {
+		return false
+	}
+	if k == 0 {
+		return true
+	}
+	for p := n.Parent; p != nil && p != root; p = p.Parent {
+		if matchSelector(root, p, steps, k-1) {
+			return true
+		}
+		if steps[k].child {
+			break
+		}
+	}
+	return false
+}
+
+// matches reports whether the element n satisfies the compound selector.
+func (s selectorStep) matches(n *html.Node) bool {
+	if n.Type != html.ElementNode || (s.tag != "" && n.Data != s.tag) {
+		return false
+	}
+	if s.id != "" && getAttr(n, "id") != s.id {
+		return false
+	}
+	classes := strings.Fields(getAttr(n, "class"))
+	for _, want := range s.classes {
+		found := false
+		for _, c := range classes {
+			if c == want {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	for _, a := range s.attrs {
+		if !hasAttr(n, a.name) || (a.hasValue && getAttr(n, a.name) != a.value) {
+			return false
+		}
+	}
+	if s.nthChild > 0 {
+		index := 0
+		for c := n.Parent.FirstChild; c != nil; c = c.NextSibling {
+			if c.Type == html.ElementNode {
+				index++
+			}
+			if c == n {
+				break
+			}
+		}
+		if index != s.nthChild {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,73 @@
+package vchtml
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+)
+
+// SignDelta sets d.Signature to an HMAC-SHA256 of d's canonical encoding
+// under key, so a receiver holding the key can detect tampering.
+func SignDelta(d *Delta, key []byte) {
+	d.Signature = deltaMAC(d, key)
+}
+
+// VerifyDelta reports whether d.Signature is a valid HMAC of d under key.
+// Any change to the delta's fields or operations after signing fails it.
+func VerifyDelta(d *Delta, key []byte) bool {
+	if len(d.Signature) == 0 {
+		return false
+	}
+	return hmac.Equal(d.Signature, deltaMAC(d, key))
+}
+
+// deltaMAC computes the HMAC over every field of d except Signature, using
+// the same length-prefixed encoding as the structural hashes.
+func deltaMAC(d *Delta, key []byte) []byte {
+	w := hashWriter{h: hmac.New(sha256.New, key)}
+	w.string(d.BaseHash)
+	w.uint(uint64(d.Timestamp))
+	w.string(d.Author)
+	w.string(string(d.Root))
+	elementIndex := uint64(0)
+	if d.ElementIndex {
+		elementIndex = 1
+	}
+	w.uint(elementIndex)
+	w.uint(uint64(len(d.Operations)))
+	for _, op := range d.Operations {
+		w.string(string(op.Type))
+		w.uint(uint64(len(op.Path)))
+		for _, index := range op.Path {
+			w.uint(uint64(index))
+		}
+		w.string(op.Key)
+		w.string(op.OldValue)
+		w.string(op.NewValue)
+		w.string(op.NodeData)
+		w.uint(uint64(op.Position))
+		flags := uint64(0)
+		if op.Removed {
+			flags |= 1
+		}
+		if op.Added {
+			flags |= 2
+		}
+		w.uint(flags)
+		w.string(op.OrderKey)
+		w.string(op.SubKey)
+		w.string(op.Anchor)
+		w.string(op.ParentTag)
+		w.uint(uint64(len(op.To)))
+		for _, index := range op.To {
+			w.uint(uint64(index))
+		}
+		w.string(string(op.Placement))
+		w.string(op.ContextBefore)
+		w.string(op.ContextAfter)
+		w.uint(uint64(len(op.MovedFrom)))
+		for _, index := range op.MovedFrom {
+			w.uint(uint64(index))
+		}
+	}
+	return w.h.Sum(nil)
+}
@@ -0,0 +1,71 @@
+package vchtml
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestSignDelta(t *testing.T) {
+	key := []byte("server-secret")
+	delta, err := Diff(`<p class="a">Hello</p>`, `<p class="b">Hello World</p>`, "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if VerifyDelta(delta, key) {
+		t.Error("An unsigned delta must not verify")
+	}
+	SignDelta(delta, key)
+	if !VerifyDelta(delta, key) {
+		t.Fatal("Signed delta failed verification")
+	}
+	if VerifyDelta(delta, []byte("other-key")) {
+		t.Error("Delta verified under the wrong key")
+	}
+
+	// The signature survives a JSON round-trip.
+	data, err := json.Marshal(delta)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var decoded Delta
+	if err := json.Unmarshal(data, &decoded); err != nil {
+		t.Fatal(err)
+	}
+	if !VerifyDelta(&decoded, key) {
+		t.Error("Decoded delta failed verification")
+	}
+
+	// Tampering with a single op invalidates the signature.
+	decoded.Operations[0].NewValue += "!"
+	if VerifyDelta(&decoded, key) {
+		t.Error("Tampered delta passed verification")
+	}
+
+	// Optional fields are encoded whether set or not, so moving a value
+	// between them changes the signature.
+	op := Operation{Type: OpInsertText, Path: NodePath{0}, NewValue: "a", ContextAfter: "x"}
+	after := &Delta{BaseHash: "h", Operations: []Operation{op}}
+	op.ContextBefore, op.ContextAfter = "x", ""
+	before := &Delta{BaseHash: "h", Operations: []Operation{op}}
+	SignDelta(after, key)
+	before.Signature = after.Signature
+	if VerifyDelta(before, key) {
+		t.Error("Context before and after signed alike")
+	}
+
+	// An empty MovedFrom signs like a missing one, which it decodes as.
+	moved := &Delta{BaseHash: "h", Operations: []Operation{{Type: OpUpdateAttr, Path: NodePath{0}, Key: "id", NewValue: "x", MovedFrom: NodePath{}}}}
+	SignDelta(moved, key)
+	data, err = json.Marshal(moved)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var relayed Delta
+	if err := json.Unmarshal(data, &relayed); err != nil {
+		t.Fatal(err)
+	}
+	if !VerifyDelta(&relayed, key) {
+		t.Error("Relayed delta with an empty MovedFrom failed verification")
+	}
+}
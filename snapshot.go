@@ -0,0 +1,103 @@
+package vchtml
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
+)
+
+// Snapshot is a serialized DOM node as a browser client might send it, e.g.
+// built by walking document.documentElement and encoded as JSON.
+type Snapshot struct {
+	Tag       string            `json:"tag,omitempty"`   // Element tag name; empty for text and comments
+	Namespace string            `json:"ns,omitempty"`    // "svg" or "math" for foreign elements
+	Attrs     map[string]string `json:"attrs,omitempty"` // Element attributes
+	Text      string            `json:"text,omitempty"`  // Text node content, or a comment's data
+	Comment   bool              `json:"comment,omitempty"`
+	Children  []Snapshot        `json:"children,omitempty"`
+}
+
+// Node converts s to a detached html.Node tree. Tags of HTML elements are
+// lower-cased (browsers report them upper case); attributes are sorted by
+// name, since a map has no order.
+func (s Snapshot) Node() *html.Node {
+	var n *html.Node
+	switch {
+	case s.Comment:
+		return &html.Node{Type: html.CommentNode, Data: s.Text}
+	case s.Tag == "":
+		return &html.Node{Type: html.TextNode, Data: s.Text}
+	case s.Namespace == "":
+		tag := strings.ToLower(s.Tag)
+		n = &html.Node{Type: html.ElementNode, Data: tag, DataAtom: atom.Lookup([]byte(tag))}
+	default:
+		n = &html.Node{Type: html.ElementNode, Data: s.Tag, Namespace: s.Namespace}
+	}
+	keys := make([]string, 0, len(s.Attrs))
+	for k := range s.Attrs {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		n.Attr = append(n.Attr, html.Attribute{Key: k, Val: s.Attrs[k]})
+	}
+	for _, c := range s.Children {
+		n.AppendChild(c.Node())
+	}
+	return n
+}
+
+// snapshotDoc builds the tree DiffSnapshots diffs for s: a document holding
+// s, or for PathRootFragment a virtual root holding s's children.
+func snapshotDoc(s Snapshot, root PathRoot) *html.Node {
+	if root == PathRootFragment {
+		doc := &html.Node{Type: html.ElementNode, Data: "body", DataAtom: atom.Body}
+		for _, c := range s.Children {
+			doc.AppendChild(c.Node())
+		}
+		return doc
+	}
+	doc := &html.Node{Type: html.DocumentNode}
+	doc.AppendChild(s.Node())
+	return doc
+}
+
+// DiffSnapshots diffs two DOM snapshots without going through HTML strings.
+// The snapshots are of the document element (<html>), or with
+// PathRootFragment of a container whose children are the fragment. The delta
+// is based on the old snapshot rendered as HTML, which SnapshotHTML returns;
+// that is the string to patch, so it is what the server should store. The
+// snapshots must be trees a parser could produce (as a browser's DOM
+// normally is), or the rendered base won't parse back to the same paths.
+func DiffSnapshots(oldSnap, newSnap Snapshot, author string, opts DiffOptions) (*Delta, error) {
+	if err := checkDiffOptions(opts); err != nil {
+		return nil, err
+	}
+	oldDoc := snapshotDoc(oldSnap, opts.Root)
+	base, err := renderForRoot(oldDoc, opts.Root)
+	if err != nil {
+		return nil, err
+	}
+	delta := &Delta{
+		BaseHash:     hashFunc(base),
+		Timestamp:    time.Now().Unix(),
+		Author:       author,
+		Root:         opts.Root,
+		ElementIndex: opts.ElementIndexOnly,
+	}
+	delta, err = diffDocs(delta, oldDoc, snapshotDoc(newSnap, opts.Root), opts)
+	if err != nil {
+		return nil, fmt.Errorf("snapshot: %w", err)
+	}
+	return delta, nil
+}
+
+// SnapshotHTML renders s as HTML the way DiffSnapshots does for a delta with
+// path root root.
+func SnapshotHTML(s Snapshot, root PathRoot) (string, error) {
+	return renderForRoot(snapshotDoc(s, root), root)
+}
@@ -0,0 +1,764 @@
+package vchtml
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
+)
+
+// sourceSpan is the byte range of a node in the source it was parsed from.
+// For elements, tagEnd is the end of the start tag and closeStart the start of
+// the end tag; end is -1 when the end tag is implied rather than written.
+type sourceSpan struct {
+	start, end int
+	tagEnd     int
+	closeStart int
+}
+
+// srcToken is a token of the source together with its byte range.
+type srcToken struct {
+	typ        html.TokenType
+	name       string
+	data       string
+	attrs      []html.Attribute
+	start, end int
+	closeStart int // For open start tags: where the matching end tag starts (-1 if implied)
+	closeEnd   int
+}
+
+// voidElements never have an end tag.
+var voidElements = map[string]bool{
+	"area": true, "base": true, "br": true, "col": true, "embed": true,
+	"hr": true, "img": true, "input": true, "keygen": true, "link": true,
+	"meta": true, "param": true, "source": true, "track": true, "wbr": true,
+}
+
+// SourceOffset returns the byte range [start, end) of the node at path (from
+// the document node) in content, so callers can edit the source directly. It
+// fails for nodes the parser implied (such as an omitted <tbody>) or whose
+// end tag is omitted, since they have no exact range in the source.
+func SourceOffset(content string, path NodePath) (int, int, error) {
+	doc, spans, err := sourceMap(content, PathRootDocument)
+	if err != nil {
+		return 0, 0, err
+	}
+	node, err := GetNode(doc, path)
+	if err != nil {
+		return 0, 0, err
+	}
+	span, ok := spans[node]
+	if !ok || span.end < 0 {
+		return 0, 0, fmt.Errorf("node at path %v has no exact source range", path)
+	}
+	return span.start, span.end, nil
+}
+
+// sourceMap parses content for root and maps each node of the tree that
+// corresponds exactly to tokens in content to its source range. Nodes the
+// parser created, merged or moved are left out.
+func sourceMap(content string, root PathRoot) (*html.Node, map[*html.Node]sourceSpan, error) {
+	doc, err := parseForRoot(content, root)
+	if err != nil {
+		return nil, nil, err
+	}
+	tokens, err := tokenizeSource(content, root)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	spans := make(map[*html.Node]sourceSpan)
+	next := 0
+	// nextToken returns the index of the first token from next on that is not
+	// skipped, or -1.
+	nextToken := func(skip func(t srcToken) bool) int {
+		for i := next; i < len(tokens); i++ {
+			if !skip(tokens[i]) {
+				return i
+			}
+		}
+		return -1
+	}
+	var walk func(n *html.Node)
+	walk = func(n *html.Node) {
+		for c := n.FirstChild; c != nil; c = c.NextSibling {
+			switch c.Type {
+			case html.ElementNode:
+				// Text tokens the parser dropped or moved are skipped; an
+				// implied element leaves the next start tag to its children.
+				i := nextToken(func(t srcToken) bool {
+					return t.typ != html.StartTagToken && t.typ != html.SelfClosingTagToken
+				})
+				if i >= 0 && strings.EqualFold(tokens[i].name, c.Data) && attrsMatch(tokens[i].attrs, c.Attr) {
+					t := tokens[i]
+					span := sourceSpan{start: t.start, tagEnd: t.end, end: -1, closeStart: -1}
+					if t.typ == html.SelfClosingTagToken || voidElements[t.name] {
+						span.end = t.end
+					} else if t.closeStart >= 0 {
+						span.closeStart, span.end = t.closeStart, t.closeEnd
+					}
+					spans[c] = span
+					next = i + 1
+				}
+			case html.TextNode, html.CommentNode, html.DoctypeNode:
+				want := map[html.NodeType]html.TokenType{
+					html.TextNode:    html.TextToken,
+					html.CommentNode: html.CommentToken,
+					html.DoctypeNode: html.DoctypeToken,
+				}[c.Type]
+				i := nextToken(func(t srcToken) bool {
+					return t.typ == html.EndTagToken || (t.typ == html.TextToken && want != html.TextToken && strings.TrimSpace(t.data) == "")
+				})
+				if i >= 0 && tokens[i].typ == want && (want == html.DoctypeToken || tokens[i].data == c.Data) {
+					spans[c] = sourceSpan{start: tokens[i].start, end: tokens[i].end, tagEnd: tokens[i].end, closeStart: -1}
+					next = i + 1
+				}
+			}
+			walk(c)
+		}
+	}
+	walk(doc)
+	return doc, spans, nil
+}
+
+// tokenizeSource splits content into tokens with byte ranges, pairing each
+// open start tag with its end tag where one is written.
+func tokenizeSource(content string, root PathRoot) ([]srcToken, error) {
+	z := html.NewTokenizer(strings.NewReader(content))
+	if root == PathRootFragment {
+		z = html.NewTokenizerFragment(strings.NewReader(content), "body")
+	}
+	var tokens []srcToken
+	var open []int // Indices of start tags awaiting their end tag
+	foreign := 0   // Depth of open <svg>/<math> elements
+	offset := 0
+	for {
+		tt := z.Next()
+		if tt == html.ErrorToken {
+			break
+		}
+		rawLen := len(z.Raw())
+		tok := z.Token()
+		t := srcToken{typ: tt, name: tok.Data, data: tok.Data, attrs: tok.Attr, start: offset, end: offset + rawLen, closeStart: -1}
+		offset += rawLen
+
+		switch tt {
+		case html.StartTagToken:
+			if !voidElements[t.name] {
+				open = append(open, len(tokens))
+				if t.name == "svg" || t.name == "math" {
+					foreign++
+				}
+			}
+		case html.SelfClosingTagToken:
+			// Outside foreign content a self-closing slash is ignored.
+			if foreign == 0 && !voidElements[t.name] {
+				t.typ = html.StartTagToken
+				open = append(open, len(tokens))
+			}
+		case html.EndTagToken:
+			for i := len(open) - 1; i >= 0; i-- {
+				if tokens[open[i]].name == t.name {
+					tokens[open[i]].closeStart, tokens[open[i]].closeEnd = t.start, t.end
+					for _, j := range open[i:] {
+						if n := tokens[j].name; n == "svg" || n == "math" {
+							foreign--
+						}
+					}
+					open = open[:i]
+					break
+				}
+			}
+		}
+		tokens = append(tokens, t)
+	}
+	if offset != len(content) {
+		return nil, errors.New("tokenizer did not consume the whole source")
+	}
+	return tokens, nil
+}
+
+// attrsMatch reports whether a start tag's attributes are exactly the
+// element's, so the element was built from that tag alone.
+func attrsMatch(tokenAttrs, nodeAttrs []html.Attribute) bool {
+	if len(tokenAttrs) != len(nodeAttrs) {
+		return false
+	}
+	for i, a := range tokenAttrs {
+		if !strings.EqualFold(a.Key, attrName(nodeAttrs[i])) || a.Val != nodeAttrs[i].Val {
+			return false
+		}
+	}
+	return true
+}
+
+// srcAttr is an attribute's byte range within a start tag. wsStart includes
+// the whitespace before it, which goes when the attribute is removed.
+type srcAttr struct {
+	name                string
+	wsStart, start, end int
+}
+
+// scanStartTag returns the attributes of the start tag in tag, with ranges
+// relative to the start of tag, and the offset where a new attribute can be
+// added (before the closing ">" or "/>").
+func scanStartTag(tag string) ([]srcAttr, int) {
+	isSpace := func(c byte) bool { return c == ' ' || c == '\t' || c == '\n' || c == '\r' || c == '\f' }
+	i := 1
+	for i < len(tag) && !isSpace(tag[i]) && tag[i] != '/' && tag[i] != '>' {
+		i++
+	}
+	var attrs []srcAttr
+	for {
+		wsStart := i
+		for i < len(tag) && (isSpace(tag[i]) || (tag[i] == '/' && i+1 < len(tag) && tag[i+1] != '>')) {
+			i++
+		}
+		if i >= len(tag) || tag[i] == '>' || tag[i] == '/' {
+			return attrs, wsStart
+		}
+		start := i
+		for i < len(tag) && !isSpace(tag[i]) && tag[i] != '=' && tag[i] != '>' && tag[i] != '/' {
+			i++
+		}
+		name := tag[start:i]
+		j := i
+		for j < len(tag) && isSpace(tag[j]) {
+			j++
+		}
+		if j < len(tag) && tag[j] == '=' {
+			j++
+			for j < len(tag) && isSpace(tag[j]) {
+				j++
+			}
+			if j < len(tag) && (tag[j] == '"' || tag[j] == '\'') {
+				if k := strings.IndexByte(tag[j+1:], tag[j]); k >= 0 {
+					j += k + 2
+				} else {
+					j = len(tag) - 1
+				}
+			} else {
+				for j < len(tag) && !isSpace(tag[j]) && tag[j] != '>' {
+					j++
+				}
+			}
+			i = j
+		}
+		attrs = append(attrs, srcAttr{name: name, wsStart: wsStart, start: start, end: i})
+	}
+}
+
+// rawTextElements render their text unescaped.
+var rawTextElements = map[string]bool{
+	"iframe": true, "noembed": true, "noframes": true, "noscript": true,
+	"plaintext": true, "script": true, "style": true, "xmp": true,
+}
+
+// escapeSourceText escapes s for use as the text of parent.
+func escapeSourceText(parent *html.Node, s string) string {
+	if parent != nil && parent.Type == html.ElementNode && rawTextElements[parent.Data] {
+		return s
+	}
+	return html.EscapeString(s)
+}
+
+// patchSource applies delta by editing baseHTML at the source ranges of the
+// targeted nodes, leaving every other byte untouched. Each op is located in a
+// fresh parse of the source as edited so far, since an edit shifts the ranges
+// after it and may change how the parser reads its neighbours; the cost is
+// one parse and tokenization of the whole source per op (two with element
+// indices), so it grows with document size times op count. The result must
+// parse to the same tree a regular Patch produces; ops that cannot be
+// expressed as a source edit (or whose target has no exact range) are
+// reported as errors.
+func patchSource(baseHTML string, delta *Delta, opts PatchOptions) (string, error) {
+	if opts.SortAttributes {
+		return "", errors.New("SortAttributes cannot be combined with PreserveSource")
+	}
+
+	order, err := opOrder(delta.Operations, opts)
+	if err != nil {
+		return "", err
+	}
+	src := baseHTML
+	var deleted []NodePath
+	var split *pendingSplit
+	for k := 0; k < len(order); k++ {
+		i := order[k]
+		op := delta.Operations[i]
+		tracked := op
+		// A DELETE_TEXT and an INSERT_TEXT at the same offset are one splice:
+		// applied apart, a delete of all the text would leave no text node
+		// in the reparsed source for the insert to go into.
+		folded := -1
+		if k+1 < len(order) && split == nil && isSplice(op, delta.Operations[order[k+1]]) {
+			k++
+			folded = order[k]
+			op.Type, op.NewValue = OpReplaceText, delta.Operations[folded].NewValue
+		}
+		var edited string
+		var err error
+		if delta.ElementIndex {
+			op, err = rawSourceIndices(src, delta.Root, op)
+		}
+		switch {
+		case err != nil: // Reported below
+		case op.Type == OpSplitText || split != nil:
+			edited, split, err = applySplitOp(src, delta.Root, split, op, opts)
+		default:
+			edited, err = applySourceOp(src, delta.Root, op, opts)
+		}
+		if err != nil {
+			if ancestor, ok := deletedAncestor(deleted, tracked); ok {
+				if opts.SkipDeletedTargets {
+					if opts.OnSkip != nil && folded >= 0 {
+						opts.OnSkip(i, delta.Operations[i])
+						opts.OnSkip(folded, delta.Operations[folded])
+					} else if opts.OnSkip != nil {
+						opts.OnSkip(i, op)
+					}
+					continue
+				}
+				return "", fmt.Errorf("failed to apply op %d (%s): target under deleted subtree %v: %w", i, op.Type, ancestor, err)
+			}
+			return "", fmt.Errorf("failed to apply op %d (%s): %w", i, op.Type, err)
+		}
+		src = edited
+		deleted = shiftDeleted(deleted, tracked)
+	}
+	if split != nil {
+		return "", fmt.Errorf("SPLIT_TEXT at %v is not followed by an insert or wrap that can be applied as a source edit", split.path)
+	}
+
+	// Cross-check against the tree patch, so a source edit that the parser
+	// reads differently (e.g. adjacent text merging) is never returned.
+	want, err := parseForRoot(baseHTML, delta.Root)
+	if err != nil {
+		return "", err
+	}
+	if err := applyDelta(want, delta, opts); err != nil {
+		return "", err
+	}
+	got, err := parseForRoot(src, delta.Root)
+	if err != nil {
+		return "", err
+	}
+	if HashNode(got) != HashNode(want) {
+		return "", errors.New("source edits do not reproduce the patched tree")
+	}
+	return src, nil
+}
+
+// isSplice reports whether ins inserts text where del, just before it,
+// deleted text, as Diff emits a replaced stretch of text.
+func isSplice(del, ins Operation) bool {
+	return del.Type == OpDeleteText && ins.Type == OpInsertText && pathEqual(del.Path, ins.Path) &&
+		del.Position == ins.Position && del.Anchor == ins.Anchor
+}
+
+// rawSourceIndices converts the element-indexed paths of op to raw indices
+// in src as edited so far (see rawIndices).
+func rawSourceIndices(src string, pathRoot PathRoot, op Operation) (Operation, error) {
+	doc, err := parseForRoot(src, pathRoot)
+	if err != nil {
+		return op, err
+	}
+	root, err := resolvePathRoot(doc, pathRoot)
+	if err != nil {
+		return op, err
+	}
+	return rawIndices(root, op)
+}
+
+// applySourceOp applies one op to src as a byte-range edit.
+func applySourceOp(src string, pathRoot PathRoot, op Operation, opts PatchOptions) (string, error) {
+	doc, spans, err := sourceMap(src, pathRoot)
+	if err != nil {
+		return "", err
+	}
+	root, err := resolvePathRoot(doc, pathRoot)
+	if err != nil {
+		return "", err
+	}
+	if op, err = resolveAnchor(root, op); err != nil {
+		return "", err
+	}
+	if op.Placement != PlaceAtIndex {
+		if _, err := GetNode(root, op.Path); err != nil {
+			return "", fmt.Errorf("sibling of %s insert: %w", op.Placement, err)
+		}
+		if op, err = atIndex(op); err != nil {
+			return "", err
+		}
+	}
+	target, err := GetNode(root, op.Path)
+	if err != nil {
+		return "", err
+	}
+	span, mapped := spans[target]
+	noSpan := fmt.Errorf("node at path %v has no exact source range", op.Path)
+	replace := func(start, end int, s string) string { return src[:start] + s + src[end:] }
+
+	switch op.Type {
+	case OpUpdateText, OpInsertText, OpDeleteText, OpReplaceText:
+		if target.Type != html.TextNode {
+			return "", fmt.Errorf("target node for %s is not a text node (type=%d)", op.Type, target.Type)
+		}
+		if !mapped {
+			return "", noSpan
+		}
+		if op.Type != OpUpdateText {
+			op.Position = relocateText(target.Data, op)
+		}
+		raw := src[span.start:span.end]
+		switch op.Type {
+		case OpUpdateText:
+			if target.Data != op.OldValue && !opts.IgnoreTextPreconditions {
+				return "", fmt.Errorf("UPDATE_TEXT old value mismatch: want '%s', got '%s'", op.OldValue, target.Data)
+			}
+			return replace(span.start, span.end, escapeSourceText(target.Parent, op.NewValue)), nil
+		case OpInsertText:
+			if raw != target.Data {
+				return "", errors.New("text contains character references; offsets do not map to the source")
+			}
+			if op.Position < 0 || op.Position > len(raw) {
+				return "", fmt.Errorf("INSERT_TEXT position out of bounds: pos=%d, len=%d", op.Position, len(raw))
+			}
+			at := span.start + op.Position
+			return replace(at, at, escapeSourceText(target.Parent, op.NewValue)), nil
+		case OpReplaceText:
+			if raw != target.Data {
+				return "", errors.New("text contains character references; offsets do not map to the source")
+			}
+			end := op.Position + len(op.OldValue)
+			if op.Position < 0 || end > len(raw) {
+				return "", fmt.Errorf("REPLACE_TEXT position out of bounds: pos=%d, len=%d, oldLen=%d", op.Position, len(raw), len(op.OldValue))
+			}
+			if raw[op.Position:end] != op.OldValue {
+				return "", fmt.Errorf("REPLACE_TEXT old value mismatch: want '%s', got '%s'", op.OldValue, raw[op.Position:end])
+			}
+			return replace(span.start+op.Position, span.start+end, escapeSourceText(target.Parent, op.NewValue)), nil
+		default:
+			if raw != target.Data {
+				return "", errors.New("text contains character references; offsets do not map to the source")
+			}
+			end := op.Position + len(op.OldValue)
+			if op.Position < 0 || end > len(raw) {
+				return "", fmt.Errorf("DELETE_TEXT position out of bounds: pos=%d, len=%d, delLen=%d", op.Position, len(raw), len(op.OldValue))
+			}
+			if raw[op.Position:end] != op.OldValue {
+				return "", fmt.Errorf("DELETE_TEXT old value mismatch: want '%s', got '%s'", op.OldValue, raw[op.Position:end])
+			}
+			return replace(span.start+op.Position, span.start+end, ""), nil
+		}
+
+	case OpInsertAttrText, OpDeleteAttrText:
+		value, err := spliceAttr(target, op)
+		if err != nil {
+			return "", err
+		}
+		return applySourceOp(src, pathRoot, Operation{Type: OpUpdateAttr, Path: op.Path, Key: op.Key, OldValue: getAttr(target, op.Key), NewValue: value}, opts)
+
+	case OpAddClass, OpRemoveClass:
+		value, err := spliceClass(target, op)
+		if err != nil {
+			return "", err
+		}
+		if value == "" {
+			return applySourceOp(src, pathRoot, Operation{Type: OpDeleteAttr, Path: op.Path, Key: "class"}, PatchOptions{})
+		}
+		return applySourceOp(src, pathRoot, Operation{Type: OpUpdateAttr, Path: op.Path, Key: "class", NewValue: value}, PatchOptions{})
+
+	case OpUpdateAttr, OpDeleteAttr:
+		if target.Type != html.ElementNode {
+			return "", fmt.Errorf("target node for %s is not an element node", op.Type)
+		}
+		if !mapped {
+			return "", noSpan
+		}
+		if opts.VerifyAttrPreconditions {
+			if err := checkAttrValue(target, op); err != nil {
+				return "", err
+			}
+		}
+		if op.SubKey != "" {
+			f, ok := structuredFormats[strings.ToLower(op.Key)]
+			if !ok {
+				return "", fmt.Errorf("attribute %q has no structured format", op.Key)
+			}
+			op.NewValue = setComponent(f, getAttr(target, op.Key), op.SubKey, op.NewValue, op.Removed)
+			op.Removed = op.NewValue == ""
+		}
+		attrs, insertAt := scanStartTag(src[span.start:span.tagEnd])
+		var existing *srcAttr
+		for i := range attrs {
+			if strings.EqualFold(attrs[i].name, op.Key) {
+				existing = &attrs[i]
+				break
+			}
+		}
+		if op.Type == OpDeleteAttr || op.Removed {
+			if existing == nil {
+				return src, nil
+			}
+			return replace(span.start+existing.wsStart, span.start+existing.end, ""), nil
+		}
+		attr := op.Key + `="` + html.EscapeString(op.NewValue) + `"`
+		if existing != nil {
+			return replace(span.start+existing.start, span.start+existing.end, existing.name+attr[len(op.Key):]), nil
+		}
+		at := span.start + insertAt
+		return replace(at, at, " "+attr), nil
+
+	case OpInsertNode:
+		children := getChildrenList(target)
+		position := op.Position
+		if position < 0 || position > len(children) {
+			if !opts.ClampInsertPosition {
+				return "", fmt.Errorf("INSERT_NODE position out of bounds: pos=%d, children=%d", position, len(children))
+			}
+			position = max(0, min(position, len(children)))
+		}
+		var at int
+		switch {
+		case position < len(children):
+			next, ok := spans[children[position]]
+			if !ok {
+				return "", fmt.Errorf("node at path %v has no exact source range", append(append(NodePath{}, op.Path...), position))
+			}
+			at = next.start
+		case position > 0:
+			prev, ok := spans[children[position-1]]
+			if !ok || prev.end < 0 {
+				return "", fmt.Errorf("node at path %v has no exact source range", append(append(NodePath{}, op.Path...), position-1))
+			}
+			at = prev.end
+		case mapped && span.closeStart >= 0:
+			at = span.closeStart
+		case target == root && pathRoot == PathRootFragment:
+			at = len(src)
+		case !mapped && target.DataAtom == atom.Body:
+			// An implied <body> runs to the end of the source.
+			at = len(src)
+		default:
+			return "", noSpan
+		}
+		return replace(at, at, op.NodeData), nil
+
+	case OpMoveNode:
+		// Cut the node's source, then insert it as-is at the target.
+		if !mapped || span.end < 0 {
+			return "", noSpan
+		}
+		cut, err := applySourceOp(src, pathRoot, Operation{Type: OpDeleteNode, Path: op.Path}, opts)
+		if err != nil {
+			return "", err
+		}
+		return applySourceOp(cut, pathRoot, Operation{Type: OpInsertNode, Path: op.To, Position: op.Position, NodeData: src[span.start:span.end]}, opts)
+
+	case OpDeleteNode:
+		if len(op.Path) == 0 || target.Parent == nil {
+			return "", errors.New("cannot delete root node or orphan")
+		}
+		if !mapped || span.end < 0 {
+			return "", noSpan
+		}
+		return replace(span.start, span.end, ""), nil
+
+	case OpChangeTag:
+		if target.Type != html.ElementNode {
+			return "", fmt.Errorf("target node for CHANGE_TAG is not an element node (type=%d)", target.Type)
+		}
+		if !strings.EqualFold(target.Data, op.OldValue) {
+			return "", fmt.Errorf("CHANGE_TAG old value mismatch: want '%s', got '%s'", op.OldValue, target.Data)
+		}
+		if !mapped || span.end < 0 {
+			return "", noSpan
+		}
+		// Rename the end tag first so the start tag's offsets stay valid.
+		name := strings.ToLower(op.NewValue)
+		out := src
+		if span.closeStart >= 0 {
+			at := span.closeStart + len("</")
+			out = out[:at] + name + out[at+len(target.Data):]
+		}
+		at := span.start + len("<")
+		return out[:at] + name + out[at+len(target.Data):], nil
+
+	case OpWrapNode:
+		if !mapped || span.end < 0 {
+			return "", noSpan
+		}
+		open, closeTag, err := wrapperTags(op.NodeData, target.Parent)
+		if err != nil {
+			return "", err
+		}
+		return src[:span.start] + open + src[span.start:span.end] + closeTag + src[span.end:], nil
+	}
+	return "", fmt.Errorf("%s cannot be applied as a source edit", op.Type)
+}
+
+// wrapperTags returns the start and end tag of the WRAP_NODE element data,
+// parsed as a child of parent.
+func wrapperTags(data string, parent *html.Node) (string, string, error) {
+	nodes, err := html.ParseFragment(strings.NewReader(data), parent)
+	if err != nil {
+		return "", "", fmt.Errorf("failed to parse wrapper: %w", err)
+	}
+	if len(nodes) != 1 || nodes[0].Type != html.ElementNode || nodes[0].FirstChild != nil {
+		return "", "", fmt.Errorf("WRAP_NODE data must be a single empty element, got %q", data)
+	}
+	wrapper, err := RenderNode(nodes[0])
+	if err != nil {
+		return "", "", err
+	}
+	closeTag := "</" + nodes[0].Data + ">"
+	return strings.TrimSuffix(wrapper, closeTag), closeTag, nil
+}
+
+// pendingSplit is the state of SPLIT_TEXT ops in a source patch. Two
+// adjacent text nodes have no source form (they parse back as one), so the
+// pieces of a split text node exist only as offsets into its text until a
+// node inserted between two of them, or a wrap of one, makes the cuts real.
+type pendingSplit struct {
+	path NodePath // The text node in the source as edited so far
+	cuts []int    // Offsets into its text where it is split, ascending
+	// A piece bounded by the cuts that was deleted, awaiting the insert
+	// that takes its place; gap is its index.
+	removed bool
+	gap     int
+}
+
+// piece returns the index of the piece of s at path, or -1 if path is not
+// one of them.
+func (s *pendingSplit) piece(path NodePath) int {
+	n := len(s.path)
+	if len(path) != n || !pathEqual(path[:n-1], s.path[:n-1]) {
+		return -1
+	}
+	if i := path[n-1] - s.path[n-1]; i >= 0 && i <= len(s.cuts) {
+		return i
+	}
+	return -1
+}
+
+// applySplitOp applies op to src while split (nil before the first
+// SPLIT_TEXT) is pending, returning what remains pending afterwards. Splits
+// and text edits of the pieces are recorded or made on the whole text node;
+// an insert at the single cut, a wrap of a piece bounded by the cuts, or a
+// delete of such a piece and an insert in its place resolves them. Other ops
+// cannot be expressed while pieces are virtual.
+func applySplitOp(src string, pathRoot PathRoot, split *pendingSplit, op Operation, opts PatchOptions) (string, *pendingSplit, error) {
+	doc, spans, err := sourceMap(src, pathRoot)
+	if err != nil {
+		return "", nil, err
+	}
+	root, err := resolvePathRoot(doc, pathRoot)
+	if err != nil {
+		return "", nil, err
+	}
+	if op, err = resolveAnchor(root, op); err != nil {
+		return "", nil, err
+	}
+	if op, err = atIndex(op); err != nil {
+		return "", nil, err
+	}
+	if split == nil {
+		split = &pendingSplit{path: op.Path}
+	}
+	text, err := GetNode(root, split.path)
+	if err != nil {
+		return "", nil, err
+	}
+	span, mapped := spans[text]
+	if text.Type != html.TextNode || !mapped || src[span.start:span.end] != text.Data {
+		return "", nil, fmt.Errorf("SPLIT_TEXT target at %v has no exact source text", split.path)
+	}
+	bounds := func(i int) (int, int) {
+		start, end := 0, len(text.Data)
+		if i > 0 {
+			start = split.cuts[i-1]
+		}
+		if i < len(split.cuts) {
+			end = split.cuts[i]
+		}
+		return start, end
+	}
+	unsupported := fmt.Errorf("%s cannot be applied as a source edit while a text node is split", op.Type)
+
+	parentPath := split.path[:len(split.path)-1]
+	first := split.path[len(split.path)-1]
+	// boundedBy reports whether every cut is an end of piece i.
+	boundedBy := func(i int) bool {
+		start, end := bounds(i)
+		for _, c := range split.cuts {
+			if c != start && c != end {
+				return false
+			}
+		}
+		return true
+	}
+	if split.removed {
+		if op.Type != OpInsertNode || !pathEqual(op.Path, parentPath) || op.Position != first+split.gap {
+			return "", nil, unsupported
+		}
+		start, end := bounds(split.gap)
+		return src[:span.start+start] + op.NodeData + src[span.start+end:], nil, nil
+	}
+	switch i := split.piece(op.Path); {
+	case op.Type == OpSplitText && i >= 0:
+		start, end := bounds(i)
+		if op.Position <= 0 || op.Position >= end-start {
+			return "", nil, fmt.Errorf("SPLIT_TEXT at offset %d of %d bytes cannot be applied as a source edit", op.Position, end-start)
+		}
+		split.cuts = append(split.cuts[:i], append([]int{start + op.Position}, split.cuts[i:]...)...)
+		return src, split, nil
+
+	case (op.Type == OpUpdateText || isGranularText(op)) && i >= 0:
+		start, end := bounds(i)
+		if op.Type == OpUpdateText {
+			if text.Data[start:end] != op.OldValue && !opts.IgnoreTextPreconditions {
+				return "", nil, fmt.Errorf("UPDATE_TEXT old value mismatch: want '%s', got '%s'", op.OldValue, text.Data[start:end])
+			}
+			op = Operation{Type: OpReplaceText, Position: 0, OldValue: text.Data[start:end], NewValue: op.NewValue}
+		}
+		removed, added := len(op.OldValue), len(op.NewValue)
+		if op.Type == OpInsertText {
+			removed = 0
+		} else if op.Type == OpDeleteText {
+			added = 0
+		}
+		if op.Position < 0 || op.Position+removed > end-start {
+			return "", nil, fmt.Errorf("%s position out of bounds: pos=%d, len=%d", op.Type, op.Position, end-start)
+		}
+		op.Path, op.Position = split.path, start+op.Position
+		edited, err := applySourceOp(src, pathRoot, op, opts)
+		if err != nil {
+			return "", nil, err
+		}
+		for k := i; k < len(split.cuts); k++ {
+			split.cuts[k] += added - removed
+		}
+		return edited, split, nil
+
+	case op.Type == OpInsertNode && len(split.cuts) == 1 && pathEqual(op.Path, parentPath) && op.Position == first+1:
+		at := span.start + split.cuts[0]
+		return src[:at] + op.NodeData + src[at:], nil, nil
+
+	case op.Type == OpDeleteNode && i >= 0 && boundedBy(i):
+		split.removed, split.gap = true, i
+		return src, split, nil
+
+	case op.Type == OpWrapNode && i >= 0 && boundedBy(i):
+		start, end := bounds(i)
+		open, closeTag, err := wrapperTags(op.NodeData, text.Parent)
+		if err != nil {
+			return "", nil, err
+		}
+		start, end = span.start+start, span.start+end
+		return src[:start] + open + src[start:end] + closeTag + src[end:], nil, nil
+	}
+	return "", nil, unsupported
+}
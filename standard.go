@@ -0,0 +1,233 @@
+package vchtml
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// StandardFormat is the value of the "format" member of documents written by
+// ToStandardFormat.
+const StandardFormat = "vchtml-delta/1"
+
+// standardNames maps op types to their names in the standard format. The
+// names are part of the format and must not change.
+var standardNames = map[OpType]string{
+	OpInsertNode:     "insert-node",
+	OpDeleteNode:     "delete-node",
+	OpMoveNode:       "move-node",
+	OpUpdateAttr:     "update-attr",
+	OpDeleteAttr:     "delete-attr",
+	OpUpdateText:     "update-text",
+	OpInsertText:     "insert-text",
+	OpDeleteText:     "delete-text",
+	OpReplaceText:    "replace-text",
+	OpSplitText:      "split-text",
+	OpWrapNode:       "wrap-node",
+	OpChangeTag:      "change-tag",
+	OpInsertAttrText: "insert-attr-text",
+	OpDeleteAttrText: "delete-attr-text",
+	OpAddClass:       "add-class",
+	OpRemoveClass:    "remove-class",
+}
+
+// positionOps are the op types whose position is always written, even when
+// zero, so readers of the format never have to know the default.
+var positionOps = map[OpType]bool{
+	OpInsertNode:     true,
+	OpMoveNode:       true,
+	OpInsertText:     true,
+	OpDeleteText:     true,
+	OpReplaceText:    true,
+	OpSplitText:      true,
+	OpInsertAttrText: true,
+	OpDeleteAttrText: true,
+}
+
+// standardDelta is the document ToStandardFormat writes.
+type standardDelta struct {
+	Format     string       `json:"format"`
+	BaseHash   string       `json:"base_hash"`
+	Author     string       `json:"author"`
+	Timestamp  int64        `json:"timestamp"`
+	Root       PathRoot     `json:"root,omitempty"`
+	Signature  []byte       `json:"signature,omitempty"`
+	Operations []standardOp `json:"operations"`
+	// ElementIndex is true when path indices skip whitespace-only text.
+	ElementIndex bool `json:"element_index,omitempty"`
+}
+
+// standardOp is one op in the standard format. Paths are JSON Pointer style
+// strings of child indices ("/0/1/0"; "" is the root).
+type standardOp struct {
+	Op        string  `json:"op"`
+	Path      string  `json:"path"`
+	To        *string `json:"to,omitempty"`
+	Position  *int    `json:"position,omitempty"`
+	Key       string  `json:"key,omitempty"`
+	SubKey    string  `json:"sub_key,omitempty"`
+	OldValue  string  `json:"old_value,omitempty"`
+	Value     string  `json:"value,omitempty"`
+	Removed   bool    `json:"removed,omitempty"`
+	Added     bool    `json:"added,omitempty"`
+	HTML      string  `json:"html,omitempty"`
+	ParentTag string  `json:"parent_tag,omitempty"`
+	OrderKey  string  `json:"order_key,omitempty"`
+	Anchor    string  `json:"anchor,omitempty"`
+	Placement string  `json:"placement,omitempty"`
+	Before    string  `json:"context_before,omitempty"`
+	After     string  `json:"context_after,omitempty"`
+	MovedFrom *string `json:"moved_from,omitempty"`
+}
+
+// ToStandardFormat encodes d in a documented, stable JSON shape meant for
+// tools outside Go: ops are named ("insert-node", "update-attr", ...), paths
+// are pointer strings such as "/0/1/0", NewValue is "value" and NodeData is
+// "html". See the README for the full schema. Unlike Delta's own JSON, the
+// shape is versioned by its "format" member.
+func ToStandardFormat(d *Delta) ([]byte, error) {
+	out := standardDelta{
+		Format:       StandardFormat,
+		BaseHash:     d.BaseHash,
+		Author:       d.Author,
+		Timestamp:    d.Timestamp,
+		Root:         d.Root,
+		Signature:    d.Signature,
+		Operations:   make([]standardOp, len(d.Operations)),
+		ElementIndex: d.ElementIndex,
+	}
+	for i, op := range d.Operations {
+		name, ok := standardNames[op.Type]
+		if !ok {
+			return nil, fmt.Errorf("op %d: unknown operation type %q", i, op.Type)
+		}
+		s := standardOp{
+			Op:        name,
+			Path:      pathPointer(op.Path),
+			Key:       op.Key,
+			SubKey:    op.SubKey,
+			OldValue:  op.OldValue,
+			Value:     op.NewValue,
+			Removed:   op.Removed,
+			Added:     op.Added,
+			HTML:      op.NodeData,
+			ParentTag: op.ParentTag,
+			OrderKey:  op.OrderKey,
+			Anchor:    op.Anchor,
+			Placement: string(op.Placement),
+			Before:    op.ContextBefore,
+			After:     op.ContextAfter,
+		}
+		if op.To != nil {
+			to := pathPointer(op.To)
+			s.To = &to
+		}
+		if op.MovedFrom != nil {
+			from := pathPointer(op.MovedFrom)
+			s.MovedFrom = &from
+		}
+		if positionOps[op.Type] || op.Position != 0 {
+			position := op.Position
+			s.Position = &position
+		}
+		out.Operations[i] = s
+	}
+	return json.Marshal(out)
+}
+
+// FromStandardFormat decodes a delta written by ToStandardFormat.
+func FromStandardFormat(data []byte) (*Delta, error) {
+	var in standardDelta
+	if err := json.Unmarshal(data, &in); err != nil {
+		return nil, fmt.Errorf("failed to decode delta: %w", err)
+	}
+	if in.Format != StandardFormat {
+		return nil, fmt.Errorf("unsupported delta format %q", in.Format)
+	}
+	types := make(map[string]OpType, len(standardNames))
+	for t, name := range standardNames {
+		types[name] = t
+	}
+
+	d := &Delta{
+		BaseHash:     in.BaseHash,
+		Author:       in.Author,
+		Timestamp:    in.Timestamp,
+		Root:         in.Root,
+		Signature:    in.Signature,
+		Operations:   make([]Operation, len(in.Operations)),
+		ElementIndex: in.ElementIndex,
+	}
+	for i, s := range in.Operations {
+		t, ok := types[s.Op]
+		if !ok {
+			return nil, fmt.Errorf("op %d: unknown operation %q", i, s.Op)
+		}
+		path, err := parsePointer(s.Path)
+		if err != nil {
+			return nil, fmt.Errorf("op %d: path: %w", i, err)
+		}
+		op := Operation{
+			Type:          t,
+			Path:          path,
+			Key:           s.Key,
+			SubKey:        s.SubKey,
+			OldValue:      s.OldValue,
+			NewValue:      s.Value,
+			Removed:       s.Removed,
+			Added:         s.Added,
+			NodeData:      s.HTML,
+			ParentTag:     s.ParentTag,
+			OrderKey:      s.OrderKey,
+			Anchor:        s.Anchor,
+			Placement:     Placement(s.Placement),
+			ContextBefore: s.Before,
+			ContextAfter:  s.After,
+		}
+		if s.To != nil {
+			if op.To, err = parsePointer(*s.To); err != nil {
+				return nil, fmt.Errorf("op %d: to: %w", i, err)
+			}
+		}
+		if s.MovedFrom != nil {
+			if op.MovedFrom, err = parsePointer(*s.MovedFrom); err != nil {
+				return nil, fmt.Errorf("op %d: moved_from: %w", i, err)
+			}
+		}
+		if s.Position != nil {
+			op.Position = *s.Position
+		}
+		d.Operations[i] = op
+	}
+	return d, nil
+}
+
+// pathPointer formats p as a pointer string, e.g. "/0/1/3".
+func pathPointer(p NodePath) string {
+	var b strings.Builder
+	for _, index := range p {
+		b.WriteByte('/')
+		b.WriteString(strconv.Itoa(index))
+	}
+	return b.String()
+}
+
+// parsePointer parses a pointer string written by pathPointer.
+func parsePointer(s string) (NodePath, error) {
+	path := NodePath{}
+	if s == "" {
+		return path, nil
+	}
+	if !strings.HasPrefix(s, "/") {
+		return nil, fmt.Errorf("pointer %q does not start with '/'", s)
+	}
+	for _, part := range strings.Split(s[1:], "/") {
+		index, err := strconv.Atoi(part)
+		if err != nil || index < 0 || strings.HasPrefix(part, "+") {
+			return nil, fmt.Errorf("invalid index %q in pointer %q", part, s)
+		}
+		path = append(path, index)
+	}
+	return path, nil
+}
@@ -0,0 +1,83 @@
+package vchtml
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestStandardFormatRoundTrip(t *testing.T) {
+	delta := &Delta{
+		BaseHash:  "abc123",
+		Author:    "alice",
+		Timestamp: 1700000000,
+		Root:      PathRootBody,
+		Signature: []byte{1, 2, 3},
+		Operations: []Operation{
+			{Type: OpInsertNode, Path: NodePath{0}, Position: 0, NodeData: `<li>new</li>`, ParentTag: "ul", OrderKey: "a0"},
+			{Type: OpDeleteNode, Path: NodePath{1, 2}},
+			{Type: OpMoveNode, Path: NodePath{0, 3}, To: NodePath{}, Position: 1},
+			{Type: OpUpdateAttr, Path: NodePath{0}, Key: "style", SubKey: "color", OldValue: "red", NewValue: "blue"},
+			{Type: OpUpdateAttr, Path: NodePath{0}, Key: "title", OldValue: "x", Removed: true, Anchor: "main"},
+			{Type: OpUpdateAttr, Path: NodePath{0}, Key: "lang", NewValue: "en", Added: true},
+			{Type: OpUpdateAttr, Path: NodePath{1}, Key: "id", NewValue: "main", Added: true, MovedFrom: NodePath{0}},
+			{Type: OpDeleteAttr, Path: NodePath{0}, Key: "hidden"},
+			{Type: OpAddClass, Path: NodePath{0}, NewValue: "active"},
+			{Type: OpRemoveClass, Path: NodePath{0}, OldValue: "btn"},
+			{Type: OpUpdateText, Path: NodePath{0, 0}, OldValue: "a & b", NewValue: "c < d"},
+			{Type: OpInsertText, Path: NodePath{0, 0}, Position: 0, NewValue: "Hi ", ContextAfter: "there"},
+			{Type: OpDeleteText, Path: NodePath{0, 0}, Position: 4, OldValue: "there"},
+			{Type: OpReplaceText, Path: NodePath{0, 0}, Position: 0, OldValue: "Hi", NewValue: "Hello"},
+			{Type: OpSplitText, Path: NodePath{0, 0}, Position: 2},
+			{Type: OpWrapNode, Path: NodePath{0, 1}, NodeData: `<b></b>`},
+			{Type: OpChangeTag, Path: NodePath{2}, OldValue: "h1", NewValue: "h2"},
+			{Type: OpInsertAttrText, Path: NodePath{3}, Key: "d", Position: 2, NewValue: "L1 1"},
+			{Type: OpDeleteAttrText, Path: NodePath{3}, Key: "d", Position: 0, OldValue: "M0"},
+			{Type: OpUpdateText, Path: NodePath{}, NewValue: "root"},
+		},
+	}
+
+	data, err := ToStandardFormat(delta)
+	if err != nil {
+		t.Fatalf("ToStandardFormat failed: %v", err)
+	}
+	got, err := FromStandardFormat(data)
+	if err != nil {
+		t.Fatalf("FromStandardFormat failed: %v", err)
+	}
+	if !reflect.DeepEqual(got, delta) {
+		t.Errorf("Round trip mismatch:\n got %+v\nwant %+v", got, delta)
+	}
+
+	// The documented shape: named ops, pointer paths, explicit positions.
+	var doc struct {
+		Format     string           `json:"format"`
+		Operations []map[string]any `json:"operations"`
+	}
+	if err := json.Unmarshal(data, &doc); err != nil {
+		t.Fatal(err)
+	}
+	first, move := doc.Operations[0], doc.Operations[2]
+	if doc.Format != StandardFormat || first["op"] != "insert-node" || first["path"] != "/0" ||
+		first["position"] != float64(0) || first["html"] != `<li>new</li>` {
+		t.Errorf("Unexpected encoding: %s", data)
+	}
+	if move["op"] != "move-node" || move["path"] != "/0/3" || move["to"] != "" {
+		t.Errorf("Unexpected move encoding: %v", move)
+	}
+
+	for _, bad := range []string{
+		`{"format":"other/1","operations":[]}`,
+		`{"format":"vchtml-delta/1","operations":[{"op":"replace","path":"/0"}]}`,
+		`{"format":"vchtml-delta/1","operations":[{"op":"delete-node","path":"0/1"}]}`,
+		`{"format":"vchtml-delta/1","operations":[{"op":"delete-node","path":"/0/-1"}]}`,
+	} {
+		if _, err := FromStandardFormat([]byte(bad)); err == nil {
+			t.Errorf("Expected an error for %s", bad)
+		}
+	}
+	if _, err := ToStandardFormat(&Delta{Operations: []Operation{{Type: "BOGUS"}}}); err == nil || !strings.Contains(err.Error(), "BOGUS") {
+		t.Errorf("Expected an unknown type error, got %v", err)
+	}
+}
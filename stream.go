@@ -0,0 +1,498 @@
+package vchtml
+
+import (
+	"io"
+	"slices"
+	"strings"
+
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
+)
+
+// specialElements are the tags the parser treats as special when closing
+// list items: a search for an open <li>, <dd> or <dt> stops at one of them
+// (other than address, div and p).
+var specialElements = map[string]bool{
+	"address": true, "applet": true, "area": true, "article": true, "aside": true,
+	"base": true, "basefont": true, "bgsound": true, "blockquote": true, "body": true,
+	"br": true, "button": true, "caption": true, "center": true, "col": true,
+	"colgroup": true, "dd": true, "details": true, "dir": true, "div": true,
+	"dl": true, "dt": true, "embed": true, "fieldset": true, "figcaption": true,
+	"figure": true, "footer": true, "form": true, "frame": true, "frameset": true,
+	"h1": true, "h2": true, "h3": true, "h4": true, "h5": true, "h6": true,
+	"head": true, "header": true, "hgroup": true, "hr": true, "html": true,
+	"iframe": true, "img": true, "input": true, "keygen": true, "li": true,
+	"link": true, "listing": true, "main": true, "marquee": true, "menu": true,
+	"meta": true, "nav": true, "noembed": true, "noframes": true, "noscript": true,
+	"object": true, "ol": true, "p": true, "param": true, "plaintext": true,
+	"pre": true, "script": true, "search": true, "section": true, "select": true,
+	"source": true, "style": true, "summary": true, "table": true, "tbody": true,
+	"td": true, "template": true, "textarea": true, "tfoot": true, "th": true,
+	"thead": true, "title": true, "tr": true, "track": true, "ul": true,
+	"wbr": true, "xmp": true,
+}
+
+// tableChildren lists, for the table elements whose content the parser
+// rearranges, the children it leaves in place. Anything else is moved out of
+// the table or gets an implied wrapper.
+var tableChildren = map[string]map[string]bool{
+	"table":    {"caption": true, "colgroup": true, "thead": true, "tbody": true, "tfoot": true, "script": true, "style": true},
+	"thead":    {"tr": true, "script": true, "style": true},
+	"tbody":    {"tr": true, "script": true, "style": true},
+	"tfoot":    {"tr": true, "script": true, "style": true},
+	"tr":       {"td": true, "th": true, "script": true, "style": true},
+	"colgroup": {"col": true},
+}
+
+// tableParents are the elements a table element must be a child of to stay
+// where it is written.
+var tableParents = map[string][]string{
+	"caption": {"table"}, "colgroup": {"table"}, "thead": {"table"},
+	"tbody": {"table"}, "tfoot": {"table"}, "tr": {"thead", "tbody", "tfoot"},
+	"td": {"tr"}, "th": {"tr"}, "col": {"colgroup"},
+}
+
+// pEnders are start tags, besides pClosers, at which the parser closes an
+// open <p>.
+var pEnders = map[string]bool{
+	"center": true, "dd": true, "dir": true, "dt": true, "search": true,
+	"summary": true, "xmp": true,
+}
+
+// headElements may appear in <head>; any other start tag implies its end.
+var headElements = map[string]bool{
+	"base": true, "link": true, "meta": true, "noscript": true, "script": true,
+	"style": true, "title": true,
+}
+
+// streamUnsupported are start tags with parsing rules the token scan doesn't
+// follow, such as foreign content and elements the parser renames.
+var streamUnsupported = map[string]bool{
+	"html": true, "head": true, "body": true, "frameset": true, "frame": true,
+	"template": true, "svg": true, "math": true, "select": true, "plaintext": true,
+	"image": true, "isindex": true, "nobr": true, "rb": true, "rp": true,
+	"rt": true, "rtc": true, "option": true, "optgroup": true,
+}
+
+// Where a token scan is in the document, following the parser's insertion
+// modes as far as it needs to.
+const (
+	scanInitial    = iota // Before <html>
+	scanBeforeHead        // In <html>, before <head>
+	scanInHead            // In <head>
+	scanAfterHead         // Between </head> and <body>
+	scanInBody            // In <body> (or a fragment)
+	scanAfterBody         // After </body>
+	scanAfterHTML         // After </html>
+)
+
+// scanFrame is an open element in a token scan.
+type scanFrame struct {
+	tag      string
+	path     NodePath
+	children int  // Child nodes so far
+	lastText bool // The last child is text, which the next text joins
+}
+
+// tokenScan follows the tree the parser builds from a token stream, for
+// documents simple enough that each element ends where its end tag is written
+// and nothing is moved or implied, other than around <head> and <body>. It
+// keeps only the open elements, so memory is bounded by the nesting depth.
+// Any token it cannot follow fails the scan.
+type tokenScan struct {
+	mode  int
+	doc   scanFrame // The document node
+	stack []scanFrame
+	body  NodePath // Path of <body>, once open
+	// prefixed is set when the top element is a <pre>, <listing> or
+	// <textarea> just opened, whose first newline the parser drops.
+	prefixed bool
+	// trailing is set by text after </body>, which the parser appends to
+	// <body>.
+	trailing bool
+}
+
+func newTokenScan(root PathRoot) *tokenScan {
+	s := &tokenScan{}
+	if root == PathRootFragment {
+		s.mode = scanInBody
+		s.stack = []scanFrame{{tag: "body"}}
+		s.body = NodePath{}
+	}
+	return s
+}
+
+// clone returns a copy of s that can be stepped independently.
+func (s *tokenScan) clone() *tokenScan {
+	c := *s
+	c.stack = slices.Clone(s.stack)
+	return &c
+}
+
+func (s *tokenScan) top() *scanFrame {
+	if len(s.stack) == 0 {
+		return &s.doc
+	}
+	return &s.stack[len(s.stack)-1]
+}
+
+// addChild counts a child of the top element (or the document) and returns
+// its path.
+func (s *tokenScan) addChild(text bool) NodePath {
+	f := s.top()
+	if text && f.lastText {
+		return nil
+	}
+	path := append(slices.Clone(f.path), f.children)
+	f.children++
+	f.lastText = text
+	return path
+}
+
+func (s *tokenScan) push(tag string) {
+	path := s.addChild(false)
+	s.stack = append(s.stack, scanFrame{tag: tag, path: path})
+	s.prefixed = tag == "pre" || tag == "listing" || tag == "textarea"
+}
+
+// inTable reports whether the top element is one whose content the parser
+// rearranges (see tableChildren).
+func (s *tokenScan) inTable() bool {
+	return len(s.stack) > 0 && tableChildren[s.top().tag] != nil
+}
+
+// open reports whether an element with tag is open.
+func (s *tokenScan) open(tag string) bool {
+	for _, f := range s.stack {
+		if f.tag == tag {
+			return true
+		}
+	}
+	return false
+}
+
+// step advances the scan past one token and reports whether it could follow
+// it.
+func (s *tokenScan) step(tok html.Token) bool {
+	prefixed := s.prefixed
+	s.prefixed = false
+	switch tok.Type {
+	case html.DoctypeToken:
+		if s.mode != scanInitial || s.doc.children > 0 {
+			return false
+		}
+		s.addChild(false)
+		return true
+	case html.CommentToken:
+		switch s.mode {
+		case scanInitial, scanAfterHTML:
+			s.doc.children++
+			s.doc.lastText = false
+		case scanAfterBody:
+			// Comments after </body> go to <html>, past <body>, so they don't
+			// change any path the scan hands out.
+		default:
+			s.addChild(false)
+		}
+		return true
+	case html.TextToken:
+		return s.text(tok.Data, prefixed)
+	case html.StartTagToken, html.SelfClosingTagToken:
+		return s.start(tok)
+	case html.EndTagToken:
+		return s.end(tok.Data)
+	}
+	return false
+}
+
+func (s *tokenScan) text(data string, prefixed bool) bool {
+	if strings.ContainsRune(data, 0) {
+		return false
+	}
+	blank := strings.Trim(data, " \t\n\f\r") == ""
+	switch s.mode {
+	case scanInitial, scanBeforeHead:
+		return blank // Dropped
+	case scanAfterBody, scanAfterHTML:
+		s.trailing = s.trailing || data != ""
+		return blank
+	case scanInHead, scanAfterHead:
+		// Other text in <head> (outside <title> and the like) implies </head>.
+		if !blank && len(s.stack) < 3 {
+			return false
+		}
+	case scanInBody:
+		if s.inTable() && !blank {
+			return false
+		}
+	}
+	if prefixed {
+		data = strings.TrimPrefix(data, "\n")
+	}
+	if data != "" {
+		s.addChild(true)
+	}
+	return true
+}
+
+func (s *tokenScan) start(tok html.Token) bool {
+	tag := tok.Data
+	switch s.mode {
+	case scanInitial, scanBeforeHead, scanAfterHead:
+		want := map[int]string{scanInitial: "html", scanBeforeHead: "head", scanAfterHead: "body"}[s.mode]
+		if tag != want {
+			return false
+		}
+		s.push(tag)
+		s.mode++
+		if tag == "body" {
+			s.body = s.top().path
+		}
+		return true
+	case scanInHead:
+		if len(s.stack) > 2 || !headElements[tag] || tok.Type == html.SelfClosingTagToken && !voidElements[tag] {
+			return false
+		}
+	case scanInBody:
+		if !s.bodyStart(tag, tok.Type == html.SelfClosingTagToken) {
+			return false
+		}
+	default:
+		return false
+	}
+	if voidElements[tag] {
+		s.addChild(false)
+		return true
+	}
+	s.push(tag)
+	return true
+}
+
+// bodyStart reports whether a start tag in body content leaves the open
+// elements as written.
+func (s *tokenScan) bodyStart(tag string, selfClosing bool) bool {
+	if streamUnsupported[tag] || selfClosing && !voidElements[tag] {
+		return false
+	}
+	top := s.top().tag
+	if allowed := tableChildren[top]; allowed != nil && !allowed[tag] {
+		return false
+	}
+	if parents, ok := tableParents[tag]; ok && !slices.Contains(parents, top) {
+		return false
+	}
+	if (pClosers[tag] || pEnders[tag]) && s.open("p") || noNesting[tag] && s.open(tag) {
+		return false
+	}
+	if isHeading(tag) && isHeading(top) {
+		return false
+	}
+	if tag == "li" || tag == "dd" || tag == "dt" {
+		// The parser closes an open item unless a list (or another special
+		// element) is open inside it.
+		for i := len(s.stack) - 1; i >= 0; i-- {
+			open := s.stack[i].tag
+			if tag == "li" && open == "li" || tag != "li" && (open == "dd" || open == "dt") {
+				return false
+			}
+			if specialElements[open] && open != "address" && open != "div" && open != "p" {
+				break
+			}
+		}
+	}
+	return true
+}
+
+// isHeading reports whether tag is h1 to h6.
+func isHeading(tag string) bool {
+	return len(tag) == 2 && tag[0] == 'h' && tag[1] >= '1' && tag[1] <= '6'
+}
+
+// structural returns how many open elements are the document's own: <html>
+// and <body> (or <head>), or a fragment's virtual root.
+func (s *tokenScan) structural() int {
+	if s.body != nil && len(s.body) == 0 {
+		return 1
+	}
+	return 2
+}
+
+func (s *tokenScan) end(tag string) bool {
+	switch s.mode {
+	case scanInHead:
+		if tag == "head" && len(s.stack) == 2 {
+			s.stack = s.stack[:1]
+			s.mode = scanAfterHead
+			return true
+		}
+	case scanInBody:
+		if tag == "body" {
+			if s.structural() == 2 && len(s.stack) == 2 {
+				s.mode = scanAfterBody
+				return true
+			}
+			return false
+		}
+	case scanAfterBody:
+		if tag == "html" {
+			s.mode = scanAfterHTML
+			return true
+		}
+		return false
+	default:
+		return false
+	}
+	if len(s.stack) > s.structural() && s.top().tag == tag {
+		s.stack = s.stack[:len(s.stack)-1]
+		return true
+	}
+	return false
+}
+
+// scanToken returns the current token of z, of type tt, as far as a token
+// scan needs it: the tag name or the text, without attributes.
+func scanToken(z *html.Tokenizer, tt html.TokenType) html.Token {
+	tok := html.Token{Type: tt}
+	switch tt {
+	case html.StartTagToken, html.SelfClosingTagToken, html.EndTagToken:
+		name, _ := z.TagName()
+		tok.Data = string(name)
+	case html.TextToken:
+		tok.Data = string(z.Text())
+	}
+	return tok
+}
+
+// maxStreamTries caps the offsets streamInserts tries the added markup at.
+const maxStreamTries = 16
+
+// streamInserts diffs oldHTML and newHTML by scanning the tokens of oldHTML,
+// without building trees. It handles newHTML adding whole nodes at one place
+// in oldHTML, such as an entry appended to a log, and returns the INSERT_NODE
+// ops for them, with paths from root. It reports false for other changes, or
+// for markup the scan cannot follow.
+func streamInserts(oldHTML, newHTML string, root PathRoot) ([]Operation, bool) {
+	if len(newHTML) <= len(oldHTML) || root != PathRootDocument && root != PathRootBody && root != PathRootFragment {
+		return nil, false
+	}
+	// The markup is added at an offset of oldHTML up to where the documents
+	// first differ and from where they agree to the end. Repeated markup,
+	// as in a list of similar entries, leaves a range to choose from.
+	size := len(newHTML) - len(oldHTML)
+	hi := commonPrefixLen(oldHTML, newHTML)
+	lo := len(oldHTML) - commonSuffixLen(oldHTML, newHTML[size:])
+	if lo > hi {
+		return nil, false
+	}
+
+	z := html.NewTokenizer(strings.NewReader(oldHTML))
+	scan := newTokenScan(root)
+	var ops []Operation
+	found, endsText := false, false
+	intoBody, at := false, 0
+	for offset, tries := 0, 0; ; {
+		tried := false
+		if !found && offset >= lo && offset <= hi && tries < maxStreamTries {
+			tries, tried = tries+1, true
+			ops, endsText, found = scan.insertAt(newHTML, offset, size, root)
+			intoBody, at = len(scan.stack) == scan.structural(), scan.top().children
+		}
+		tt := z.Next()
+		if tt == html.ErrorToken {
+			break
+		}
+		if tried && found && endsText && tt == html.TextToken {
+			// Added text would join the text after it.
+			found, ops = false, nil
+		}
+		offset += len(z.Raw())
+		if !scan.step(scanToken(z, tt)) {
+			return nil, false
+		}
+	}
+	// Text after </body> joins <body>'s last text, which nodes added at the
+	// end of <body> would come after.
+	if z.Err() != io.EOF || !found || intoBody && scan.trailing && scan.top().children == at {
+		return nil, false
+	}
+	return ops, true
+}
+
+// insertAt returns the ops that add newHTML[offset:offset+size], the markup
+// newHTML adds at offset in the document s has scanned up to there, and
+// whether that markup ends with text. It reports false if the markup is not
+// whole nodes of a body element, or starts with text that would join the text
+// before it.
+func (s *tokenScan) insertAt(newHTML string, offset, size int, root PathRoot) ([]Operation, bool, bool) {
+	if s.mode != scanInBody {
+		return nil, false, false
+	}
+	parent := *s.top()
+	switch {
+	case rawTextElements[parent.tag], parent.tag == "title", parent.tag == "pre", parent.tag == "listing", parent.tag == "textarea":
+		return nil, false, false
+	}
+
+	added := s.clone()
+	depth := len(added.stack)
+	z := html.NewTokenizer(strings.NewReader(newHTML[offset:]))
+	var nodes []string
+	start, pos, end := 0, 0, size
+	wasText := false
+	for first := true; pos < end; first = false {
+		tt := z.Next()
+		if tt == html.ErrorToken {
+			return nil, false, false
+		}
+		n := len(z.Raw())
+		tok := scanToken(z, tt)
+		if !added.step(tok) {
+			return nil, false, false
+		}
+		pos += n
+		if pos > end || len(added.stack) < depth {
+			return nil, false, false
+		}
+		if len(added.stack) > depth {
+			continue
+		}
+		text := tok.Type == html.TextToken
+		switch {
+		case first && text && parent.lastText:
+			return nil, false, false
+		case text && wasText:
+			nodes[len(nodes)-1] += newHTML[offset+start : offset+pos]
+		default:
+			nodes = append(nodes, newHTML[offset+start:offset+pos])
+		}
+		wasText, start = text, pos
+	}
+	if len(added.stack) != depth {
+		return nil, false, false
+	}
+
+	path := parent.path
+	if root == PathRootBody {
+		path = path[len(s.body):]
+	}
+	context := &html.Node{Type: html.ElementNode, Data: parent.tag, DataAtom: atom.Lookup([]byte(parent.tag))}
+	ops := make([]Operation, 0, len(nodes))
+	for i, markup := range nodes {
+		parsed, err := html.ParseFragment(strings.NewReader(markup), context)
+		if err != nil || len(parsed) != 1 {
+			return nil, false, false
+		}
+		nodeHTML, err := RenderNode(parsed[0])
+		if err != nil {
+			return nil, false, false
+		}
+		ops = append(ops, Operation{
+			Type:      OpInsertNode,
+			Path:      slices.Clone(path),
+			Position:  parent.children + i,
+			NodeData:  nodeHTML,
+			ParentTag: parent.tag,
+		})
+	}
+	return ops, wasText, true
+}
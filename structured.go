@@ -0,0 +1,186 @@
+package vchtml
+
+import (
+	"strings"
+)
+
+// attrFormat describes how a structured attribute value splits into keyed
+// components, e.g. the declarations of a style attribute.
+type attrFormat struct {
+	sep string
+	// parts splits a value into its components' text, without separators.
+	parts func(value string) []string
+	// split returns the key and value of one component.
+	split func(part string) (key, value string)
+	// join renders a component from its key and value.
+	join func(key, value string) string
+}
+
+// structuredFormats are the attributes DiffOptions.StructuredAttrs supports.
+var structuredFormats = map[string]attrFormat{
+	// style="color: red; font-size: 12px", keyed by property name.
+	"style": {
+		sep:   ";",
+		parts: func(value string) []string { return splitOutside(value, ';') },
+		split: func(part string) (string, string) {
+			name, value, _ := strings.Cut(part, ":")
+			return strings.ToLower(strings.TrimSpace(name)), strings.TrimSpace(value)
+		},
+		join: func(key, value string) string { return key + ": " + value },
+	},
+	// srcset="a.png 1x, b.png 2x", keyed by descriptor (1x when omitted).
+	"srcset": {
+		sep:   ",",
+		parts: splitSrcset,
+		split: func(part string) (string, string) {
+			fields := strings.Fields(part)
+			switch len(fields) {
+			case 0:
+				return "", ""
+			case 1:
+				return "1x", fields[0]
+			}
+			return fields[len(fields)-1], strings.Join(fields[:len(fields)-1], " ")
+		},
+		join: func(key, value string) string { return value + " " + key },
+	},
+}
+
+// splitOutside splits value at sep, except inside parentheses and quotes, so
+// a declaration such as background: url(data:image/png;base64,...) stays
+// whole.
+func splitOutside(value string, sep byte) []string {
+	var parts []string
+	depth, start := 0, 0
+	var quote byte
+	for i := 0; i < len(value); i++ {
+		switch c := value[i]; {
+		case quote != 0:
+			if c == '\\' {
+				i++
+			} else if c == quote {
+				quote = 0
+			}
+		case c == '"' || c == '\'':
+			quote = c
+		case c == '(':
+			depth++
+		case c == ')' && depth > 0:
+			depth--
+		case c == sep && depth == 0:
+			parts = append(parts, value[start:i])
+			start = i + 1
+		}
+	}
+	return append(parts, value[start:])
+}
+
+// splitSrcset splits a srcset into its image candidates as browsers do: a
+// URL runs to the next whitespace, so commas inside it (as in a data: URL)
+// are kept unless they end it, and the descriptors after it run to the next
+// comma outside parentheses.
+func splitSrcset(value string) []string {
+	isSpace := func(c byte) bool { return c == ' ' || c == '\t' || c == '\n' || c == '\r' || c == '\f' }
+	var parts []string
+	for i := 0; i < len(value); {
+		for i < len(value) && (isSpace(value[i]) || value[i] == ',') {
+			i++
+		}
+		start := i
+		for i < len(value) && !isSpace(value[i]) {
+			i++
+		}
+		if url := strings.TrimRight(value[start:i], ","); len(url) < i-start {
+			if url != "" {
+				parts = append(parts, url)
+			}
+			continue
+		}
+		depth := 0
+		for ; i < len(value) && (value[i] != ',' || depth > 0); i++ {
+			switch value[i] {
+			case '(':
+				depth++
+			case ')':
+				if depth > 0 {
+					depth--
+				}
+			}
+		}
+		if start < i {
+			parts = append(parts, value[start:i])
+		}
+	}
+	return parts
+}
+
+// attrComponent is one component of a structured value. raw keeps its source
+// text so untouched components are written back unchanged.
+type attrComponent struct {
+	key, value, raw string
+}
+
+func parseComponents(f attrFormat, value string) []attrComponent {
+	var comps []attrComponent
+	for _, part := range f.parts(value) {
+		key, v := f.split(part)
+		if key == "" {
+			continue
+		}
+		comps = append(comps, attrComponent{key: key, value: v, raw: part})
+	}
+	return comps
+}
+
+// diffComponents returns UPDATE_ATTR ops with SubKey set for every component
+// of the structured attribute key that changed between oldValue and newValue.
+func diffComponents(f attrFormat, path NodePath, key, oldValue, newValue string) []Operation {
+	oldComps := parseComponents(f, oldValue)
+	newComps := parseComponents(f, newValue)
+	newByKey := make(map[string]string)
+	for _, c := range newComps {
+		newByKey[c.key] = c.value
+	}
+	oldByKey := make(map[string]string)
+
+	var ops []Operation
+	for _, c := range oldComps {
+		oldByKey[c.key] = c.value
+		v, exists := newByKey[c.key]
+		switch {
+		case !exists:
+			ops = append(ops, Operation{Type: OpUpdateAttr, Path: path, Key: key, SubKey: c.key, OldValue: c.value, Removed: true})
+		case v != c.value:
+			ops = append(ops, Operation{Type: OpUpdateAttr, Path: path, Key: key, SubKey: c.key, OldValue: c.value, NewValue: v})
+		}
+	}
+	for _, c := range newComps {
+		if _, exists := oldByKey[c.key]; !exists {
+			ops = append(ops, Operation{Type: OpUpdateAttr, Path: path, Key: key, SubKey: c.key, NewValue: c.value})
+		}
+	}
+	return ops
+}
+
+// setComponent sets (or with removed, drops) the component subKey of a
+// structured value. Other components keep their text; a new component is
+// appended.
+func setComponent(f attrFormat, value, subKey, newValue string, removed bool) string {
+	var parts []string
+	found := false
+	for _, c := range parseComponents(f, value) {
+		if strings.EqualFold(c.key, subKey) && !found {
+			found = true
+			if removed {
+				continue
+			}
+			parts = append(parts, f.join(c.key, newValue))
+			continue
+		}
+		parts = append(parts, strings.TrimSpace(c.raw))
+	}
+	if !found && !removed {
+		parts = append(parts, f.join(subKey, newValue))
+	}
+	return strings.Join(parts, f.sep+" ")
+}
@@ -0,0 +1,207 @@
+package vchtml
+
+import (
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"golang.org/x/net/html"
+	"golang.org/x/text/unicode/norm"
+)
+
+// blockElements separate their text from the surrounding text in TextContent.
+var blockElements = map[string]bool{
+	"address": true, "article": true, "aside": true, "blockquote": true,
+	"caption": true, "dd": true, "details": true, "dialog": true, "div": true,
+	"dl": true, "dt": true, "fieldset": true, "figcaption": true, "figure": true,
+	"footer": true, "form": true, "h1": true, "h2": true, "h3": true, "h4": true,
+	"h5": true, "h6": true, "header": true, "hgroup": true, "hr": true,
+	"li": true, "main": true, "nav": true, "ol": true, "p": true, "pre": true,
+	"section": true, "summary": true, "table": true, "tbody": true, "td": true,
+	"tfoot": true, "th": true, "thead": true, "tr": true, "ul": true,
+}
+
+// hiddenElements hold no visible text.
+var hiddenElements = map[string]bool{
+	"head": true, "script": true, "style": true, "template": true,
+}
+
+// TextContent returns the visible text under root: its text nodes in document
+// order, with a newline between block-level elements (and for <br>). Text in
+// <head>, <script>, <style> and <template> is skipped.
+func TextContent(root *html.Node) string {
+	var b strings.Builder
+	pendingBreak := false
+	lineBreak := func() {
+		if b.Len() > 0 {
+			pendingBreak = true
+		}
+	}
+
+	var walk func(n *html.Node)
+	walk = func(n *html.Node) {
+		switch n.Type {
+		case html.TextNode:
+			if pendingBreak {
+				b.WriteByte('\n')
+				pendingBreak = false
+			}
+			b.WriteString(n.Data)
+			return
+		case html.ElementNode:
+			if hiddenElements[n.Data] {
+				return
+			}
+			if n.Data == "br" {
+				if pendingBreak {
+					b.WriteByte('\n')
+				}
+				b.WriteByte('\n')
+				pendingBreak = false
+				return
+			}
+		}
+
+		block := n.Type == html.ElementNode && blockElements[n.Data]
+		if block {
+			lineBreak()
+		}
+		for c := n.FirstChild; c != nil; c = c.NextSibling {
+			walk(c)
+		}
+		if block {
+			lineBreak()
+		}
+	}
+	walk(root)
+	return b.String()
+}
+
+// DiffText diffs the visible text of two trees (see TextContent) word by word,
+// ignoring markup. The ops are INSERT_TEXT and DELETE_TEXT with an empty path
+// and byte positions into the flattened text; applied in order, they turn the
+// old text into the new one.
+func DiffText(oldRoot, newRoot *html.Node) []Operation {
+	oldWords := splitWords(TextContent(oldRoot))
+	newWords := splitWords(TextContent(newRoot))
+
+	// LCS table: lcs[i][j] is the match length of oldWords[i:] and newWords[j:].
+	n, m := len(oldWords), len(newWords)
+	lcs := make([][]int, n+1)
+	for i := range lcs {
+		lcs[i] = make([]int, m+1)
+	}
+	for i := n - 1; i >= 0; i-- {
+		for j := m - 1; j >= 0; j-- {
+			if oldWords[i] == newWords[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else if lcs[i+1][j] >= lcs[i][j+1] {
+				lcs[i][j] = lcs[i+1][j]
+			} else {
+				lcs[i][j] = lcs[i][j+1]
+			}
+		}
+	}
+
+	var ops []Operation
+	var deleted, inserted strings.Builder
+	pos := 0 // Offset into the text as transformed so far
+	flush := func() {
+		if deleted.Len() > 0 {
+			ops = append(ops, Operation{Type: OpDeleteText, Path: NodePath{}, Position: pos, OldValue: deleted.String()})
+			deleted.Reset()
+		}
+		if inserted.Len() > 0 {
+			ops = append(ops, Operation{Type: OpInsertText, Path: NodePath{}, Position: pos, NewValue: inserted.String()})
+			pos += inserted.Len()
+			inserted.Reset()
+		}
+	}
+
+	i, j := 0, 0
+	for i < n || j < m {
+		switch {
+		case i < n && j < m && oldWords[i] == newWords[j]:
+			flush()
+			pos += len(oldWords[i])
+			i++
+			j++
+		case j == m || (i < n && lcs[i+1][j] >= lcs[i][j+1]):
+			deleted.WriteString(oldWords[i])
+			i++
+		default:
+			inserted.WriteString(newWords[j])
+			j++
+		}
+	}
+	flush()
+	return ops
+}
+
+// splitWords splits s into alternating runs of whitespace and non-whitespace,
+// so the tokens concatenate back to s.
+func splitWords(s string) []string {
+	var words []string
+	start := 0
+	for i, r := range s {
+		if i > start {
+			prev, _ := utf8.DecodeLastRuneInString(s[:i])
+			if unicode.IsSpace(prev) != unicode.IsSpace(r) {
+				words = append(words, s[start:i])
+				start = i
+			}
+		}
+	}
+	if start < len(s) {
+		words = append(words, s[start:])
+	}
+	return words
+}
+
+// nfcSegments returns s in normalization form C together with a map from the
+// offset of each segment boundary in the result to the same boundary in s.
+func nfcSegments(s string) (string, map[int]int) {
+	var it norm.Iter
+	it.InitString(norm.NFC, s)
+	var b strings.Builder
+	bounds := map[int]int{0: 0}
+	for !it.Done() {
+		b.Write(it.Next())
+		bounds[b.Len()] = it.Pos()
+	}
+	return b.String(), bounds
+}
+
+// diffTextNFC is diffText comparing the NFC forms of oldText and newText. The
+// unchanged prefix and suffix are cut at segment boundaries present in both,
+// so the ops' offsets and values refer to the original strings.
+func diffTextNFC(oldText, newText string, path NodePath) []Operation {
+	normOld, oldAt := nfcSegments(oldText)
+	normNew, newAt := nfcSegments(newText)
+	if normOld == normNew {
+		return nil
+	}
+	shared := func(oldOffset, newOffset int) bool {
+		_, inOld := oldAt[oldOffset]
+		_, inNew := newAt[newOffset]
+		return inOld && inNew
+	}
+
+	prefixLen, suffixLen := commonAffixes(normOld, normNew)
+	for prefixLen > 0 && !shared(prefixLen, prefixLen) {
+		prefixLen--
+	}
+	for suffixLen > 0 && !shared(len(normOld)-suffixLen, len(normNew)-suffixLen) {
+		suffixLen--
+	}
+
+	start := oldAt[prefixLen]
+	var ops []Operation
+	if deleted := oldText[start:oldAt[len(normOld)-suffixLen]]; deleted != "" {
+		ops = append(ops, Operation{Type: OpDeleteText, Path: path, Position: start, OldValue: deleted})
+	}
+	if inserted := newText[newAt[prefixLen]:newAt[len(normNew)-suffixLen]]; inserted != "" {
+		ops = append(ops, Operation{Type: OpInsertText, Path: path, Position: start, NewValue: inserted})
+	}
+	return ops
+}
@@ -0,0 +1,111 @@
+package vchtml
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestTextContent(t *testing.T) {
+	cases := []struct {
+		html string
+		want string
+	}{
+		{`<div><p>Hi</p><p>there</p></div>`, "Hi\nthere"},
+		{`<p>Hello <b>bold</b> world</p>`, "Hello bold world"},
+		{`<ul><li>one</li><li>two</li></ul><p>after<br>break</p>`, "one\ntwo\nafter\nbreak"},
+		{`<head><title>T</title><style>p{}</style></head><p>x<script>y()</script></p>`, "x"},
+	}
+	for _, c := range cases {
+		doc, err := ParseHTML(c.html)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := TextContent(doc); got != c.want {
+			t.Errorf("TextContent(%q) = %q, want %q", c.html, got, c.want)
+		}
+	}
+}
+
+func TestDiffText(t *testing.T) {
+	oldDoc, _ := ParseHTML(`<div><p>The quick fox</p><p>jumps over</p></div>`)
+	newDoc, _ := ParseHTML(`<div><p>The <em>slow</em> fox</p><p>jumps far over</p></div>`)
+
+	ops := DiffText(oldDoc, newDoc)
+
+	// Applying the ops in order to the old text yields the new text.
+	text := TextContent(oldDoc)
+	for _, op := range ops {
+		switch op.Type {
+		case OpDeleteText:
+			if text[op.Position:op.Position+len(op.OldValue)] != op.OldValue {
+				t.Fatalf("DELETE_TEXT old value mismatch at %d: %q", op.Position, op.OldValue)
+			}
+			text = text[:op.Position] + text[op.Position+len(op.OldValue):]
+		case OpInsertText:
+			text = text[:op.Position] + op.NewValue + text[op.Position:]
+		default:
+			t.Fatalf("Unexpected op type %s", op.Type)
+		}
+	}
+	if want := TextContent(newDoc); text != want {
+		t.Errorf("Applied text = %q, want %q", text, want)
+	}
+
+	// Word granularity: "quick" is replaced whole, "far " is inserted whole.
+	if len(ops) != 3 || ops[0].OldValue != "quick" || ops[1].NewValue != "slow" || ops[2].NewValue != "far " {
+		t.Errorf("Unexpected ops: %+v", ops)
+	}
+}
+
+func TestDiffTokenizer(t *testing.T) {
+	// The waving hand keeps its code point; only the skin tone changes.
+	oldHTML := "<p>Hi \U0001F44B\U0001F3FB!</p>"
+	newHTML := "<p>Hi \U0001F44B\U0001F3FD!</p>"
+
+	delta, err := DiffWithOptions(oldHTML, newHTML, "tester", DiffOptions{Tokenizer: TokenizeGraphemes})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(delta.Operations) != 2 {
+		t.Fatalf("Expected a delete and an insert, got %v", delta.Operations)
+	}
+	del, ins := delta.Operations[0], delta.Operations[1]
+	if del.Type != OpDeleteText || del.Position != 3 || del.OldValue != "\U0001F44B\U0001F3FB" ||
+		ins.Type != OpInsertText || ins.Position != 3 || ins.NewValue != "\U0001F44B\U0001F3FD" {
+		t.Errorf("Expected the whole emoji to be replaced, got %v", delta.Operations)
+	}
+	patched, err := Patch(oldHTML, delta)
+	if err != nil {
+		t.Fatalf("Patch failed: %v", err)
+	}
+	if !compareHTML(t, patched, newHTML) {
+		t.Error("Patched output mismatch")
+	}
+
+	// Byte by byte, the diff cuts inside the modifier.
+	delta, _ = Diff(oldHTML, newHTML, "tester")
+	if len(delta.Operations) == 0 || delta.Operations[0].Position == 3 {
+		t.Errorf("Expected a byte-level edit, got %v", delta.Operations)
+	}
+}
+
+func TestTokenizers(t *testing.T) {
+	cases := []struct {
+		name     string
+		tokenize func(string) []string
+		in       string
+		want     []string
+	}{
+		{"runes", TokenizeRunes, "e\u0301!", []string{"e", "\u0301", "!"}},
+		{"graphemes", TokenizeGraphemes, "e\u0301\U0001F1EF\U0001F1F5\U0001F468\u200d\U0001F469\r\nx",
+			[]string{"e\u0301", "\U0001F1EF\U0001F1F5", "\U0001F468\u200d\U0001F469", "\r\n", "x"}},
+		{"words", TokenizeWords, "Don't stop, 日本語 ok", []string{"Don't", " ", "stop", ",", " ", "日", "本", "語", " ", "ok"}},
+		{"sentences", TokenizeSentences, "One. Two?! Pi is 3.14 here.  Last", []string{"One. ", "Two?! ", "Pi is 3.14 here.  ", "Last"}},
+	}
+	for _, c := range cases {
+		got := c.tokenize(c.in)
+		if strings.Join(got, "|") != strings.Join(c.want, "|") {
+			t.Errorf("%s: got %q, want %q", c.name, got, c.want)
+		}
+	}
+}
@@ -0,0 +1,206 @@
+package vchtml
+
+import (
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Built-in tokenizers for DiffOptions.Tokenizer. Each splits s into tokens
+// that concatenate back to s.
+
+// TokenizeRunes splits s into single code points.
+func TokenizeRunes(s string) []string {
+	tokens := make([]string, 0, len(s))
+	for len(s) > 0 {
+		_, size := utf8.DecodeRuneInString(s)
+		tokens = append(tokens, s[:size])
+		s = s[size:]
+	}
+	return tokens
+}
+
+// TokenizeGraphemes splits s into user-perceived characters, approximating
+// the extended grapheme clusters of UAX #29: a base character keeps its
+// combining marks, variation selectors and emoji modifiers, emoji joined by
+// zero-width joiners stay together, regional indicators pair into flags, and
+// CR LF is one token.
+func TokenizeGraphemes(s string) []string {
+	var tokens []string
+	start := 0
+	var prev rune
+	regional := 0 // Regional indicators in a row so far
+	for i, r := range s {
+		if i > start && !graphemeBreak(prev, r, regional) {
+			prev = r
+			if isRegionalIndicator(r) {
+				regional++
+			}
+			continue
+		}
+		if i > start {
+			tokens = append(tokens, s[start:i])
+			start = i
+		}
+		prev = r
+		regional = 0
+		if isRegionalIndicator(r) {
+			regional = 1
+		}
+	}
+	if start < len(s) {
+		tokens = append(tokens, s[start:])
+	}
+	return tokens
+}
+
+// graphemeBreak reports whether a cluster boundary falls between prev and r.
+// regional counts the regional indicators ending the current cluster.
+func graphemeBreak(prev, r rune, regional int) bool {
+	switch {
+	case prev == '\r' && r == '\n':
+		return false
+	case prev == '\r' || prev == '\n' || r == '\r' || r == '\n':
+		return true
+	case isGraphemeExtend(r):
+		return false
+	case prev == '\u200d':
+		return false // Zero-width joiner sequence
+	case isRegionalIndicator(prev) && isRegionalIndicator(r):
+		return regional%2 == 0
+	}
+	return true
+}
+
+// isGraphemeExtend reports whether r attaches to the character before it.
+func isGraphemeExtend(r rune) bool {
+	switch {
+	case unicode.In(r, unicode.Mn, unicode.Me, unicode.Mc):
+		return true
+	case r == '\u200d', r >= 0xFE00 && r <= 0xFE0F, r >= 0xE0100 && r <= 0xE01EF:
+		return true // Zero-width joiner and variation selectors
+	case r >= 0x1F3FB && r <= 0x1F3FF:
+		return true // Emoji skin tone modifiers
+	case r >= 0xE0020 && r <= 0xE007F:
+		return true // Emoji tag sequences
+	}
+	return false
+}
+
+func isRegionalIndicator(r rune) bool {
+	return r >= 0x1F1E6 && r <= 0x1F1FF
+}
+
+// TokenizeWords splits s into words, runs of whitespace and single
+// punctuation marks. Scripts written without spaces between words (Han,
+// Hiragana, Katakana, Thai, Lao, Khmer, Myanmar) have no word boundaries to
+// find without a dictionary, so each of their characters is a token. Marks
+// and joiners stay with the character they follow.
+func TokenizeWords(s string) []string {
+	var tokens []string
+	start := 0
+	prevClass := wordNone
+	for i, r := range s {
+		class := wordClass(r)
+		if class == wordExtend && i > start {
+			continue
+		}
+		if i > start && (class != prevClass || class == wordPunct || class == wordIdeograph) {
+			tokens = append(tokens, s[start:i])
+			start = i
+		}
+		prevClass = class
+	}
+	if start < len(s) {
+		tokens = append(tokens, s[start:])
+	}
+	return tokens
+}
+
+// Character classes for TokenizeWords.
+const (
+	wordNone = iota
+	wordSpace
+	wordLetter
+	wordPunct
+	wordIdeograph
+	wordExtend
+)
+
+// wordClass classifies r for TokenizeWords.
+func wordClass(r rune) int {
+	switch {
+	case isGraphemeExtend(r):
+		return wordExtend
+	case unicode.IsSpace(r):
+		return wordSpace
+	case unicode.In(r, unicode.Han, unicode.Hiragana, unicode.Katakana, unicode.Thai, unicode.Lao, unicode.Khmer, unicode.Myanmar):
+		return wordIdeograph
+	case unicode.IsLetter(r) || unicode.IsDigit(r) || r == '\'' || r == '\u2019' || r == '_':
+		return wordLetter
+	}
+	return wordPunct
+}
+
+// TokenizeSentences splits s after each run of sentence-ending marks (".",
+// "!", "?", their full-width forms and "…") followed by whitespace, keeping
+// the whitespace with the sentence before it.
+func TokenizeSentences(s string) []string {
+	var tokens []string
+	start := 0
+	const (
+		inSentence = iota
+		atTerminator
+		afterTerminator // In the whitespace after a terminator
+	)
+	state := inSentence
+	for i, r := range s {
+		terminator := strings.ContainsRune(".!?。！？…", r)
+		switch state {
+		case atTerminator:
+			if unicode.IsSpace(r) {
+				state = afterTerminator
+			} else if !terminator {
+				state = inSentence // e.g. "3.14"
+			}
+			continue
+		case afterTerminator:
+			if unicode.IsSpace(r) {
+				continue
+			}
+			tokens = append(tokens, s[start:i])
+			start = i
+		}
+		state = inSentence
+		if terminator {
+			state = atTerminator
+		}
+	}
+	if start < len(s) {
+		tokens = append(tokens, s[start:])
+	}
+	return tokens
+}
+
+// diffTokens is diffText with the unchanged prefix and suffix measured in
+// whole tokens of tokenize, so no op starts or ends inside a token. Offsets
+// stay in bytes. If the tokens do not concatenate back to the text, it falls
+// back to diffText.
+func diffTokens(oldText, newText string, path NodePath, tokenize func(string) []string) []Operation {
+	oldTokens, newTokens := tokenize(oldText), tokenize(newText)
+	if strings.Join(oldTokens, "") != oldText || strings.Join(newTokens, "") != newText {
+		return diffText(oldText, newText, path)
+	}
+	minLen := min(len(oldTokens), len(newTokens))
+	prefix, prefixLen := 0, 0
+	for prefix < minLen && oldTokens[prefix] == newTokens[prefix] {
+		prefixLen += len(oldTokens[prefix])
+		prefix++
+	}
+	suffix, suffixLen := 0, 0
+	for suffix < minLen-prefix && oldTokens[len(oldTokens)-1-suffix] == newTokens[len(newTokens)-1-suffix] {
+		suffixLen += len(oldTokens[len(oldTokens)-1-suffix])
+		suffix++
+	}
+	return replaceMiddle(oldText, newText, prefixLen, suffixLen, path)
+}
@@ -7,38 +7,109 @@ type NodePath []int
 type OpType string
 
 const (
-	OpInsertNode OpType = "INSERT_NODE" // Insert a new node
-	OpDeleteNode OpType = "DELETE_NODE" // Remove a node
-	OpMoveNode   OpType = "MOVE_NODE"   // Reparent or reorder a node
-	OpUpdateAttr OpType = "UPDATE_ATTR" // Change/Add/Remove an attribute
-	OpUpdateText OpType = "UPDATE_TEXT" // Replace full text (Atomic)
-	OpInsertText OpType = "INSERT_TEXT" // Insert text at position
-	OpDeleteText OpType = "DELETE_TEXT" // Delete text at position
+	OpInsertNode  OpType = "INSERT_NODE"  // Insert a new node
+	OpDeleteNode  OpType = "DELETE_NODE"  // Remove a node
+	OpMoveNode    OpType = "MOVE_NODE"    // Reparent or reorder a node
+	OpUpdateAttr  OpType = "UPDATE_ATTR"  // Change/Add/Remove an attribute
+	OpDeleteAttr  OpType = "DELETE_ATTR"  // Remove an attribute entirely
+	OpUpdateText  OpType = "UPDATE_TEXT"  // Replace full text (Atomic)
+	OpInsertText  OpType = "INSERT_TEXT"  // Insert text at position
+	OpDeleteText  OpType = "DELETE_TEXT"  // Delete text at position
+	OpReplaceText OpType = "REPLACE_TEXT" // Replace text at position: OldValue is removed, NewValue inserted, in one step
+	OpSplitText   OpType = "SPLIT_TEXT"   // Split a text node in two at position
+	OpWrapNode    OpType = "WRAP_NODE"    // Wrap a node in a new (empty) element
+	OpChangeTag   OpType = "CHANGE_TAG"   // Rename an element, keeping its attributes and children
+
+	OpInsertAttrText OpType = "INSERT_ATTR_TEXT" // Insert text into an attribute value at position
+	OpDeleteAttrText OpType = "DELETE_ATTR_TEXT" // Delete text from an attribute value at position
+
+	OpAddClass    OpType = "ADD_CLASS"    // Add the class NewValue to an element's class list, if missing
+	OpRemoveClass OpType = "REMOVE_CLASS" // Remove the class OldValue from an element's class list
 )
 
 // Operation represents an atomic change to the HTML structure.
+//
+// OldValue and NewValue hold decoded values: the text or attribute value as the
+// parser reports it, not its source spelling. "a &amp; b" in the source is
+// "a & b" here. Patch stores NewValue as is and the renderer escapes it, so
+// the output parses back to exactly NewValue; passing pre-encoded values
+// yields double-encoded output.
 type Operation struct {
-	Type     OpType   `json:"type"`
-	Path     NodePath `json:"path"`
-	Key      string   `json:"key,omitempty"`       // For Attributes (name of the attribute)
-	OldValue string   `json:"old_value,omitempty"` // Previous value (for verification/conflict check)
-	NewValue string   `json:"new_value,omitempty"` // New value/Content. For InsertText: text to insert.
-	NodeData string   `json:"node_data,omitempty"` // For Insert: The HTML string of the node
-	Position int      `json:"position,omitempty"`  // For InsertNode/MoveNode: child index. For InsertText/DeleteText: char offset.
+	Type      OpType    `json:"type"`
+	Path      NodePath  `json:"path"`
+	Key       string    `json:"key,omitempty"`        // For Attributes (name of the attribute)
+	OldValue  string    `json:"old_value,omitempty"`  // Previous value (for verification/conflict check). For ChangeTag: the old tag name
+	NewValue  string    `json:"new_value,omitempty"`  // New value/Content. For InsertText: text to insert.
+	NodeData  string    `json:"node_data,omitempty"`  // For Insert: The HTML string of the node. For WrapNode: the empty wrapper element
+	Position  int       `json:"position,omitempty"`   // For InsertNode/MoveNode: child index. For InsertText/DeleteText/ReplaceText/SplitText and the attribute text ops: char offset.
+	Removed   bool      `json:"removed,omitempty"`    // For UpdateAttr: the attribute is removed rather than set
+	Added     bool      `json:"added,omitempty"`      // For UpdateAttr: the attribute was absent, so it is added rather than changed
+	OrderKey  string    `json:"order_key,omitempty"`  // For InsertNode: place the element among keyed siblings by this key (see KeyBetween)
+	SubKey    string    `json:"sub_key,omitempty"`    // For UpdateAttr on a structured attribute: the component changed (e.g. a style property)
+	Anchor    string    `json:"anchor,omitempty"`     // Id of the element Path is relative to (see DiffOptions.AnchorPaths)
+	ParentTag string    `json:"parent_tag,omitempty"` // For InsertNode: tag of the intended parent, the context NodeData is parsed in
+	To        NodePath  `json:"to,omitempty"`         // For MoveNode: the new parent, resolved (like Position) after the node is removed
+	Placement Placement `json:"placement,omitempty"`  // For InsertNode: how Path addresses the insert (see Placement)
+	MovedFrom NodePath  `json:"moved_from,omitempty"` // For UpdateAttr: the element the attribute moved from, addressed when this op applies (see DiffOptions.DetectAttrMoves)
+
+	// For InsertText/DeleteText/ReplaceText: the text just before Position
+	// and just after the edited range, used to re-locate a shifted edit (see
+	// DiffOptions.TextContext).
+	ContextBefore string `json:"context_before,omitempty"`
+	ContextAfter  string `json:"context_after,omitempty"`
 }
 
+// Placement says how an INSERT_NODE addresses where its node goes.
+//
+// A relative insert names a sibling instead of an index, so it follows that
+// sibling when other nodes are added or removed around it. Combined with
+// Operation.Anchor and an empty Path it names the sibling by id ("after
+// #intro"), which survives being applied with PatchOptions.IgnoreBaseHash to
+// a copy where earlier siblings have been added.
+type Placement string
+
+const (
+	PlaceAtIndex Placement = ""       // Path is the parent and Position the child index (the default)
+	PlaceBefore  Placement = "before" // Path is the sibling the node is inserted in front of
+	PlaceAfter   Placement = "after"  // Path is the sibling the node is inserted after
+)
+
+// PathRoot names the node that operation paths in a Delta are relative to.
+type PathRoot string
+
+const (
+	PathRootDocument PathRoot = ""         // Paths start at the document node (html is [0], body is [0, 1])
+	PathRootBody     PathRoot = "body"     // Paths start at the <body> element
+	PathRootFragment PathRoot = "fragment" // Paths start at a virtual root holding the top-level nodes of a fragment
+)
+
 // Delta represents a set of changes applied to a base document.
 type Delta struct {
 	BaseHash   string      `json:"base_hash"` // Hash of the original document to ensure validity
 	Operations []Operation `json:"operations"`
 	Timestamp  int64       `json:"timestamp"`
 	Author     string      `json:"author"`
+	Root       PathRoot    `json:"root,omitempty"`      // Node the operation paths are relative to
+	Signature  []byte      `json:"signature,omitempty"` // HMAC set by SignDelta, checked by VerifyDelta
+	// ElementIndex means path indices skip whitespace-only text nodes (see
+	// DiffOptions.ElementIndexOnly).
+	ElementIndex bool `json:"element_index,omitempty"`
 }
 
+// ConflictType classifies why two operations could not be merged.
+type ConflictType string
+
+const (
+	ConflictDirect       ConflictType = "Direct"        // Both sides changed the same value differently
+	ConflictStructure    ConflictType = "Structure"     // One side modified a descendant of a node the other deleted
+	ConflictPosition     ConflictType = "Position"      // Overlapping edits within a node that cannot be ordered
+	ConflictDeleteModify ConflictType = "Delete/Modify" // One side deleted a node the other modified
+)
+
 // Conflict represents a detected conflict between two operations.
 type Conflict struct {
-	Type        string      `json:"type"`
-	Description string      `json:"description"`
-	Path        NodePath    `json:"path"`
-	Ops         []Operation `json:"ops"`
+	Type        ConflictType `json:"type"`
+	Description string       `json:"description"`
+	Path        NodePath     `json:"path"`
+	Ops         []Operation  `json:"ops"`
 }
@@ -0,0 +1,119 @@
+package vchtml
+
+import (
+	"fmt"
+
+	"golang.org/x/net/html"
+)
+
+// pClosers are the flow elements a <p> cannot contain: the parser closes
+// an open <p> at each of their start tags.
+var pClosers = map[string]bool{
+	"address": true, "article": true, "aside": true, "blockquote": true,
+	"details": true, "dialog": true, "div": true, "dl": true, "fieldset": true,
+	"figcaption": true, "figure": true, "footer": true, "form": true,
+	"h1": true, "h2": true, "h3": true, "h4": true, "h5": true, "h6": true,
+	"header": true, "hgroup": true, "hr": true, "li": true, "main": true,
+	"menu": true, "nav": true, "ol": true, "p": true, "pre": true,
+	"section": true, "table": true, "ul": true,
+}
+
+// requiredParents lists, for elements only valid in certain parents, the
+// parents they may have.
+var requiredParents = map[string][]string{
+	"li":       {"ul", "ol", "menu"},
+	"dt":       {"dl", "div"},
+	"dd":       {"dl", "div"},
+	"tr":       {"table", "thead", "tbody", "tfoot"},
+	"td":       {"tr"},
+	"th":       {"tr"},
+	"thead":    {"table"},
+	"tbody":    {"table"},
+	"tfoot":    {"table"},
+	"caption":  {"table"},
+	"colgroup": {"table"},
+	"col":      {"colgroup", "table"},
+	"option":   {"select", "datalist", "optgroup"},
+	"optgroup": {"select"},
+	"legend":   {"fieldset"},
+	"summary":  {"details"},
+}
+
+// noNesting are elements that may not appear inside another of their kind.
+var noNesting = map[string]bool{"a": true, "button": true, "form": true, "label": true}
+
+// ValidateTree checks the HTML elements under root against the content models
+// a parser would enforce, such as a <div> inside a <p>, a <td> outside a
+// <tr>, a nested <a> or a void element with children, and returns one message
+// per violation, prefixed with the element's path from root. Such trees
+// render to markup that parses back differently. Foreign (SVG and MathML)
+// content is not checked. A valid tree yields nil.
+func ValidateTree(root *html.Node) []string {
+	var violations []string
+	var walk func(n *html.Node, path NodePath, open map[string]bool)
+	walk = func(n *html.Node, path NodePath, open map[string]bool) {
+		index := 0
+		for c := n.FirstChild; c != nil; c = c.NextSibling {
+			childPath := append(path[:len(path):len(path)], index)
+			index++
+			if c.Type != html.ElementNode || c.Namespace != "" {
+				continue
+			}
+			report := func(format string, args ...any) {
+				violations = append(violations, childPath.String()+": "+fmt.Sprintf(format, args...))
+			}
+			if n.Type == html.ElementNode && n.Namespace == "" {
+				if n.Data == "p" && pClosers[c.Data] {
+					report("<%s> is not allowed in <p>", c.Data)
+				}
+				if voidElements[n.Data] {
+					report("<%s> is inside void element <%s>", c.Data, n.Data)
+				}
+			}
+			if parents, ok := requiredParents[c.Data]; ok && !hasParent(n, parents) {
+				report("<%s> must be in %s", c.Data, tagList(parents))
+			}
+			if noNesting[c.Data] && open[c.Data] {
+				report("<%s> is nested in another <%s>", c.Data, c.Data)
+			}
+			if noNesting[c.Data] && !open[c.Data] {
+				open[c.Data] = true
+				walk(c, childPath, open)
+				delete(open, c.Data)
+				continue
+			}
+			walk(c, childPath, open)
+		}
+	}
+	walk(root, nil, map[string]bool{})
+	return violations
+}
+
+// hasParent reports whether n is an HTML element with one of the tags.
+func hasParent(n *html.Node, tags []string) bool {
+	if n.Type != html.ElementNode || n.Namespace != "" {
+		return false
+	}
+	for _, tag := range tags {
+		if n.Data == tag {
+			return true
+		}
+	}
+	return false
+}
+
+// tagList formats tags as "<a>, <b> or <c>".
+func tagList(tags []string) string {
+	s := ""
+	for i, tag := range tags {
+		switch {
+		case i == 0:
+		case i == len(tags)-1:
+			s += " or "
+		default:
+			s += ", "
+		}
+		s += "<" + tag + ">"
+	}
+	return s
+}
@@ -0,0 +1,459 @@
+package vchtml
+
+import (
+	"fmt"
+	"strings"
+	"unicode/utf8"
+
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
+)
+
+// RenderVisualDiff renders baseHTML with d applied as a track-changes view
+// for review: inserted nodes and text are wrapped in <ins>, and deleted ones
+// stay where they were, wrapped in <del>. Text edits are marked character by
+// character, an UPDATE_TEXT included. A moved node shows as deleted at its
+// old place and inserted at its new one. Attribute, tag and wrap changes
+// are applied without marks, as are changes where <ins> and <del> cannot
+// appear, such as in <head>, raw text elements and SVG; inside lists and
+// tables the marks go around the content of the changed items and cells.
+func RenderVisualDiff(baseHTML string, d *Delta) (string, error) {
+	if hash := hashFunc(baseHTML); hash != d.BaseHash {
+		return "", fmt.Errorf("base hash mismatch: expected %s, got %s", d.BaseHash, hash)
+	}
+	doc, err := parseForRoot(baseHTML, d.Root)
+	if err != nil {
+		return "", err
+	}
+	root, err := resolvePathRoot(doc, d.Root)
+	if err != nil {
+		return "", err
+	}
+
+	v := &visualDiff{
+		inserted: make(map[*html.Node]bool),
+		text:     make(map[*html.Node][]textSegment),
+	}
+	cur := NewCursor(root)
+	for i, op := range d.Operations {
+		op, err := resolveOp(root, d, op)
+		if err != nil {
+			return "", fmt.Errorf("op %d (%s): %w", i, op.Type, err)
+		}
+		if op, err = atIndex(op); err != nil {
+			return "", fmt.Errorf("op %d (%s): %w", i, op.Type, err)
+		}
+		if err := v.apply(cur, op); err != nil {
+			return "", fmt.Errorf("op %d (%s): %w", i, op.Type, err)
+		}
+	}
+	v.mark()
+	return renderForRoot(doc, d.Root)
+}
+
+// visualDiff is the state of RenderVisualDiff: the tree is patched as usual
+// while the changes to mark are recorded, and marked once every op applied.
+type visualDiff struct {
+	inserted map[*html.Node]bool          // Inserted (or moved) nodes, outermost only
+	ghosts   []ghost                      // Deleted nodes, in the order deleted
+	text     map[*html.Node][]textSegment // Edited text nodes not inside an inserted node
+}
+
+// ghost is a deleted node, to be put back before the sibling it preceded
+// (or at the end of parent when before is nil).
+type ghost struct {
+	node, parent, before *html.Node
+}
+
+type segmentKind int
+
+const (
+	segmentKept segmentKind = iota
+	segmentInserted
+	segmentDeleted
+)
+
+// textSegment is a run of a text node's text. The node's current text is
+// its kept and inserted segments; its base text is its kept and deleted ones.
+type textSegment struct {
+	kind segmentKind
+	text string
+}
+
+// apply applies op, whose target is resolved by cur, and records what it
+// changed.
+func (v *visualDiff) apply(cur *Cursor, op Operation) error {
+	target, err := cur.Resolve(op.Path)
+	if err != nil {
+		return err
+	}
+	tracked := !v.insideInserted(target)
+
+	switch op.Type {
+	case OpInsertNode:
+		before := getChildrenList(target)
+		if err := applyOp(cur, op, PatchOptions{}); err != nil {
+			return err
+		}
+		if tracked {
+			for _, c := range getChildrenList(target) {
+				if !containsNode(before, c) {
+					v.inserted[c] = true
+				}
+			}
+		}
+		return nil
+
+	case OpDeleteNode:
+		parent, before := target.Parent, target.NextSibling
+		if err := applyOp(cur, op, PatchOptions{}); err != nil {
+			return err
+		}
+		if v.inserted[target] || !tracked {
+			delete(v.inserted, target)
+			return nil
+		}
+		v.restore(target, nil)
+		v.ghosts = append(v.ghosts, ghost{node: target, parent: parent, before: before})
+		return nil
+
+	case OpMoveNode:
+		parent, before := target.Parent, target.NextSibling
+		if err := applyOp(cur, op, PatchOptions{}); err != nil {
+			return err
+		}
+		if tracked && !v.inserted[target] {
+			clone, copies := cloneTree(target)
+			v.restore(target, copies)
+			v.ghosts = append(v.ghosts, ghost{node: clone, parent: parent, before: before})
+		}
+		// The node shows as it ends up, so marks inside it are dropped.
+		v.forget(target)
+		if !v.insideInserted(target.Parent) {
+			v.inserted[target] = true
+		}
+		return nil
+
+	case OpInsertText, OpDeleteText, OpReplaceText, OpUpdateText:
+		if tracked {
+			v.editText(target, op)
+		}
+
+	case OpSplitText:
+		segs, ok := v.text[target]
+		if err := applyOp(cur, op, PatchOptions{}); err != nil {
+			return err
+		}
+		if ok {
+			segs = splitSegments(segs, op.Position)
+			k := segmentIndex(segs, op.Position)
+			v.text[target] = segs[:k:k]
+			v.text[target.NextSibling] = segs[k:]
+		}
+		return nil
+	}
+	return applyOp(cur, op, PatchOptions{})
+}
+
+// insideInserted reports whether n or one of its ancestors was inserted.
+func (v *visualDiff) insideInserted(n *html.Node) bool {
+	for p := n; p != nil; p = p.Parent {
+		if v.inserted[p] {
+			return true
+		}
+	}
+	return false
+}
+
+// editText records the text op op on the text node n before it applies.
+func (v *visualDiff) editText(n *html.Node, op Operation) {
+	segs, ok := v.text[n]
+	if !ok {
+		segs = []textSegment{{segmentKept, n.Data}}
+	}
+	if isContextOp(op) {
+		op.Position = relocateText(n.Data, op)
+	}
+	edits := []Operation{op}
+	if op.Type == OpUpdateText {
+		edits = diffTokens(n.Data, op.NewValue, op.Path, TokenizeRunes)
+	}
+	for _, e := range edits {
+		switch e.Type {
+		case OpInsertText:
+			segs = insertSegment(segs, e.Position, e.NewValue)
+		case OpDeleteText:
+			segs = deleteSegments(segs, e.Position, len(e.OldValue))
+		case OpReplaceText:
+			segs = deleteSegments(segs, e.Position, len(e.OldValue))
+			segs = insertSegment(segs, e.Position, e.NewValue)
+		}
+	}
+	v.text[n] = segs
+}
+
+// restore turns the removed subtree n back into its base form for showing
+// as deleted: nodes inserted into it are dropped and edited text reverts.
+// With copies set, the copies of n's nodes are restored instead, and the
+// originals keep their record.
+func (v *visualDiff) restore(n *html.Node, copies map[*html.Node]*html.Node) {
+	self := n
+	if copies != nil {
+		self = copies[n]
+	}
+	if v.inserted[n] {
+		if self.Parent != nil {
+			self.Parent.RemoveChild(self)
+		}
+		if copies == nil {
+			delete(v.inserted, n)
+		}
+		return
+	}
+	if segs, ok := v.text[n]; ok {
+		self.Data = segmentText(segs, segmentInserted)
+		if copies == nil {
+			delete(v.text, n)
+		}
+	}
+	for _, c := range getChildrenList(n) {
+		v.restore(c, copies)
+	}
+}
+
+// forget drops the records of n's subtree, n included.
+func (v *visualDiff) forget(n *html.Node) {
+	delete(v.inserted, n)
+	delete(v.text, n)
+	for c := n.FirstChild; c != nil; c = c.NextSibling {
+		v.forget(c)
+	}
+}
+
+// mark puts the deleted nodes back and adds the <ins> and <del> elements.
+// Ghosts go back latest first: a node deleted later stood before one
+// deleted earlier in front of the same sibling, and may be its parent.
+func (v *visualDiff) mark() {
+	for i := len(v.ghosts) - 1; i >= 0; i-- {
+		g := v.ghosts[i]
+		before := g.before
+		for before != nil && before.Parent != g.parent {
+			before = before.Parent // The sibling was wrapped, or removed.
+		}
+		g.parent.InsertBefore(g.node, before)
+	}
+
+	for n, segs := range v.text {
+		if n.Parent != nil && canHoldMarks(n.Parent) {
+			markText(n, segs)
+		}
+	}
+	for _, g := range v.ghosts {
+		if !markNode(g.node, atom.Del) {
+			// Unmarked, it would look kept.
+			g.node.Parent.RemoveChild(g.node)
+		}
+	}
+	for n := range v.inserted {
+		if n.Parent != nil {
+			markNode(n, atom.Ins)
+		}
+	}
+}
+
+// markText replaces the text node n by its segments, the inserted and
+// deleted ones in <ins> and <del>.
+func markText(n *html.Node, segs []textSegment) {
+	base, current := segmentText(segs, segmentInserted), segmentText(segs, segmentDeleted)
+	for _, s := range segs {
+		if !utf8.ValidString(s.text) {
+			// Byte offsets cut a character apart; mark the change as a
+			// whole instead, character by character.
+			segs = []textSegment{{segmentKept, base}}
+			for _, e := range diffTokens(base, current, nil, TokenizeRunes) {
+				if e.Type == OpDeleteText {
+					segs = deleteSegments(segs, e.Position, len(e.OldValue))
+				} else {
+					segs = insertSegment(segs, e.Position, e.NewValue)
+				}
+			}
+			break
+		}
+	}
+
+	marked := false
+	for _, s := range segs {
+		marked = marked || s.kind != segmentKept
+	}
+	if !marked {
+		return
+	}
+	for _, s := range segs {
+		text := &html.Node{Type: html.TextNode, Data: s.text}
+		switch s.kind {
+		case segmentKept:
+			n.Parent.InsertBefore(text, n)
+		case segmentInserted, segmentDeleted:
+			a := atom.Ins
+			if s.kind == segmentDeleted {
+				a = atom.Del
+			}
+			mark := &html.Node{Type: html.ElementNode, Data: a.String(), DataAtom: a}
+			mark.AppendChild(text)
+			n.Parent.InsertBefore(mark, n)
+		}
+	}
+	n.Parent.RemoveChild(n)
+}
+
+// markNode wraps n in a new element a (<ins> or <del>) where its parent may
+// hold one, or else marks its content: a <li> is marked inside, a <tr> in
+// each of its cells. It reports whether anything was marked.
+func markNode(n *html.Node, a atom.Atom) bool {
+	mark := &html.Node{Type: html.ElementNode, Data: a.String(), DataAtom: a}
+	if canHoldMarks(n.Parent) {
+		n.Parent.InsertBefore(mark, n)
+		n.Parent.RemoveChild(n)
+		mark.AppendChild(n)
+		return true
+	}
+	if n.Type != html.ElementNode || n.FirstChild == nil {
+		return false
+	}
+	if canHoldMarks(n) {
+		for n.FirstChild != nil {
+			c := n.FirstChild
+			n.RemoveChild(c)
+			mark.AppendChild(c)
+		}
+		n.AppendChild(mark)
+		return true
+	}
+	marked := false
+	for _, c := range getChildrenList(n) {
+		marked = markNode(c, a) || marked
+	}
+	return marked
+}
+
+// noMarkElements cannot hold <ins> or <del>: their content model admits
+// only certain children, or only text.
+var noMarkElements = map[string]bool{
+	"colgroup": true, "datalist": true, "dl": true, "frameset": true,
+	"head": true, "html": true, "menu": true, "ol": true, "optgroup": true,
+	"option": true, "select": true, "table": true, "tbody": true,
+	"textarea": true, "tfoot": true, "thead": true, "title": true,
+	"tr": true, "ul": true,
+}
+
+// canHoldMarks reports whether <ins> and <del> may be children of n.
+func canHoldMarks(n *html.Node) bool {
+	return n != nil && n.Type == html.ElementNode && n.Namespace == "" &&
+		!noMarkElements[n.Data] && !rawTextElements[n.Data] && !voidElements[n.Data]
+}
+
+// segmentText joins the text of segs, leaving out those of kind skip.
+func segmentText(segs []textSegment, skip segmentKind) string {
+	var b strings.Builder
+	for _, s := range segs {
+		if s.kind != skip {
+			b.WriteString(s.text)
+		}
+	}
+	return b.String()
+}
+
+// splitSegments splits the kept or inserted segment spanning the offset pos
+// of the current text in two.
+func splitSegments(segs []textSegment, pos int) []textSegment {
+	var out []textSegment
+	off := 0
+	for _, s := range segs {
+		if s.kind != segmentDeleted {
+			if off < pos && pos < off+len(s.text) {
+				cut := pos - off
+				out = append(out, textSegment{s.kind, s.text[:cut]}, textSegment{s.kind, s.text[cut:]})
+				off += len(s.text)
+				continue
+			}
+			off += len(s.text)
+		}
+		out = append(out, s)
+	}
+	return out
+}
+
+// segmentIndex returns the index of the first kept or inserted segment
+// starting at or after pos in the current text, so deleted segments at pos
+// come before it.
+func segmentIndex(segs []textSegment, pos int) int {
+	off := 0
+	for i, s := range segs {
+		if s.kind == segmentDeleted {
+			continue
+		}
+		if off >= pos {
+			return i
+		}
+		off += len(s.text)
+	}
+	return len(segs)
+}
+
+// insertSegment records text inserted at pos.
+func insertSegment(segs []textSegment, pos int, text string) []textSegment {
+	segs = splitSegments(segs, pos)
+	k := segmentIndex(segs, pos)
+	segs = append(segs[:k], append([]textSegment{{segmentInserted, text}}, segs[k:]...)...)
+	return joinSegments(segs)
+}
+
+// deleteSegments records the n bytes at pos deleted: kept text becomes
+// deleted and inserted text is dropped.
+func deleteSegments(segs []textSegment, pos, n int) []textSegment {
+	segs = splitSegments(splitSegments(segs, pos), pos+n)
+	var out []textSegment
+	off := 0
+	for _, s := range segs {
+		if s.kind == segmentDeleted {
+			out = append(out, s)
+			continue
+		}
+		start := off
+		off += len(s.text)
+		if start >= pos && start < pos+n {
+			if s.kind == segmentKept {
+				out = append(out, textSegment{segmentDeleted, s.text})
+			}
+			continue
+		}
+		out = append(out, s)
+	}
+	return joinSegments(out)
+}
+
+// joinSegments drops empty segments and merges neighbours of one kind.
+func joinSegments(segs []textSegment) []textSegment {
+	var out []textSegment
+	for _, s := range segs {
+		if s.text == "" {
+			continue
+		}
+		if len(out) > 0 && out[len(out)-1].kind == s.kind {
+			out[len(out)-1].text += s.text
+			continue
+		}
+		out = append(out, s)
+	}
+	return out
+}
+
+// containsNode reports whether nodes holds n.
+func containsNode(nodes []*html.Node, n *html.Node) bool {
+	for _, c := range nodes {
+		if c == n {
+			return true
+		}
+	}
+	return false
+}